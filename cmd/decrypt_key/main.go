@@ -0,0 +1,61 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Provide a tool to decrypt the private keys and the keystore passwords that
+// are sealed by the KMS of Istio CA, e.g. in an init container that copies the
+// mounted Istio secret to a memory-backed volume.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"istio.io/auth/pkg/kms"
+
+	"github.com/golang/glog"
+)
+
+var (
+	in           = flag.String("in", "", "Input file of a sealed private key, PEM bundle or keystore password.")
+	out          = flag.String("out", "", "Output file of the decrypted content.")
+	kmsKeyFile   = flag.String("kms-key-file", "", "File of the base64-encoded KEK of a local KMS.")
+	pluginSocket = flag.String("kms-plugin-socket", "", "Unix domain socket of the KMS plugin.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *in == "" || *out == "" {
+		glog.Fatal("Both --in and --out must be specified.")
+	}
+	k, err := kms.New(kms.Options{KeyFile: *kmsKeyFile, PluginSocket: *pluginSocket})
+	if err != nil {
+		glog.Fatalf("Failed to create the KMS: %s.", err)
+	}
+
+	sealed, err := ioutil.ReadFile(*in)
+	if err != nil {
+		glog.Fatalf("Could not read input file: %s.", err)
+	}
+	opened, err := kms.OpenBlocks(k, sealed)
+	if err != nil {
+		glog.Fatalf("Failed to decrypt %s: %s.", *in, err)
+	}
+	if err := ioutil.WriteFile(*out, opened, 0600); err != nil {
+		glog.Fatalf("Could not write output file: %s.", err)
+	}
+	fmt.Printf("Decrypted content successfully saved in %s\n", *out)
+}
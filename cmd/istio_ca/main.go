@@ -18,20 +18,40 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"istio.io/auth/cmd/istio_ca/version"
+	"istio.io/auth/pkg/audit"
 	"istio.io/auth/pkg/cmd"
+	"istio.io/auth/pkg/kms"
+	"istio.io/auth/pkg/leaderelection"
+	"istio.io/auth/pkg/monitoring"
 	"istio.io/auth/pkg/pki/ca"
 	"istio.io/auth/pkg/pki/ca/controller"
+	"istio.io/auth/pkg/pki/ca/storage"
+	"istio.io/auth/pkg/server/acme"
 	"istio.io/auth/pkg/server/grpc"
+	"istio.io/auth/pkg/server/servingcert"
+	"istio.io/auth/pkg/server/webhook"
+	"istio.io/auth/pkg/tlspolicy"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -42,6 +62,16 @@ const (
 
 	// The key for the environment variable that specifies the namespace.
 	namespaceKey = "NAMESPACE"
+
+	// The default time given to in-flight requests to finish on shutdown. It is
+	// shorter than the default termination grace period of Kubernetes pods.
+	defaultShutdownGracePeriod = 20 * time.Second
+
+	// The timeout of posting an audit event to the webhook.
+	auditWebhookTimeout = 5 * time.Second
+
+	// How often the expired certificates are removed from the ledger.
+	ledgerPrunePeriod = time.Hour
 )
 
 type cliOptions struct {
@@ -55,6 +85,35 @@ type cliOptions struct {
 	istioCaStorageNamespace string
 
 	kubeConfigFile string
+	noKube         bool
+
+	storageBackend    string
+	storagePath       string
+	recordIssuedCerts bool
+
+	kmsKeyFile      string
+	kmsPluginSocket string
+
+	secretControllerWorkers int
+	includeNamespaces       []string
+	excludeNamespaces       []string
+	namespaceSelector       string
+	serviceAccountSelector  string
+	requireIdentityOptIn    bool
+	maxWorkloadCertTTL      time.Duration
+	certRenewalRatio        float64
+	certRenewalJitter       float64
+	certRotationQPS         float32
+	certRotationBurst       int
+	namespaceOutputFormats  []string
+	rootCertConfigMap       bool
+	secretAuditPeriod       time.Duration
+
+	leaderElect              bool
+	leaderElectLockName      string
+	leaderElectLeaseDuration time.Duration
+	leaderElectRenewDeadline time.Duration
+	leaderElectRetryPeriod   time.Duration
 
 	selfSignedCA    bool
 	selfSignedCAOrg string
@@ -62,8 +121,44 @@ type cliOptions struct {
 	caCertTTL time.Duration
 	certTTL   time.Duration
 
-	grpcHostname string
-	grpcPort     int
+	grpcHostname       string
+	grpcPort           int
+	grpcAuthenticators []string
+
+	udsPath           string
+	udsAuthenticators []string
+	udsAllowedUIDs    []int
+
+	plaintextLocalhostPort  int
+	plaintextAuthenticators []string
+
+	gatewayPort     int
+	adminIdentities []string
+	grpcReflection  bool
+	csrRateLimits   string
+
+	tlsPolicy   tlspolicy.Options
+	servingCert servingcert.Options
+
+	shutdownGracePeriod time.Duration
+
+	monitoringPort int
+
+	auditLogFile       string
+	auditLogMaxSize    int64
+	auditLogMaxBackups int
+	auditStdout        bool
+	auditWebhookURL    string
+
+	acmePort        int
+	allowedDNSNames []string
+
+	podCerts               bool
+	podCertTTL             time.Duration
+	podCertWebhookPort     int
+	podCertInitImage       string
+	podCertCAAddress       string
+	podCertTokenExpiration time.Duration
 }
 
 var (
@@ -95,6 +190,73 @@ func init() {
 	flags.StringVar(&opts.kubeConfigFile, "kube-config", "",
 		"Specifies path to kubeconfig file. This must be specified when not running inside a Kubernetes pod.")
 
+	flags.BoolVar(&opts.noKube, "no-kube", false, "Indicates whether to run Istio CA without Kubernetes, "+
+		"e.g. on VMs. Istio CA then only signs CSRs through GRPC. The self-signed CA key pair and the ledger "+
+		"of issued certificates, if any, are kept in a dir or bolt storage.")
+	flags.StringVar(&opts.storageBackend, "storage", storage.BackendKubernetes, "The storage of the self-signed "+
+		"CA key pair and the ledger of issued certificates: "+storage.BackendKubernetes+" | "+storage.BackendDir+
+		" | "+storage.BackendBolt+". The "+storage.BackendKubernetes+" storage uses the Istio CA storage namespace.")
+	flags.StringVar(&opts.storagePath, "storage-path", "",
+		"The directory of the dir storage, or the database file of the bolt storage.")
+	flags.BoolVar(&opts.recordIssuedCerts, "record-issued-certs", false, "Indicates whether to record the "+
+		"issued certificates in the ledger of the storage, so that they can be revoked.")
+
+	flags.StringVar(&opts.kmsKeyFile, "kms-key-file", "", "Specifies the file of the base64-encoded 256-bit key "+
+		"encryption key of a local KMS, which is meant for testing. With a KMS, the private keys stored by Istio CA "+
+		"are sealed with envelope encryption, and can be decrypted with the decrypt_key tool.")
+	flags.StringVar(&opts.kmsPluginSocket, "kms-plugin-socket", "", "Specifies the Unix domain socket of a KMS "+
+		"plugin that wraps the data keys of the envelope encryption.")
+
+	flags.IntVar(&opts.secretControllerWorkers, "secret-controller-workers", 5,
+		"The number of service accounts whose Istio secrets are reconciled concurrently.")
+	flags.StringSliceVar(&opts.includeNamespaces, "include-namespaces", nil,
+		"The namespaces whose service accounts get Istio secrets. If unspecified, all the namespaces are included.")
+	flags.StringSliceVar(&opts.excludeNamespaces, "exclude-namespaces", nil,
+		"The namespaces whose service accounts never get Istio secrets, e.g. kube-system.")
+	flags.StringVar(&opts.namespaceSelector, "namespace-selector", "",
+		"The label selector of the namespaces whose service accounts get Istio secrets, e.g. istio=enabled.")
+	flags.StringVar(&opts.serviceAccountSelector, "service-account-selector", "",
+		"The label selector of the service accounts that get Istio secrets.")
+	flags.BoolVar(&opts.requireIdentityOptIn, "require-identity-opt-in", false, "Indicates whether only the "+
+		"service accounts labeled or annotated with "+controller.IdentityKey+"="+controller.IdentityEnabled+
+		" get Istio secrets. A service account with "+controller.IdentityKey+"="+controller.IdentityDisabled+
+		" never gets an Istio secret. The Istio secrets of the service accounts that are not selected are deleted.")
+	flags.DurationVar(&opts.maxWorkloadCertTTL, "max-workload-cert-ttl", 90*24*time.Hour,
+		"The maximum TTL that a service account can request with the "+controller.TTLAnnotationKey+
+			" annotation. If zero, the TTL of the workload certificates cannot be customized.")
+	flags.Float64Var(&opts.certRenewalRatio, "cert-renewal-ratio", 0.7, "The fraction of the lifetime of a "+
+		"workload certificate after which it is rotated. If zero, a certificate is rotated when it is about to expire.")
+	flags.Float64Var(&opts.certRenewalJitter, "cert-renewal-jitter", 0.1, "The maximum fraction of the lifetime "+
+		"of a workload certificate by which its rotation is brought forward at random, so that the certificates "+
+		"issued together are not rotated together.")
+	flags.Float32Var(&opts.certRotationQPS, "cert-rotation-qps", 10, "The maximum number of workload certificates "+
+		"rotated per second, e.g. after the root certificate is changed. If zero, the rotations are not rate limited.")
+	flags.IntVar(&opts.certRotationBurst, "cert-rotation-burst", 20,
+		"The maximum burst of workload certificate rotations.")
+	flags.DurationVar(&opts.secretAuditPeriod, "secret-audit-period", 10*time.Minute, "How often the Istio secrets "+
+		"are audited. The secrets of deleted service accounts are deleted, and the secrets whose certificate chains "+
+		"do not verify to the root certificate, are not issued to their service accounts or do not match their keys "+
+		"are re-issued. If zero, the secrets are not audited.")
+	flags.BoolVar(&opts.rootCertConfigMap, "root-cert-configmap", true, "Indicates whether to publish the root "+
+		"certificate into a ConfigMap named "+controller.RootCertConfigMapName+" in each namespace whose service "+
+		"accounts get Istio secrets, except the ones that only opt in individually.")
+	flags.StringArrayVar(&opts.namespaceOutputFormats, "namespace-output-formats", nil, "The output formats of the "+
+		"Istio secrets in a namespace besides the PEM files, e.g. my-ns=pkcs12,jks. Can be repeated for multiple "+
+		"namespaces. The formats are pem-bundle | pkcs12 | jks | tls, and are overridden by the "+
+		controller.OutputFormatsAnnotationKey+" annotation of a service account. With a KMS, pem-bundle and tls "+
+		"are not written, since they would hold the sealed private key.")
+
+	flags.BoolVar(&opts.leaderElect, "leader-elect", false, "Indicates whether the replicas of Istio CA elect "+
+		"a leader that runs the secret controller. Every replica serves CSRs regardless of the leadership.")
+	flags.StringVar(&opts.leaderElectLockName, "leader-elect-lock-name", "istio-ca-leader",
+		"The name of the ConfigMap in the Istio CA storage namespace that records the leader.")
+	flags.DurationVar(&opts.leaderElectLeaseDuration, "leader-elect-lease-duration", 15*time.Second,
+		"How long the followers wait after the leader last renewed its lease before they try to take over.")
+	flags.DurationVar(&opts.leaderElectRenewDeadline, "leader-elect-renew-deadline", 10*time.Second,
+		"How long the leader keeps trying to renew its lease before it gives up the leadership.")
+	flags.DurationVar(&opts.leaderElectRetryPeriod, "leader-elect-retry-period", 2*time.Second,
+		"How often the lease is acquired or renewed.")
+
 	flags.BoolVar(&opts.selfSignedCA, "self-signed-ca", false,
 		"Indicates whether to use auto-generated self-signed CA certificate. "+
 			"When set to true, the '--signing-cert' and '--signing-key' options are ignored.")
@@ -109,6 +271,100 @@ func init() {
 	flags.StringVar(&opts.grpcHostname, "grpc-hostname", "localhost", "Specifies the hostname for GRPC server.")
 	flags.IntVar(&opts.grpcPort, "grpc-port", 0, "Specifies the port number for GRPC server. "+
 		"If unspecified, Istio CA will not server GRPC request.")
+	flags.StringSliceVar(&opts.grpcAuthenticators, "grpc-authenticators",
+		[]string{"client_certificate", "id_token"},
+		"The authenticators of the GRPC port in the order they are tried: client_certificate | id_token | "+
+			"service_account_token")
+	flags.StringVar(&opts.udsPath, "uds-path", "", "Specifies path to a Unix domain socket to serve GRPC "+
+		"requests on, e.g. for a co-located admin sidecar. If unspecified, Istio CA will not listen on a socket.")
+	flags.StringSliceVar(&opts.udsAuthenticators, "uds-authenticators", []string{"peer_credential"},
+		"The authenticators of the Unix domain socket in the order they are tried: peer_credential | id_token")
+	flags.IntSliceVar(&opts.udsAllowedUIDs, "uds-allowed-uids", nil,
+		"The UIDs of the local processes that are authenticated by their peer credentials on the Unix domain "+
+			"socket. Such processes can request certificates for any identity.")
+	flags.IntVar(&opts.plaintextLocalhostPort, "plaintext-localhost-port", 0,
+		"Specifies the port number of a plaintext GRPC listener on 127.0.0.1 for debugging. "+
+			"If unspecified, Istio CA will not serve GRPC requests without TLS.")
+	flags.StringSliceVar(&opts.plaintextAuthenticators, "plaintext-authenticators", []string{"id_token"},
+		"The authenticators of the plaintext localhost port in the order they are tried: id_token")
+	flags.IntVar(&opts.gatewayPort, "gateway-port", 0, "Specifies the port number for the HTTP/JSON gateway "+
+		"of the GRPC server. If unspecified, Istio CA will not serve HTTP/JSON requests.")
+	flags.StringSliceVar(&opts.adminIdentities, "admin-identities", nil,
+		"The identities allowed to revoke issued certificates through the HTTP/JSON gateway. "+
+			"Requires '--gateway-port' and '--record-issued-certs'.")
+	flags.BoolVar(&opts.grpcReflection, "grpc-reflection", false,
+		"Indicates whether to enable the GRPC server reflection service.")
+	flags.StringVar(&opts.csrRateLimits, "csr-rate-limits", "",
+		"Comma-separated rate limits of CSRs in the form of key=qps:burst, where key is 'global', 'ip', "+
+			"'client_certificate' or 'id_token'. The last two limit each identity authenticated by the "+
+			"authenticator. If unspecified, CSRs are not rate limited.")
+	flags.StringVar(&opts.tlsPolicy.MinVersion, "tls-min-version", "",
+		"The minimum TLS version of the GRPC server and the gateway: 1.0 | 1.1 | 1.2")
+	flags.StringSliceVar(&opts.tlsPolicy.CipherSuites, "tls-cipher-suites", nil,
+		"The allowed TLS cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. "+
+			"If unspecified, the defaults of Go are used.")
+	flags.StringSliceVar(&opts.tlsPolicy.CurvePreferences, "tls-curve-preferences", nil,
+		"The preferred elliptic curves: P256 | P384 | P521 | X25519")
+	flags.BoolVar(&opts.tlsPolicy.RequireClientCert, "require-client-cert", false,
+		"Indicates whether GRPC clients must present a certificate.")
+	flags.StringSliceVar(&opts.tlsPolicy.ClientCAFiles, "client-ca-bundles", nil,
+		"Specifies paths to PEM bundles of CAs that are trusted for client certificates in addition to "+
+			"the root of Istio CA, e.g. the CA of the bootstrap certificates of node agents.")
+	flags.StringSliceVar(&opts.tlsPolicy.AllowedSANs, "client-cert-allowed-sans", nil,
+		"The identities that a client certificate must carry one of. An entry ending with '*' "+
+			"matches the identities with the prefix. If unspecified, any identity is accepted.")
+	flags.StringSliceVar(&opts.servingCert.Hosts, "serving-cert-hosts", nil,
+		"The DNS names and IP addresses of the serving certificate of the GRPC server, the gateway and the "+
+			"ACME server, e.g. the names of the Kubernetes service. If unspecified, the GRPC hostname is used.")
+	flags.IntVar(&opts.servingCert.KeySize, "serving-cert-key-size", 2048,
+		"The size of the RSA key of the serving certificate.")
+	flags.Float64Var(&opts.servingCert.RenewFraction, "serving-cert-renew-fraction", 0.5,
+		"The fraction of the lifetime of the serving certificate after which it is renewed.")
+	flags.StringVar(&opts.servingCert.CertFile, "serving-cert", "",
+		"Specifies path to an operator-supplied serving certificate chain. If specified, it is served instead "+
+			"of a certificate issued by Istio CA, and reloaded when it changes.")
+	flags.StringVar(&opts.servingCert.KeyFile, "serving-key", "",
+		"Specifies path to the private key of the operator-supplied serving certificate.")
+	flags.DurationVar(&opts.servingCert.ReloadInterval, "serving-cert-reload-interval", 10*time.Second,
+		"How often the operator-supplied serving certificate is checked for changes.")
+	flags.DurationVar(&opts.shutdownGracePeriod, "shutdown-grace-period", defaultShutdownGracePeriod,
+		"The time given to in-flight requests to finish when Istio CA is stopped.")
+
+	flags.IntVar(&opts.monitoringPort, "monitoring-port", 0, "Specifies the port number for the Prometheus "+
+		"metrics. If unspecified, Istio CA will not serve metrics.")
+
+	flags.StringVar(&opts.auditLogFile, "audit-log-file", "",
+		"Specifies path to the file that audit events of certificate issuance are appended to.")
+	flags.Int64Var(&opts.auditLogMaxSize, "audit-log-max-size", 100,
+		"The size in megabytes at which the audit log file is rotated. Zero disables rotation.")
+	flags.IntVar(&opts.auditLogMaxBackups, "audit-log-max-backups", 10,
+		"The number of rotated audit log files to keep.")
+	flags.BoolVar(&opts.auditStdout, "audit-stdout", false, "Indicates whether to write audit events to stdout.")
+	flags.StringVar(&opts.auditWebhookURL, "audit-webhook-url", "",
+		"Specifies the URL that audit events are posted to as JSON.")
+
+	flags.IntVar(&opts.acmePort, "acme-port", 0, "Specifies the port number for ACME server. "+
+		"If unspecified, Istio CA will not serve ACME requests. The server uses the GRPC hostname.")
+	flags.StringSliceVar(&opts.allowedDNSNames, "allowed-dns-names", nil,
+		"The DNS names that can be requested through ACME, and by service accounts with the "+
+			controller.DNSNamesAnnotationKey+" annotation. An entry starting with '.' or '*.' allows "+
+			"all the subdomains of the entry.")
+
+	flags.BoolVar(&opts.podCerts, "pod-certs", false, "Indicates whether to issue pod-scoped certificates "+
+		"to the pods with the "+controller.PodCertAnnotationKey+" annotation. The pods are mutated by an "+
+		"admission webhook to get the certificates from an init container that authenticates with a "+
+		"projected service account token, and a sidecar that renews them. Only the pods in the namespaces "+
+		"that get the root certificate ConfigMap are admitted.")
+	flags.DurationVar(&opts.podCertTTL, "pod-cert-ttl", time.Hour, "The TTL of pod-scoped certificates.")
+	flags.IntVar(&opts.podCertWebhookPort, "pod-cert-webhook-port", 8443, "Specifies the port number for the "+
+		"admission webhook that injects the pod certificate init container. The DNS name of the webhook "+
+		"service must be included in --serving-cert-hosts.")
+	flags.StringVar(&opts.podCertInitImage, "pod-cert-init-image", "", "The image of the node agent that "+
+		"runs as the pod certificate init container and renewal sidecar.")
+	flags.StringVar(&opts.podCertCAAddress, "pod-cert-ca-address", "istio-ca.istio-system:8060",
+		"The address of Istio CA that the pod certificate init container sends CSRs to.")
+	flags.DurationVar(&opts.podCertTokenExpiration, "pod-cert-token-expiration", 10*time.Minute,
+		"The expiration of the projected service account token of the pods with pod-scoped certificates.")
 
 	rootCmd.AddCommand(version.Command)
 
@@ -134,26 +390,270 @@ func runCA() {
 
 	verifyCommandLineOptions()
 
-	cs := createClientset()
-	ca := createCA(cs.CoreV1())
-	sc := controller.NewSecretController(ca, cs.CoreV1(), opts.namespace)
+	var cs *kubernetes.Clientset
+	if !opts.noKube {
+		cs = createClientset()
+	}
+	keyManager, err := kms.New(kms.Options{KeyFile: opts.kmsKeyFile, PluginSocket: opts.kmsPluginSocket})
+	if err != nil {
+		glog.Fatalf("Failed to create the KMS (error: %v)", err)
+	}
+	store := createStore(cs, keyManager)
+	ca := createCA(store, keyManager)
+	auditSink := createAuditSink()
 
+	if opts.monitoringPort > 0 {
+		runMonitoring(ca)
+	}
+
+	certManager := createCertManager(ca)
 	stopCh := make(chan struct{})
-	sc.Run(stopCh)
 
-	if opts.grpcPort > 0 {
-		grpcServer := grpc.New(ca, opts.grpcHostname, opts.grpcPort)
+	// The pod certificate controller runs on every replica, since every replica
+	// serves CSRs and looks up the pods of the service account tokens.
+	var saTokens *grpc.ServiceAccountTokenOptions
+	if opts.podCerts {
+		if opts.podCertInitImage == "" {
+			glog.Fatal("No pod certificate init image has been specified via '--pod-cert-init-image'")
+		}
+		podCertController := controller.NewPodCertController(cs.CoreV1(), opts.namespace, auditSink)
+		podCertController.Run(stopCh)
+		saTokens = &grpc.ServiceAccountTokenOptions{
+			Reviewer: cs.AuthenticationV1beta1().TokenReviews(),
+			Pods:     podCertController,
+			CertTTL:  opts.podCertTTL,
+		}
+		podCertWebhook := webhook.New(webhook.Options{
+			Port:            opts.podCertWebhookPort,
+			Image:           opts.podCertInitImage,
+			CAAddress:       opts.podCertCAAddress,
+			TokenExpiration: opts.podCertTokenExpiration,
+			Namespace:       opts.namespace,
+			Selector:        createSelector(),
+			Namespaces:      cs.CoreV1(),
+		}, certManager)
+		if err := podCertWebhook.Run(); err != nil {
+			glog.Warningf("Failed to start pod certificate webhook with error: %v", err)
+		}
+	}
+
+	var grpcServer *grpc.Server
+	if listeners := createListeners(); len(listeners) > 0 {
+		rateLimits, err := grpc.ParseRateLimits(opts.csrRateLimits)
+		if err != nil {
+			glog.Fatalf("Invalid CSR rate limits (error: %v)", err)
+		}
+		var revoker grpc.Revoker
+		if opts.recordIssuedCerts {
+			revoker = ca
+		}
+		grpcServer, err = grpc.New(ca, &grpc.ServerOptions{
+			Hostname:         opts.grpcHostname,
+			Port:             opts.grpcPort,
+			Listeners:        listeners,
+			GatewayPort:      opts.gatewayPort,
+			EnableReflection: opts.grpcReflection,
+			RateLimits:       *rateLimits,
+			AuditSink:        auditSink,
+			TLSPolicy:        opts.tlsPolicy,
+			CertManager:      certManager,
+
+			ServiceAccountTokens: saTokens,
+			Revoker:              revoker,
+			AdminIdentities:      opts.adminIdentities,
+		})
+		if err != nil {
+			glog.Fatalf("Failed to create GRPC server (error: %v)", err)
+		}
 		if err := grpcServer.Run(); err != nil {
 			glog.Warningf("Failed to start GRPC server with error: %v", err)
 		}
 	}
 
+	if opts.acmePort > 0 {
+		if len(opts.allowedDNSNames) == 0 {
+			glog.Warning("No DNS name is allowed, all ACME orders will be rejected")
+		}
+		acmeServer := acme.New(ca, createHostnamePolicy(), acme.NewChallengeValidator(nil, nil),
+			opts.grpcHostname, opts.acmePort, certManager)
+		if err := acmeServer.Run(); err != nil {
+			glog.Warningf("Failed to start ACME server with error: %v", err)
+		}
+	}
+
+	if opts.recordIssuedCerts {
+		go wait.Until(func() {
+			if err := store.Prune(time.Now()); err != nil {
+				glog.Warningf("Failed to prune the ledger (error: %v)", err)
+			}
+		}, ledgerPrunePeriod, stopCh)
+	}
+
+	var controllerStopped <-chan struct{}
+	if cs != nil {
+		controllerStopped = runSecretController(cs, ca, keyManager, auditSink, grpcServer, stopCh)
+	} else {
+		stopped := make(chan struct{})
+		close(stopped)
+		controllerStopped = stopped
+	}
+
 	glog.Info("Istio CA has started")
 
-	<-stopCh
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigCh
+	glog.Infof("Received signal %v, stopping Istio CA", sig)
+
+	if grpcServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.shutdownGracePeriod)
+		if err := grpcServer.Stop(ctx); err != nil {
+			glog.Warningf("Failed to gracefully stop GRPC server (error: %v)", err)
+		}
+		cancel()
+	}
+	close(stopCh)
+	<-controllerStopped
+	if store != nil {
+		if err := store.Close(); err != nil {
+			glog.Warningf("Failed to close the storage (error: %v)", err)
+		}
+	}
+	if auditSink != nil {
+		if err := auditSink.Close(); err != nil {
+			glog.Warningf("Failed to close audit sinks (error: %v)", err)
+		}
+	}
+
 	glog.Warning("Istio CA has stopped")
 }
 
+// runSecretController runs the secret controller, and the root certificate
+// ConfigMap controller if enabled, until stopCh is closed. With leader
+// election, only the leader runs them. The returned channel is closed when the
+// controllers have stopped and the leadership, if any, is released.
+func runSecretController(cs *kubernetes.Clientset, istioCA *ca.IstioCA, keyManager kms.KMS,
+	auditSink audit.Sink, grpcServer *grpc.Server, stopCh <-chan struct{}) <-chan struct{} {
+
+	setLeader := func(isLeader bool) {
+		if grpcServer != nil {
+			grpcServer.SetLeader(isLeader)
+		}
+	}
+	scOpts := controller.SecretControllerOptions{
+		Namespace: opts.namespace,
+		Selector:  createSelector(),
+		CertPolicy: &controller.CertPolicy{
+			DNSNames: createHostnamePolicy(),
+			MaxTTL:   opts.maxWorkloadCertTTL,
+		},
+		EventRecorder: createEventRecorder(cs),
+		Rotation: controller.RotationOptions{
+			RenewalRatio:  opts.certRenewalRatio,
+			RenewalJitter: opts.certRenewalJitter,
+			RotationQPS:   opts.certRotationQPS,
+			RotationBurst: opts.certRotationBurst,
+		},
+		OutputFormats: createOutputFormats(),
+		AuditSink:     auditSink,
+		AuditPeriod:   opts.secretAuditPeriod,
+		KMS:           keyManager,
+	}
+	// run returns once the controllers have stopped, so that they do not write
+	// secrets alongside the next leader.
+	run := func(stopCh <-chan struct{}) {
+		setLeader(true)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc := controller.NewSecretController(istioCA, cs.CoreV1(), scOpts)
+			sc.Run(opts.secretControllerWorkers, stopCh)
+		}()
+		if opts.rootCertConfigMap {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rc := controller.NewRootCertController(istioCA, cs.CoreV1(), opts.namespace, scOpts.Selector)
+				rc.Run(opts.secretControllerWorkers, stopCh)
+			}()
+		}
+		wg.Wait()
+	}
+
+	stopped := make(chan struct{})
+	if !opts.leaderElect {
+		go func() {
+			run(stopCh)
+			close(stopped)
+		}()
+		return stopped
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed to get the hostname as the identity of leader election (error: %v)", err)
+	}
+	elector, err := leaderelection.New(cs.CoreV1(), leaderelection.Options{
+		Namespace:        opts.istioCaStorageNamespace,
+		Name:             opts.leaderElectLockName,
+		Identity:         identity,
+		LeaseDuration:    opts.leaderElectLeaseDuration,
+		RenewDeadline:    opts.leaderElectRenewDeadline,
+		RetryPeriod:      opts.leaderElectRetryPeriod,
+		OnStartedLeading: run,
+		OnStoppedLeading: func() { setLeader(false) },
+	})
+	if err != nil {
+		glog.Fatalf("Failed to create the leader elector (error: %v)", err)
+	}
+	go func() {
+		elector.Run(stopCh)
+		close(stopped)
+	}()
+	return stopped
+}
+
+// createSelector returns the selector of the service accounts that get Istio
+// secrets.
+func createSelector() *controller.Selector {
+	selector := &controller.Selector{
+		IncludeNamespaces: opts.includeNamespaces,
+		ExcludeNamespaces: opts.excludeNamespaces,
+		RequireOptIn:      opts.requireIdentityOptIn,
+	}
+	var err error
+	if opts.namespaceSelector != "" {
+		if selector.NamespaceSelector, err = labels.Parse(opts.namespaceSelector); err != nil {
+			glog.Fatalf("Invalid namespace selector %q (error: %v)", opts.namespaceSelector, err)
+		}
+	}
+	if opts.serviceAccountSelector != "" {
+		if selector.ServiceAccountSelector, err = labels.Parse(opts.serviceAccountSelector); err != nil {
+			glog.Fatalf("Invalid service account selector %q (error: %v)", opts.serviceAccountSelector, err)
+		}
+	}
+	return selector
+}
+
+// createOutputFormats returns the output formats of the Istio secrets in each
+// namespace.
+func createOutputFormats() map[string][]string {
+	outputFormats := make(map[string][]string)
+	for _, entry := range opts.namespaceOutputFormats {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			glog.Fatalf("Invalid namespace output formats %q, expecting namespace=formats", entry)
+		}
+		formats, err := controller.ParseOutputFormats(parts[1])
+		if err != nil {
+			glog.Fatalf("Invalid output formats of namespace %q (error: %v)", parts[0], err)
+		}
+		outputFormats[parts[0]] = formats
+	}
+	return outputFormats
+}
+
 func createClientset() *kubernetes.Clientset {
 	c := generateConfig()
 	cs, err := kubernetes.NewForConfig(c)
@@ -163,13 +663,41 @@ func createClientset() *kubernetes.Clientset {
 	return cs
 }
 
-func createCA(core corev1.SecretsGetter) ca.CertificateAuthority {
+// createStore returns the storage of the CA state, which seals the private key
+// of the CA if keyManager is not nil. The Kubernetes storage requires cs. It
+// returns nil if neither the self-signed CA nor the ledger needs the storage.
+func createStore(cs *kubernetes.Clientset, keyManager kms.KMS) storage.Store {
+	if !needsStore() {
+		return nil
+	}
+	var store storage.Store
+	if opts.storageBackend == storage.BackendKubernetes {
+		store = storage.NewKubernetesStore(cs.CoreV1(), opts.istioCaStorageNamespace)
+	} else {
+		var err error
+		if store, err = storage.New(storage.Options{Backend: opts.storageBackend, Path: opts.storagePath}); err != nil {
+			glog.Fatalf("Failed to create the storage (error: %v)", err)
+		}
+	}
+	if keyManager != nil {
+		store = storage.NewEncryptedStore(store, keyManager)
+	}
+	return store
+}
+
+// needsStore returns whether the CA state is kept in a storage, i.e. the CA is
+// self-signed or records the issued certificates.
+func needsStore() bool {
+	return opts.selfSignedCA || opts.recordIssuedCerts
+}
+
+func createCA(store storage.Store, keyManager kms.KMS) *ca.IstioCA {
 	if opts.selfSignedCA {
 		glog.Info("Use self-signed certificate as the CA certificate")
 
 		// TODO(wattli): Refactor this and combine it with NewIstioCA().
-		ca, err := ca.NewSelfSignedIstioCA(opts.caCertTTL, opts.certTTL, opts.selfSignedCAOrg,
-			opts.istioCaStorageNamespace, core)
+		ca, err := ca.NewSelfSignedIstioCA(opts.caCertTTL, opts.certTTL, opts.selfSignedCAOrg, store,
+			opts.recordIssuedCerts)
 		if err != nil {
 			glog.Fatalf("Failed to create a self-signed Istio CA (error: %v)", err)
 		}
@@ -184,9 +712,12 @@ func createCA(core corev1.SecretsGetter) ca.CertificateAuthority {
 		CertChainBytes:   certChainBytes,
 		CertTTL:          opts.certTTL,
 		SigningCertBytes: readFile(opts.signingCertFile),
-		SigningKeyBytes:  readFile(opts.signingKeyFile),
+		SigningKeyBytes:  readSigningKey(keyManager),
 		RootCertBytes:    readFile(opts.rootCertFile),
 	}
+	if opts.recordIssuedCerts {
+		caOpts.Ledger = store
+	}
 
 	ca, err := ca.NewIstioCA(caOpts)
 	if err != nil {
@@ -195,6 +726,116 @@ func createCA(core corev1.SecretsGetter) ca.CertificateAuthority {
 	return ca
 }
 
+// readSigningKey reads the signing key file, which may be sealed by the KMS.
+func readSigningKey(keyManager kms.KMS) []byte {
+	key, err := kms.Open(keyManager, readFile(opts.signingKeyFile))
+	if err != nil {
+		glog.Fatalf("Failed to decrypt the signing key %s (error: %v)", opts.signingKeyFile, err)
+	}
+	return key
+}
+
+func runMonitoring(istioCA *ca.IstioCA) {
+	prometheus.MustRegister(ca.NewCertTTLCollector(istioCA))
+	if err := monitoring.Run(opts.monitoringPort); err != nil {
+		glog.Warningf("Failed to start monitoring server with error: %v", err)
+	}
+}
+
+// createListeners returns the listeners of the GRPC service.
+func createListeners() []grpc.ListenerOptions {
+	var listeners []grpc.ListenerOptions
+	if opts.grpcPort > 0 {
+		listeners = append(listeners, grpc.ListenerOptions{
+			Network:        grpc.NetworkTCP,
+			Address:        fmt.Sprintf(":%d", opts.grpcPort),
+			Authenticators: opts.grpcAuthenticators,
+		})
+	}
+	if opts.udsPath != "" {
+		uids := make([]uint32, 0, len(opts.udsAllowedUIDs))
+		for _, uid := range opts.udsAllowedUIDs {
+			if uid < 0 {
+				glog.Fatalf("Invalid UID %d", uid)
+			}
+			uids = append(uids, uint32(uid))
+		}
+		listeners = append(listeners, grpc.ListenerOptions{
+			Network:        grpc.NetworkUnix,
+			Address:        opts.udsPath,
+			Authenticators: opts.udsAuthenticators,
+			AllowedUIDs:    uids,
+		})
+	}
+	if opts.plaintextLocalhostPort > 0 {
+		glog.Warningf("GRPC requests are served without TLS on localhost port %d", opts.plaintextLocalhostPort)
+		listeners = append(listeners, grpc.ListenerOptions{
+			Network:        grpc.NetworkTCP,
+			Address:        fmt.Sprintf("127.0.0.1:%d", opts.plaintextLocalhostPort),
+			Plaintext:      true,
+			Authenticators: opts.plaintextAuthenticators,
+		})
+	}
+	return listeners
+}
+
+// createCertManager returns the manager of the serving certificate that is
+// shared by the servers of Istio CA.
+func createCertManager(ca ca.CertificateAuthority) *servingcert.Manager {
+	if (opts.servingCert.CertFile == "") != (opts.servingCert.KeyFile == "") {
+		glog.Fatalf("'--serving-cert' and '--serving-key' must be specified together")
+	}
+	if len(opts.servingCert.Hosts) == 0 {
+		opts.servingCert.Hosts = []string{opts.grpcHostname}
+	}
+	return servingcert.NewManager(ca, opts.servingCert)
+}
+
+// createAuditSink returns the sink of the audit events, or nil if auditing is
+// not enabled.
+func createAuditSink() audit.Sink {
+	var sinks []audit.Sink
+	if opts.auditLogFile != "" {
+		sink, err := audit.NewFileSink(opts.auditLogFile, opts.auditLogMaxSize*1024*1024, opts.auditLogMaxBackups)
+		if err != nil {
+			glog.Fatalf("Failed to create audit log (error: %v)", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if opts.auditStdout {
+		sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+	}
+	if opts.auditWebhookURL != "" {
+		sinks = append(sinks, audit.NewWebhookSink(opts.auditWebhookURL, auditWebhookTimeout))
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil
+	case 1:
+		return sinks[0]
+	default:
+		return audit.NewMultiSink(sinks...)
+	}
+}
+
+func createHostnamePolicy() *ca.HostnamePolicy {
+	policy, err := ca.NewHostnamePolicy(opts.allowedDNSNames)
+	if err != nil {
+		glog.Fatalf("Invalid allowed DNS names (error: %v)", err)
+	}
+	return policy
+}
+
+// createEventRecorder returns the recorder of the Kubernetes events of the
+// secret controller.
+func createEventRecorder(cs *kubernetes.Clientset) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	return broadcaster.NewRecorder(api.Scheme, v1.EventSource{Component: "istio-ca"})
+}
+
 func generateConfig() *rest.Config {
 	if opts.kubeConfigFile != "" {
 		c, err := clientcmd.BuildConfigFromFlags("", opts.kubeConfigFile)
@@ -221,6 +862,24 @@ func readFile(filename string) []byte {
 }
 
 func verifyCommandLineOptions() {
+	if opts.noKube {
+		if needsStore() && opts.storageBackend == storage.BackendKubernetes {
+			glog.Fatalf("The %s storage cannot be used with '--no-kube', use '--storage=%s' or '--storage=%s'",
+				storage.BackendKubernetes, storage.BackendDir, storage.BackendBolt)
+		}
+		if opts.leaderElect || opts.podCerts {
+			glog.Fatal("Leader election and pod certificates require Kubernetes, and cannot be used with '--no-kube'")
+		}
+	}
+	if opts.podCerts && !opts.rootCertConfigMap {
+		glog.Fatal("Pod certificates mount the root certificate from its ConfigMap, and cannot be used with " +
+			"'--root-cert-configmap=false'")
+	}
+
+	if len(opts.adminIdentities) > 0 && (opts.gatewayPort == 0 || !opts.recordIssuedCerts) {
+		glog.Fatal("Revoking certificates through the gateway requires '--gateway-port' and '--record-issued-certs'")
+	}
+
 	if opts.selfSignedCA {
 		return
 	}
@@ -16,17 +16,28 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 
 	"istio.io/auth/cmd/node_agent/na"
 	"istio.io/auth/pkg/cmd"
+	"istio.io/auth/pkg/monitoring"
+	"istio.io/auth/pkg/workload"
 )
 
 var (
 	naConfig na.Config
 
+	monitoringPort int
+
+	workloadAPIAuthorizedUIDs []string
+	rotationHooks             []string
+	workloadCertMode          string
+	workloadKeyMode           string
+	workloadOwner             string
+
 	rootCmd = &cobra.Command{
 		Run: func(cmd *cobra.Command, args []string) {
 			runNodeAgent()
@@ -43,13 +54,64 @@ func init() {
 	flags.IntVar(&naConfig.RSAKeySize, "key-size", 1024, "Size of generated private key")
 	flags.StringVar(&naConfig.IstioCAAddress,
 		"ca-address", "istio-ca:8060", "Istio CA address")
-	flags.StringVar(&naConfig.Env, "env", "onprem", "Node Environment : onprem | gcp | aws")
+	flags.StringVar(&naConfig.Env, "env", "onprem", "Node Environment : onprem | gcp | aws | k8s")
+	flags.BoolVar(&naConfig.OneShot, "one-shot", false,
+		"Indicates whether to exit once the first certificate is written, e.g. in an init container.")
 	flags.StringVar(&naConfig.PlatformConfig.CertChainFile, "cert-chain",
 		"/etc/certs/cert-chain.pem", "Node Agent identity cert file")
 	flags.StringVar(&naConfig.PlatformConfig.KeyFile,
 		"key", "/etc/certs/key.pem", "Node identity private key file")
 	flags.StringVar(&naConfig.PlatformConfig.RootCACertFile, "root-cert",
 		"/etc/certs/root-cert.pem", "Root Certificate file")
+	flags.StringVar(&naConfig.PlatformConfig.ServiceAccountTokenFile, "service-account-token",
+		"/var/run/secrets/istio/istio-token", "The projected service account token file of the pod in the k8s env")
+	policy := &naConfig.PlatformConfig.TLSPolicy
+	flags.StringVar(&policy.MinVersion, "tls-min-version", "",
+		"The minimum TLS version of the connections to Istio CA: 1.0 | 1.1 | 1.2")
+	flags.StringSliceVar(&policy.CipherSuites, "tls-cipher-suites", nil,
+		"The allowed TLS cipher suites of the connections to Istio CA, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	flags.StringSliceVar(&policy.CurvePreferences, "tls-curve-preferences", nil,
+		"The preferred elliptic curves of the connections to Istio CA: P256 | P384 | P521 | X25519")
+	flags.StringSliceVar(&policy.AllowedSANs, "ca-allowed-sans", nil,
+		"The identities that the certificate of Istio CA must carry one of. An entry ending with '*' "+
+			"matches the identities with the prefix.")
+	out := &naConfig.WorkloadOutput
+	flags.StringVar(&out.CertChainFile, "workload-cert-chain", "",
+		"The file that the certificate chain of the workload is written to. It must be specified with "+
+			"--workload-key. If both are unspecified, the certificate is written to --cert-chain and --key, "+
+			"which Node Agent then keeps renewing as its own credential.")
+	flags.StringVar(&out.KeyFile, "workload-key", "",
+		"The file that the private key of the workload is written to. See --workload-cert-chain.")
+	flags.StringVar(&out.RootCertFile, "workload-root-cert", "",
+		"The file that the root certificate is written to. If empty, it is not written.")
+	flags.StringVar(&out.BundleFile, "workload-bundle", "",
+		"The file that the root certificate followed by the federated bundle is written to. "+
+			"If empty, it is not written.")
+	flags.StringSliceVar(&out.FederatedBundleFiles, "federated-bundle", nil,
+		"The PEM files with the root certificates of the other trust domains that the workload trusts")
+	flags.StringVar(&workloadCertMode, "workload-cert-mode", "0644",
+		"The permission of the certificate files of the workload")
+	flags.StringVar(&workloadKeyMode, "workload-key-mode", "0600",
+		"The permission of the private key file of the workload")
+	flags.StringVar(&workloadOwner, "workload-owner", "",
+		"The owner of the files of the workload, in the form of <uid>:<gid>. "+
+			"If empty, the files are owned by the user of Node Agent.")
+	flags.StringVar(&naConfig.WorkloadAPISocket, "workload-api-socket", "",
+		"The Unix domain socket on which the certificate is served to the workloads through the SPIFFE "+
+			"Workload API. If unspecified, the certificate is written to the --workload-* files.")
+	flags.StringSliceVar(&workloadAPIAuthorizedUIDs, "workload-api-authorized-uids", nil,
+		"The UIDs of the workloads that may fetch an identity through the Workload API, in the form of "+
+			"<identity>=<uid>. An identity that is not listed is only served to the user of Node Agent.")
+	flags.StringArrayVar(&rotationHooks, "rotation-hook", nil,
+		"A hook run after the certificate files are rotated, e.g. to reload a server: exec:<command> [<arg>...] | "+
+			"signal:<signal>:<PID file> | <http(s) URL to POST to>. Can be repeated.")
+	flags.StringVar(&naConfig.IdentitiesFile, "identities-file", "",
+		"The YAML or JSON file that lists the identities to manage, each with its own key, renewal schedule and "+
+			"output files or Workload API UIDs, instead of the identity of the platform. It is reloaded on changes.")
+	flags.DurationVar(&naConfig.IdentitiesReloadInterval, "identities-reload-interval", 10*time.Second,
+		"How often --identities-file is checked for changes")
+	flags.IntVar(&monitoringPort, "monitoring-port", 0, "Specifies the port number for the Prometheus metrics. "+
+		"If unspecified, Node Agent will not serve metrics.")
 
 	cmd.InitializeFlags(rootCmd)
 }
@@ -62,12 +124,46 @@ func main() {
 }
 
 func runNodeAgent() {
+	uids, err := na.ParseAuthorizedUIDs(workloadAPIAuthorizedUIDs)
+	if err != nil {
+		glog.Errorf("Invalid --workload-api-authorized-uids: %v", err)
+		os.Exit(-1)
+	}
+	naConfig.WorkloadAPIAuthorizedUIDs = uids
+	out := &naConfig.WorkloadOutput
+	if out.CertFilePermission, err = na.ParseFileMode(workloadCertMode); err != nil {
+		glog.Errorf("Invalid --workload-cert-mode: %v", err)
+		os.Exit(-1)
+	}
+	if out.KeyFilePermission, err = na.ParseFileMode(workloadKeyMode); err != nil {
+		glog.Errorf("Invalid --workload-key-mode: %v", err)
+		os.Exit(-1)
+	}
+	if out.Owner, err = na.ParseFileOwner(workloadOwner); err != nil {
+		glog.Errorf("Invalid --workload-owner: %v", err)
+		os.Exit(-1)
+	}
+	for _, value := range rotationHooks {
+		hook, err := workload.ParseHook(value)
+		if err != nil {
+			glog.Errorf("Invalid --rotation-hook: %v", err)
+			os.Exit(-1)
+		}
+		naConfig.RotationHooks = append(naConfig.RotationHooks, hook)
+	}
+
 	nodeAgent, err := na.NewNodeAgent(&naConfig)
 	if err != nil {
 		glog.Error(err)
 		os.Exit(-1)
 	}
 
+	if monitoringPort > 0 {
+		if err := monitoring.Run(monitoringPort); err != nil {
+			glog.Warningf("Failed to start monitoring server with error: %v", err)
+		}
+	}
+
 	glog.Infof("Starting Node Agent")
 	if err := nodeAgent.Start(); err != nil {
 		glog.Errorf("Node agent terminated with error: %v.", err)
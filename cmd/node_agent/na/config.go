@@ -15,9 +15,15 @@
 package na
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"istio.io/auth/pkg/platform"
+	"istio.io/auth/pkg/util"
+	"istio.io/auth/pkg/workload"
 )
 
 const (
@@ -27,6 +33,8 @@ const (
 	defaultCSRMaxRetries = 5
 	// defaultCSRGracePeriodPercentage is the default value of Config.CSRGracePeriodPercentage.
 	defaultCSRGracePeriodPercentage = 50
+	// defaultIdentitiesReloadInterval is the default value of Config.IdentitiesReloadInterval.
+	defaultIdentitiesReloadInterval = time.Second * 10
 )
 
 // Config is Node agent configuration.
@@ -54,6 +62,66 @@ type Config struct {
 
 	// The Configuration for talking to the platform metadata server.
 	PlatformConfig platform.ClientConfig
+
+	// OneShot indicates whether the node agent exits once the first
+	// certificate is written, e.g. in an init container of a pod.
+	OneShot bool
+
+	// WorkloadAPISocket is the Unix domain socket on which the certificate
+	// is served to the workloads through the Workload API. If empty, the
+	// certificate is written to files.
+	WorkloadAPISocket string
+
+	// WorkloadAPIAuthorizedUIDs maps the identities to the UIDs of the
+	// workload processes that may fetch them through the Workload API.
+	WorkloadAPIAuthorizedUIDs map[string][]uint32
+
+	// WorkloadOutput specifies the files that the certificate of the
+	// workload is written to.
+	WorkloadOutput WorkloadOutputConfig
+
+	// RotationHooks are run after the certificate files are rotated.
+	RotationHooks []workload.Hook
+
+	// IdentitiesFile lists the identities that the node agent manages, each
+	// with its own key, renewal schedule and output, instead of the identity
+	// of the platform. See IdentitiesConfig.
+	IdentitiesFile string
+
+	// IdentitiesReloadInterval is how often IdentitiesFile is checked for
+	// changes.
+	IdentitiesReloadInterval time.Duration
+}
+
+// WorkloadOutputConfig specifies the files of the certificate of the workload.
+type WorkloadOutputConfig struct {
+	// CertChainFile and KeyFile are optional, but must be specified together.
+	// If specified, they separate the certificate of the workload from the
+	// credential of the node agent in PlatformConfig, which is then left as
+	// it is. Otherwise, the certificate of the workload is written to the
+	// credential of the node agent, which is renewed along with it.
+	CertChainFile string
+	KeyFile       string
+
+	// RootCertFile is optional.
+	RootCertFile string
+
+	// BundleFile is optional. It has the root certificate followed by the
+	// federated bundle.
+	BundleFile string
+
+	// FederatedBundleFiles are the PEM files with the root certificates of
+	// the other trust domains that the workload trusts.
+	FederatedBundleFiles []string
+
+	// CertFilePermission and KeyFilePermission are the permissions of the
+	// files, or zero for the defaults.
+	CertFilePermission os.FileMode
+	KeyFilePermission  os.FileMode
+
+	// Owner is the owner of the files, or nil to keep the user of the node
+	// agent.
+	Owner *util.FileOwner
 }
 
 // InitializeConfig initializes Config with default values.
@@ -61,5 +129,68 @@ func InitializeConfig(config *Config) {
 	config.CSRInitialRetrialInterval = defaultCSRInitialRetrialInterval
 	config.CSRMaxRetries = defaultCSRMaxRetries
 	config.CSRGracePeriodPercentage = defaultCSRGracePeriodPercentage
+	config.IdentitiesReloadInterval = defaultIdentitiesReloadInterval
 	config.PlatformConfig = platform.ClientConfig{}
 }
+
+// ParseAuthorizedUIDs parses the UIDs authorized for the identities, in the
+// form of <identity>=<uid>. An identity may be listed several times.
+func ParseAuthorizedUIDs(values []string) (map[string][]uint32, error) {
+	uids := make(map[string][]uint32)
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not in the form of <identity>=<uid>", value)
+		}
+		uid, err := strconv.ParseUint(value[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID in %q (error: %v)", value, err)
+		}
+		uids[value[:i]] = append(uids[value[:i]], uint32(uid))
+	}
+	return uids, nil
+}
+
+// workloadCertFiles returns the files that the certificate chain and the
+// private key of the workload are written to. See WorkloadOutputConfig.
+func (c *Config) workloadCertFiles() (string, string, error) {
+	out := c.WorkloadOutput
+	switch {
+	case out.CertChainFile == "" && out.KeyFile == "":
+		return c.PlatformConfig.CertChainFile, c.PlatformConfig.KeyFile, nil
+	case out.CertChainFile == "" || out.KeyFile == "":
+		return "", "", fmt.Errorf("the certificate chain and the private key files of the workload " +
+			"must be specified together")
+	}
+	return out.CertChainFile, out.KeyFile, nil
+}
+
+// ParseFileMode parses an octal file permission, e.g. 0640.
+func ParseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("%q is not an octal file permission", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// ParseFileOwner parses a file owner in the form of <uid>:<gid>. An empty
+// value is parsed to nil.
+func ParseFileOwner(value string) (*util.FileOwner, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%q is not in the form of <uid>:<gid>", value)
+	}
+	uid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID in %q (error: %v)", value, err)
+	}
+	gid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GID in %q (error: %v)", value, err)
+	}
+	return &util.FileOwner{UID: int(uid), GID: int(gid)}, nil
+}
@@ -15,7 +15,12 @@
 package na
 
 import (
+	"os"
+	"reflect"
 	"testing"
+
+	"istio.io/auth/pkg/platform"
+	"istio.io/auth/pkg/util"
 )
 
 func TestInitializeConfig(t *testing.T) {
@@ -36,3 +41,172 @@ func TestInitializeConfig(t *testing.T) {
 	}
 
 }
+
+func TestParseAuthorizedUIDs(t *testing.T) {
+	testCases := map[string]struct {
+		values      []string
+		uids        map[string][]uint32
+		expectedErr string
+	}{
+		"Empty": {
+			uids: map[string][]uint32{},
+		},
+		"Several UIDs": {
+			values: []string{"spiffe://cluster.local/ns/a/sa/a=1000", "spiffe://cluster.local/ns/b/sa/b=1001",
+				"spiffe://cluster.local/ns/a/sa/a=1002"},
+			uids: map[string][]uint32{
+				"spiffe://cluster.local/ns/a/sa/a": {1000, 1002},
+				"spiffe://cluster.local/ns/b/sa/b": {1001},
+			},
+		},
+		"Missing identity": {
+			values:      []string{"=1000"},
+			expectedErr: `"=1000" is not in the form of <identity>=<uid>`,
+		},
+		"Invalid UID": {
+			values: []string{"spiffe://cluster.local/ns/a/sa/a=root"},
+			expectedErr: `invalid UID in "spiffe://cluster.local/ns/a/sa/a=root" ` +
+				`(error: strconv.ParseUint: parsing "root": invalid syntax)`,
+		},
+	}
+
+	for id, c := range testCases {
+		uids, err := ParseAuthorizedUIDs(c.values)
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if !reflect.DeepEqual(uids, c.uids) {
+			t.Errorf("Case %s: expecting %v but got %v", id, c.uids, uids)
+		}
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	testCases := map[string]struct {
+		value       string
+		mode        os.FileMode
+		expectedErr string
+	}{
+		"Key file": {
+			value: "0640",
+			mode:  0640,
+		},
+		"Without leading zero": {
+			value: "644",
+			mode:  0644,
+		},
+		"Not octal": {
+			value:       "0648",
+			expectedErr: `"0648" is not an octal file permission`,
+		},
+		"Not a permission": {
+			value:       "01777",
+			expectedErr: `"01777" is not an octal file permission`,
+		},
+	}
+
+	for id, c := range testCases {
+		mode, err := ParseFileMode(c.value)
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if mode != c.mode {
+			t.Errorf("Case %s: expecting %v but got %v", id, c.mode, mode)
+		}
+	}
+}
+
+func TestParseFileOwner(t *testing.T) {
+	testCases := map[string]struct {
+		value       string
+		owner       *util.FileOwner
+		expectedErr string
+	}{
+		"Empty": {},
+		"Owner": {
+			value: "1337:1338",
+			owner: &util.FileOwner{UID: 1337, GID: 1338},
+		},
+		"Missing GID": {
+			value:       "1337",
+			expectedErr: `"1337" is not in the form of <uid>:<gid>`,
+		},
+		"Invalid UID": {
+			value:       "istio:1338",
+			expectedErr: `invalid UID in "istio:1338" (error: strconv.ParseUint: parsing "istio": invalid syntax)`,
+		},
+		"Invalid GID": {
+			value:       "1337:-1",
+			expectedErr: `invalid GID in "1337:-1" (error: strconv.ParseUint: parsing "-1": invalid syntax)`,
+		},
+	}
+
+	for id, c := range testCases {
+		owner, err := ParseFileOwner(c.value)
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if !reflect.DeepEqual(owner, c.owner) {
+			t.Errorf("Case %s: expecting %v but got %v", id, c.owner, owner)
+		}
+	}
+}
+
+func TestWorkloadCertFiles(t *testing.T) {
+	platformConfig := platform.ClientConfig{CertChainFile: "/etc/certs/cert-chain.pem", KeyFile: "/etc/certs/key.pem"}
+	testCases := map[string]struct {
+		output        WorkloadOutputConfig
+		certChainFile string
+		keyFile       string
+		expectedErr   string
+	}{
+		"Credential of the node agent": {
+			certChainFile: "/etc/certs/cert-chain.pem",
+			keyFile:       "/etc/certs/key.pem",
+		},
+		"Separate files": {
+			output: WorkloadOutputConfig{
+				CertChainFile: "/etc/certs/workload/cert-chain.pem",
+				KeyFile:       "/etc/certs/workload/key.pem",
+			},
+			certChainFile: "/etc/certs/workload/cert-chain.pem",
+			keyFile:       "/etc/certs/workload/key.pem",
+		},
+		"Missing key file": {
+			output:      WorkloadOutputConfig{CertChainFile: "/etc/certs/workload/cert-chain.pem"},
+			expectedErr: "the certificate chain and the private key files of the workload must be specified together",
+		},
+	}
+
+	for id, c := range testCases {
+		config := &Config{PlatformConfig: platformConfig, WorkloadOutput: c.output}
+		certChainFile, keyFile, err := config.workloadCertFiles()
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if certChainFile != c.certChainFile || keyFile != c.keyFile {
+			t.Errorf("Case %s: expecting %s and %s but got %s and %s",
+				id, c.certChainFile, c.keyFile, certChainFile, keyFile)
+		}
+	}
+}
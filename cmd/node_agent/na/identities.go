@@ -0,0 +1,497 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package na
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/workload"
+)
+
+// identityRestartInterval is how long the renewal of an identity waits before
+// it starts over, after the CSR is not approved in the max number of retries.
+const identityRestartInterval = time.Minute
+
+// IdentitiesConfig is the content of Config.IdentitiesFile, in YAML or JSON.
+type IdentitiesConfig struct {
+	Identities []IdentityConfig `json:"identities"`
+}
+
+// IdentityConfig is an identity that the node agent manages. Its certificate
+// is written to the files if they are set, or served through the Workload API
+// otherwise.
+type IdentityConfig struct {
+	// Identity is the SAN of the certificate, e.g. a SPIFFE ID. It must be a
+	// SPIFFE ID if the identity is served through the Workload API.
+	Identity string `json:"identity"`
+
+	// RSAKeySize and CSRGracePeriodPercentage default to those of Config.
+	RSAKeySize               int `json:"rsaKeySize,omitempty"`
+	CSRGracePeriodPercentage int `json:"csrGracePeriodPercentage,omitempty"`
+
+	// The files that the certificate is written to. The root certificate and
+	// the bundle files are optional. See WorkloadOutputConfig.
+	CertChainFile string `json:"certChainFile,omitempty"`
+	KeyFile       string `json:"keyFile,omitempty"`
+	RootCertFile  string `json:"rootCertFile,omitempty"`
+	BundleFile    string `json:"bundleFile,omitempty"`
+	// CertFileMode and KeyFileMode are octal permissions, and Owner is in the
+	// form of <uid>:<gid>.
+	CertFileMode string `json:"certFileMode,omitempty"`
+	KeyFileMode  string `json:"keyFileMode,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	// RotationHooks are run after the files are rotated. See
+	// workload.ParseHook.
+	RotationHooks []string `json:"rotationHooks,omitempty"`
+
+	// AuthorizedUIDs are the UIDs of the workload processes that may fetch
+	// the identity through the Workload API. If empty, the identity is only
+	// served to the user of the node agent.
+	AuthorizedUIDs []uint32 `json:"authorizedUIDs,omitempty"`
+	// OnDemand indicates whether the certificate is only issued once a
+	// workload process of AuthorizedUIDs fetches its identities through the
+	// Workload API.
+	OnDemand bool `json:"onDemand,omitempty"`
+}
+
+// servedByWorkloadAPI returns whether the identity is served through the
+// Workload API rather than written to files.
+func (c *IdentityConfig) servedByWorkloadAPI() bool {
+	return c.CertChainFile == "" && c.KeyFile == ""
+}
+
+// secretFileServerConfig returns the configuration of the files of the
+// identity.
+func (c *IdentityConfig) secretFileServerConfig() (workload.Config, error) {
+	cfg := workload.NewSecretFileServerConfig(c.CertChainFile, c.KeyFile)
+	cfg.ServiceIdentityRootCertFile = c.RootCertFile
+	cfg.ServiceIdentityBundleFile = c.BundleFile
+	var err error
+	if c.CertFileMode != "" {
+		if cfg.CertFilePermission, err = ParseFileMode(c.CertFileMode); err != nil {
+			return cfg, err
+		}
+	}
+	if c.KeyFileMode != "" {
+		if cfg.KeyFilePermission, err = ParseFileMode(c.KeyFileMode); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.FileOwner, err = ParseFileOwner(c.Owner); err != nil {
+		return cfg, err
+	}
+	for _, value := range c.RotationHooks {
+		hook, err := workload.ParseHook(value)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Hooks = append(cfg.Hooks, hook)
+	}
+	return cfg, nil
+}
+
+func (c *IdentityConfig) validate(workloadAPIEnabled bool) error {
+	if c.Identity == "" {
+		return fmt.Errorf("the identity is empty")
+	}
+	if c.RSAKeySize < 0 || c.CSRGracePeriodPercentage < 0 || c.CSRGracePeriodPercentage >= 100 {
+		return fmt.Errorf("invalid key size or grace period percentage of %s", c.Identity)
+	}
+	if !c.servedByWorkloadAPI() {
+		if c.CertChainFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("both the certificate chain file and the key file of %s must be set", c.Identity)
+		}
+		if len(c.AuthorizedUIDs) > 0 || c.OnDemand {
+			return fmt.Errorf("%s is written to files, so it cannot have authorized UIDs or be on demand", c.Identity)
+		}
+		if _, err := c.secretFileServerConfig(); err != nil {
+			return fmt.Errorf("invalid files of %s (error: %v)", c.Identity, err)
+		}
+		return nil
+	}
+	if !workloadAPIEnabled {
+		return fmt.Errorf("%s has no files, but the Workload API is not enabled", c.Identity)
+	}
+	if !strings.HasPrefix(c.Identity, "spiffe://") || strings.Contains(c.Identity, ",") {
+		return fmt.Errorf("%s is served through the Workload API, so it must be a SPIFFE ID", c.Identity)
+	}
+	if c.OnDemand && len(c.AuthorizedUIDs) == 0 {
+		return fmt.Errorf("%s is on demand, so it must have authorized UIDs", c.Identity)
+	}
+	return nil
+}
+
+// dirs returns the directories of the files of the identity.
+func (c *IdentityConfig) dirs() []string {
+	var dirs []string
+	for _, file := range []string{c.CertChainFile, c.KeyFile, c.RootCertFile, c.BundleFile} {
+		if file != "" {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	return dirs
+}
+
+// LoadIdentities reads and validates the identities file. The identities are
+// written to separate directories, since the files of a directory are
+// rotated together.
+func LoadIdentities(file string, workloadAPIEnabled bool) ([]IdentityConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config IdentitiesConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s (error: %v)", file, err)
+	}
+	seen := make(map[string]bool)
+	dirOwners := make(map[string]string)
+	for i := range config.Identities {
+		c := &config.Identities[i]
+		if err := c.validate(workloadAPIEnabled); err != nil {
+			return nil, err
+		}
+		if seen[c.Identity] {
+			return nil, fmt.Errorf("%s is listed more than once", c.Identity)
+		}
+		seen[c.Identity] = true
+		for _, dir := range c.dirs() {
+			if owner, ok := dirOwners[dir]; ok && owner != c.Identity {
+				return nil, fmt.Errorf("%s and %s are written to the same directory %s", owner, c.Identity, dir)
+			}
+			dirOwners[dir] = c.Identity
+		}
+	}
+	return config.Identities, nil
+}
+
+// identityManager renews the certificates of the identities in the identities
+// file concurrently, and starts and stops their renewals as the file changes.
+type identityManager struct {
+	na             *nodeAgentInternal
+	file           string
+	reloadInterval time.Duration
+	// apiServer serves the identities without files, or is nil if the
+	// Workload API is not enabled.
+	apiServer *workload.WorkloadAPIServer
+
+	// The fields below are guarded by mutex.
+	mutex      sync.Mutex
+	modTime    time.Time
+	identities map[string]*managedIdentity
+}
+
+// managedIdentity is an identity of the identities file.
+type managedIdentity struct {
+	config IdentityConfig
+	// stop is closed to stop the renewal, and done is closed once it stops.
+	// They are nil while the renewal is not started, i.e. an on-demand
+	// identity is not fetched yet.
+	stop chan struct{}
+	done chan struct{}
+	// err is the error of the renewal in the one-shot mode. It is set before
+	// done is closed.
+	err error
+}
+
+// newIdentityManager creates an identityManager, and starts serving the
+// Workload API if it is enabled.
+func newIdentityManager(na *nodeAgentInternal, cfg *Config) (*identityManager, error) {
+	m := &identityManager{
+		na:             na,
+		file:           cfg.IdentitiesFile,
+		reloadInterval: cfg.IdentitiesReloadInterval,
+	}
+	if m.reloadInterval <= 0 {
+		m.reloadInterval = defaultIdentitiesReloadInterval
+	}
+	if cfg.WorkloadAPISocket != "" {
+		serverCfg := workload.NewWorkloadAPIServerConfig(cfg.WorkloadAPISocket, cfg.WorkloadAPIAuthorizedUIDs)
+		serverCfg.OnFetch = m.request
+		server, err := workload.NewWorkloadAPIServer(serverCfg)
+		if err != nil {
+			return nil, err
+		}
+		m.apiServer = server
+	}
+	return m, nil
+}
+
+// run loads the identities file and renews the identities. In the one-shot
+// mode, it returns once the certificates of the identities that are not on
+// demand are written. Otherwise, it reloads the file whenever it changes, until
+// stop is closed; the renewals are then stopped, and it returns once they have
+// returned.
+func (m *identityManager) run(stop <-chan struct{}) error {
+	if err := m.reload(); err != nil {
+		return err
+	}
+	if m.na.config.OneShot {
+		return m.wait()
+	}
+	ticker := time.NewTicker(m.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.reload(); err != nil {
+				glog.Errorf("Failed to reload %s, the current identities are kept (error: %v)", m.file, err)
+			}
+		case <-stop:
+			m.stopAll()
+			return nil
+		}
+	}
+}
+
+// stopAll stops the renewals of all the identities, and waits for them to
+// return.
+func (m *identityManager) stopAll() {
+	m.mutex.Lock()
+	var done []<-chan struct{}
+	for _, id := range m.identities {
+		if d := m.stop(id); d != nil {
+			done = append(done, d)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, d := range done {
+		<-d
+	}
+}
+
+// reload loads the identities file if it has changed. The renewals of the
+// removed and changed identities are stopped, and those of the added and
+// changed ones are started once the stopped ones have returned, so that they
+// do not write the same secrets concurrently.
+func (m *identityManager) reload() error {
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	if m.identities != nil && info.ModTime().Equal(m.modTime) {
+		m.mutex.Unlock()
+		return nil
+	}
+	configs, err := LoadIdentities(m.file, m.apiServer != nil)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.modTime = info.ModTime()
+	if m.identities == nil {
+		m.identities = make(map[string]*managedIdentity)
+	}
+
+	loaded := make(map[string]IdentityConfig)
+	for _, c := range configs {
+		loaded[c.Identity] = c
+	}
+	var stopped []stoppedIdentity
+	for identity, id := range m.identities {
+		c, ok := loaded[identity]
+		if ok && reflect.DeepEqual(c, id.config) {
+			continue
+		}
+		s := stoppedIdentity{config: id.config, done: m.stop(id)}
+		if ok {
+			s.replacement = &c
+		}
+		stopped = append(stopped, s)
+		delete(m.identities, identity)
+	}
+	m.mutex.Unlock()
+
+	// The renewals are waited for without the mutex, since a pending CSR
+	// would block the Workload API clients that request their identities.
+	for _, s := range stopped {
+		if s.done != nil {
+			<-s.done
+		}
+		m.release(s.config, s.replacement)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, c := range configs {
+		if _, ok := m.identities[c.Identity]; ok {
+			continue
+		}
+		id := &managedIdentity{config: c}
+		m.identities[c.Identity] = id
+		if !c.OnDemand {
+			m.start(id)
+		}
+	}
+	glog.Infof("Loaded %d identities from %s", len(configs), m.file)
+	return nil
+}
+
+// stoppedIdentity is an identity whose renewal is being stopped by reload.
+type stoppedIdentity struct {
+	config IdentityConfig
+	// replacement is the changed configuration of the identity, or nil if it
+	// is removed.
+	replacement *IdentityConfig
+	// done is closed once the renewal has returned, or nil if it is not
+	// started.
+	done <-chan struct{}
+}
+
+// request starts the renewals of the on-demand identities that the UID is
+// authorized for. It is called when a workload process of the UID fetches its
+// identities through the Workload API.
+func (m *identityManager) request(uid uint32) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, id := range m.identities {
+		if !id.config.OnDemand || id.stop != nil {
+			continue
+		}
+		for _, authorized := range id.config.AuthorizedUIDs {
+			if authorized == uid {
+				glog.Infof("%s is requested by a workload process of UID %d", id.config.Identity, uid)
+				m.start(id)
+				break
+			}
+		}
+	}
+}
+
+// start starts the renewal of the identity. In the one-shot mode, it stops
+// after the first certificate is written. Otherwise, it starts over after a
+// failure, including a failure to create the secret server of the files,
+// until it is stopped. It must be called with the mutex held.
+func (m *identityManager) start(id *managedIdentity) {
+	c := id.config
+	if c.servedByWorkloadAPI() {
+		m.apiServer.SetAuthorizedUIDs(c.Identity, c.AuthorizedUIDs)
+	}
+	r := renewal{
+		identity:              c.Identity,
+		keySize:               c.RSAKeySize,
+		gracePeriodPercentage: c.CSRGracePeriodPercentage,
+	}
+	if r.keySize == 0 {
+		r.keySize = m.na.config.RSAKeySize
+	}
+	if r.gracePeriodPercentage == 0 {
+		r.gracePeriodPercentage = m.na.config.CSRGracePeriodPercentage
+	}
+
+	id.stop = make(chan struct{})
+	id.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		for {
+			err := m.renewIdentity(c, r, stop)
+			if m.na.config.OneShot {
+				id.err = err
+				return
+			}
+			if err == nil {
+				return
+			}
+			glog.Errorf("Failed to renew %s, will start over in %s (error: %v)",
+				r.identity, identityRestartInterval.String(), err)
+			if !sleep(identityRestartInterval, stop) {
+				return
+			}
+		}
+	}(id.stop, id.done)
+}
+
+// renewIdentity creates the secret server of the identity, and keeps its
+// certificate renewed. See nodeAgentInternal.renew.
+func (m *identityManager) renewIdentity(c IdentityConfig, r renewal, stop <-chan struct{}) error {
+	if c.servedByWorkloadAPI() {
+		r.secretServer = m.apiServer
+		return m.na.renew(r, stop)
+	}
+	// The configuration is validated when the file is loaded.
+	secretCfg, _ := c.secretFileServerConfig()
+	secretServer, err := workload.NewSecretServer(secretCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create the secret server (error: %v)", err)
+	}
+	r.secretServer = secretServer
+	return m.na.renew(r, stop)
+}
+
+// stop stops the renewal of the identity, and returns a channel that is closed
+// once the renewal has returned, or nil if it is not started. It must be
+// called with the mutex held, and the channel must be waited on without it.
+func (m *identityManager) stop(id *managedIdentity) <-chan struct{} {
+	if id.stop == nil {
+		return nil
+	}
+	done := id.done
+	close(id.stop)
+	id.stop, id.done = nil, nil
+	glog.Infof("Stopped renewing %s", id.config.Identity)
+	return done
+}
+
+// release stops serving the identity once its renewal has returned. If the
+// identity is replaced by a changed configuration that is still served by the
+// Workload API, the old SVID is served until the new renewal replaces it.
+func (m *identityManager) release(c IdentityConfig, replacement *IdentityConfig) {
+	if replacement == nil {
+		currentCertExpiry.remove(c.Identity)
+	}
+	if !c.servedByWorkloadAPI() {
+		return
+	}
+	if replacement != nil && replacement.servedByWorkloadAPI() {
+		m.apiServer.SetAuthorizedUIDs(c.Identity, replacement.AuthorizedUIDs)
+		return
+	}
+	m.apiServer.RemoveSecret(c.Identity)
+	m.apiServer.SetAuthorizedUIDs(c.Identity, nil)
+}
+
+// wait waits for the renewals in the one-shot mode, and returns the first
+// error.
+func (m *identityManager) wait() error {
+	m.mutex.Lock()
+	var started []*managedIdentity
+	for _, id := range m.identities {
+		if id.done != nil {
+			started = append(started, id)
+		}
+	}
+	m.mutex.Unlock()
+
+	var err error
+	for _, id := range started {
+		<-id.done
+		if id.err != nil && err == nil {
+			err = fmt.Errorf("failed to renew %s (error: %v)", id.config.Identity, id.err)
+		}
+	}
+	return err
+}
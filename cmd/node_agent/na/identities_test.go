@@ -0,0 +1,512 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package na
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"istio.io/auth/pkg/platform"
+	mockpc "istio.io/auth/pkg/platform/mock"
+	pb "istio.io/auth/proto"
+)
+
+// syncCAClient approves all the CSRs. It can be shared by concurrent renewals.
+type syncCAClient struct {
+	mutex   sync.Mutex
+	counter int
+}
+
+func (f *syncCAClient) SendCSR(ctx context.Context, req *pb.Request, pc platform.Client,
+	cfg *Config) (*pb.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.counter++
+	return &pb.Response{IsApproved: true, SignedCertChain: []byte(`TESTCERT`)}, nil
+}
+
+func (f *syncCAClient) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.counter
+}
+
+// pendingCAClient never answers the CSRs, which are pending until their
+// contexts are cancelled.
+type pendingCAClient struct {
+	sent chan struct{}
+}
+
+func (f *pendingCAClient) SendCSR(ctx context.Context, req *pb.Request, pc platform.Client,
+	cfg *Config) (*pb.Response, error) {
+	f.sent <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLoadIdentities(t *testing.T) {
+	testCases := map[string]struct {
+		content            string
+		workloadAPIEnabled bool
+		expectedIdentities []string
+		expectedErr        string
+	}{
+		"Files and Workload API": {
+			content: `
+identities:
+- identity: spiffe://cluster.local/ns/default/sa/foo
+  rsaKeySize: 2048
+  certChainFile: /etc/certs/foo/cert-chain.pem
+  keyFile: /etc/certs/foo/key.pem
+  keyFileMode: "0640"
+  owner: "1000:1000"
+  rotationHooks: ["signal:HUP:/var/run/foo.pid"]
+- identity: spiffe://cluster.local/ns/default/sa/bar
+  authorizedUIDs: [1001]
+  onDemand: true
+`,
+			workloadAPIEnabled: true,
+			expectedIdentities: []string{
+				"spiffe://cluster.local/ns/default/sa/foo", "spiffe://cluster.local/ns/default/sa/bar",
+			},
+		},
+		"JSON": {
+			content:            `{"identities": [{"identity": "foo", "certChainFile": "cert", "keyFile": "key"}]}`,
+			expectedIdentities: []string{"foo"},
+		},
+		"Malformed": {
+			content:     "identities: foo",
+			expectedErr: "failed to parse",
+		},
+		"Empty identity": {
+			content:     "identities: [{certChainFile: cert, keyFile: key}]",
+			expectedErr: "the identity is empty",
+		},
+		"Shared directory": {
+			content: `
+identities:
+- {identity: foo, certChainFile: /etc/certs/foo/cert.pem, keyFile: /etc/certs/foo/key.pem}
+- {identity: bar, certChainFile: /etc/certs/bar/cert.pem, keyFile: /etc/certs/foo/bar-key.pem}
+`,
+			expectedErr: "foo and bar are written to the same directory /etc/certs/foo",
+		},
+		"Duplicate identity": {
+			content: `
+identities:
+- {identity: foo, certChainFile: foo1/cert, keyFile: foo1/key}
+- {identity: foo, certChainFile: foo2/cert, keyFile: foo2/key}
+`,
+			expectedErr: "foo is listed more than once",
+		},
+		"Missing key file": {
+			content:     "identities: [{identity: foo, certChainFile: cert}]",
+			expectedErr: "both the certificate chain file and the key file of foo must be set",
+		},
+		"Invalid file mode": {
+			content:     `identities: [{identity: foo, certChainFile: cert, keyFile: key, keyFileMode: "rw"}]`,
+			expectedErr: "invalid files of foo",
+		},
+		"Files on demand": {
+			content:     "identities: [{identity: foo, certChainFile: cert, keyFile: key, onDemand: true}]",
+			expectedErr: "foo is written to files, so it cannot have authorized UIDs or be on demand",
+		},
+		"Workload API not enabled": {
+			content:     "identities: [{identity: 'spiffe://cluster.local/ns/default/sa/foo'}]",
+			expectedErr: "spiffe://cluster.local/ns/default/sa/foo has no files, but the Workload API is not enabled",
+		},
+		"Not a SPIFFE ID": {
+			content:            "identities: [{identity: foo.default.svc}]",
+			workloadAPIEnabled: true,
+			expectedErr:        "foo.default.svc is served through the Workload API, so it must be a SPIFFE ID",
+		},
+		"On demand without UIDs": {
+			content:            "identities: [{identity: 'spiffe://cluster.local/ns/default/sa/foo', onDemand: true}]",
+			workloadAPIEnabled: true,
+			expectedErr:        "spiffe://cluster.local/ns/default/sa/foo is on demand, so it must have authorized UIDs",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+
+	for id, c := range testCases {
+		if err := ioutil.WriteFile(file, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		configs, err := LoadIdentities(file, c.workloadAPIEnabled)
+		if c.expectedErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), c.expectedErr) {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+			continue
+		}
+		var identities []string
+		for _, config := range configs {
+			identities = append(identities, config.Identity)
+		}
+		if strings.Join(identities, " ") != strings.Join(c.expectedIdentities, " ") {
+			t.Errorf("Case %s: expecting identities %v but got %v", id, c.expectedIdentities, identities)
+		}
+	}
+}
+
+func TestIdentityManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+	writeIdentities := func(content string, modTime time.Time) {
+		content = strings.Replace(content, "$DIR", dir, -1)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The modification time must change even if the file is rewritten
+		// within its resolution.
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caClient := &syncCAClient{}
+	na := &nodeAgentInternal{
+		config: &Config{
+			IstioCAAddress:            "ca_addr",
+			RSAKeySize:                512,
+			CSRInitialRetrialInterval: time.Millisecond,
+			CSRMaxRetries:             3,
+		},
+		pc:       mockpc.FakeClient{nil, "", "service1", "", true},
+		cAClient: caClient,
+		// The certificates are renewed after an hour.
+		certUtil: FakeCertUtil{time.Hour, nil},
+	}
+	m, err := newIdentityManager(na, &Config{IdentitiesFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeIdentities(`
+identities:
+- {identity: foo, certChainFile: $DIR/foo/cert.pem, keyFile: $DIR/foo/key.pem}
+- {identity: bar, certChainFile: $DIR/bar/cert.pem, keyFile: $DIR/bar/key.pem}
+`, time.Now().Add(-time.Minute))
+	if err := m.reload(); err != nil {
+		t.Fatal(err)
+	}
+	// The identities are renewed concurrently.
+	for _, name := range []string{"foo/cert.pem", "bar/cert.pem"} {
+		waitForFile(t, filepath.Join(dir, name))
+	}
+	if count := caClient.count(); count != 2 {
+		t.Errorf("Expecting 2 CSRs but got %d", count)
+	}
+
+	// The unchanged file is not reloaded.
+	if err := m.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if count := caClient.count(); count != 2 {
+		t.Errorf("Expecting no more CSRs but got %d", count)
+	}
+
+	// The removed identity is stopped, and the changed one is restarted.
+	writeIdentities(`
+identities:
+- {identity: foo, rsaKeySize: 1024, certChainFile: $DIR/foo/cert.pem, keyFile: $DIR/foo/key.pem}
+`, time.Now())
+	if err := os.Remove(filepath.Join(dir, "foo/cert.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(dir, "foo/cert.pem"))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.identities["bar"]; ok || len(m.identities) != 1 {
+		t.Errorf("Expecting only foo to be managed but got %v", m.identities)
+	}
+	if foo := m.identities["foo"]; foo == nil || foo.config.RSAKeySize != 1024 {
+		t.Errorf("Expecting foo to be renewed with the new key size")
+	} else {
+		<-m.stop(foo)
+	}
+}
+
+func TestIdentityManagerOneShot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+	content := strings.Replace(`
+identities:
+- {identity: foo, certChainFile: $DIR/foo/cert.pem, keyFile: $DIR/foo/key.pem}
+- {identity: bar, certChainFile: $DIR/bar/cert.pem, keyFile: $DIR/bar/key.pem}
+`, "$DIR", dir, -1)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	caClient := &syncCAClient{}
+	na := &nodeAgentInternal{
+		config: &Config{
+			IstioCAAddress: "ca_addr",
+			RSAKeySize:     512,
+			OneShot:        true,
+		},
+		pc:       mockpc.FakeClient{nil, "", "service1", "", true},
+		cAClient: caClient,
+		certUtil: FakeCertUtil{time.Hour, nil},
+	}
+	m, err := newIdentityManager(na, &Config{IdentitiesFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run returns once all the certificates are written.
+	if err := m.run(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"foo/cert.pem", "bar/cert.pem"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expecting %s to be written but got error %v", name, err)
+		}
+	}
+	if count := caClient.count(); count != 2 {
+		t.Errorf("Expecting 2 CSRs but got %d", count)
+	}
+}
+
+func TestIdentityManagerRunStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+	content := strings.Replace(`
+identities:
+- {identity: foo, certChainFile: $DIR/foo/cert.pem, keyFile: $DIR/foo/key.pem}
+`, "$DIR", dir, -1)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	na := &nodeAgentInternal{
+		config: &Config{
+			IstioCAAddress: "ca_addr",
+			RSAKeySize:     512,
+		},
+		pc:       mockpc.FakeClient{nil, "", "service1", "", true},
+		cAClient: &syncCAClient{},
+		certUtil: FakeCertUtil{time.Hour, nil},
+	}
+	m, err := newIdentityManager(na, &Config{IdentitiesFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- m.run(stop)
+	}()
+	waitForFile(t, filepath.Join(dir, "foo/cert.pem"))
+
+	close(stop)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run does not return after stop is closed")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if foo := m.identities["foo"]; foo == nil || foo.stop != nil {
+		t.Errorf("Expecting the renewal of foo to be stopped")
+	}
+}
+
+func TestOnDemandIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+	content := `
+identities:
+- identity: spiffe://cluster.local/ns/default/sa/foo
+  authorizedUIDs: [1000]
+  onDemand: true
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	na := &nodeAgentInternal{
+		config: &Config{
+			IstioCAAddress:            "ca_addr",
+			RSAKeySize:                512,
+			CSRInitialRetrialInterval: time.Millisecond,
+		},
+		pc:       mockpc.FakeClient{nil, "", "service1", "", true},
+		cAClient: &syncCAClient{},
+		certUtil: FakeCertUtil{time.Hour, nil},
+	}
+	m, err := newIdentityManager(na, &Config{
+		IdentitiesFile:    file,
+		WorkloadAPISocket: filepath.Join(dir, "workload.sock"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.apiServer.Stop()
+	if err := m.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	foo := m.identities["spiffe://cluster.local/ns/default/sa/foo"]
+	if foo == nil || foo.stop != nil {
+		t.Fatal("Expecting the on-demand identity not to be renewed before it is requested")
+	}
+	m.mutex.Unlock()
+	m.request(1001)
+	m.mutex.Lock()
+	if foo.stop != nil {
+		t.Error("Expecting the on-demand identity not to be renewed for another UID")
+	}
+	m.mutex.Unlock()
+	m.request(1000)
+	m.mutex.Lock()
+	if foo.stop == nil {
+		t.Fatal("Expecting the on-demand identity to be renewed once it is requested")
+	}
+	<-m.stop(foo)
+}
+
+func TestReloadWithPendingCSR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "identities.yaml")
+	writeIdentities := func(keySize int, modTime time.Time) {
+		content := fmt.Sprintf("identities:\n- {identity: foo, rsaKeySize: %d, certChainFile: %s, keyFile: %s}\n",
+			keySize, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caClient := &pendingCAClient{sent: make(chan struct{}, 2)}
+	na := &nodeAgentInternal{
+		config: &Config{
+			IstioCAAddress:            "ca_addr",
+			RSAKeySize:                512,
+			CSRInitialRetrialInterval: time.Millisecond,
+		},
+		pc:       mockpc.FakeClient{nil, "", "service1", "", true},
+		cAClient: caClient,
+		certUtil: FakeCertUtil{time.Hour, nil},
+	}
+	m, err := newIdentityManager(na, &Config{IdentitiesFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeIdentities(512, time.Now().Add(-time.Minute))
+	if err := m.reload(); err != nil {
+		t.Fatal(err)
+	}
+	<-caClient.sent
+
+	// The pending CSR of the changed identity is abandoned, and the new
+	// renewal sends its own CSR.
+	writeIdentities(1024, time.Now())
+	reloaded := make(chan error)
+	go func() { reloaded <- m.reload() }()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting the reload not to wait for the pending CSR")
+	}
+	select {
+	case <-caClient.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting the changed identity to send a new CSR")
+	}
+
+	// The Workload API clients are not blocked by the pending CSR.
+	requested := make(chan struct{})
+	go func() {
+		m.request(1000)
+		close(requested)
+	}()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting the identities to be requested while a CSR is pending")
+	}
+
+	m.mutex.Lock()
+	foo := m.identities["foo"]
+	m.mutex.Unlock()
+	if foo == nil || foo.config.RSAKeySize != 1024 {
+		t.Fatal("Expecting foo to be renewed with the new key size")
+	}
+	m.mutex.Lock()
+	done := m.stop(foo)
+	m.mutex.Unlock()
+	<-done
+}
+
+func waitForFile(t *testing.T, file string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(file); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not written", file)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package na
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "istio_node_agent"
+
+var (
+	renewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_renewals_total",
+		Help:      "The number of successful certificate renewals.",
+	})
+
+	renewalFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_renewal_failures_total",
+		Help:      "The number of failed attempts to renew the certificate.",
+	})
+
+	// The expiration times of the current certificates of the identities.
+	currentCertExpiry = &expiry{notAfter: make(map[string]time.Time)}
+
+	timeToExpiry = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_ttl_seconds",
+		Help: "The time until the first of the current certificates expires. " +
+			"It is 0 before a certificate is issued.",
+	}, func() float64 {
+		return currentCertExpiry.ttl(time.Now()).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(renewals, renewalFailures, timeToExpiry)
+}
+
+type expiry struct {
+	mutex    sync.Mutex
+	notAfter map[string]time.Time
+}
+
+func (e *expiry) set(identity string, notAfter time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.notAfter[identity] = notAfter
+}
+
+func (e *expiry) remove(identity string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.notAfter, identity)
+}
+
+// ttl returns the time until the first certificate expires.
+func (e *expiry) ttl(now time.Time) time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var first time.Time
+	for _, notAfter := range e.notAfter {
+		if first.IsZero() || notAfter.Before(first) {
+			first = notAfter
+		}
+	}
+	if first.IsZero() {
+		return 0
+	}
+	return first.Sub(now)
+}
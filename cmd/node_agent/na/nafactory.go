@@ -48,12 +48,50 @@ func NewNodeAgent(cfg *Config) (NodeAgent, error) {
 	cAClient := &cAGrpcClientImpl{}
 	na.cAClient = cAClient
 
-	// TODO: Specify files for service identity cert/key instead of node agent files.
-	secretServer, err := workload.NewSecretServer(
-		workload.NewSecretFileServerConfig(cfg.PlatformConfig.CertChainFile, cfg.PlatformConfig.KeyFile))
+	if cfg.IdentitiesFile != "" {
+		identities, err := newIdentityManager(na, cfg)
+		if err != nil {
+			return nil, err
+		}
+		na.identities = identities
+		return na, nil
+	}
+
+	if cfg.WorkloadAPISocket != "" {
+		secretServer, err := newWorkloadAPIServer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		na.secretServer = secretServer
+		return na, nil
+	}
+
+	certChainFile, keyFile, err := cfg.workloadCertFiles()
+	if err != nil {
+		return nil, err
+	}
+	out := cfg.WorkloadOutput
+	secretCfg := workload.NewSecretFileServerConfig(certChainFile, keyFile)
+	secretCfg.ServiceIdentityRootCertFile = out.RootCertFile
+	secretCfg.ServiceIdentityBundleFile = out.BundleFile
+	secretCfg.CertFilePermission = out.CertFilePermission
+	secretCfg.KeyFilePermission = out.KeyFilePermission
+	secretCfg.FileOwner = out.Owner
+	secretCfg.Hooks = cfg.RotationHooks
+	secretServer, err := workload.NewSecretServer(secretCfg)
 	if err != nil {
 		glog.Fatalf("Workload IO creation error: %v", err)
 	}
 	na.secretServer = secretServer
 	return na, nil
 }
+
+// newWorkloadAPIServer starts serving the Workload API.
+func newWorkloadAPIServer(cfg *Config) (workload.SecretServer, error) {
+	server, err := workload.NewWorkloadAPIServer(
+		workload.NewWorkloadAPIServerConfig(cfg.WorkloadAPISocket, cfg.WorkloadAPIAuthorizedUIDs))
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
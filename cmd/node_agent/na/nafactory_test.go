@@ -40,6 +40,23 @@ func TestNewNodeAgent(t *testing.T) {
 			},
 			expectedErr: "",
 		},
+		"Workload API test": {
+			config: &Config{
+				Env:               "onprem",
+				WorkloadAPISocket: "/nonexistent/workload.sock",
+			},
+			expectedErr: "cannot listen on /nonexistent/workload.sock " +
+				"(error: listen unix /nonexistent/workload.sock: bind: no such file or directory)",
+		},
+		"Identities file with Workload API test": {
+			config: &Config{
+				Env:               "onprem",
+				IdentitiesFile:    "identities.yaml",
+				WorkloadAPISocket: "/nonexistent/workload.sock",
+			},
+			expectedErr: "cannot listen on /nonexistent/workload.sock " +
+				"(error: listen unix /nonexistent/workload.sock: bind: no such file or directory)",
+		},
 		"Unsupported env test": {
 			config: &Config{
 				Env: "somethig else",
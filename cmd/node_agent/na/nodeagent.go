@@ -16,32 +16,89 @@ package na
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"istio.io/auth/pkg/pki"
 	"istio.io/auth/pkg/pki/ca"
 	"istio.io/auth/pkg/platform"
 	"istio.io/auth/pkg/workload"
 	pb "istio.io/auth/proto"
 )
 
+// retryAfterKey is the key of the GRPC trailer in which a rate-limited CA
+// tells how many seconds to wait before retrying. It must match
+// istio.io/auth/pkg/server/grpc.RetryAfterKey.
+const retryAfterKey = "retry-after"
+
+// retryAfterError is returned by SendCSR when the CA rejects the CSR with a
+// hint of when to retry.
+type retryAfterError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
 // CAGrpcClient is for implementing the GRPC client to talk to CA.
 type CAGrpcClient interface {
-	// Send CSR to the CA and gets the response or error.
-	SendCSR(*pb.Request, platform.Client, *Config) (*pb.Response, error)
+	// Send CSR to the CA and gets the response or error. The request is
+	// abandoned when the context is cancelled.
+	SendCSR(context.Context, *pb.Request, platform.Client, *Config) (*pb.Response, error)
 }
 
-// cAGrpcClientImpl is an implementation of GRPC client to talk to CA.
+// cAGrpcClientImpl is an implementation of GRPC client to talk to CA. The
+// concurrent renewals of the identities share its connection.
 type cAGrpcClientImpl struct {
+	mutex sync.Mutex
+	conn  *grpc.ClientConn
 }
 
 // SendCSR sends CSR to CA through GRPC.
-func (c *cAGrpcClientImpl) SendCSR(req *pb.Request, pc platform.Client, cfg *Config) (*pb.Response, error) {
+func (c *cAGrpcClientImpl) SendCSR(ctx context.Context, req *pb.Request, pc platform.Client,
+	cfg *Config) (*pb.Response, error) {
 	if cfg.IstioCAAddress == "" {
 		return nil, fmt.Errorf("Istio CA address is empty")
 	}
+	conn, err := c.getConn(pc, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := pb.NewIstioCAServiceClient(conn)
+	var trailer metadata.MD
+	resp, err := client.HandleCSR(ctx, req, grpc.Trailer(&trailer))
+	if err != nil {
+		// The dial options carry the credential of the node agent, which may
+		// have expired or been rotated since the dial.
+		if code := grpc.Code(err); code == codes.Unauthenticated || code == codes.Unavailable {
+			c.closeConn(conn)
+		}
+		retryAfter := getRetryAfter(err, trailer)
+		err = fmt.Errorf("CSR request failed %v", err)
+		if retryAfter > 0 {
+			return nil, &retryAfterError{err: err, retryAfter: retryAfter}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// getConn returns the connection to the CA, and dials it if there is none.
+func (c *cAGrpcClientImpl) getConn(pc platform.Client, cfg *Config) (*grpc.ClientConn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil {
+		return c.conn, nil
+	}
 	dialOptions, err := pc.GetDialOptions(&cfg.PlatformConfig)
 	if err != nil {
 		return nil, err
@@ -50,17 +107,39 @@ func (c *cAGrpcClientImpl) SendCSR(req *pb.Request, pc platform.Client, cfg *Con
 	if err != nil {
 		return nil, fmt.Errorf("Failed to dial %s: %s", cfg.IstioCAAddress, err)
 	}
-	defer func() {
-		if closeErr := conn.Close(); closeErr != nil {
-			glog.Errorf("Failed to close connection")
-		}
-	}()
-	client := pb.NewIstioCAServiceClient(conn)
-	resp, err := client.HandleCSR(context.Background(), req)
-	if err != nil {
-		return nil, fmt.Errorf("CSR request failed %v", err)
+	c.conn = conn
+	return conn, nil
+}
+
+// closeConn closes the connection, so that the next request dials again. It
+// does nothing if the connection has been replaced already.
+func (c *cAGrpcClientImpl) closeConn(conn *grpc.ClientConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != conn {
+		return
 	}
-	return resp, nil
+	c.conn = nil
+	if err := conn.Close(); err != nil {
+		glog.Errorf("Failed to close connection")
+	}
+}
+
+// getRetryAfter returns the retry hint carried by a ResourceExhausted error,
+// or 0 if there is none.
+func getRetryAfter(err error, trailer metadata.MD) time.Duration {
+	if grpc.Code(err) != codes.ResourceExhausted {
+		return 0
+	}
+	values := trailer[retryAfterKey]
+	if len(values) == 0 {
+		return 0
+	}
+	seconds, convErr := strconv.Atoi(values[0])
+	if convErr != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 // The real node agent implementation. This implements the "Start" function
@@ -73,6 +152,17 @@ type nodeAgentInternal struct {
 	identity     string
 	secretServer workload.SecretServer
 	certUtil     CertUtil
+	// identities manages the identities of Config.IdentitiesFile instead of
+	// identity and secretServer, or is nil.
+	identities *identityManager
+}
+
+// renewal is the renewal of the certificate of an identity.
+type renewal struct {
+	identity              string
+	keySize               int
+	gracePeriodPercentage int
+	secretServer          workload.SecretServer
 }
 
 // Start starts the node Agent.
@@ -87,41 +177,78 @@ func (na *nodeAgentInternal) Start() error {
 
 	glog.Infof("Node Agent starts successfully.")
 
-	retries := 0
-	retrialInterval := na.config.CSRInitialRetrialInterval
+	if na.identities != nil {
+		return na.identities.run(nil)
+	}
+
 	identity, err := na.pc.GetServiceIdentity()
 	if err != nil {
 		return err
 	}
 	na.identity = identity
+	return na.renew(renewal{
+		identity:              identity,
+		keySize:               na.config.RSAKeySize,
+		gracePeriodPercentage: na.config.CSRGracePeriodPercentage,
+		secretServer:          na.secretServer,
+	}, nil)
+}
+
+// renew keeps the certificate of the identity renewed. It returns nil once the
+// certificate is written in the one-shot mode, or once stop is closed, and an
+// error if the CSR is not approved after the max number of retries.
+func (na *nodeAgentInternal) renew(r renewal, stop <-chan struct{}) error {
+	// The context abandons the pending CSR once the renewal is stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retries := 0
+	retrialInterval := na.config.CSRInitialRetrialInterval
 	var success bool
 	for {
-		privateKey, req, reqErr := na.createRequest()
+		privateKey, req, reqErr := na.createRequest(r.identity, r.keySize)
 		if reqErr != nil {
 			return reqErr
 		}
 
-		glog.Infof("Sending CSR (retrial #%d) ...", retries)
+		glog.Infof("Sending CSR for %s (retrial #%d) ...", r.identity, retries)
 
-		resp, err := na.cAClient.SendCSR(req, na.pc, na.config)
+		resp, err := na.cAClient.SendCSR(ctx, req, na.pc, na.config)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err == nil && resp != nil && resp.IsApproved {
-			waitTime, ttlErr := na.certUtil.GetWaitTime(
-				resp.SignedCertChain, time.Now(), na.config.CSRGracePeriodPercentage)
+			waitTime, ttlErr := na.certUtil.GetWaitTime(resp.SignedCertChain, time.Now(), r.gracePeriodPercentage)
 			if ttlErr != nil {
 				glog.Errorf("Error getting TTL from approved cert: %v", ttlErr)
 				success = false
 			} else {
-				if writeErr := na.secretServer.SetServiceIdentityCert(resp.SignedCertChain); writeErr != nil {
+				id := workload.ServiceIdentity{CertChain: resp.SignedCertChain, PrivateKey: privateKey}
+				id.RootCert, id.FederatedBundle = na.readTrustBundles()
+				if writeErr := r.secretServer.SetServiceIdentity(id); writeErr != nil {
 					return writeErr
 				}
-				if writeErr := na.secretServer.SetServiceIdentityPrivateKey(privateKey); writeErr != nil {
-					return writeErr
+				renewals.Inc()
+				if cert, certErr := pki.ParsePemEncodedCertificate(resp.SignedCertChain); certErr == nil {
+					currentCertExpiry.set(r.identity, cert.NotAfter)
+				}
+				if na.config.OneShot {
+					glog.Infof("CSR for %s is approved successfully. Exiting since the node agent runs once.", r.identity)
+					return nil
 				}
-				glog.Infof("CSR is approved successfully. Will renew cert in %s", waitTime.String())
+				glog.Infof("CSR for %s is approved successfully. Will renew cert in %s", r.identity, waitTime.String())
 				retries = 0
 				retrialInterval = na.config.CSRInitialRetrialInterval
-				timer := time.NewTimer(waitTime)
-				<-timer.C
+				if !sleep(waitTime, stop) {
+					return nil
+				}
 				success = true
 			}
 		} else {
@@ -129,6 +256,7 @@ func (na *nodeAgentInternal) Start() error {
 		}
 
 		if !success {
+			renewalFailures.Inc()
 			if retries >= na.config.CSRMaxRetries {
 				return fmt.Errorf(
 					"node agent can't get the CSR approved from Istio CA after max number of retries (%d)", na.config.CSRMaxRetries)
@@ -143,19 +271,60 @@ func (na *nodeAgentInternal) Start() error {
 				glog.Errorf("Certificate parsing error. Will retry in %s", retrialInterval.String())
 			}
 			retries++
-			timer := time.NewTimer(retrialInterval)
+			waitTime := retrialInterval
+			// Honour the retry hint of a rate-limited CA if it is longer than the backoff.
+			if rerr, ok := err.(*retryAfterError); ok && rerr.retryAfter > waitTime {
+				glog.Infof("Istio CA asks to retry in %s", rerr.retryAfter.String())
+				waitTime = rerr.retryAfter
+			}
 			// Exponentially increase the backoff time.
 			retrialInterval = retrialInterval * 2
-			<-timer.C
+			if !sleep(waitTime, stop) {
+				return nil
+			}
+		}
+	}
+}
+
+// sleep waits for the duration, and returns false if stop is closed before.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// readTrustBundles reads the root certificate and the federated bundle. They
+// are read at every rotation, so that their updates reach the workload.
+func (na *nodeAgentInternal) readTrustBundles() ([]byte, []byte) {
+	rootCert, err := ioutil.ReadFile(na.config.PlatformConfig.RootCACertFile)
+	if err != nil {
+		glog.Warningf("Failed to read the root certificate (error: %v)", err)
+	}
+	var federated []byte
+	for _, file := range na.config.WorkloadOutput.FederatedBundleFiles {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			glog.Warningf("Failed to read the federated bundle %s (error: %v)", file, err)
+			continue
+		}
+		federated = append(federated, content...)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			federated = append(federated, '\n')
 		}
 	}
+	return rootCert, federated
 }
 
-func (na *nodeAgentInternal) createRequest() ([]byte, *pb.Request, error) {
+func (na *nodeAgentInternal) createRequest(identity string, keySize int) ([]byte, *pb.Request, error) {
 	csr, privKey, err := ca.GenCSR(ca.CertOptions{
-		Host:       na.identity,
+		Host:       identity,
 		Org:        na.config.ServiceIdentityOrg,
-		RSAKeySize: na.config.RSAKeySize,
+		RSAKeySize: keySize,
 	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate CSR: %v", err)
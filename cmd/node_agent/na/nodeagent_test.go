@@ -17,7 +17,10 @@ package na
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -25,6 +28,8 @@ import (
 	rpc "github.com/googleapis/googleapis/google/rpc"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 
 	"istio.io/auth/pkg/platform"
@@ -44,7 +49,8 @@ type FakeCAClient struct {
 	err      error
 }
 
-func (f *FakeCAClient) SendCSR(req *pb.Request, pc platform.Client, cfg *Config) (*pb.Response, error) {
+func (f *FakeCAClient) SendCSR(ctx context.Context, req *pb.Request, pc platform.Client,
+	cfg *Config) (*pb.Response, error) {
 	f.Counter++
 	if f.Counter > maxCAClientSuccessReturns {
 		return nil, fmt.Errorf("Terminating the test with errors")
@@ -87,10 +93,22 @@ func (f FakeCertUtil) GetWaitTime(certBytes []byte, now time.Time, gracePeriodPe
 }
 
 func TestStartWithArgs(t *testing.T) {
-	generalPcConfig := platform.ClientConfig{"ca_file", "pkey", "cert_file"}
+	generalPcConfig := platform.ClientConfig{RootCACertFile: "ca_file", KeyFile: "pkey", CertChainFile: "cert_file"}
 	generalConfig := Config{
-		"ca_addr", "Google Inc.", 512, "onprem", time.Millisecond, 3, 50, generalPcConfig,
+		IstioCAAddress:            "ca_addr",
+		ServiceIdentityOrg:        "Google Inc.",
+		RSAKeySize:                512,
+		Env:                       "onprem",
+		CSRInitialRetrialInterval: time.Millisecond,
+		CSRMaxRetries:             3,
+		CSRGracePeriodPercentage:  50,
+		PlatformConfig:            generalPcConfig,
 	}
+	oneShotConfig := generalConfig
+	oneShotConfig.OneShot = true
+	// 128 is too small for a RSA private key. GenCSR will return error.
+	smallKeyConfig := generalConfig
+	smallKeyConfig.RSAKeySize = 128
 	testCases := map[string]struct {
 		config      *Config
 		pc          platform.Client
@@ -109,6 +127,14 @@ func TestStartWithArgs(t *testing.T) {
 			sendTimes:   12,
 			fileContent: []byte(`TESTCERT`),
 		},
+		"One shot": {
+			config:      &oneShotConfig,
+			pc:          mockpc.FakeClient{nil, "", "service1", "", true},
+			cAClient:    &FakeCAClient{0, &pb.Response{IsApproved: true, SignedCertChain: []byte(`TESTCERT`)}, nil},
+			certUtil:    FakeCertUtil{time.Duration(0), nil},
+			sendTimes:   1,
+			fileContent: []byte(`TESTCERT`),
+		},
 		"Config Nil error": {
 			pc:          mockpc.FakeClient{nil, "", "service1", "", true},
 			cAClient:    &FakeCAClient{0, nil, nil},
@@ -123,10 +149,7 @@ func TestStartWithArgs(t *testing.T) {
 			sendTimes:   0,
 		},
 		"CreateCSR error": {
-			// 128 is too small for a RSA private key. GenCSR will return error.
-			config: &Config{
-				"ca_addr", "Google Inc.", 128, "onprem", time.Millisecond, 3, 50, generalPcConfig,
-			},
+			config:      &smallKeyConfig,
 			pc:          mockpc.FakeClient{nil, "", "service1", "", true},
 			cAClient:    &FakeCAClient{0, nil, nil},
 			expectedErr: "failed to generate CSR: crypto/rsa: message too long for RSA public key size",
@@ -177,10 +200,21 @@ func TestStartWithArgs(t *testing.T) {
 				ServiceIdentityPrivateKeyFile: "key_file",
 			},
 		)
-		na := nodeAgentInternal{c.config, c.pc, c.cAClient, "service1", fakeWorkloadIO, c.certUtil}
+		na := nodeAgentInternal{
+			config:       c.config,
+			pc:           c.pc,
+			cAClient:     c.cAClient,
+			identity:     "service1",
+			secretServer: fakeWorkloadIO,
+			certUtil:     c.certUtil,
+		}
 		err := na.Start()
-		if err.Error() != c.expectedErr {
-			t.Errorf("Test case [%s]: incorrect error message: %s VS %s", id, err.Error(), c.expectedErr)
+		if c.expectedErr == "" {
+			if err != nil {
+				t.Errorf("Test case [%s]: unexpected error: %v", id, err)
+			}
+		} else if err == nil || err.Error() != c.expectedErr {
+			t.Errorf("Test case [%s]: incorrect error message: %v VS %s", id, err, c.expectedErr)
 		}
 		if c.cAClient.Counter != c.sendTimes {
 			t.Errorf("Test case [%s]: sendCSR is called incorrect times: %d. It should be %d.",
@@ -304,12 +338,19 @@ func TestSendCSRAgainstLocalInstance(t *testing.T) {
 			},
 		)
 
-		na := nodeAgentInternal{c.config, c.pc, c.cAClient, "service1", fakeWorkloadIO, c.certUtil}
+		na := nodeAgentInternal{
+			config:       c.config,
+			pc:           c.pc,
+			cAClient:     c.cAClient,
+			identity:     "service1",
+			secretServer: fakeWorkloadIO,
+			certUtil:     c.certUtil,
+		}
 
 		serv.SetResponseAndError(&c.res, c.resErr)
 
-		_, req, _ := na.createRequest()
-		_, err := na.cAClient.SendCSR(req, na.pc, na.config)
+		_, req, _ := na.createRequest(na.identity, na.config.RSAKeySize)
+		_, err := na.cAClient.SendCSR(context.Background(), req, na.pc, na.config)
 		if len(c.expectedErr) > 0 {
 			if err == nil {
 				t.Errorf("Error expected: %v", c.expectedErr)
@@ -323,3 +364,69 @@ func TestSendCSRAgainstLocalInstance(t *testing.T) {
 		}
 	}
 }
+
+func TestGetRetryAfter(t *testing.T) {
+	testCases := map[string]struct {
+		err        error
+		trailer    metadata.MD
+		retryAfter time.Duration
+	}{
+		"Rate limited with hint": {
+			err:        grpc.Errorf(codes.ResourceExhausted, "too many requests"),
+			trailer:    metadata.Pairs(retryAfterKey, "3"),
+			retryAfter: 3 * time.Second,
+		},
+		"Rate limited without hint": {
+			err: grpc.Errorf(codes.ResourceExhausted, "too many requests"),
+		},
+		"Malformed hint": {
+			err:     grpc.Errorf(codes.ResourceExhausted, "too many requests"),
+			trailer: metadata.Pairs(retryAfterKey, "soon"),
+		},
+		"Other error": {
+			err:     grpc.Errorf(codes.PermissionDenied, "not authorized"),
+			trailer: metadata.Pairs(retryAfterKey, "3"),
+		},
+	}
+
+	for id, c := range testCases {
+		if retryAfter := getRetryAfter(c.err, c.trailer); retryAfter != c.retryAfter {
+			t.Errorf("Case %s: expecting retry-after to be %v but got %v", id, c.retryAfter, retryAfter)
+		}
+	}
+}
+
+func TestReadTrustBundles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeagent_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"root-cert.pem": "root\n",
+		"federated-1":   "federated 1",
+		"federated-2":   "federated 2\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	na := nodeAgentInternal{config: &Config{
+		PlatformConfig: platform.ClientConfig{RootCACertFile: filepath.Join(dir, "root-cert.pem")},
+		WorkloadOutput: WorkloadOutputConfig{
+			FederatedBundleFiles: []string{
+				filepath.Join(dir, "federated-1"), filepath.Join(dir, "missing"), filepath.Join(dir, "federated-2"),
+			},
+		},
+	}}
+	rootCert, federated := na.readTrustBundles()
+	if string(rootCert) != "root\n" {
+		t.Errorf("Unexpected root certificate: %q", rootCert)
+	}
+	// The missing file is skipped, and the files are separated by new lines.
+	if string(federated) != "federated 1\nfederated 2\n" {
+		t.Errorf("Unexpected federated bundle: %q", federated)
+	}
+}
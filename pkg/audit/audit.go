@@ -0,0 +1,111 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records the certificate issuance decisions of Istio CA as
+// structured JSON events.
+package audit
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/pki"
+)
+
+// Source is the component that makes a decision.
+type Source string
+
+// Decision is the outcome of a certificate request.
+type Decision string
+
+const (
+	// SourceCSR is the source of the events of CSRs received by the CA server.
+	SourceCSR Source = "csr"
+	// SourceSecretController is the source of the events of the certificates
+	// issued for the Kubernetes service accounts.
+	SourceSecretController Source = "secret_controller"
+	// SourcePodCertController is the source of the events of the pod-scoped
+	// certificates that are forgotten when their pods are deleted.
+	SourcePodCertController Source = "pod_cert_controller"
+	// SourceRevocation is the source of the events of the revocations
+	// requested through the gateway of the CA server.
+	SourceRevocation Source = "revocation"
+
+	// Allow means a certificate is issued.
+	Allow Decision = "allow"
+	// Deny means the request is rejected or failed.
+	Deny Decision = "deny"
+	// Forget means an issued certificate is no longer bound to its workload,
+	// e.g. because its pod is deleted.
+	Forget Decision = "forget"
+	// Revoke means an issued certificate is revoked.
+	Revoke Decision = "revoke"
+)
+
+// Event is an audit event of a certificate request.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Source Source    `json:"source"`
+
+	// The address of the client, if the request is received over the network.
+	PeerAddress string `json:"peer_address,omitempty"`
+	// The type of the authenticator that authenticated the client, e.g.
+	// "client_certificate".
+	AuthSource string `json:"auth_source,omitempty"`
+	// The identities of the authenticated client.
+	Identities []string `json:"identities,omitempty"`
+	// The identities requested for the certificate.
+	RequestedIDs []string `json:"requested_ids,omitempty"`
+
+	Decision Decision `json:"decision"`
+	// Why the request is allowed or denied.
+	Reason string `json:"reason,omitempty"`
+	// The hex-encoded serial number of the issued certificate.
+	Serial string `json:"serial,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Sink receives audit events.
+type Sink interface {
+	// Write records the event. It must be safe for concurrent use.
+	Write(*Event) error
+	// Close releases the resources held by the sink.
+	Close() error
+}
+
+// Record writes the event to the sink, stamping its time if it is not set.
+// A nil sink discards the event. Failures are logged rather than returned,
+// since a broken audit trail must not fail the request being audited.
+func Record(sink Sink, e *Event) {
+	if sink == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if err := sink.Write(e); err != nil {
+		glog.Errorf("Failed to write audit event (error: %v)", err)
+	}
+}
+
+// CertSerial returns the hex-encoded serial number of the PEM-encoded
+// certificate, or an empty string if the certificate cannot be parsed.
+func CertSerial(certPEM []byte) string {
+	cert, err := pki.ParsePemEncodedCertificate(certPEM)
+	if err != nil {
+		return ""
+	}
+	return cert.SerialNumber.Text(16)
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent(serial string) *Event {
+	return &Event{
+		Time:         time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC),
+		Source:       SourceCSR,
+		PeerAddress:  "10.0.0.1:12345",
+		AuthSource:   "client_certificate",
+		Identities:   []string{"spiffe://cluster.local/ns/default/sa/foo"},
+		RequestedIDs: []string{"spiffe://cluster.local/ns/default/sa/foo"},
+		Decision:     Allow,
+		Serial:       serial,
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewWriterSink(buf)
+	for _, serial := range []string{"1", "2"} {
+		if err := sink.Write(testEvent(serial)); err != nil {
+			t.Fatalf("Failed to write event (error: %v)", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expecting 2 lines but got %d: %q", len(lines), buf.String())
+	}
+	e := &Event{}
+	if err := json.Unmarshal([]byte(lines[1]), e); err != nil {
+		t.Fatalf("Failed to decode event (error: %v)", err)
+	}
+	if !reflect.DeepEqual(testEvent("2"), e) {
+		t.Errorf("Unexpected event: want %+v but got %+v", testEvent("2"), e)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	line, err := marshalLine(testEvent("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	// Every file holds two events.
+	sink, err := NewFileSink(path, int64(2*len(line)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(testEvent("1")); err != nil {
+			t.Fatalf("Failed to write event #%d (error: %v)", i, err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seven events make four files, and the oldest one is dropped.
+	expected := map[string]int{
+		path:                1,
+		backupPath(path, 1): 2,
+		backupPath(path, 2): 2,
+		backupPath(path, 3): -1,
+	}
+	for p, events := range expected {
+		content, err := ioutil.ReadFile(p)
+		if events < 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expecting %s to be removed but got error %v", p, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to read %s (error: %v)", p, err)
+		} else if n := strings.Count(string(content), "\n"); n != events {
+			t.Errorf("Expecting %d events in %s but got %d", events, p, n)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	testCases := map[string]struct {
+		status int
+		errMsg string
+	}{
+		"Accepted": {
+			status: http.StatusOK,
+		},
+		"Rejected": {
+			status: http.StatusInternalServerError,
+			errMsg: "returns status 500",
+		},
+	}
+
+	for id, c := range testCases {
+		var received *Event
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = &Event{}
+			if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+				t.Errorf("Case %s: failed to decode event (error: %v)", id, err)
+			}
+			w.WriteHeader(c.status)
+		}))
+
+		err := NewWebhookSink(server.URL, time.Second).Write(testEvent("1"))
+		server.Close()
+
+		if c.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+				t.Errorf("Case %s: expecting error containing (%s) but got (%v)", id, c.errMsg, err)
+			}
+		} else if err != nil {
+			t.Errorf("Case %s: unexpected error %v", id, err)
+		}
+		if !reflect.DeepEqual(testEvent("1"), received) {
+			t.Errorf("Case %s: unexpected event: want %+v but got %+v", id, testEvent("1"), received)
+		}
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	buf1, buf2 := &bytes.Buffer{}, &bytes.Buffer{}
+	Record(NewMultiSink(NewWriterSink(buf1), NewWriterSink(buf2)), &Event{Source: SourceCSR, Decision: Deny})
+
+	if buf1.Len() == 0 || buf1.String() != buf2.String() {
+		t.Errorf("Expecting the same event in both sinks but got (%q) and (%q)", buf1.String(), buf2.String())
+	}
+	e := &Event{}
+	if err := json.Unmarshal(buf1.Bytes(), e); err != nil {
+		t.Fatalf("Failed to decode event (error: %v)", err)
+	}
+	if e.Time.IsZero() {
+		t.Error("Expecting the time of the event to be set")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// SealedBlockType is the type of the PEM block of sealed data.
+	SealedBlockType = "ISTIO SEALED DATA"
+
+	// The PEM header that holds the base64-encoded wrapped data key.
+	wrappedKeyHeader = "Wrapped-Data-Key"
+
+	// The size of the AES-256 data keys.
+	dataKeySize = 32
+)
+
+// Seal encrypts the data with a new data key, which is wrapped by the KMS. The
+// sealed data is a PEM block of SealedBlockType, so that it can replace a
+// PEM-encoded private key in a secret or a file.
+func Seal(k KMS, data []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	ciphertext, err := encrypt(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := k.Encrypt(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap the data key (error: %v)", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    SealedBlockType,
+		Headers: map[string]string{wrappedKeyHeader: base64.StdEncoding.EncodeToString(wrapped)},
+		Bytes:   ciphertext,
+	}), nil
+}
+
+// Open decrypts the data sealed by Seal. The data that is not sealed is
+// returned as is, so that the keys stored before the encryption was enabled
+// remain usable. k can be nil if the data is known not to be sealed.
+func Open(k KMS, data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, errors.New("the data is sealed but no KMS is configured")
+	}
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	wrapped, err := base64.StdEncoding.DecodeString(block.Headers[wrappedKeyHeader])
+	if err != nil || len(wrapped) == 0 {
+		return nil, fmt.Errorf("malformed %s header of the sealed data", wrappedKeyHeader)
+	}
+	dataKey, err := k.Decrypt(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key (error: %v)", err)
+	}
+	return decrypt(dataKey, block.Bytes)
+}
+
+// OpenBlocks opens each sealed block in a sequence of PEM blocks, e.g. a PEM
+// bundle with a sealed private key followed by the certificate chain. The
+// other blocks are kept as is.
+func OpenBlocks(k KMS, data []byte) ([]byte, error) {
+	var opened []byte
+	rest := data
+	for {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			return append(opened, rest...), nil
+		}
+		encoded := rest[:len(rest)-len(next)]
+		if block.Type == SealedBlockType {
+			plaintext, err := Open(k, pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, err
+			}
+			encoded = plaintext
+		}
+		opened = append(opened, encoded...)
+		rest = next
+	}
+}
+
+// IsSealed returns whether the data is sealed by Seal.
+func IsSealed(data []byte) bool {
+	block, rest := pem.Decode(bytes.TrimSpace(data))
+	return block != nil && block.Type == SealedBlockType && len(rest) == 0
+}
+
+// encrypt encrypts the plaintext with AES-GCM, and prepends the nonce to the
+// ciphertext.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt decrypts the ciphertext returned by encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("the ciphertext is too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt (error: %v)", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
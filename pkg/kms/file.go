@@ -0,0 +1,51 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// fileKMS wraps the data keys with a KEK read from a local file. The KEK is only
+// as safe as the file, so it is meant for testing, and for the setups where
+// the file is kept apart from the stored keys.
+type fileKMS struct {
+	kek []byte
+}
+
+// NewFileKMS returns a KMS with the base64-encoded 256-bit KEK in the file,
+// which can be generated with `head -c 32 /dev/urandom | base64`.
+func NewFileKMS(path string) (KMS, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the KEK file %s (error: %v)", path, err)
+	}
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(kek) != dataKeySize {
+		return nil, fmt.Errorf("the KEK file %s must hold a base64-encoded %d-byte key", path, dataKeySize)
+	}
+	return &fileKMS{kek: kek}, nil
+}
+
+func (k *fileKMS) Encrypt(plaintext []byte) ([]byte, error) {
+	return encrypt(k.kek, plaintext)
+}
+
+func (k *fileKMS) Decrypt(ciphertext []byte) ([]byte, error) {
+	return decrypt(k.kek, ciphertext)
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kms provides the envelope encryption of the private keys stored by
+// Istio CA. Each private key is encrypted with a random data key, and the data
+// key is wrapped by a KMS with a key encryption key (KEK) that never leaves
+// the KMS, so that the stored keys, e.g. in etcd backups, are not usable
+// without the KMS.
+package kms
+
+import (
+	"fmt"
+)
+
+// KMS wraps and unwraps data keys with a key encryption key.
+type KMS interface {
+	// Encrypt wraps the data key.
+	Encrypt(plaintext []byte) ([]byte, error)
+	// Decrypt unwraps the data key wrapped by Encrypt.
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// Options holds the configurations of a KMS. At most one of the options can
+// be set.
+type Options struct {
+	// The file of the local base64-encoded 256-bit KEK, which is meant for
+	// testing.
+	KeyFile string
+	// The Unix domain socket of a KMS plugin, which implements the
+	// KeyManagementService of kms_service.proto.
+	PluginSocket string
+}
+
+// New returns the KMS of the options, or nil if none is configured.
+func New(opts Options) (KMS, error) {
+	switch {
+	case opts.KeyFile != "" && opts.PluginSocket != "":
+		return nil, fmt.Errorf("a KMS key file and a KMS plugin cannot be both specified")
+	case opts.KeyFile != "":
+		return NewFileKMS(opts.KeyFile)
+	case opts.PluginSocket != "":
+		return NewPluginKMS(opts.PluginSocket)
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "istio.io/auth/proto"
+)
+
+// The timeout of the calls to a KMS plugin.
+const pluginTimeout = 10 * time.Second
+
+// pluginKMS wraps the data keys through a KMS plugin, which implements the
+// KeyManagementService of kms_service.proto on a Unix domain socket.
+type pluginKMS struct {
+	client pb.KeyManagementServiceClient
+}
+
+// NewPluginKMS returns a KMS that calls the plugin on the socket. The
+// connection is established lazily.
+func NewPluginKMS(socket string) (KMS, error) {
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial the KMS plugin %s (error: %v)", socket, err)
+	}
+	return &pluginKMS{client: pb.NewKeyManagementServiceClient(conn)}, nil
+}
+
+func (k *pluginKMS) Encrypt(plaintext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	resp, err := k.client.Encrypt(ctx, &pb.EncryptRequest{Plaintext: plaintext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (k *pluginKMS) Decrypt(ciphertext []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	resp, err := k.client.Decrypt(ctx, &pb.DecryptRequest{Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// pluginServer serves a KMS as a KMS plugin.
+type pluginServer struct {
+	kms KMS
+}
+
+// RegisterPluginServer registers the KMS as the KeyManagementService of the
+// GRPC server, so that a KMS plugin can be built from a KMS implementation.
+func RegisterPluginServer(s *grpc.Server, k KMS) {
+	pb.RegisterKeyManagementServiceServer(s, &pluginServer{kms: k})
+}
+
+func (s *pluginServer) Encrypt(ctx context.Context, req *pb.EncryptRequest) (*pb.EncryptResponse, error) {
+	ciphertext, err := s.kms.Encrypt(req.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.EncryptResponse{Ciphertext: ciphertext}, nil
+}
+
+func (s *pluginServer) Decrypt(ctx context.Context, req *pb.DecryptRequest) (*pb.DecryptResponse, error) {
+	plaintext, err := s.kms.Decrypt(req.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DecryptResponse{Plaintext: plaintext}, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestPluginKMS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kms_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileKMS, err := NewFileKMS(createKeyFile(t, dir, bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "kms.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	RegisterPluginServer(server, fileKMS)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	k, err := New(Options{PluginSocket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("private key")
+	sealed, err := Seal(k, key)
+	if err != nil {
+		t.Fatalf("Failed to seal through the plugin: %v", err)
+	}
+	// The data sealed through the plugin can be opened with the KEK of the
+	// plugin.
+	if opened, err := Open(fileKMS, sealed); err != nil || !bytes.Equal(opened, key) {
+		t.Errorf("Expecting %q but got %q (%v)", key, opened, err)
+	}
+	if opened, err := Open(k, sealed); err != nil || !bytes.Equal(opened, key) {
+		t.Errorf("Expecting %q but got %q (%v)", key, opened, err)
+	}
+}
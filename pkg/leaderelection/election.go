@@ -0,0 +1,315 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package leaderelection implements leader election between the replicas of
+// Istio CA. The leader holds a lease that is recorded as an annotation of a
+// ConfigMap, and renews the lease before it expires. Optimistic concurrency
+// on the ConfigMap guarantees that at most one replica holds the lease.
+package leaderelection
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// LeaderAnnotationKey is the annotation of the ConfigMap that records the lease.
+const LeaderAnnotationKey = "istio.io/leader"
+
+// LeaderRecord is the lease held by the leader.
+type LeaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// Options are the options of an Elector.
+type Options struct {
+	// The namespace and the name of the ConfigMap that records the lease.
+	Namespace string
+	Name      string
+	// The identity of this replica, e.g. the pod name.
+	Identity string
+
+	// How long the followers wait after they last observed a change of the
+	// lease before they try to acquire it.
+	LeaseDuration time.Duration
+	// How long the leader keeps trying to renew the lease before it gives up
+	// the leadership. It must be shorter than LeaseDuration.
+	RenewDeadline time.Duration
+	// How often the lease is acquired or renewed.
+	RetryPeriod time.Duration
+
+	// OnStartedLeading is called in a new goroutine when the leadership is
+	// acquired. stopCh is closed when the leadership is lost, after which it
+	// must return. The lease is not released or acquired again until it has
+	// returned, so that it does not run alongside the next leader.
+	OnStartedLeading func(stopCh <-chan struct{})
+	// OnStoppedLeading is called when the leadership is lost.
+	OnStoppedLeading func()
+}
+
+// Elector elects a leader among the replicas that use the same ConfigMap.
+type Elector struct {
+	core corev1.ConfigMapsGetter
+	opts Options
+
+	// The lease last observed, and when it was observed by the local clock.
+	// The expiration of a lease held by another replica is based on the local
+	// clock, so that it is not affected by clock skew between the replicas.
+	observedRecord LeaderRecord
+	observedTime   time.Time
+
+	mutex    sync.RWMutex
+	isLeader bool
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+}
+
+// New returns an Elector with the given options.
+func New(core corev1.ConfigMapsGetter, opts Options) (*Elector, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("the name of the lock is not specified")
+	}
+	if opts.Identity == "" {
+		return nil, fmt.Errorf("the identity of the replica is not specified")
+	}
+	if opts.RenewDeadline <= 0 || opts.LeaseDuration <= opts.RenewDeadline {
+		return nil, fmt.Errorf("the lease duration (%v) must be longer than the renew deadline (%v)",
+			opts.LeaseDuration, opts.RenewDeadline)
+	}
+	if opts.RetryPeriod <= 0 || opts.RenewDeadline <= opts.RetryPeriod {
+		return nil, fmt.Errorf("the renew deadline (%v) must be longer than the retry period (%v)",
+			opts.RenewDeadline, opts.RetryPeriod)
+	}
+	if opts.OnStartedLeading == nil {
+		return nil, fmt.Errorf("OnStartedLeading is not specified")
+	}
+	return &Elector{core: core, opts: opts, now: time.Now}, nil
+}
+
+// IsLeader returns whether this replica is the leader.
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.isLeader
+}
+
+// Run takes part in the election until stopCh is closed. The lease is released
+// when the leader stops, so that another replica can take over without waiting
+// for the lease to expire. It returns once OnStartedLeading has returned.
+func (e *Elector) Run(stopCh <-chan struct{}) {
+	for {
+		if !e.acquire(stopCh) {
+			return
+		}
+
+		leaderStopCh := make(chan struct{})
+		leaderDone := make(chan struct{})
+		e.setLeader(true)
+		go func() {
+			defer close(leaderDone)
+			e.opts.OnStartedLeading(leaderStopCh)
+		}()
+
+		stopped := e.renew(stopCh)
+
+		close(leaderStopCh)
+		e.setLeader(false)
+		if e.opts.OnStoppedLeading != nil {
+			e.opts.OnStoppedLeading()
+		}
+		<-leaderDone
+		if stopped {
+			e.release()
+			return
+		}
+	}
+}
+
+// acquire retries to acquire the lease until it succeeds, or stopCh is closed.
+// It returns whether the lease is acquired.
+func (e *Elector) acquire(stopCh <-chan struct{}) bool {
+	ticker := time.NewTicker(e.opts.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		if e.tryAcquireOrRenew() {
+			glog.Infof("%s became the leader of %s/%s", e.opts.Identity, e.opts.Namespace, e.opts.Name)
+			return true
+		}
+		select {
+		case <-stopCh:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// renew retries to renew the lease until it fails for longer than the renew
+// deadline, or stopCh is closed. It returns whether stopCh is closed.
+func (e *Elector) renew(stopCh <-chan struct{}) bool {
+	ticker := time.NewTicker(e.opts.RetryPeriod)
+	defer ticker.Stop()
+	lastRenewal := e.now()
+	for {
+		select {
+		case <-stopCh:
+			return true
+		case <-ticker.C:
+		}
+		if e.tryAcquireOrRenew() {
+			lastRenewal = e.now()
+			continue
+		}
+		if e.now().Sub(lastRenewal) >= e.opts.RenewDeadline {
+			glog.Warningf("%s lost the leadership of %s/%s", e.opts.Identity, e.opts.Namespace, e.opts.Name)
+			return false
+		}
+	}
+}
+
+// tryAcquireOrRenew tries to acquire the lease, or renew it if it is already
+// held by this replica, and returns whether it succeeds.
+func (e *Elector) tryAcquireOrRenew() bool {
+	now := e.now()
+	record := LeaderRecord{
+		HolderIdentity:       e.opts.Identity,
+		LeaseDurationSeconds: int(e.opts.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm, err := e.core.ConfigMaps(e.opts.Namespace).Get(e.opts.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: e.opts.Name, Namespace: e.opts.Namespace}}
+		if err := setRecord(cm, record); err != nil {
+			glog.Errorf("Failed to encode the leader record (error: %v)", err)
+			return false
+		}
+		if _, err := e.core.ConfigMaps(e.opts.Namespace).Create(cm); err != nil {
+			glog.Errorf("Failed to create the lock %s/%s (error: %v)", e.opts.Namespace, e.opts.Name, err)
+			return false
+		}
+		e.observe(record, now)
+		return true
+	}
+	if err != nil {
+		glog.Errorf("Failed to get the lock %s/%s (error: %v)", e.opts.Namespace, e.opts.Name, err)
+		return false
+	}
+
+	oldRecord, err := getRecord(cm)
+	if err != nil {
+		glog.Warningf("Overwriting the malformed leader record of %s/%s (error: %v)",
+			e.opts.Namespace, e.opts.Name, err)
+	}
+	if !sameRecord(oldRecord, e.observedRecord) {
+		e.observe(oldRecord, now)
+	}
+	held := oldRecord.HolderIdentity != ""
+	if held && oldRecord.HolderIdentity != e.opts.Identity &&
+		now.Before(e.observedTime.Add(e.opts.LeaseDuration)) {
+		return false
+	}
+
+	if oldRecord.HolderIdentity == e.opts.Identity {
+		record.AcquireTime = oldRecord.AcquireTime
+	}
+	if err := setRecord(cm, record); err != nil {
+		glog.Errorf("Failed to encode the leader record (error: %v)", err)
+		return false
+	}
+	if _, err := e.core.ConfigMaps(e.opts.Namespace).Update(cm); err != nil {
+		glog.Errorf("Failed to update the lock %s/%s (error: %v)", e.opts.Namespace, e.opts.Name, err)
+		return false
+	}
+	e.observe(record, now)
+	return true
+}
+
+// release gives up the lease if it is held by this replica.
+func (e *Elector) release() {
+	cm, err := e.core.ConfigMaps(e.opts.Namespace).Get(e.opts.Name, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Failed to get the lock %s/%s (error: %v)", e.opts.Namespace, e.opts.Name, err)
+		return
+	}
+	if record, err := getRecord(cm); err != nil || record.HolderIdentity != e.opts.Identity {
+		return
+	}
+	if err := setRecord(cm, LeaderRecord{}); err != nil {
+		return
+	}
+	if _, err := e.core.ConfigMaps(e.opts.Namespace).Update(cm); err != nil {
+		glog.Warningf("Failed to release the lock %s/%s (error: %v)", e.opts.Namespace, e.opts.Name, err)
+	}
+}
+
+func (e *Elector) observe(record LeaderRecord, now time.Time) {
+	e.observedRecord = record
+	e.observedTime = now
+}
+
+func (e *Elector) setLeader(isLeader bool) {
+	e.mutex.Lock()
+	e.isLeader = isLeader
+	e.mutex.Unlock()
+
+	if isLeader {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+}
+
+// sameRecord returns whether the two records are the same lease in the same
+// renewal.
+func sameRecord(a, b LeaderRecord) bool {
+	return a.HolderIdentity == b.HolderIdentity && a.AcquireTime.Equal(b.AcquireTime) &&
+		a.RenewTime.Equal(b.RenewTime)
+}
+
+func getRecord(cm *v1.ConfigMap) (LeaderRecord, error) {
+	var record LeaderRecord
+	value, ok := cm.Annotations[LeaderAnnotationKey]
+	if !ok {
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return LeaderRecord{}, err
+	}
+	return record, nil
+}
+
+func setRecord(cm *v1.ConfigMap, record LeaderRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[LeaderAnnotationKey] = string(value)
+	return nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leaderelection
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	namespace = "istio-system"
+	lockName  = "istio-ca-leader"
+)
+
+func createLock(annotation string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{LeaderAnnotationKey: annotation},
+			Name:        lockName,
+			Namespace:   namespace,
+		},
+	}
+}
+
+func createElector(t *testing.T, client *fake.Clientset, identity string, opts Options) *Elector {
+	opts.Namespace = namespace
+	opts.Name = lockName
+	opts.Identity = identity
+	if opts.OnStartedLeading == nil {
+		opts.OnStartedLeading = func(<-chan struct{}) {}
+	}
+	e, err := New(client.CoreV1(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		opts        Options
+		expectedErr string
+	}{
+		"Valid options": {
+			opts: Options{
+				Name:             lockName,
+				Identity:         "ca-1",
+				LeaseDuration:    15 * time.Second,
+				RenewDeadline:    10 * time.Second,
+				RetryPeriod:      2 * time.Second,
+				OnStartedLeading: func(<-chan struct{}) {},
+			},
+		},
+		"Missing identity": {
+			opts: Options{
+				Name:             lockName,
+				LeaseDuration:    15 * time.Second,
+				RenewDeadline:    10 * time.Second,
+				RetryPeriod:      2 * time.Second,
+				OnStartedLeading: func(<-chan struct{}) {},
+			},
+			expectedErr: "the identity of the replica is not specified",
+		},
+		"Renew deadline longer than lease duration": {
+			opts: Options{
+				Name:             lockName,
+				Identity:         "ca-1",
+				LeaseDuration:    10 * time.Second,
+				RenewDeadline:    15 * time.Second,
+				RetryPeriod:      2 * time.Second,
+				OnStartedLeading: func(<-chan struct{}) {},
+			},
+			expectedErr: "the lease duration (10s) must be longer than the renew deadline (15s)",
+		},
+		"Retry period longer than renew deadline": {
+			opts: Options{
+				Name:             lockName,
+				Identity:         "ca-1",
+				LeaseDuration:    15 * time.Second,
+				RenewDeadline:    10 * time.Second,
+				RetryPeriod:      10 * time.Second,
+				OnStartedLeading: func(<-chan struct{}) {},
+			},
+			expectedErr: "the renew deadline (10s) must be longer than the retry period (10s)",
+		},
+		"Missing callback": {
+			opts: Options{
+				Name:          lockName,
+				Identity:      "ca-1",
+				LeaseDuration: 15 * time.Second,
+				RenewDeadline: 10 * time.Second,
+				RetryPeriod:   2 * time.Second,
+			},
+			expectedErr: "OnStartedLeading is not specified",
+		},
+	}
+
+	for id, c := range testCases {
+		_, err := New(fake.NewSimpleClientset().CoreV1(), c.opts)
+		if c.expectedErr == "" {
+			if err != nil {
+				t.Errorf("Case %s: unexpected error: %v", id, err)
+			}
+		} else if err == nil || err.Error() != c.expectedErr {
+			t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+		}
+	}
+}
+
+func TestTryAcquireOrRenew(t *testing.T) {
+	now := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	acquired := now.Add(-time.Minute)
+	otherRecord := `{"holderIdentity":"ca-2","leaseDurationSeconds":15,` +
+		`"acquireTime":"2017-07-31T23:59:00Z","renewTime":"2017-07-31T23:59:55Z"}`
+	selfRecord := `{"holderIdentity":"ca-1","leaseDurationSeconds":15,` +
+		`"acquireTime":"2017-07-31T23:59:00Z","renewTime":"2017-07-31T23:59:55Z"}`
+
+	testCases := map[string]struct {
+		existingLock *v1.ConfigMap
+		// How long ago the existing lease was first observed.
+		observedAgo         time.Duration
+		expectedAcquired    bool
+		expectedAcquireTime time.Time
+	}{
+		"No lock": {
+			expectedAcquired:    true,
+			expectedAcquireTime: now,
+		},
+		"Lease held by another replica": {
+			existingLock:     createLock(otherRecord),
+			expectedAcquired: false,
+		},
+		"Lease held by another replica expires": {
+			existingLock:        createLock(otherRecord),
+			observedAgo:         20 * time.Second,
+			expectedAcquired:    true,
+			expectedAcquireTime: now,
+		},
+		"Lease held by this replica": {
+			existingLock:        createLock(selfRecord),
+			expectedAcquired:    true,
+			expectedAcquireTime: acquired,
+		},
+		"Released lease": {
+			existingLock:        createLock(`{"holderIdentity":""}`),
+			expectedAcquired:    true,
+			expectedAcquireTime: now,
+		},
+		"Malformed lease": {
+			existingLock:        createLock("not json"),
+			expectedAcquired:    true,
+			expectedAcquireTime: now,
+		},
+	}
+
+	for id, c := range testCases {
+		client := fake.NewSimpleClientset()
+		if c.existingLock != nil {
+			client = fake.NewSimpleClientset(c.existingLock)
+		}
+		e := createElector(t, client, "ca-1", Options{
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   2 * time.Second,
+		})
+
+		// The existing lease is first observed in the past, and then again now.
+		e.now = func() time.Time { return now.Add(-c.observedAgo) }
+		e.tryAcquireOrRenew()
+		e.now = func() time.Time { return now }
+
+		if acquired := e.tryAcquireOrRenew(); acquired != c.expectedAcquired {
+			t.Errorf("Case %s: expecting acquired to be %v but got %v", id, c.expectedAcquired, acquired)
+			continue
+		}
+
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(lockName, metav1.GetOptions{})
+		if err != nil {
+			t.Errorf("Case %s: failed to get the lock: %v", id, err)
+			continue
+		}
+		record, err := getRecord(cm)
+		if !c.expectedAcquired {
+			if err != nil || record.HolderIdentity != "ca-2" {
+				t.Errorf("Case %s: expecting the lease to be kept by ca-2 but got %+v (%v)", id, record, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: failed to decode the lease: %v", id, err)
+			continue
+		}
+		if record.HolderIdentity != "ca-1" {
+			t.Errorf("Case %s: expecting the holder to be ca-1 but got %q", id, record.HolderIdentity)
+		}
+		if !record.RenewTime.Equal(now) {
+			t.Errorf("Case %s: expecting the renew time to be %v but got %v", id, now, record.RenewTime)
+		}
+		if !record.AcquireTime.Equal(c.expectedAcquireTime) {
+			t.Errorf("Case %s: expecting the acquire time to be %v but got %v",
+				id, c.expectedAcquireTime, record.AcquireTime)
+		}
+		if record.LeaseDurationSeconds != 15 {
+			t.Errorf("Case %s: expecting the lease duration to be 15 but got %d", id, record.LeaseDurationSeconds)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	opts := Options{
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   10 * time.Millisecond,
+	}
+
+	leading := make(chan string, 2)
+	stoppedLeading := make(chan string, 2)
+	createRunningElector := func(identity string) (*Elector, chan struct{}) {
+		o := opts
+		o.OnStartedLeading = func(stopCh <-chan struct{}) {
+			leading <- identity
+			<-stopCh
+			stoppedLeading <- identity
+		}
+		e := createElector(t, client, identity, o)
+		stopCh := make(chan struct{})
+		go e.Run(stopCh)
+		return e, stopCh
+	}
+	expect := func(ch chan string, identity, event string) {
+		select {
+		case id := <-ch:
+			if id != identity {
+				t.Fatalf("Expecting %s to have %s but got %s", identity, event, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s to have %s", identity, event)
+		}
+	}
+
+	first, firstStopCh := createRunningElector("ca-1")
+	expect(leading, "ca-1", "started leading")
+	if !first.IsLeader() {
+		t.Error("Expecting ca-1 to be the leader")
+	}
+
+	second, secondStopCh := createRunningElector("ca-2")
+	defer close(secondStopCh)
+	time.Sleep(100 * time.Millisecond)
+	if second.IsLeader() {
+		t.Error("Expecting ca-2 not to be the leader while ca-1 holds the lease")
+	}
+
+	// The lease is released when the leader stops, so the other replica takes
+	// over without waiting for the lease to expire.
+	close(firstStopCh)
+	expect(stoppedLeading, "ca-1", "stopped leading")
+	expect(leading, "ca-2", "started leading")
+	if first.IsLeader() {
+		t.Error("Expecting ca-1 not to be the leader after it stops")
+	}
+	if !second.IsLeader() {
+		t.Error("Expecting ca-2 to be the leader")
+	}
+}
+
+func TestRunWaitsForLeader(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	opts := Options{
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   10 * time.Millisecond,
+	}
+
+	// The first leader keeps working for a while after it loses the leadership.
+	var mutex sync.Mutex
+	firstReturned := false
+	firstOpts := opts
+	firstOpts.OnStartedLeading = func(stopCh <-chan struct{}) {
+		<-stopCh
+		time.Sleep(200 * time.Millisecond)
+		mutex.Lock()
+		firstReturned = true
+		mutex.Unlock()
+	}
+	first := createElector(t, client, "ca-1", firstOpts)
+	firstStopCh := make(chan struct{})
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstStopCh)
+		close(firstDone)
+	}()
+	for !first.IsLeader() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	secondLeading := make(chan bool, 1)
+	secondOpts := opts
+	secondOpts.OnStartedLeading = func(stopCh <-chan struct{}) {
+		mutex.Lock()
+		secondLeading <- firstReturned
+		mutex.Unlock()
+		<-stopCh
+	}
+	second := createElector(t, client, "ca-2", secondOpts)
+	secondStopCh := make(chan struct{})
+	defer close(secondStopCh)
+	go second.Run(secondStopCh)
+
+	close(firstStopCh)
+	select {
+	case <-firstDone:
+		mutex.Lock()
+		if !firstReturned {
+			t.Error("Expecting Run to return after OnStartedLeading has returned")
+		}
+		mutex.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ca-1 to stop")
+	}
+	select {
+	case returned := <-secondLeading:
+		if !returned {
+			t.Error("Expecting ca-2 not to lead before ca-1 has stopped leading")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ca-2 to start leading")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package monitoring exposes the Prometheus metrics of Istio Auth binaries.
+package monitoring
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is the HTTP path of the metrics.
+const MetricsPath = "/metrics"
+
+// Run starts a HTTP server that exposes the metrics registered with the
+// default Prometheus registry on the specified port.
+func Run(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %d (error: %v)", port, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.Handler())
+
+	// http.Serve() is a blocking call, so run it in a goroutine.
+	go func() {
+		glog.Infof("Starting monitoring server on port %d", port)
+
+		err := http.Serve(listener, mux)
+
+		// http.Serve() always returns a non-nil error.
+		glog.Warningf("Monitoring server returns an error: %v", err)
+	}()
+
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package peercred provides the gRPC transport credentials of Unix domain
+// sockets, which attach the credential of the peer process reported by the
+// kernel to the connections.
+package peercred
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// AuthType is the auth type of the connections over Unix domain sockets.
+const AuthType = "peercred"
+
+// Cred is the credential of the process at the other end of a Unix domain
+// socket, as reported by the kernel.
+type Cred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// AuthInfo is the AuthInfo of a connection over a Unix domain socket.
+type AuthInfo struct {
+	Cred Cred
+}
+
+// AuthType implements credentials.AuthInfo.
+func (AuthInfo) AuthType() string {
+	return AuthType
+}
+
+// FromContext returns the credential of the peer process of the request, if
+// it is received over a Unix domain socket.
+func FromContext(ctx context.Context) (*Cred, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	if !ok {
+		return nil, false
+	}
+	return &info.Cred, true
+}
+
+// NewCredentials returns the transport credentials of Unix domain sockets.
+// The connections are not encrypted, and the credentials of the peer process
+// are attached to them on the server side.
+func NewCredentials() credentials.TransportCredentials {
+	return transportCredentials{}
+}
+
+type transportCredentials struct{}
+
+func (transportCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (
+	net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (transportCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cred, err := Get(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the peer credential (error: %v)", err)
+	}
+	return conn, AuthInfo{Cred: *cred}, nil
+}
+
+func (transportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: AuthType}
+}
+
+func (c transportCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (transportCredentials) OverrideServerName(string) error {
+	return nil
+}
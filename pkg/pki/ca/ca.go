@@ -20,33 +20,24 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang/glog"
 	"istio.io/auth/pkg/pki"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
-	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"istio.io/auth/pkg/pki/ca/storage"
 )
 
 const (
-	// istioCASecretType is the Istio secret annotation type.
-	istioCASecretType = "istio.io/ca-root"
-
-	// cACertChainID is the CA certificate chain file.
-	cACertID = "ca-cert.pem"
-	// cAPrivateKeyID is the private key file of CA.
-	cAPrivateKeyID = "ca-key.pem"
-	// cASecret stores the key/cert of self-signed CA for persistency purpose.
-	cASecret = "istio-ca-secret"
-
 	// The size of a private key for a self-signed Istio CA.
 	caKeySize = 2048
 )
 
 // CertificateAuthority contains methods to be supported by a CA.
 type CertificateAuthority interface {
-	Sign(csrPEM []byte) ([]byte, error)
+	// Sign signs the CSR with the given TTL. A zero TTL stands for the default
+	// TTL of the CA.
+	Sign(csrPEM []byte, ttl time.Duration) ([]byte, error)
 	GetRootCertificate() []byte
 }
 
@@ -57,6 +48,10 @@ type IstioCAOptions struct {
 	SigningCertBytes []byte
 	SigningKeyBytes  []byte
 	RootCertBytes    []byte
+
+	// The ledger that records the issued certificates, or nil if they are not
+	// recorded.
+	Ledger storage.Store
 }
 
 // IstioCA generates keys and certificates for Istio identities.
@@ -67,20 +62,21 @@ type IstioCA struct {
 
 	certChainBytes []byte
 	rootCertBytes  []byte
+
+	ledger storage.Store
 }
 
 // NewSelfSignedIstioCA returns a new IstioCA instance using self-signed certificate.
-func NewSelfSignedIstioCA(caCertTTL, certTTL time.Duration, org string, namespace string,
-	core corev1.SecretsGetter) (*IstioCA, error) {
+// The key pair is kept in the store, which also records the issued certificates
+// if recordCerts is true.
+func NewSelfSignedIstioCA(caCertTTL, certTTL time.Duration, org string, store storage.Store,
+	recordCerts bool) (*IstioCA, error) {
 
 	// For the first time the CA is up, it generates a self-signed key/cert pair and write it to
-	// cASecret. For subsequent restart, CA will reads key/cert from cASecret.
-	caSecret, err := core.Secrets(namespace).Get(cASecret, metav1.GetOptions{})
-	opts := &IstioCAOptions{
-		CertTTL: certTTL,
-	}
-	if err != nil {
-		glog.Infof("Failed to get secret (error: %s), will create one", err)
+	// the store. For subsequent restart, CA will reads key/cert from the store.
+	kp, err := store.LoadKeyPair()
+	if err == storage.ErrNotFound {
+		glog.Info("No CA key pair is found in the store, will create one")
 
 		now := time.Now()
 		options := CertOptions{
@@ -92,41 +88,39 @@ func NewSelfSignedIstioCA(caCertTTL, certTTL time.Duration, org string, namespac
 			RSAKeySize:   caKeySize,
 		}
 		pemCert, pemKey := GenCert(options)
-
-		opts.SigningCertBytes = pemCert
-		opts.SigningKeyBytes = pemKey
-		opts.RootCertBytes = pemCert
-
-		// Rewrite the key/cert back to secret so they will be persistent when CA restarts.
-		secret := &apiv1.Secret{
-			Data: map[string][]byte{
-				cACertID:       pemCert,
-				cAPrivateKeyID: pemKey,
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      cASecret,
-				Namespace: namespace,
-			},
-			Type: istioCASecretType,
-		}
-		_, err := core.Secrets(namespace).Create(secret)
-		if err != nil {
-			glog.Errorf("Failed to write secret to CA (error: %s). This CA will not persist when restart.", err)
+		kp = &storage.KeyPair{CertPEM: pemCert, KeyPEM: pemKey}
+
+		// Write the key/cert to the store so they will be persistent when CA restarts.
+		err = store.CreateKeyPair(kp)
+		if err == storage.ErrAlreadyExists {
+			// Another replica has created the key pair first.
+			kp, err = store.LoadKeyPair()
+		} else if err != nil {
+			glog.Errorf("Failed to write the key pair to the store (error: %s). This CA will not persist when restart.",
+				err)
+			err = nil
 		}
-	} else {
-		// Reuse existing key/cert in secrets.
-		// TODO(wattli): better handle the logic when the key/cert are invalid.
-		opts.SigningCertBytes = caSecret.Data[cACertID]
-		opts.SigningKeyBytes = caSecret.Data[cAPrivateKeyID]
-		opts.RootCertBytes = caSecret.Data[cACertID]
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA key pair (error: %v)", err)
 	}
 
+	// TODO(wattli): better handle the logic when the key/cert are invalid.
+	opts := &IstioCAOptions{
+		CertTTL:          certTTL,
+		SigningCertBytes: kp.CertPEM,
+		SigningKeyBytes:  kp.KeyPEM,
+		RootCertBytes:    kp.CertPEM,
+	}
+	if recordCerts {
+		opts.Ledger = store
+	}
 	return NewIstioCA(opts)
 }
 
 // NewIstioCA returns a new IstioCA instance.
 func NewIstioCA(opts *IstioCAOptions) (*IstioCA, error) {
-	ca := &IstioCA{certTTL: opts.CertTTL}
+	ca := &IstioCA{certTTL: opts.CertTTL, ledger: opts.Ledger}
 
 	ca.certChainBytes = copyBytes(opts.CertChainBytes)
 	ca.rootCertBytes = copyBytes(opts.RootCertBytes)
@@ -155,19 +149,32 @@ func (ca *IstioCA) GetRootCertificate() []byte {
 }
 
 // Sign takes a PEM-encoded certificate signing request and returns a signed
-// certificate.
-func (ca *IstioCA) Sign(csrPEM []byte) ([]byte, error) {
+// certificate, which is valid for the given TTL, or the default TTL of the CA
+// if ttl is zero.
+func (ca *IstioCA) Sign(csrPEM []byte, ttl time.Duration) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		signDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	csr, err := pki.ParsePemEncodedCSR(csrPEM)
 	if err != nil {
+		signErrors.Inc()
 		return nil, err
 	}
 
-	tmpl := ca.generateCertificateTemplate(csr)
+	if ttl == 0 {
+		ttl = ca.certTTL
+	}
+	tmpl := ca.generateCertificateTemplate(csr, ttl)
 
 	bytes, err := x509.CreateCertificate(rand.Reader, tmpl, ca.signingCert, csr.PublicKey, ca.signingKey)
 	if err != nil {
+		signErrors.Inc()
 		return nil, err
 	}
+	issuedCerts.add(tmpl.NotAfter)
+	ca.record(bytes)
 
 	block := &pem.Block{
 		Type:  "CERTIFICATE",
@@ -181,14 +188,64 @@ func (ca *IstioCA) Sign(csrPEM []byte) ([]byte, error) {
 	return chain, nil
 }
 
-func (ca *IstioCA) generateCertificateTemplate(request *x509.CertificateRequest) *x509.Certificate {
+// Revoke records the revocation of the certificate with the given hex-encoded
+// serial number, which must be in the ledger.
+func (ca *IstioCA) Revoke(serial, reason string) error {
+	if ca.ledger == nil {
+		return errors.New("the issued certificates are not recorded")
+	}
+	rec, err := ca.ledger.GetCertificate(serial)
+	if err == storage.ErrNotFound {
+		return fmt.Errorf("certificate %s is not issued by this CA", serial)
+	} else if err != nil {
+		return err
+	}
+	return ca.ledger.Revoke(&storage.Revocation{
+		Serial:    rec.Serial,
+		RevokedAt: time.Now(),
+		Reason:    reason,
+		NotAfter:  rec.NotAfter,
+	})
+}
+
+// record adds the DER-encoded issued certificate to the ledger. A failure does
+// not fail the signing, so that the workloads keep getting certificates while
+// the ledger is unavailable.
+func (ca *IstioCA) record(der []byte) {
+	if ca.ledger == nil {
+		return
+	}
+	// The issued certificate is parsed, since its validity is truncated to
+	// seconds from the template.
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		glog.Errorf("Failed to parse the issued certificate (error: %v)", err)
+		ledgerErrors.Inc()
+		return
+	}
+	rec := &storage.CertRecord{
+		Serial:    cert.SerialNumber.Text(16),
+		IDs:       pki.ExtractIDs(cert.Extensions),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	if err := ca.ledger.RecordCertificate(rec); err != nil {
+		glog.Errorf("Failed to record certificate %s in the ledger (error: %v)", rec.Serial, err)
+		ledgerErrors.Inc()
+	}
+}
+
+// generateCertificateTemplate returns the template of the certificate for the
+// CSR. The signature algorithm is chosen by the type of the signing key, which
+// may differ from the type of the key of the CSR.
+func (ca *IstioCA) generateCertificateTemplate(request *x509.CertificateRequest, ttl time.Duration) *x509.Certificate {
 	exts := append(request.Extensions, request.ExtraExtensions...)
 	now := time.Now()
 
 	return &x509.Certificate{
 		SerialNumber: genSerialNum(),
 		Subject:      request.Subject,
-		NotAfter:     now.Add(ca.certTTL),
+		NotAfter:     now.Add(ttl),
 		NotBefore:    now,
 		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
@@ -198,7 +255,6 @@ func (ca *IstioCA) generateCertificateTemplate(request *x509.CertificateRequest)
 		DNSNames:              request.DNSNames,
 		EmailAddresses:        request.EmailAddresses,
 		IPAddresses:           request.IPAddresses,
-		SignatureAlgorithm:    request.SignatureAlgorithm,
 	}
 }
 
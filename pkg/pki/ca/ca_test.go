@@ -16,14 +16,18 @@ package ca
 
 import (
 	"bytes"
+	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/asn1"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 	"time"
 
 	"istio.io/auth/pkg/pki"
+	"istio.io/auth/pkg/pki/ca/storage"
 	"istio.io/auth/pkg/pki/testutil"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -36,7 +40,8 @@ func TestSelfSignedIstioCAWithoutSecret(t *testing.T) {
 	org := "test.ca.org"
 	caNamespace := "default"
 	client := fake.NewSimpleClientset()
-	ca, err := NewSelfSignedIstioCA(caCertTTL, certTTL, org, caNamespace, client.CoreV1())
+	store := storage.NewKubernetesStore(client.CoreV1(), caNamespace)
+	ca, err := NewSelfSignedIstioCA(caCertTTL, certTTL, org, store, false)
 	if err != nil {
 		t.Errorf("Failed to create a self-signed CA: %v", err)
 	}
@@ -52,7 +57,7 @@ func TestSelfSignedIstioCAWithoutSecret(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	cb, err := ca.Sign(csr)
+	cb, err := ca.Sign(csr, 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -107,12 +112,12 @@ func TestSelfSignedIstioCAWithoutSecret(t *testing.T) {
 		t.Errorf("SAN field does not match: %s is expected but actual is %s", bs, san.Value)
 	}
 
-	caSecret, err := client.CoreV1().Secrets("default").Get(cASecret, metav1.GetOptions{})
+	caSecret, err := client.CoreV1().Secrets("default").Get("istio-ca-secret", metav1.GetOptions{})
 	if err != nil {
 		t.Errorf("Failed to get secret (error: %s)", err)
 	}
 
-	signingCert, err := pki.ParsePemEncodedCertificate(caSecret.Data[cACertID])
+	signingCert, err := pki.ParsePemEncodedCertificate(caSecret.Data["ca-cert.pem"])
 	if err != nil {
 		t.Errorf("Failed to parse cert (error: %s)", err)
 	}
@@ -124,7 +129,7 @@ func TestSelfSignedIstioCAWithoutSecret(t *testing.T) {
 		t.Error("CertChain should be empty")
 	}
 
-	rootCertBytes := copyBytes(caSecret.Data[cACertID])
+	rootCertBytes := copyBytes(caSecret.Data["ca-cert.pem"])
 	if !bytes.Equal(ca.rootCertBytes, rootCertBytes) {
 		t.Error("Root cert does not match")
 	}
@@ -197,7 +202,8 @@ YQTFeoqvepyHWE9e1Mb5dGFHMvXywZQR0hR2rpWxA2OgNaRhqL7Rh7th+V/owIi9
 	org := "test.ca.org"
 	caNamespace := "default"
 
-	ca, err := NewSelfSignedIstioCA(caCertTTL, certTTL, org, caNamespace, client.CoreV1())
+	store := storage.NewKubernetesStore(client.CoreV1(), caNamespace)
+	ca, err := NewSelfSignedIstioCA(caCertTTL, certTTL, org, store, false)
 	if ca == nil || err != nil {
 		t.Errorf("Expecting an error but an Istio CA is wrongly instantiated")
 	}
@@ -221,6 +227,73 @@ YQTFeoqvepyHWE9e1Mb5dGFHMvXywZQR0hR2rpWxA2OgNaRhqL7Rh7th+V/owIi9
 
 }
 
+func TestSelfSignedIstioCAWithLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.ca.org", store, true)
+	if err != nil {
+		t.Fatalf("Failed to create a self-signed CA: %v", err)
+	}
+	// The CA restarts with the key pair in the store.
+	restarted, err := NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.ca.org", store, true)
+	if err != nil {
+		t.Fatalf("Failed to re-create the self-signed CA: %v", err)
+	}
+	if !bytes.Equal(ca.GetRootCertificate(), restarted.GetRootCertificate()) {
+		t.Error("Expecting the restarted CA to have the same root certificate")
+	}
+
+	id := "spiffe://cluster.local/ns/bar/sa/foo"
+	csr, _, err := GenCSR(CertOptions{Host: id, RSAKeySize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := restarted.Sign(csr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := pki.ParsePemEncodedCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := cert.SerialNumber.Text(16)
+
+	rec, err := store.GetCertificate(serial)
+	if err != nil {
+		t.Fatalf("Expecting certificate %s in the ledger: %v", serial, err)
+	}
+	if !reflect.DeepEqual(rec.IDs, []string{id}) || !rec.NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("Unexpected ledger entry %v", rec)
+	}
+
+	if err := ca.Revoke(serial, "key compromise"); err != nil {
+		t.Errorf("Failed to revoke certificate %s: %v", serial, err)
+	}
+	revs, err := store.ListRevocations()
+	if err != nil || len(revs) != 1 || revs[0].Serial != serial || revs[0].Reason != "key compromise" {
+		t.Errorf("Unexpected revocations %v (%v)", revs, err)
+	}
+	if err := ca.Revoke("ff", ""); err == nil {
+		t.Error("Expecting an error when revoking a certificate that is not in the ledger")
+	}
+
+	noLedger, err := NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.ca.org", store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := noLedger.Revoke(serial, ""); err == nil {
+		t.Error("Expecting an error when revoking a certificate without a ledger")
+	}
+}
+
 // Pass in unmatched chain and cert to make sure the `verify` method yeilds an error.
 func TestInvalidIstioCAOptions(t *testing.T) {
 	rootCert := `
@@ -316,6 +389,48 @@ RRoQIlr5T8PG4vXwsn2/hohILCJJyHAee/4gIq42jLu6hQsQxcoy
 	}
 }
 
+func TestSignCSRWithTTLAndECDSAKey(t *testing.T) {
+	host := "spiffe://example.com/ns/foo/sa/bar"
+	csrPEM, keyPEM, err := GenCSR(CertOptions{
+		Host:       host,
+		Org:        "istio.io",
+		ECDSACurve: elliptic.P256(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := 2 * time.Hour
+	certPEM, err := ca.Sign(csrPEM, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := &testutil.VerifyFields{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if err = testutil.VerifyCertificate(keyPEM, certPEM, ca.GetRootCertificate(), host, fields); err != nil {
+		t.Error(err)
+	}
+
+	cert, err := pki.ParsePemEncodedCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := cert.NotAfter.Sub(cert.NotBefore); actual != ttl {
+		t.Errorf("Unexpected certificate TTL (expecting %v, actual %v)", ttl, actual)
+	}
+	if cert.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("Expecting an ECDSA public key but got %v", cert.PublicKeyAlgorithm)
+	}
+}
+
 func TestSignCSR(t *testing.T) {
 	host := "spiffe://example.com/ns/foo/sa/bar"
 	opts := CertOptions{
@@ -333,7 +448,7 @@ func TestSignCSR(t *testing.T) {
 		t.Error(err)
 	}
 
-	certPEM, err := ca.Sign(csrPEM)
+	certPEM, err := ca.Sign(csrPEM, 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -413,13 +528,13 @@ func createCA() (CertificateAuthority, error) {
 func createSecret(namespace, signingCert, signingKey, rootCert string) *v1.Secret {
 	return &v1.Secret{
 		Data: map[string][]byte{
-			cACertID:       []byte(signingCert),
-			cAPrivateKeyID: []byte(signingKey),
+			"ca-cert.pem": []byte(signingCert),
+			"ca-key.pem":  []byte(signingKey),
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cASecret,
+			Name:      "istio-ca-secret",
 			Namespace: namespace,
 		},
-		Type: istioCASecretType,
+		Type: "istio.io/ca-root",
 	}
 }
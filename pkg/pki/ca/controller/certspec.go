@@ -0,0 +1,214 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// DNSNamesAnnotationKey is the annotation of a service account with the
+	// comma-separated DNS names that are added to its certificate.
+	DNSNamesAnnotationKey = "istio.io/cert-dns-names"
+	// TTLAnnotationKey is the annotation of a service account with the TTL of
+	// its certificate, e.g. "24h".
+	TTLAnnotationKey = "istio.io/cert-ttl"
+	// KeyAlgorithmAnnotationKey is the annotation of a service account with the
+	// algorithm of its private key, i.e. "RSA" or "ECDSA".
+	KeyAlgorithmAnnotationKey = "istio.io/cert-key-algorithm"
+	// KeySizeAnnotationKey is the annotation of a service account with the size
+	// of its private key in bits, i.e. 2048, 3072 or 4096 for RSA, and 256 or
+	// 384 for ECDSA.
+	KeySizeAnnotationKey = "istio.io/cert-key-size"
+
+	// KeyAlgorithmRSA is the RSA key algorithm.
+	KeyAlgorithmRSA = "RSA"
+	// KeyAlgorithmECDSA is the ECDSA key algorithm.
+	KeyAlgorithmECDSA = "ECDSA"
+
+	// The annotation of an Istio secret with the spec of its certificate, so
+	// that the certificate is re-issued when the spec changes.
+	certSpecAnnotationKey = "istio.io/cert-spec"
+
+	// The minimum TTL that can be requested. A shorter TTL would make the
+	// certificate refreshed on every re-sync.
+	minCertTTL = 10 * time.Minute
+
+	defaultECDSAKeySize = 256
+)
+
+var (
+	rsaKeySizes   = map[int]bool{2048: true, 3072: true, 4096: true}
+	ecdsaKeySizes = map[int]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384()}
+)
+
+// CertPolicy is the policy that the certificate annotations of the service
+// accounts are validated against. A nil CertPolicy rejects all of them.
+type CertPolicy struct {
+	// The DNS names that can be requested. If nil, no DNS name can be
+	// requested.
+	DNSNames *ca.HostnamePolicy
+	// The maximum TTL that can be requested. If zero, the TTL cannot be
+	// customized.
+	MaxTTL time.Duration
+}
+
+// certSpec is the spec of the certificate of a service account.
+type certSpec struct {
+	dnsNames []string
+	// The TTL of the certificate, or zero for the default TTL of the CA.
+	ttl          time.Duration
+	keyAlgorithm string
+	keySize      int
+}
+
+var defaultCertSpec = certSpec{keyAlgorithm: KeyAlgorithmRSA, keySize: keySize}
+
+// String returns the canonical form of the spec, which is empty for the
+// default spec.
+func (s certSpec) String() string {
+	if s.isDefault() {
+		return ""
+	}
+	return fmt.Sprintf("dns=%s;ttl=%v;key=%s-%d", strings.Join(s.dnsNames, ","), s.ttl, s.keyAlgorithm, s.keySize)
+}
+
+func (s certSpec) isDefault() bool {
+	return len(s.dnsNames) == 0 && s.ttl == defaultCertSpec.ttl &&
+		s.keyAlgorithm == defaultCertSpec.keyAlgorithm && s.keySize == defaultCertSpec.keySize
+}
+
+// certOptions returns the options of the CSR of the service account.
+func (s certSpec) certOptions(saName, saNamespace string) ca.CertOptions {
+	hosts := append([]string{getServiceAccountID(saName, saNamespace)}, s.dnsNames...)
+	options := ca.CertOptions{
+		Host:       strings.Join(hosts, ","),
+		RSAKeySize: s.keySize,
+	}
+	if s.keyAlgorithm == KeyAlgorithmECDSA {
+		options.ECDSACurve = ecdsaKeySizes[s.keySize]
+	}
+	return options
+}
+
+// getCertSpec returns the spec of the certificate of the service account
+// according to its annotations. The annotations that are rejected by the
+// policy are ignored, and returned as errors.
+func (p *CertPolicy) getCertSpec(sa *v1.ServiceAccount) (certSpec, []error) {
+	spec := defaultCertSpec
+	var errs []error
+
+	if value, ok := sa.Annotations[DNSNamesAnnotationKey]; ok {
+		if names, err := p.validateDNSNames(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s is rejected: %v", DNSNamesAnnotationKey, err))
+		} else {
+			spec.dnsNames = names
+		}
+	}
+
+	if value, ok := sa.Annotations[TTLAnnotationKey]; ok {
+		if ttl, err := p.validateTTL(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s is rejected: %v", TTLAnnotationKey, err))
+		} else {
+			spec.ttl = ttl
+		}
+	}
+
+	algorithm, hasAlgorithm := sa.Annotations[KeyAlgorithmAnnotationKey]
+	size, hasSize := sa.Annotations[KeySizeAnnotationKey]
+	if hasAlgorithm || hasSize {
+		if algorithm, bits, err := validateKey(algorithm, size); err != nil {
+			errs = append(errs, fmt.Errorf("%s and %s are rejected: %v",
+				KeyAlgorithmAnnotationKey, KeySizeAnnotationKey, err))
+		} else {
+			spec.keyAlgorithm = algorithm
+			spec.keySize = bits
+		}
+	}
+
+	return spec, errs
+}
+
+func (p *CertPolicy) validateDNSNames(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if p == nil || !p.DNSNames.IsAllowed(name) {
+			return nil, fmt.Errorf("DNS name %q is not allowed by the CA policy", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (p *CertPolicy) validateTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if p == nil || p.MaxTTL == 0 {
+		return 0, fmt.Errorf("the TTL cannot be customized")
+	}
+	if ttl < minCertTTL || ttl > p.MaxTTL {
+		return 0, fmt.Errorf("the TTL must be between %v and %v", minCertTTL, p.MaxTTL)
+	}
+	return ttl, nil
+}
+
+// validateKey returns the key algorithm and size that are specified by the
+// annotations. The algorithm defaults to RSA.
+func validateKey(algorithm, size string) (string, int, error) {
+	if algorithm == "" {
+		algorithm = KeyAlgorithmRSA
+	}
+	algorithm = strings.ToUpper(algorithm)
+
+	bits := 0
+	if size != "" {
+		var err error
+		if bits, err = strconv.Atoi(size); err != nil {
+			return "", 0, fmt.Errorf("invalid key size %q", size)
+		}
+	}
+
+	switch algorithm {
+	case KeyAlgorithmRSA:
+		if bits == 0 {
+			bits = keySize
+		} else if !rsaKeySizes[bits] {
+			return "", 0, fmt.Errorf("unsupported RSA key size %d", bits)
+		}
+	case KeyAlgorithmECDSA:
+		if bits == 0 {
+			bits = defaultECDSAKeySize
+		} else if ecdsaKeySizes[bits] == nil {
+			return "", 0, fmt.Errorf("unsupported ECDSA key size %d", bits)
+		}
+	default:
+		return "", 0, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+	return algorithm, bits, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca"
+)
+
+func TestGetCertSpec(t *testing.T) {
+	dnsNames, err := ca.NewHostnamePolicy([]string{".svc.cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &CertPolicy{DNSNames: dnsNames, MaxTTL: 90 * 24 * time.Hour}
+
+	testCases := map[string]struct {
+		policy      *CertPolicy
+		annotations map[string]string
+		spec        certSpec
+		specString  string
+		errors      int
+	}{
+		"No annotation": {
+			policy: policy,
+			spec:   defaultCertSpec,
+		},
+		"DNS names": {
+			policy:      policy,
+			annotations: map[string]string{DNSNamesAnnotationKey: "foo.ns.svc.cluster.local, bar.ns.svc.cluster.local"},
+			spec: certSpec{
+				dnsNames:     []string{"foo.ns.svc.cluster.local", "bar.ns.svc.cluster.local"},
+				keyAlgorithm: KeyAlgorithmRSA,
+				keySize:      keySize,
+			},
+			specString: "dns=foo.ns.svc.cluster.local,bar.ns.svc.cluster.local;ttl=0s;key=RSA-1024",
+		},
+		"DNS name not allowed": {
+			policy:      policy,
+			annotations: map[string]string{DNSNamesAnnotationKey: "foo.ns.svc.cluster.local,www.example.com"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"TTL": {
+			policy:      policy,
+			annotations: map[string]string{TTLAnnotationKey: "24h"},
+			spec:        certSpec{ttl: 24 * time.Hour, keyAlgorithm: KeyAlgorithmRSA, keySize: keySize},
+			specString:  "dns=;ttl=24h0m0s;key=RSA-1024",
+		},
+		"TTL too long": {
+			policy:      policy,
+			annotations: map[string]string{TTLAnnotationKey: "2400h"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"TTL too short": {
+			policy:      policy,
+			annotations: map[string]string{TTLAnnotationKey: "1m"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"Malformed TTL": {
+			policy:      policy,
+			annotations: map[string]string{TTLAnnotationKey: "one day"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"ECDSA key with the default size": {
+			policy:      policy,
+			annotations: map[string]string{KeyAlgorithmAnnotationKey: "ecdsa"},
+			spec:        certSpec{keyAlgorithm: KeyAlgorithmECDSA, keySize: 256},
+			specString:  "dns=;ttl=0s;key=ECDSA-256",
+		},
+		"ECDSA key with size": {
+			policy:      policy,
+			annotations: map[string]string{KeyAlgorithmAnnotationKey: "ECDSA", KeySizeAnnotationKey: "384"},
+			spec:        certSpec{keyAlgorithm: KeyAlgorithmECDSA, keySize: 384},
+			specString:  "dns=;ttl=0s;key=ECDSA-384",
+		},
+		"RSA key size": {
+			policy:      policy,
+			annotations: map[string]string{KeySizeAnnotationKey: "2048"},
+			spec:        certSpec{keyAlgorithm: KeyAlgorithmRSA, keySize: 2048},
+			specString:  "dns=;ttl=0s;key=RSA-2048",
+		},
+		"Unsupported key size": {
+			policy:      policy,
+			annotations: map[string]string{KeyAlgorithmAnnotationKey: "ECDSA", KeySizeAnnotationKey: "2048"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"Unsupported key algorithm": {
+			policy:      policy,
+			annotations: map[string]string{KeyAlgorithmAnnotationKey: "DSA"},
+			spec:        defaultCertSpec,
+			errors:      1,
+		},
+		"Valid and invalid annotations": {
+			policy: policy,
+			annotations: map[string]string{
+				DNSNamesAnnotationKey:     "www.example.com",
+				TTLAnnotationKey:          "1h",
+				KeyAlgorithmAnnotationKey: "ECDSA",
+			},
+			spec:       certSpec{ttl: time.Hour, keyAlgorithm: KeyAlgorithmECDSA, keySize: 256},
+			specString: "dns=;ttl=1h0m0s;key=ECDSA-256",
+			errors:     1,
+		},
+		"Nil policy": {
+			annotations: map[string]string{
+				DNSNamesAnnotationKey: "foo.ns.svc.cluster.local",
+				TTLAnnotationKey:      "1h",
+			},
+			spec:   defaultCertSpec,
+			errors: 2,
+		},
+	}
+
+	for id, c := range testCases {
+		sa := createServiceAccount("sa", "ns")
+		sa.Annotations = c.annotations
+		spec, errs := c.policy.getCertSpec(sa)
+		if !reflect.DeepEqual(spec, c.spec) {
+			t.Errorf("Case %s: expecting spec %+v but got %+v", id, c.spec, spec)
+		}
+		if spec.String() != c.specString {
+			t.Errorf("Case %s: expecting spec string %q but got %q", id, c.specString, spec.String())
+		}
+		if len(errs) != c.errors {
+			t.Errorf("Case %s: expecting %d errors but got %v", id, c.errors, errs)
+		}
+	}
+}
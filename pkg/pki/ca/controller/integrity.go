@@ -0,0 +1,187 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/kms"
+	"istio.io/auth/pkg/pki"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// The reasons of the events recorded by the audit pass.
+	secretInvalidReason  = "SecretInvalid"
+	secretOrphanedReason = "SecretOrphaned"
+
+	// The problems found by the audit pass, as the label of the audit metric.
+	auditProblemInvalid  = "invalid"
+	auditProblemOrphaned = "orphaned"
+)
+
+// auditSecrets checks that each Istio secret belongs to an existing service
+// account, and that its certificate chain verifies to the current root
+// certificate, is issued to the service account and matches the private key.
+// The invalid secrets are re-issued by the workers, and the orphaned secrets
+// are deleted.
+func (sc *SecretController) auditSecrets() {
+	invalid := 0
+	for _, obj := range sc.scrtStore.List() {
+		scrt := obj.(*v1.Secret)
+		saName := scrt.Annotations[serviceAccountNameAnnotationKey]
+		if saName == "" || getSecretName(saName) != scrt.Name {
+			// The workers never reach the secret since it is keyed by its
+			// annotation, so it is deleted here. Its TLS secret, if any, is left
+			// alone since the annotation cannot be trusted.
+			sc.deleteOrphanedSecret(scrt)
+			continue
+		}
+
+		key := scrt.Namespace + "/" + saName
+		obj, exists, err := sc.saStore.GetByKey(key)
+		if err != nil {
+			glog.Errorf("Failed to get service account %s (error: %v)", key, err)
+			continue
+		}
+		if !exists {
+			secretAuditProblems.WithLabelValues(auditProblemOrphaned).Inc()
+			sc.recorder.Eventf(scrt, v1.EventTypeWarning, secretOrphanedReason,
+				"Service account %s does not exist, deleting the secret", saName)
+			sc.queue.Add(key)
+			continue
+		}
+
+		if err := sc.verifySecret(scrt, saName); err != nil {
+			invalid++
+			secretAuditProblems.WithLabelValues(auditProblemInvalid).Inc()
+			sc.recordEvent(obj.(*v1.ServiceAccount), scrt, v1.EventTypeWarning, secretInvalidReason,
+				fmt.Sprintf("Re-issuing the certificate in secret %s: %v", scrt.Name, err))
+			sc.markRepair(key)
+			sc.queue.Add(key)
+		}
+	}
+	secretsInvalidGauge.Set(float64(invalid))
+}
+
+func (sc *SecretController) deleteOrphanedSecret(scrt *v1.Secret) {
+	secretAuditProblems.WithLabelValues(auditProblemOrphaned).Inc()
+	sc.recorder.Event(scrt, v1.EventTypeWarning, secretOrphanedReason,
+		"The secret is not annotated with the service account it is named after, deleting the secret")
+	if err := sc.core.Secrets(scrt.Namespace).Delete(scrt.Name, nil); err != nil {
+		glog.Errorf("Failed to delete orphaned Istio secret %s/%s (error: %v)", scrt.Namespace, scrt.Name, err)
+		return
+	}
+	secretsDeleted.Inc()
+	glog.Infof("Orphaned Istio secret %s/%s has been deleted", scrt.Namespace, scrt.Name)
+}
+
+// verifySecret returns an error if the certificate chain of the secret is
+// not a valid chain of the service account. The chain is only verified to the
+// root certificate if the secret has the current root certificate, since an
+// outdated root certificate is replaced by rotation.
+func (sc *SecretController) verifySecret(scrt *v1.Secret, saName string) error {
+	chain, err := parseCertificates(scrt.Data[CertChainID])
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+
+	keyPEM, err := kms.Open(sc.kms, scrt.Data[PrivateKeyID])
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the private key (error: %v)", err)
+	}
+	key, err := pki.ParsePemEncodedKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse the private key (error: %v)", err)
+	}
+	if match, err := publicKeyMatches(key, leaf); err != nil {
+		return err
+	} else if !match {
+		return fmt.Errorf("the private key does not match the certificate")
+	}
+
+	id := getServiceAccountID(saName, scrt.Namespace)
+	if !contains(pki.ExtractIDs(leaf.Extensions), id) {
+		return fmt.Errorf("the certificate is not issued to %s", id)
+	}
+
+	rootCertificate := sc.ca.GetRootCertificate()
+	if !bytes.Equal(rootCertificate, scrt.Data[RootCertID]) {
+		return nil
+	}
+	root, err := pki.ParsePemEncodedCertificate(rootCertificate)
+	if err != nil {
+		glog.Errorf("Failed to parse the root certificate, skipping the verification of the chains (error: %v)", err)
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	// The chain is verified at the time it was issued, since an expired
+	// certificate is replaced by rotation.
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("the certificate chain does not verify to the root certificate (error: %v)", err)
+	}
+	return nil
+}
+
+func publicKeyMatches(key crypto.PrivateKey, cert *x509.Certificate) (bool, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false, fmt.Errorf("unsupported private key type %T", key)
+	}
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false, err
+	}
+	certPublic, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(public, certPublic), nil
+}
+
+// markRepair makes the next reconciliation of the service account re-issue
+// its certificate.
+func (sc *SecretController) markRepair(key string) {
+	sc.repairsLock.Lock()
+	defer sc.repairsLock.Unlock()
+	sc.repairs[key] = true
+}
+
+// takeRepair returns whether the certificate of the service account needs to
+// be re-issued, and clears the mark.
+func (sc *SecretController) takeRepair(key string) bool {
+	sc.repairsLock.Lock()
+	defer sc.repairsLock.Unlock()
+	repair := sc.repairs[key]
+	delete(sc.repairs, key)
+	return repair
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/pki/ca/storage"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestAuditSecrets(t *testing.T) {
+	istioCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "other.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(issuer ca.CertificateAuthority, saName string) ([]byte, []byte) {
+		sc := NewSecretController(issuer, fake.NewSimpleClientset().CoreV1(), SecretControllerOptions{})
+		chain, key, err := sc.generateKeyAndCert(saName, "test-ns", defaultCertSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain, key
+	}
+	chain, key := issue(istioCA, "test")
+	_, otherKey := issue(istioCA, "test")
+	otherSAChain, otherSAKey := issue(istioCA, "other")
+	foreignChain, foreignKey := issue(otherCA, "test")
+
+	gvr := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+	testCases := map[string]struct {
+		scrtName        string
+		chain           []byte
+		key             []byte
+		root            []byte
+		noSA            bool
+		expectedRepair  bool
+		expectedActions []ktesting.Action
+	}{
+		"Valid secret": {
+			chain: chain,
+			key:   key,
+			root:  istioCA.GetRootCertificate(),
+		},
+		"Mismatched private key": {
+			chain:          chain,
+			key:            otherKey,
+			root:           istioCA.GetRootCertificate(),
+			expectedRepair: true,
+			expectedActions: []ktesting.Action{
+				ktesting.NewUpdateAction(gvr, "test-ns", createSecret("test", "istio.test", "test-ns")),
+			},
+		},
+		"Certificate of another service account": {
+			chain:          otherSAChain,
+			key:            otherSAKey,
+			root:           istioCA.GetRootCertificate(),
+			expectedRepair: true,
+			expectedActions: []ktesting.Action{
+				ktesting.NewUpdateAction(gvr, "test-ns", createSecret("test", "istio.test", "test-ns")),
+			},
+		},
+		"Chain of another CA": {
+			chain:          foreignChain,
+			key:            foreignKey,
+			root:           istioCA.GetRootCertificate(),
+			expectedRepair: true,
+			expectedActions: []ktesting.Action{
+				ktesting.NewUpdateAction(gvr, "test-ns", createSecret("test", "istio.test", "test-ns")),
+			},
+		},
+		"Outdated root certificate is left to rotation": {
+			chain: foreignChain,
+			key:   foreignKey,
+			root:  otherCA.GetRootCertificate(),
+		},
+		"Unparseable certificate": {
+			chain:          []byte("fake cert chain"),
+			key:            key,
+			root:           istioCA.GetRootCertificate(),
+			expectedRepair: true,
+			expectedActions: []ktesting.Action{
+				ktesting.NewUpdateAction(gvr, "test-ns", createSecret("test", "istio.test", "test-ns")),
+			},
+		},
+		"Deleted service account": {
+			chain: chain,
+			key:   key,
+			root:  istioCA.GetRootCertificate(),
+			noSA:  true,
+			expectedActions: []ktesting.Action{
+				ktesting.NewDeleteAction(gvr, "test-ns", "istio.test"),
+			},
+		},
+		"Secret not named after its service account": {
+			scrtName: "istio.renamed",
+			chain:    chain,
+			key:      key,
+			root:     istioCA.GetRootCertificate(),
+			expectedActions: []ktesting.Action{
+				ktesting.NewDeleteAction(gvr, "test-ns", "istio.renamed"),
+			},
+		},
+	}
+
+	for id, tc := range testCases {
+		scrtName := tc.scrtName
+		if scrtName == "" {
+			scrtName = "istio.test"
+		}
+		scrt := createSecret("test", scrtName, "test-ns")
+		scrt.Data = map[string][]byte{CertChainID: tc.chain, PrivateKeyID: tc.key, RootCertID: tc.root}
+
+		client := fake.NewSimpleClientset(scrt)
+		controller := NewSecretController(istioCA, client.CoreV1(), SecretControllerOptions{})
+		if !tc.noSA {
+			addServiceAccount(t, controller, createServiceAccount("test", "test-ns"))
+		}
+		if err := controller.scrtStore.Add(scrt); err != nil {
+			t.Fatalf("Case %s: failed to add a secret (error %v)", id, err)
+		}
+
+		controller.auditSecrets()
+		if repair := controller.repairs["test-ns/test"]; repair != tc.expectedRepair {
+			t.Errorf("Case %s: expecting the secret to be repaired to be %t but got %t", id, tc.expectedRepair, repair)
+		}
+		processQueue(controller)
+		if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
+			t.Errorf("Case %s: %v", id, err)
+		}
+		if len(controller.repairs) != 0 {
+			t.Errorf("Case %s: expecting no pending repairs but got %v", id, controller.repairs)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const metricsNamespace = "istio_ca"
+
+var (
+	secretsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_created_total",
+		Help:      "The number of Istio secrets created by the secret controller.",
+	})
+
+	secretsRefreshed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_refreshed_total",
+		Help:      "The number of Istio secrets refreshed by the secret controller.",
+	})
+
+	secretsDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_deleted_total",
+		Help:      "The number of Istio secrets deleted by the secret controller.",
+	})
+
+	reconcileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_reconcile_errors_total",
+		Help:      "The number of failed reconciliations of Istio secrets, which are retried with backoff.",
+	})
+
+	secretsRepaired = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_repaired_total",
+		Help:      "The number of Istio secrets whose certificates were re-issued after failing the audit.",
+	})
+
+	secretAuditProblems = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_audit_problems_total",
+		Help:      "The number of problems found by the audit of Istio secrets, by problem (invalid or orphaned).",
+	}, []string{"problem"})
+
+	secretsInvalidGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_invalid",
+		Help:      "The number of Istio secrets whose certificates failed the last audit.",
+	})
+
+	podCertsForgotten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pod_certs_forgotten_total",
+		Help:      "The number of pod-scoped certificates forgotten because their pods were deleted.",
+	})
+
+	rootCertConfigMapsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "root_cert_configmaps_written_total",
+		Help:      "The number of root certificate ConfigMaps created or updated by the root certificate controller.",
+	})
+
+	rotationsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_rotations_throttled_total",
+		Help:      "The number of rotations of Istio secrets delayed by the rotation rate limit.",
+	})
+
+	secretsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets",
+		Help:      "The number of Istio secrets.",
+	})
+
+	secretsOutdatedRootGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_outdated_root",
+		Help:      "The number of Istio secrets whose root certificate is not the current one.",
+	})
+
+	secretsDueGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_due_for_rotation",
+		Help:      "The number of Istio secrets whose certificates are due for rotation.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(secretsCreated, secretsRefreshed, secretsDeleted, reconcileErrors, rotationsThrottled,
+		secretsGauge, secretsOutdatedRootGauge, secretsDueGauge, rootCertConfigMapsWritten, secretsRepaired,
+		secretAuditProblems, secretsInvalidGauge, podCertsForgotten)
+}
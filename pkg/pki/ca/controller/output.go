@@ -0,0 +1,340 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/kms"
+	"istio.io/auth/pkg/pki"
+	"istio.io/auth/pkg/pki/keystore"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+/* #nosec: disable gas linter */
+const (
+	// OutputFormatsAnnotationKey is the annotation of a service account with
+	// the comma-separated output formats of its Istio secret, which overrides
+	// the output formats of its namespace.
+	OutputFormatsAnnotationKey = "istio.io/cert-output-formats"
+
+	// OutputFormatPEM is the PEM files of an Istio secret, which are always
+	// written for backward compatibility.
+	OutputFormatPEM = "pem"
+	// OutputFormatPEMBundle is a single PEM file with the private key and the
+	// certificate chain.
+	OutputFormatPEMBundle = "pem-bundle"
+	// OutputFormatPKCS12 is a PKCS#12 keystore with the private key and the
+	// certificate chain, protected by a random password.
+	OutputFormatPKCS12 = "pkcs12"
+	// OutputFormatJKS is a JKS keystore with the private key and the
+	// certificate chain, and the root certificate as a trusted certificate,
+	// protected by a random password.
+	OutputFormatJKS = "jks"
+	// OutputFormatTLS is an additional secret of type kubernetes.io/tls, named
+	// with the prefix "istio-tls.".
+	OutputFormatTLS = "tls"
+
+	// The ID/name for the PEM bundle file.
+	PEMBundleID = "bundle.pem"
+	// The ID/name for the PKCS#12 keystore file.
+	PKCS12KeystoreID = "keystore.p12"
+	// The ID/name for the JKS keystore file.
+	JKSKeystoreID = "keystore.jks"
+	// The ID/name for the password of the keystores.
+	KeystorePasswordID = "keystore.password"
+
+	// The aliases of the entries in the keystores.
+	keystoreKeyAlias  = "istio"
+	keystoreRootAlias = "istio-root"
+
+	// The annotation of an Istio secret with the output formats written to it.
+	outputFormatsSecretAnnotationKey = "istio.io/cert-outputs"
+
+	tlsSecretNamePrefix = "istio-tls."
+)
+
+var outputFormats = map[string]bool{
+	OutputFormatPEM:       true,
+	OutputFormatPEMBundle: true,
+	OutputFormatPKCS12:    true,
+	OutputFormatJKS:       true,
+	OutputFormatTLS:       true,
+}
+
+// plainKeyFormats are the output formats that hold the private key in plain
+// text, so they cannot be written when the private key is sealed by a KMS.
+var plainKeyFormats = map[string]bool{
+	OutputFormatPEMBundle: true,
+	OutputFormatTLS:       true,
+}
+
+// ParseOutputFormats parses the comma-separated output formats. The result is
+// sorted, and does not include OutputFormatPEM, which is always written.
+func ParseOutputFormats(value string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if !outputFormats[format] {
+			return nil, fmt.Errorf("unknown output format %q", format)
+		}
+		if format != OutputFormatPEM {
+			set[format] = true
+		}
+	}
+	var formats []string
+	for format := range set {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats, nil
+}
+
+// getOutputFormats returns the output formats of the Istio secret of the
+// service account, and records an event if its annotation is rejected. With a
+// KMS, the formats that hold the private key in plain text are rejected, since
+// the key is sealed and their consumers cannot open it.
+func (sc *SecretController) getOutputFormats(sa *v1.ServiceAccount) []string {
+	formats := sc.outputFormats[sa.Namespace]
+	if value, ok := sa.Annotations[OutputFormatsAnnotationKey]; ok {
+		parsed, err := ParseOutputFormats(value)
+		if err == nil {
+			formats = parsed
+		} else {
+			err = fmt.Errorf("%s is rejected: %v", OutputFormatsAnnotationKey, err)
+			glog.Warningf("Invalid output formats of service account %s/%s (error: %v)", sa.Namespace, sa.Name, err)
+			sc.recorder.Event(sa, v1.EventTypeWarning, invalidCertAnnotationReason, err.Error())
+		}
+	}
+	if sc.kms == nil {
+		return formats
+	}
+
+	var allowed, rejected []string
+	for _, format := range formats {
+		if plainKeyFormats[format] {
+			rejected = append(rejected, format)
+		} else {
+			allowed = append(allowed, format)
+		}
+	}
+	if len(rejected) > 0 {
+		message := fmt.Sprintf("Output formats %s are not written, since the private key is sealed by a KMS",
+			strings.Join(rejected, ","))
+		glog.Warningf("%s for service account %s/%s", message, sa.Namespace, sa.Name)
+		sc.recorder.Event(sa, v1.EventTypeWarning, outputFailedReason, message)
+	}
+	return allowed
+}
+
+// secretFormats returns the output formats written to the Istio secret.
+func secretFormats(scrt *v1.Secret) []string {
+	formats, _ := ParseOutputFormats(scrt.Annotations[outputFormatsSecretAnnotationKey])
+	return formats
+}
+
+// writeOutputs writes the output formats to the Istio secret from its PEM
+// files, and removes the files of the other formats. The keystores are written
+// from the private key opened by k, and their password is sealed by k.
+func writeOutputs(scrt *v1.Secret, formats []string, k kms.KMS) error {
+	data := scrt.Data
+	chainPEM, keyPEM, rootPEM := data[CertChainID], data[PrivateKeyID], data[RootCertID]
+
+	if contains(formats, OutputFormatPEMBundle) {
+		data[PEMBundleID] = append(append([]byte{}, keyPEM...), chainPEM...)
+	} else {
+		delete(data, PEMBundleID)
+	}
+
+	p12, jks := contains(formats, OutputFormatPKCS12), contains(formats, OutputFormatJKS)
+	if !p12 && !jks {
+		delete(data, PKCS12KeystoreID)
+		delete(data, JKSKeystoreID)
+		delete(data, KeystorePasswordID)
+	} else {
+		opened, err := kms.Open(k, keyPEM)
+		if err != nil {
+			return err
+		}
+		key, err := pki.ParsePemEncodedKey(opened)
+		if err != nil {
+			return err
+		}
+		chain, err := parseCertificates(chainPEM)
+		if err != nil {
+			return err
+		}
+		// The password is kept across rotations, so that it can be configured
+		// once in the applications.
+		var password string
+		if stored := data[KeystorePasswordID]; len(stored) > 0 {
+			opened, err := kms.Open(k, stored)
+			if err != nil {
+				return err
+			}
+			password = string(opened)
+		} else {
+			if password, err = randomPassword(); err != nil {
+				return err
+			}
+			data[KeystorePasswordID] = []byte(password)
+			if k != nil {
+				if data[KeystorePasswordID], err = kms.Seal(k, []byte(password)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if p12 {
+			if data[PKCS12KeystoreID], err = keystore.EncodePKCS12(key, chain, keystoreKeyAlias, password); err != nil {
+				return fmt.Errorf("failed to encode the PKCS#12 keystore (error: %v)", err)
+			}
+		} else {
+			delete(data, PKCS12KeystoreID)
+		}
+		if jks {
+			trusted := make(map[string]*x509.Certificate)
+			if root, err := pki.ParsePemEncodedCertificate(rootPEM); err == nil {
+				trusted[keystoreRootAlias] = root
+			}
+			if data[JKSKeystoreID], err = keystore.EncodeJKS(key, chain, keystoreKeyAlias, trusted, password); err != nil {
+				return fmt.Errorf("failed to encode the JKS keystore (error: %v)", err)
+			}
+		} else {
+			delete(data, JKSKeystoreID)
+		}
+	}
+
+	if len(formats) == 0 {
+		delete(scrt.Annotations, outputFormatsSecretAnnotationKey)
+	} else {
+		scrt.Annotations[outputFormatsSecretAnnotationKey] = strings.Join(formats, ",")
+	}
+	return nil
+}
+
+// syncTLSSecret creates or updates the kubernetes.io/tls secret of the Istio
+// secret if its output formats include OutputFormatTLS, and deletes it if they
+// no longer do. A secret with the same name that the controller did not
+// create is left alone, and an event is recorded on the service account.
+func (sc *SecretController) syncTLSSecret(sa *v1.ServiceAccount, scrt *v1.Secret, oldFormats []string) error {
+	saName := scrt.Annotations[serviceAccountNameAnnotationKey]
+	name := getTLSSecretName(saName)
+	secrets := sc.core.Secrets(scrt.Namespace)
+
+	if !contains(secretFormats(scrt), OutputFormatTLS) {
+		if !contains(oldFormats, OutputFormatTLS) {
+			return nil
+		}
+		existing, err := secrets.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err == nil {
+			if !sc.ownsTLSSecret(sa, existing, saName) {
+				return nil
+			}
+			err = secrets.Delete(name, nil)
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete TLS secret %s/%s (error: %v)", scrt.Namespace, name, err)
+		}
+		return nil
+	}
+
+	tlsSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{serviceAccountNameAnnotationKey: saName},
+			Name:        name,
+			Namespace:   scrt.Namespace,
+		},
+		Data: map[string][]byte{
+			v1.TLSCertKey:              scrt.Data[CertChainID],
+			v1.TLSPrivateKeyKey:        scrt.Data[PrivateKeyID],
+			v1.ServiceAccountRootCAKey: scrt.Data[RootCertID],
+		},
+		Type: v1.SecretTypeTLS,
+	}
+	_, err := secrets.Create(tlsSecret)
+	if errors.IsAlreadyExists(err) {
+		var existing *v1.Secret
+		if existing, err = secrets.Get(name, metav1.GetOptions{}); err == nil {
+			if !sc.ownsTLSSecret(sa, existing, saName) {
+				return nil
+			}
+			tlsSecret.ResourceVersion = existing.ResourceVersion
+			_, err = secrets.Update(tlsSecret)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write TLS secret %s/%s (error: %v)", scrt.Namespace, name, err)
+	}
+	return nil
+}
+
+// ownsTLSSecret returns whether the existing secret is the TLS secret that the
+// controller created for the service account, and records an event if not.
+func (sc *SecretController) ownsTLSSecret(sa *v1.ServiceAccount, existing *v1.Secret, saName string) bool {
+	if existing.Type == v1.SecretTypeTLS && existing.Annotations[serviceAccountNameAnnotationKey] == saName {
+		return true
+	}
+	message := fmt.Sprintf("Secret %s/%s is not managed by Istio CA, so it is left alone", existing.Namespace,
+		existing.Name)
+	glog.Warning(message)
+	sc.recorder.Event(sa, v1.EventTypeWarning, tlsSecretConflictReason, message)
+	return false
+}
+
+// parseCertificates parses the PEM-encoded certificates.
+func parseCertificates(certsPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(certsPEM); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the certificate chain (error: %v)", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("the certificate chain is empty")
+	}
+	return certs, nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the keystore password (error: %v)", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func getTLSSecretName(saName string) string {
+	return tlsSecretNamePrefix + saName
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/kms"
+	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/pki/ca/storage"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseOutputFormats(t *testing.T) {
+	testCases := map[string]struct {
+		value       string
+		formats     []string
+		expectedErr string
+	}{
+		"Empty": {},
+		"PEM only": {
+			value: "pem",
+		},
+		"Multiple formats": {
+			value:   "tls, JKS,pkcs12,pem,jks",
+			formats: []string{"jks", "pkcs12", "tls"},
+		},
+		"Unknown format": {
+			value:       "pkcs12,der",
+			expectedErr: `unknown output format "der"`,
+		},
+	}
+
+	for id, c := range testCases {
+		formats, err := ParseOutputFormats(c.value)
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if !reflect.DeepEqual(formats, c.formats) {
+			t.Errorf("Case %s: expecting %v but got %v", id, c.formats, formats)
+		}
+	}
+}
+
+func TestSecretOutputFormats(t *testing.T) {
+	istioCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	controller := NewSecretController(istioCA, client.CoreV1(), SecretControllerOptions{
+		OutputFormats: map[string][]string{"test-ns": {OutputFormatPKCS12}},
+	})
+
+	// The service account without the annotation gets the formats of its
+	// namespace.
+	addServiceAccount(t, controller, createServiceAccount("default", "test-ns"))
+	sa := createServiceAccount("test", "test-ns")
+	sa.Annotations = map[string]string{OutputFormatsAnnotationKey: "pem-bundle,jks,tls"}
+	addServiceAccount(t, controller, sa)
+	for _, key := range []string{"test-ns/default", "test-ns/test"} {
+		if err := controller.reconcile(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secrets := writtenSecrets(client.Actions())
+	expectedKeys := map[string][]string{
+		"istio.default":  {CertChainID, KeystorePasswordID, PrivateKeyID, RootCertID, PKCS12KeystoreID},
+		"istio-tls.test": {v1.ServiceAccountRootCAKey, v1.TLSCertKey, v1.TLSPrivateKeyKey},
+		"istio.test":     {PEMBundleID, CertChainID, KeystorePasswordID, JKSKeystoreID, PrivateKeyID, RootCertID},
+	}
+	checkSecretKeys(t, secrets, expectedKeys)
+	scrt := secrets["istio.test"]
+	if tlsSecret := secrets["istio-tls.test"]; tlsSecret.Type != v1.SecretTypeTLS ||
+		!bytes.Equal(tlsSecret.Data[v1.TLSCertKey], scrt.Data[CertChainID]) {
+		t.Errorf("The TLS secret does not match the Istio secret: %v", tlsSecret)
+	}
+
+	// Removing the annotation rewrites the secret with the formats of the
+	// namespace without re-issuing the certificate, and deletes the TLS secret.
+	if err := controller.scrtStore.Add(scrt); err != nil {
+		t.Fatal(err)
+	}
+	updatedSa := createServiceAccount("test", "test-ns")
+	if err := controller.saStore.Update(updatedSa); err != nil {
+		t.Fatal(err)
+	}
+	client.ClearActions()
+	if err := controller.reconcile("test-ns/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The TLS secret is checked to be created by the controller before it is
+	// deleted.
+	actions := client.Actions()
+	if len(actions) != 3 || !actions[0].Matches("get", "secrets") || !actions[1].Matches("delete", "secrets") ||
+		!actions[2].Matches("update", "secrets") {
+		t.Fatalf("Expecting the TLS secret to be deleted and the Istio secret to be updated but got %v", actions)
+	}
+	if name := actions[1].(ktesting.DeleteAction).GetName(); name != "istio-tls.test" {
+		t.Errorf("Expecting istio-tls.test to be deleted but got %s", name)
+	}
+	updated := writtenSecrets(actions)["istio.test"]
+	checkSecretKeys(t, map[string]*v1.Secret{"istio.test": updated}, map[string][]string{
+		"istio.test": {CertChainID, KeystorePasswordID, PrivateKeyID, RootCertID, PKCS12KeystoreID},
+	})
+	if !bytes.Equal(updated.Data[CertChainID], scrt.Data[CertChainID]) {
+		t.Error("Expecting the certificate not to be re-issued")
+	}
+	if !bytes.Equal(updated.Data[KeystorePasswordID], scrt.Data[KeystorePasswordID]) {
+		t.Error("Expecting the keystore password to be kept")
+	}
+}
+
+func TestForeignTLSSecret(t *testing.T) {
+	istioCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "istio-tls.test", Namespace: "test-ns"},
+		Data:       map[string][]byte{"foo": []byte("bar")},
+	}
+	client := fake.NewSimpleClientset(foreign)
+	recorder := record.NewFakeRecorder(10)
+	controller := NewSecretController(istioCA, client.CoreV1(), SecretControllerOptions{EventRecorder: recorder})
+
+	sa := createServiceAccount("test", "test-ns")
+	sa.Annotations = map[string]string{OutputFormatsAnnotationKey: "tls"}
+	addServiceAccount(t, controller, sa)
+	if err := controller.reconcile("test-ns/test"); err != nil {
+		t.Fatal(err)
+	}
+	scrt := writtenSecrets(client.Actions())["istio.test"]
+	if scrt == nil {
+		t.Fatal("Expecting the Istio secret to be created")
+	}
+
+	// The TLS secret is not deleted either once the format is removed.
+	if err := controller.scrtStore.Add(scrt); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.saStore.Update(createServiceAccount("test", "test-ns")); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.reconcile("test-ns/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := client.CoreV1().Secrets("test-ns").Get("istio-tls.test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expecting the foreign secret to be kept but got error %v", err)
+	}
+	if !reflect.DeepEqual(existing.Data, foreign.Data) {
+		t.Errorf("Expecting the foreign secret to be left alone but got %v", existing.Data)
+	}
+	conflicts := 0
+	for len(recorder.Events) > 0 {
+		if strings.HasPrefix(<-recorder.Events, "Warning "+tlsSecretConflictReason) {
+			conflicts++
+		}
+	}
+	if conflicts != 2 {
+		t.Errorf("Expecting 2 conflict events but got %d", conflicts)
+	}
+}
+
+func TestSecretEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kekFile := filepath.Join(dir, "kek")
+	if err := ioutil.WriteFile(kekFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := kms.NewFileKMS(kekFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	istioCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+
+	recorder := record.NewFakeRecorder(10)
+	controller := NewSecretController(istioCA, client.CoreV1(), SecretControllerOptions{
+		KMS:           k,
+		EventRecorder: recorder,
+	})
+
+	// The formats with the private key in plain text are not written.
+	sa := createServiceAccount("test", "test-ns")
+	sa.Annotations = map[string]string{OutputFormatsAnnotationKey: "pem-bundle,pkcs12,tls"}
+	addServiceAccount(t, controller, sa)
+	if err := controller.reconcile("test-ns/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := writtenSecrets(client.Actions())
+	checkSecretKeys(t, secrets, map[string][]string{
+		"istio.test": {CertChainID, KeystorePasswordID, PrivateKeyID, RootCertID, PKCS12KeystoreID},
+	})
+	scrt := secrets["istio.test"]
+	if scrt == nil {
+		t.Fatal("Expecting the Istio secret to be created")
+	}
+	if formats := secretFormats(scrt); !reflect.DeepEqual(formats, []string{OutputFormatPKCS12}) {
+		t.Errorf("Expecting only the PKCS#12 format to be written but got %v", formats)
+	}
+	rejected := false
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.HasPrefix(event, "Warning "+outputFailedReason+" Output formats "+
+			"pem-bundle,tls are not written") {
+			rejected = true
+		}
+	}
+	if !rejected {
+		t.Error("Expecting an event for the rejected output formats")
+	}
+	for _, key := range []string{PrivateKeyID, KeystorePasswordID} {
+		if !kms.IsSealed(scrt.Data[key]) {
+			t.Errorf("Expecting %s to be sealed but got %s", key, scrt.Data[key])
+		}
+	}
+	if len(scrt.Data[PKCS12KeystoreID]) == 0 {
+		t.Error("Expecting the PKCS#12 keystore to be written from the opened private key")
+	}
+
+	// The audit opens the private key with the KMS.
+	if err := controller.verifySecret(scrt, "test"); err != nil {
+		t.Errorf("Expecting the sealed secret to pass the audit but got %v", err)
+	}
+	controller.kms = nil
+	if err := controller.verifySecret(scrt, "test"); err == nil {
+		t.Error("Expecting the sealed secret to fail the audit without the KMS")
+	}
+}
+
+// writtenSecrets returns the secrets created or updated by the actions.
+func writtenSecrets(actions []ktesting.Action) map[string]*v1.Secret {
+	secrets := make(map[string]*v1.Secret)
+	for _, action := range actions {
+		var obj interface{}
+		switch a := action.(type) {
+		case ktesting.CreateAction:
+			obj = a.GetObject()
+		case ktesting.UpdateAction:
+			obj = a.GetObject()
+		}
+		if scrt, ok := obj.(*v1.Secret); ok {
+			secrets[scrt.Name] = scrt
+		}
+	}
+	return secrets
+}
+
+func checkSecretKeys(t *testing.T, secrets map[string]*v1.Secret, expectedKeys map[string][]string) {
+	if len(secrets) != len(expectedKeys) {
+		t.Errorf("Expecting %d secrets but got %d", len(expectedKeys), len(secrets))
+	}
+	for name, expected := range expectedKeys {
+		scrt, ok := secrets[name]
+		if !ok {
+			t.Errorf("Expecting secret %s", name)
+			continue
+		}
+		var keys []string
+		for key := range scrt.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expecting secret %s to have %v but got %v", name, expected, keys)
+		}
+	}
+}
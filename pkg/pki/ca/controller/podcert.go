@@ -0,0 +1,178 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/audit"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// PodCertAnnotationKey is the annotation of a pod that opts in to a
+	// pod-scoped certificate, with the value "true".
+	PodCertAnnotationKey = "istio.io/pod-cert"
+	// PodCertLabelKey is the label of the pods that are injected with the
+	// init container that requests a pod-scoped certificate. Only the labeled
+	// pods are issued pod-scoped certificates.
+	PodCertLabelKey = "istio.io/pod-cert"
+
+	podCertResyncPeriod = time.Minute
+)
+
+// PodCertController tracks the pods that get pod-scoped certificates, so that
+// a certificate is only issued to a live pod, and the certificates of a pod
+// are forgotten when it is deleted. The certificates are bound to the UIDs of
+// the pods in memory.
+type PodCertController struct {
+	podController cache.Controller
+	podStore      cache.Indexer
+
+	// The sink of the audit events of the forgotten certificates.
+	auditSink audit.Sink
+
+	bindingsLock sync.Mutex
+	// The pods that are issued certificates, by their UIDs.
+	bindings map[types.UID]*podBinding
+}
+
+// podBinding is the certificates issued to a pod.
+type podBinding struct {
+	namespace string
+	name      string
+	// The hex-encoded serial numbers of the certificates.
+	serials []string
+}
+
+// NewPodCertController returns a PodCertController that watches the labeled
+// pods in the given namespace, or in all the namespaces with
+// metav1.NamespaceAll.
+func NewPodCertController(core corev1.CoreV1Interface, namespace string, auditSink audit.Sink) *PodCertController {
+	c := &PodCertController{
+		auditSink: auditSink,
+		bindings:  map[types.UID]*podBinding{},
+	}
+
+	labelSelector := labels.SelectorFromSet(map[string]string{PodCertLabelKey: "true"}).String()
+	podLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = labelSelector
+			return core.Pods(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = labelSelector
+			return core.Pods(namespace).Watch(options)
+		},
+	}
+	c.podStore, c.podController = cache.NewIndexerInformer(podLW, &v1.Pod{}, podCertResyncPeriod,
+		cache.ResourceEventHandlerFuncs{DeleteFunc: c.podDeleted}, cache.Indexers{})
+
+	return c
+}
+
+// Run starts the PodCertController until stopCh is closed.
+func (c *PodCertController) Run(stopCh <-chan struct{}) {
+	go c.podController.Run(stopCh)
+}
+
+// HasSynced returns whether the pods have been listed.
+func (c *PodCertController) HasSynced() bool {
+	return c.podController.HasSynced()
+}
+
+// GetPod returns the pod with the given name and UID, or an error if it does
+// not exist, is not labeled for a pod-scoped certificate or is being deleted.
+func (c *PodCertController) GetPod(namespace, name, uid string) (*v1.Pod, error) {
+	obj, exists, err := c.podStore.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("pod %s/%s does not exist or does not get a pod-scoped certificate", namespace, name)
+	}
+	pod := obj.(*v1.Pod)
+	if string(pod.UID) != uid {
+		return nil, fmt.Errorf("pod %s/%s has UID %s rather than %s", namespace, name, pod.UID, uid)
+	}
+	if pod.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("pod %s/%s is being deleted", namespace, name)
+	}
+	return pod, nil
+}
+
+// Bind records the certificate with the given serial number as issued to the
+// pod, so that it is forgotten when the pod is deleted.
+func (c *PodCertController) Bind(pod *v1.Pod, serial string) {
+	c.bindingsLock.Lock()
+	defer c.bindingsLock.Unlock()
+	binding, ok := c.bindings[pod.UID]
+	if !ok {
+		binding = &podBinding{namespace: pod.Namespace, name: pod.Name}
+		c.bindings[pod.UID] = binding
+	}
+	binding.serials = append(binding.serials, serial)
+}
+
+func (c *PodCertController) podDeleted(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			glog.Warningf("Failed to convert to pod object: %v", obj)
+			return
+		}
+		if pod, ok = tombstone.Obj.(*v1.Pod); !ok {
+			glog.Warningf("Failed to convert to pod object: %v", tombstone.Obj)
+			return
+		}
+	}
+	c.forget(pod.UID)
+}
+
+// forget drops the certificates bound to the pod with the given UID, and
+// records an audit event for each of them.
+func (c *PodCertController) forget(uid types.UID) {
+	c.bindingsLock.Lock()
+	binding, ok := c.bindings[uid]
+	delete(c.bindings, uid)
+	c.bindingsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, serial := range binding.serials {
+		podCertsForgotten.Inc()
+		audit.Record(c.auditSink, &audit.Event{
+			Source:   audit.SourcePodCertController,
+			Decision: audit.Forget,
+			Reason:   fmt.Sprintf("pod %s/%s (UID %s) is deleted", binding.namespace, binding.name, uid),
+			Serial:   serial,
+		})
+	}
+	glog.Infof("Forgot %d certificate(s) of deleted pod %s/%s", len(binding.serials), binding.namespace, binding.name)
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"istio.io/auth/pkg/audit"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createPod(name, namespace, uid string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			UID:       types.UID(uid),
+			Labels:    map[string]string{PodCertLabelKey: "true"},
+		},
+	}
+}
+
+func TestGetPod(t *testing.T) {
+	controller := NewPodCertController(fake.NewSimpleClientset().CoreV1(), metav1.NamespaceAll, nil)
+	deleting := createPod("deleting", "test-ns", "uid-2")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	for _, pod := range []*v1.Pod{createPod("test", "test-ns", "uid-1"), deleting} {
+		if err := controller.podStore.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := map[string]struct {
+		name        string
+		uid         string
+		expectedErr string
+	}{
+		"Live pod": {
+			name: "test",
+			uid:  "uid-1",
+		},
+		"Pod with another UID": {
+			name:        "test",
+			uid:         "uid-0",
+			expectedErr: "pod test-ns/test has UID uid-1 rather than uid-0",
+		},
+		"Missing pod": {
+			name:        "missing",
+			uid:         "uid-3",
+			expectedErr: "pod test-ns/missing does not exist or does not get a pod-scoped certificate",
+		},
+		"Pod being deleted": {
+			name:        "deleting",
+			uid:         "uid-2",
+			expectedErr: "pod test-ns/deleting is being deleted",
+		},
+	}
+
+	for id, tc := range testCases {
+		pod, err := controller.GetPod("test-ns", tc.name, tc.uid)
+		if tc.expectedErr != "" {
+			if err == nil || err.Error() != tc.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, tc.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error %v", id, err)
+		} else if pod.Name != tc.name {
+			t.Errorf("Case %s: expecting pod %s but got %s", id, tc.name, pod.Name)
+		}
+	}
+}
+
+func TestForgetDeletedPod(t *testing.T) {
+	buf := &bytes.Buffer{}
+	controller := NewPodCertController(fake.NewSimpleClientset().CoreV1(), metav1.NamespaceAll,
+		audit.NewWriterSink(buf))
+	pod := createPod("test", "test-ns", "uid-1")
+	other := createPod("other", "test-ns", "uid-2")
+	controller.Bind(pod, "1a")
+	controller.Bind(other, "2b")
+
+	controller.podDeleted(cache.DeletedFinalStateUnknown{Key: "test-ns/test", Obj: pod})
+
+	if _, ok := controller.bindings[pod.UID]; ok {
+		t.Errorf("Expecting the certificates of the deleted pod to be forgotten")
+	}
+	if _, ok := controller.bindings[other.UID]; !ok {
+		t.Errorf("Expecting the certificates of the other pod to be kept")
+	}
+	event := &audit.Event{}
+	if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+		t.Fatalf("Failed to decode the audit event %q (error %v)", buf.String(), err)
+	}
+	if event.Source != audit.SourcePodCertController || event.Decision != audit.Forget || event.Serial != "1a" {
+		t.Errorf("Unexpected audit event %+v", event)
+	}
+}
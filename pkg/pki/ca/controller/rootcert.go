@@ -0,0 +1,280 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/pki/ca"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// RootCertConfigMapName is the name of the ConfigMap that holds the root
+	// certificate in each watched namespace, under the key RootCertID.
+	RootCertConfigMapName = "istio-ca-root-cert"
+
+	// The label of the ConfigMaps managed by the RootCertController, so that
+	// a ConfigMap of the same name created by others is never deleted.
+	managedByLabelKey   = "istio.io/managed-by"
+	managedByLabelValue = "istio-ca"
+
+	rootCertResyncPeriod = time.Minute
+)
+
+// RootCertController publishes the root certificate of the CA into a
+// ConfigMap in each watched namespace, so that the workloads that only verify
+// their peers do not need to mount an Istio secret with a private key. The
+// ConfigMaps are updated when the root certificate changes, and re-created
+// when they are deleted.
+type RootCertController struct {
+	ca   ca.CertificateAuthority
+	core corev1.CoreV1Interface
+
+	// The namespaces that get the ConfigMap. The namespaces are only selected
+	// by their names and labels.
+	selector *Selector
+
+	// Controller and store for namespace objects.
+	nsController cache.Controller
+	nsStore      cache.Store
+
+	// Controller and store for the ConfigMaps of the root certificate.
+	cmController cache.Controller
+	cmStore      cache.Store
+
+	// The names of the namespaces whose ConfigMaps need reconciliation.
+	queue workqueue.RateLimitingInterface
+}
+
+// NewRootCertController returns a RootCertController that watches the given
+// namespace, or all the namespaces with metav1.NamespaceAll. All the watched
+// namespaces get the ConfigMap if selector is nil.
+func NewRootCertController(ca ca.CertificateAuthority, core corev1.CoreV1Interface, namespace string,
+	selector *Selector) *RootCertController {
+
+	c := &RootCertController{
+		ca:       ca,
+		core:     core,
+		selector: selector,
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "root-certs"),
+	}
+
+	nsFieldSelector := fields.Everything().String()
+	if namespace != metav1.NamespaceAll {
+		nsFieldSelector = fields.OneTermEqualSelector("metadata.name", namespace).String()
+	}
+	nsLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = nsFieldSelector
+			return core.Namespaces().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = nsFieldSelector
+			return core.Namespaces().Watch(options)
+		},
+	}
+	c.nsStore, c.nsController = cache.NewInformer(nsLW, &v1.Namespace{}, rootCertResyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.nsChanged,
+			DeleteFunc: c.nsChanged,
+			UpdateFunc: c.nsUpdated,
+		})
+
+	cmFieldSelector := fields.OneTermEqualSelector("metadata.name", RootCertConfigMapName).String()
+	cmLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = cmFieldSelector
+			return core.ConfigMaps(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = cmFieldSelector
+			return core.ConfigMaps(namespace).Watch(options)
+		},
+	}
+	// The ConfigMaps are re-synced periodically, so that they are updated
+	// when the root certificate of the CA changes.
+	c.cmStore, c.cmController = cache.NewInformer(cmLW, &v1.ConfigMap{}, rootCertResyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.cmChanged,
+			DeleteFunc: c.cmChanged,
+			UpdateFunc: func(oldObj, curObj interface{}) { c.cmChanged(curObj) },
+		})
+
+	return c
+}
+
+// Run runs the RootCertController until stopCh is closed. The namespaces are
+// reconciled by the given number of workers once the caches are synced. It
+// returns once the workers have exited, like SecretController.Run.
+func (c *RootCertController) Run(workers int, stopCh <-chan struct{}) {
+	go c.nsController.Run(stopCh)
+	go c.cmController.Run(stopCh)
+
+	go func() {
+		<-stopCh
+		c.queue.ShutDown()
+	}()
+
+	var g goroutineGroup
+	if cache.WaitForCacheSync(stopCh, c.nsController.HasSynced, c.cmController.HasSynced) {
+		for i := 0; i < workers; i++ {
+			g.start(func() { wait.Until(c.runWorker, time.Second, stopCh) })
+		}
+	}
+	g.wait()
+}
+
+// Handles the event where a namespace is added or deleted.
+func (c *RootCertController) nsChanged(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Failed to get the key of %v (error: %v)", obj, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Handles the event where a namespace is updated. Only the labels of a
+// namespace affect whether it gets the ConfigMap.
+func (c *RootCertController) nsUpdated(oldObj, curObj interface{}) {
+	oldNs, ok := oldObj.(*v1.Namespace)
+	if ok && reflect.DeepEqual(oldNs.Labels, curObj.(*v1.Namespace).Labels) {
+		return
+	}
+	c.nsChanged(curObj)
+}
+
+// Handles the events of the ConfigMaps, so that a ConfigMap that is deleted or
+// modified is restored, and an outdated one is updated on re-sync.
+func (c *RootCertController) cmChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		glog.Warningf("Failed to convert to ConfigMap object: %v", obj)
+		return
+	}
+	c.queue.Add(cm.Namespace)
+}
+
+func (c *RootCertController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+// processNextItem reconciles the next namespace in the work queue, and returns
+// false when the queue is shut down. A failed reconciliation is retried with
+// exponential backoff.
+func (c *RootCertController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(key.(string)); err != nil {
+		glog.Errorf("Failed to reconcile the root certificate ConfigMap in namespace %s, retrying (error: %v)",
+			key, err)
+		reconcileErrors.Inc()
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile makes the ConfigMap in the namespace match the desired state: the
+// ConfigMap exists with the current root certificate if and only if the
+// namespace exists and is selected.
+func (c *RootCertController) reconcile(namespace string) error {
+	obj, nsExists, err := c.nsStore.GetByKey(namespace)
+	if err != nil {
+		return err
+	}
+	wanted := false
+	if nsExists {
+		ns := obj.(*v1.Namespace)
+		wanted = ns.Status.Phase != v1.NamespaceTerminating && c.selector.SelectsNamespace(ns)
+	}
+	obj, cmExists, err := c.cmStore.GetByKey(namespace + "/" + RootCertConfigMapName)
+	if err != nil {
+		return err
+	}
+
+	configMaps := c.core.ConfigMaps(namespace)
+	rootCert := c.ca.GetRootCertificate()
+	switch {
+	case !wanted && cmExists:
+		if obj.(*v1.ConfigMap).Labels[managedByLabelKey] != managedByLabelValue {
+			return nil
+		}
+		if err := configMaps.Delete(RootCertConfigMapName, nil); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete ConfigMap %s/%s (error: %v)", namespace, RootCertConfigMapName, err)
+		}
+		glog.Infof("Root certificate ConfigMap in namespace %q has been deleted", namespace)
+	case wanted && !cmExists:
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:    map[string]string{managedByLabelKey: managedByLabelValue},
+				Name:      RootCertConfigMapName,
+				Namespace: namespace,
+			},
+			Data: map[string]string{RootCertID: string(rootCert)},
+		}
+		if _, err := configMaps.Create(cm); err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create ConfigMap %s/%s (error: %v)", namespace, RootCertConfigMapName, err)
+		}
+		rootCertConfigMapsWritten.Inc()
+		glog.Infof("Root certificate ConfigMap in namespace %q has been created", namespace)
+	case wanted && cmExists:
+		cm := obj.(*v1.ConfigMap)
+		if bytes.Equal([]byte(cm.Data[RootCertID]), rootCert) && cm.Labels[managedByLabelKey] == managedByLabelValue {
+			return nil
+		}
+		// The ConfigMap is owned by the cache, so it is copied before the update.
+		updated := &v1.ConfigMap{
+			ObjectMeta: cm.ObjectMeta,
+			Data:       map[string]string{RootCertID: string(rootCert)},
+		}
+		updated.Labels = make(map[string]string, len(cm.Labels)+1)
+		for k, v := range cm.Labels {
+			updated.Labels[k] = v
+		}
+		updated.Labels[managedByLabelKey] = managedByLabelValue
+		if _, err := configMaps.Update(updated); err != nil {
+			return fmt.Errorf("failed to update ConfigMap %s/%s (error: %v)", namespace, RootCertConfigMapName, err)
+		}
+		rootCertConfigMapsWritten.Inc()
+		glog.Infof("Root certificate ConfigMap in namespace %q has been updated", namespace)
+	}
+	return nil
+}
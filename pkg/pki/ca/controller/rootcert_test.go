@@ -0,0 +1,179 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func createRootCertConfigMap(rootCert string, managed bool) *v1.ConfigMap {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: RootCertConfigMapName, Namespace: "test-ns"},
+		Data:       map[string]string{RootCertID: rootCert},
+	}
+	if managed {
+		cm.Labels = map[string]string{managedByLabelKey: managedByLabelValue}
+	}
+	return cm
+}
+
+func TestRootCertController(t *testing.T) {
+	gvr := schema.GroupVersionResource{
+		Resource: "configmaps",
+		Version:  "v1",
+	}
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns"}}
+	terminatingNs := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ns"},
+		Status:     v1.NamespaceStatus{Phase: v1.NamespaceTerminating},
+	}
+	excluding := &Selector{ExcludeNamespaces: []string{"test-ns"}}
+
+	testCases := map[string]struct {
+		selector        *Selector
+		ns              *v1.Namespace
+		cm              *v1.ConfigMap
+		expectedActions []ktesting.Action
+	}{
+		"Create ConfigMap": {
+			ns: ns,
+			expectedActions: []ktesting.Action{
+				ktesting.NewCreateAction(gvr, "test-ns", createRootCertConfigMap("fake root cert", true)),
+			},
+		},
+		"Up-to-date ConfigMap": {
+			ns:              ns,
+			cm:              createRootCertConfigMap("fake root cert", true),
+			expectedActions: []ktesting.Action{},
+		},
+		"Update outdated ConfigMap": {
+			ns: ns,
+			cm: createRootCertConfigMap("outdated root cert", true),
+			expectedActions: []ktesting.Action{
+				ktesting.NewUpdateAction(gvr, "test-ns", createRootCertConfigMap("fake root cert", true)),
+			},
+		},
+		"Delete ConfigMap of excluded namespace": {
+			selector: excluding,
+			ns:       ns,
+			cm:       createRootCertConfigMap("fake root cert", true),
+			expectedActions: []ktesting.Action{
+				ktesting.NewDeleteAction(gvr, "test-ns", RootCertConfigMapName),
+			},
+		},
+		"Keep unmanaged ConfigMap of excluded namespace": {
+			selector:        excluding,
+			ns:              ns,
+			cm:              createRootCertConfigMap("other cert", false),
+			expectedActions: []ktesting.Action{},
+		},
+		"Deleted namespace": {
+			expectedActions: []ktesting.Action{},
+		},
+		"Terminating namespace": {
+			ns:              terminatingNs,
+			expectedActions: []ktesting.Action{},
+		},
+	}
+
+	for id, c := range testCases {
+		client := fake.NewSimpleClientset()
+		if c.cm != nil {
+			client = fake.NewSimpleClientset(c.cm)
+		}
+		controller := NewRootCertController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll, c.selector)
+		if c.ns != nil {
+			if err := controller.nsStore.Add(c.ns); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.cm != nil {
+			if err := controller.cmStore.Add(c.cm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := controller.reconcile("test-ns"); err != nil {
+			t.Errorf("Case %q: unexpected error: %v", id, err)
+			continue
+		}
+		if err := checkActions(client.Actions(), c.expectedActions); err != nil {
+			t.Errorf("Case %q: %s", id, err.Error())
+		}
+	}
+}
+
+func TestRootCertControllerRecreatesDeletedConfigMap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	controller := NewRootCertController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll, nil)
+	if err := controller.nsStore.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	controller.cmChanged(createRootCertConfigMap("fake root cert", true))
+	for controller.queue.Len() > 0 {
+		controller.processNextItem()
+	}
+
+	actions := client.Actions()
+	if len(actions) != 1 || !actions[0].Matches("create", "configmaps") {
+		t.Fatalf("Expecting the ConfigMap to be re-created but got %v", actions)
+	}
+	cm := actions[0].(ktesting.CreateAction).GetObject().(*v1.ConfigMap)
+	if cm.Data[RootCertID] != "fake root cert" {
+		t.Errorf("Unexpected root certificate %q", cm.Data[RootCertID])
+	}
+}
+
+func TestRootCertControllerRun(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns"}})
+	controller := NewRootCertController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll, nil)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		controller.Run(2, stopCh)
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		if _, err := client.CoreV1().ConfigMaps("test-ns").Get(RootCertConfigMapName, metav1.GetOptions{}); err == nil {
+			break
+		}
+		if i == 500 {
+			t.Fatal("Timed out waiting for the ConfigMap to be created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expecting Run to block until it is stopped")
+	default:
+	}
+
+	// Run returns once the workers have exited.
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Run to return")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"crypto/x509"
+	"hash/fnv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/pki"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// How long a rotation that is throttled by the rate limit waits before it
+	// is retried.
+	rotationRetryDelay = time.Second
+
+	// How often the rotation progress is reported.
+	rotationProgressPeriod = 10 * time.Second
+)
+
+// RotationOptions are the options of the rotation of the certificates in the
+// Istio secrets. The zero value rotates a certificate only when it is about to
+// expire, without a rate limit.
+type RotationOptions struct {
+	// The fraction of the lifetime of a certificate after which it is rotated,
+	// e.g. 0.7. If zero, a certificate is rotated when it is about to expire.
+	RenewalRatio float64
+	// The maximum fraction of the lifetime of a certificate by which its
+	// rotation is brought forward, so that the certificates issued at the same
+	// time are not rotated at the same time. Each secret gets a stable random
+	// fraction between zero and RenewalJitter.
+	RenewalJitter float64
+	// The maximum number of rotations per second, with bursts of up to
+	// RotationBurst. If zero, the rotations are not rate limited. The
+	// certificates that are about to expire are rotated regardless of the
+	// limit.
+	RotationQPS   float32
+	RotationBurst int
+}
+
+// RotationProgress is the progress of the rotation of the certificates in the
+// Istio secrets, e.g. after the root certificate is changed.
+type RotationProgress struct {
+	// The number of Istio secrets.
+	Secrets int
+	// The number of Istio secrets whose root certificate is not the current
+	// one.
+	OutdatedRoot int
+	// The number of Istio secrets that are due for rotation, including the
+	// ones with an outdated root certificate.
+	Due int
+}
+
+// rotationPolicy decides when the certificates are rotated.
+type rotationPolicy struct {
+	opts    RotationOptions
+	limiter flowcontrol.RateLimiter
+}
+
+func newRotationPolicy(opts RotationOptions) *rotationPolicy {
+	p := &rotationPolicy{opts: opts}
+	if opts.RotationQPS > 0 {
+		burst := opts.RotationBurst
+		if burst < 1 {
+			burst = 1
+		}
+		p.limiter = flowcontrol.NewTokenBucketRateLimiter(opts.RotationQPS, burst)
+	}
+	return p
+}
+
+// renewalTime returns when the certificate in the secret is due for rotation.
+func (p *rotationPolicy) renewalTime(scrt *v1.Secret, cert *x509.Certificate) time.Time {
+	// A certificate is always rotated when it is about to expire, because the
+	// secret may not be checked again before it expires.
+	latest := cert.NotAfter.Add(-secretResyncPeriod)
+	if p.opts.RenewalRatio <= 0 || p.opts.RenewalRatio >= 1 {
+		return latest
+	}
+
+	ratio := p.opts.RenewalRatio - p.opts.RenewalJitter*jitterFraction(scrt, cert)
+	if ratio < 0 {
+		ratio = 0
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewal := cert.NotBefore.Add(time.Duration(float64(lifetime) * ratio))
+	if renewal.After(latest) {
+		return latest
+	}
+	return renewal
+}
+
+// urgent returns whether the certificate is about to expire, so that it is
+// rotated regardless of the rate limit.
+func (p *rotationPolicy) urgent(cert *x509.Certificate) bool {
+	return time.Until(cert.NotAfter) < secretResyncPeriod
+}
+
+// tryAccept returns whether a rotation is allowed by the rate limit now.
+func (p *rotationPolicy) tryAccept() bool {
+	return p.limiter == nil || p.limiter.TryAccept()
+}
+
+// jitterFraction returns a fraction in [0, 1) that is stable for the same
+// certificate in the same secret, and spread across the secrets.
+func jitterFraction(scrt *v1.Secret, cert *x509.Certificate) float64 {
+	h := fnv.New64a()
+	// Writes to a hash never fail.
+	_, _ = h.Write([]byte(scrt.Namespace + "/" + scrt.Name + "/" + cert.SerialNumber.String()))
+	// The top 53 bits are exactly representable in a float64.
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// RotationProgress returns the progress of the rotation of the certificates in
+// the Istio secrets.
+func (sc *SecretController) RotationProgress() RotationProgress {
+	var progress RotationProgress
+	rootCert := sc.ca.GetRootCertificate()
+	now := time.Now()
+	for _, obj := range sc.scrtStore.List() {
+		scrt, ok := obj.(*v1.Secret)
+		if !ok {
+			continue
+		}
+		progress.Secrets++
+		outdated := !bytes.Equal(rootCert, scrt.Data[RootCertID])
+		if outdated {
+			progress.OutdatedRoot++
+		}
+		cert, err := pki.ParsePemEncodedCertificate(scrt.Data[CertChainID])
+		if outdated || err != nil || !now.Before(sc.rotation.renewalTime(scrt, cert)) {
+			progress.Due++
+		}
+	}
+	return progress
+}
+
+// reportRotationProgress exports the rotation progress as metrics, and logs it
+// while the secrets are moved to a new root certificate.
+func (sc *SecretController) reportRotationProgress() {
+	progress := sc.RotationProgress()
+	secretsGauge.Set(float64(progress.Secrets))
+	secretsOutdatedRootGauge.Set(float64(progress.OutdatedRoot))
+	secretsDueGauge.Set(float64(progress.Due))
+
+	if progress.OutdatedRoot > 0 {
+		glog.Infof("Rotating to the current root certificate: %d of %d Istio secrets are updated",
+			progress.Secrets-progress.OutdatedRoot, progress.Secrets)
+	}
+}
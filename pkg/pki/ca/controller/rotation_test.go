@@ -0,0 +1,154 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(100 * time.Hour),
+		SerialNumber: big.NewInt(1),
+	}
+	scrt := createSecret("test", "istio.test", "test-ns")
+
+	testCases := map[string]struct {
+		opts RotationOptions
+		// The earliest and the latest expected renewal time, relative to
+		// notBefore.
+		earliest time.Duration
+		latest   time.Duration
+	}{
+		"Default": {
+			earliest: 100*time.Hour - secretResyncPeriod,
+			latest:   100*time.Hour - secretResyncPeriod,
+		},
+		"Renewal ratio": {
+			opts:     RotationOptions{RenewalRatio: 0.75},
+			earliest: 75 * time.Hour,
+			latest:   75 * time.Hour,
+		},
+		"Renewal ratio with jitter": {
+			opts:     RotationOptions{RenewalRatio: 0.75, RenewalJitter: 0.25},
+			earliest: 50 * time.Hour,
+			latest:   75 * time.Hour,
+		},
+		"Jitter larger than renewal ratio": {
+			opts:     RotationOptions{RenewalRatio: 0.25, RenewalJitter: 1},
+			earliest: 0,
+			latest:   25 * time.Hour,
+		},
+	}
+
+	for id, c := range testCases {
+		p := newRotationPolicy(c.opts)
+		renewal := p.renewalTime(scrt, cert)
+		if renewal.Before(notBefore.Add(c.earliest)) || renewal.After(notBefore.Add(c.latest)) {
+			t.Errorf("Case %s: expecting the renewal time between %v and %v but got %v",
+				id, notBefore.Add(c.earliest), notBefore.Add(c.latest), renewal)
+		}
+		if again := p.renewalTime(scrt, cert); !again.Equal(renewal) {
+			t.Errorf("Case %s: expecting a stable renewal time %v but got %v", id, renewal, again)
+		}
+	}
+}
+
+func TestRenewalJitterIsSpread(t *testing.T) {
+	notBefore := time.Now()
+	cert := &x509.Certificate{
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(time.Hour),
+		SerialNumber: big.NewInt(1),
+	}
+	p := newRotationPolicy(RotationOptions{RenewalRatio: 0.7, RenewalJitter: 0.2})
+	renewals := make(map[time.Time]bool)
+	for i := 0; i < 10; i++ {
+		scrt := createSecret(fmt.Sprintf("sa-%d", i), fmt.Sprintf("istio.sa-%d", i), "test-ns")
+		renewals[p.renewalTime(scrt, cert)] = true
+	}
+	if len(renewals) < 5 {
+		t.Errorf("Expecting the renewal times of 10 secrets to be spread but got %d distinct times", len(renewals))
+	}
+}
+
+func TestRotationRateLimit(t *testing.T) {
+	validCert, _ := ca.GenCert(ca.CertOptions{
+		IsSelfSigned: true,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		RSAKeySize:   512,
+	})
+	expiringCert, _ := ca.GenCert(ca.CertOptions{
+		IsSelfSigned: true,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Second),
+		RSAKeySize:   512,
+	})
+	// All the secrets have an outdated root certificate, and the last one is
+	// also about to expire.
+	var secrets []*v1.Secret
+	for i, chain := range [][]byte{validCert, validCert, expiringCert} {
+		name := fmt.Sprintf("sa-%d", i)
+		scrt := createSecret(name, "istio."+name, "test-ns")
+		scrt.Data[CertChainID] = chain
+		scrt.Data[RootCertID] = []byte("outdated root cert")
+		secrets = append(secrets, scrt)
+	}
+	client := fake.NewSimpleClientset(secrets[0], secrets[1], secrets[2])
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{
+		Rotation: RotationOptions{RotationQPS: 0.001, RotationBurst: 1},
+	})
+	for _, scrt := range secrets {
+		addServiceAccount(t, controller, createServiceAccount(scrt.Annotations[serviceAccountNameAnnotationKey], "test-ns"))
+		if err := controller.scrtStore.Add(scrt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := RotationProgress{Secrets: 3, OutdatedRoot: 3, Due: 3}
+	if progress := controller.RotationProgress(); progress != expected {
+		t.Errorf("Expecting progress %+v but got %+v", expected, progress)
+	}
+
+	// Only one of the secrets with a valid certificate is rotated within the
+	// burst, while the expiring one is rotated regardless of the rate limit.
+	for i := 0; i < 3; i++ {
+		if err := controller.reconcile(fmt.Sprintf("test-ns/sa-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var updated []string
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			updated = append(updated, action.(ktesting.UpdateAction).GetObject().(*v1.Secret).Name)
+		}
+	}
+	if fmt.Sprint(updated) != "[istio.sa-0 istio.sa-2]" {
+		t.Errorf("Expecting istio.sa-0 and istio.sa-2 to be rotated but got %v", updated)
+	}
+}
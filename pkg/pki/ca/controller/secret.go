@@ -18,10 +18,14 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
+	"istio.io/auth/pkg/audit"
+	"istio.io/auth/pkg/kms"
 	"istio.io/auth/pkg/pki"
 	"istio.io/auth/pkg/pki/ca"
 
@@ -29,10 +33,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 /* #nosec: disable gas linter */
@@ -54,30 +61,113 @@ const (
 
 	// The size of a private key for a leaf certificate.
 	keySize = 1024
+
+	// The reason of the event recorded when a certificate annotation of a
+	// service account is rejected.
+	invalidCertAnnotationReason = "InvalidCertAnnotation"
 )
 
+// SecretControllerOptions are the options of a SecretController.
+type SecretControllerOptions struct {
+	// The namespace whose service accounts are watched, or metav1.NamespaceAll.
+	Namespace string
+	// The service accounts that get Istio secrets. If nil, all the service
+	// accounts get Istio secrets.
+	Selector *Selector
+	// The policy of the certificate annotations of the service accounts. If
+	// nil, the annotations are rejected.
+	CertPolicy *CertPolicy
+	// The recorder of the Kubernetes events. If nil, the events are discarded.
+	EventRecorder record.EventRecorder
+	// When and how fast the certificates are rotated.
+	Rotation RotationOptions
+	// The output formats of the Istio secrets in each namespace, as returned by
+	// ParseOutputFormats. They are overridden by OutputFormatsAnnotationKey.
+	OutputFormats map[string][]string
+	// The sink of the audit events of the issued certificates. If nil, the
+	// audit events are discarded.
+	AuditSink audit.Sink
+	// How often the Istio secrets are checked for orphaned and invalid
+	// certificates. If zero, the secrets are not checked.
+	AuditPeriod time.Duration
+	// The KMS that seals the private keys and the keystore passwords in the
+	// Istio secrets with envelope encryption. If nil, they are not encrypted.
+	KMS kms.KMS
+}
+
 // SecretController manages the service accounts' secrets that contains Istio keys and certificates.
 type SecretController struct {
 	ca   ca.CertificateAuthority
 	core corev1.CoreV1Interface
 
-	// Controller and store for service account objects.
+	// The service accounts that get Istio secrets.
+	selector *Selector
+
+	// The policy of the certificate annotations of the service accounts.
+	certPolicy *CertPolicy
+
+	// The recorder of the Kubernetes events.
+	recorder record.EventRecorder
+
+	// When and how fast the certificates are rotated.
+	rotation *rotationPolicy
+
+	// The output formats of the Istio secrets in each namespace.
+	outputFormats map[string][]string
+
+	// The sink of the audit events of the issued certificates.
+	auditSink audit.Sink
+
+	// How often the Istio secrets are checked, and the keys of the service
+	// accounts whose certificates failed the check and are re-issued.
+	auditPeriod time.Duration
+	repairs     map[string]bool
+	repairsLock sync.Mutex
+
+	// The KMS that seals the private keys, or nil.
+	kms kms.KMS
+
+	// Controller and store for service account objects, indexed by namespace.
 	saController cache.Controller
-	saStore      cache.Store
+	saStore      cache.Indexer
+
+	// Controller and store for namespace objects. They are nil unless the
+	// namespaces are selected by their labels.
+	nsController cache.Controller
+	nsStore      cache.Store
 
 	// Controller and store for secret objects.
 	scrtController cache.Controller
 	scrtStore      cache.Store
+
+	// The keys of the service accounts whose secrets need reconciliation.
+	queue workqueue.RateLimitingInterface
 }
 
 // NewSecretController returns a pointer to a newly constructed SecretController instance.
 func NewSecretController(ca ca.CertificateAuthority, core corev1.CoreV1Interface,
-	namespace string) *SecretController {
+	opts SecretControllerOptions) *SecretController {
 
+	recorder := opts.EventRecorder
+	if recorder == nil {
+		recorder = &record.FakeRecorder{}
+	}
 	c := &SecretController{
-		ca:   ca,
-		core: core,
+		ca:            ca,
+		core:          core,
+		selector:      opts.Selector,
+		certPolicy:    opts.CertPolicy,
+		recorder:      recorder,
+		rotation:      newRotationPolicy(opts.Rotation),
+		outputFormats: opts.OutputFormats,
+		auditSink:     opts.AuditSink,
+		auditPeriod:   opts.AuditPeriod,
+		repairs:       map[string]bool{},
+		kms:           opts.KMS,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "secrets"),
 	}
+	namespace := opts.Namespace
+	selector := opts.Selector
 
 	saLW := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
@@ -92,7 +182,25 @@ func NewSecretController(ca ca.CertificateAuthority, core corev1.CoreV1Interface
 		DeleteFunc: c.saDeleted,
 		UpdateFunc: c.saUpdated,
 	}
-	c.saStore, c.saController = cache.NewInformer(saLW, &v1.ServiceAccount{}, time.Minute, rehf)
+	c.saStore, c.saController = cache.NewIndexerInformer(saLW, &v1.ServiceAccount{}, time.Minute, rehf,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+	if selector.watchesNamespaces() {
+		nsLW := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return core.Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return core.Namespaces().Watch(options)
+			},
+		}
+		c.nsStore, c.nsController = cache.NewInformer(nsLW, &v1.Namespace{}, time.Minute,
+			cache.ResourceEventHandlerFuncs{
+				AddFunc:    c.nsChanged,
+				DeleteFunc: c.nsChanged,
+				UpdateFunc: c.nsUpdated,
+			})
+	}
 
 	istioSecretSelector := fields.SelectorFromSet(map[string]string{"type": IstioSecretType}).String()
 	scrtLW := &cache.ListWatch{
@@ -107,6 +215,7 @@ func NewSecretController(ca ca.CertificateAuthority, core corev1.CoreV1Interface
 	}
 	c.scrtStore, c.scrtController =
 		cache.NewInformer(scrtLW, &v1.Secret{}, secretResyncPeriod, cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.scrtAdded,
 			DeleteFunc: c.scrtDeleted,
 			UpdateFunc: c.scrtUpdated,
 		})
@@ -114,22 +223,49 @@ func NewSecretController(ca ca.CertificateAuthority, core corev1.CoreV1Interface
 	return c
 }
 
-// Run starts the SecretController until stopCh is closed.
-func (sc *SecretController) Run(stopCh chan struct{}) {
+// Run runs the SecretController until stopCh is closed. The service accounts
+// are reconciled by the given number of workers once the caches are synced.
+// It returns once the workers have exited, so that no reconciliation is in
+// progress after it returns. The informers only fill the caches and the queue,
+// and are not waited for, since they do not return until a change is observed
+// after stopCh is closed.
+func (sc *SecretController) Run(workers int, stopCh <-chan struct{}) {
 	go sc.scrtController.Run(stopCh)
 	go sc.saController.Run(stopCh)
+	synced := []cache.InformerSynced{sc.saController.HasSynced, sc.scrtController.HasSynced}
+	if sc.nsController != nil {
+		go sc.nsController.Run(stopCh)
+		synced = append(synced, sc.nsController.HasSynced)
+	}
+
+	go func() {
+		<-stopCh
+		sc.queue.ShutDown()
+	}()
+
+	// The stores must be complete before reconciliation, otherwise the secrets
+	// of the service accounts that are not listed yet are deleted.
+	var g goroutineGroup
+	if cache.WaitForCacheSync(stopCh, synced...) {
+		for i := 0; i < workers; i++ {
+			g.start(func() { wait.Until(sc.runWorker, time.Second, stopCh) })
+		}
+		g.start(func() { wait.Until(sc.reportRotationProgress, rotationProgressPeriod, stopCh) })
+		if sc.auditPeriod > 0 {
+			g.start(func() { wait.Until(sc.auditSecrets, sc.auditPeriod, stopCh) })
+		}
+	}
+	g.wait()
 }
 
 // Handles the event where a service account is added.
 func (sc *SecretController) saAdded(obj interface{}) {
-	acct := obj.(*v1.ServiceAccount)
-	sc.upsertSecret(acct.GetName(), acct.GetNamespace())
+	sc.enqueue(obj)
 }
 
 // Handles the event where a service account is deleted.
 func (sc *SecretController) saDeleted(obj interface{}) {
-	acct := obj.(*v1.ServiceAccount)
-	sc.deleteSecret(acct.GetName(), acct.GetNamespace())
+	sc.enqueue(obj)
 }
 
 // Handles the event where a service account is updated.
@@ -138,160 +274,478 @@ func (sc *SecretController) saUpdated(oldObj, curObj interface{}) {
 		// Nothing is changed. The method is invoked by periodical re-sync with the apiserver.
 		return
 	}
-	oldSa := oldObj.(*v1.ServiceAccount)
-	curSa := curObj.(*v1.ServiceAccount)
+	// The key of the work queue is the name and namespace of a service account.
+	// Changes of its labels and annotations may change whether it is selected
+	// and the spec of its certificate, which are checked by the reconciliation.
+	sc.enqueue(oldObj)
+	sc.enqueue(curObj)
+}
 
-	curName := curSa.GetName()
-	curNamespace := curSa.GetNamespace()
-	oldName := oldSa.GetName()
-	oldNamespace := oldSa.GetNamespace()
+// Handles the event where a namespace is added or deleted, so that the service
+// accounts in it are selected again.
+func (sc *SecretController) nsChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		glog.Warningf("Failed to convert to namespace object: %v", obj)
+		return
+	}
+	sas, err := sc.saStore.ByIndex(cache.NamespaceIndex, ns.Name)
+	if err != nil {
+		glog.Errorf("Failed to list the service accounts in namespace %q (error: %v)", ns.Name, err)
+		return
+	}
+	for _, sa := range sas {
+		sc.enqueue(sa)
+	}
+}
 
-	// We only care the name and namespace of a service account.
-	if curName != oldName || curNamespace != oldNamespace {
-		sc.deleteSecret(oldName, oldNamespace)
-		sc.upsertSecret(curName, curNamespace)
+// Handles the event where a namespace is updated. Only the labels of a
+// namespace affect the selection of the service accounts.
+func (sc *SecretController) nsUpdated(oldObj, curObj interface{}) {
+	oldNs, ok := oldObj.(*v1.Namespace)
+	if ok && reflect.DeepEqual(oldNs.Labels, curObj.(*v1.Namespace).Labels) {
+		return
+	}
+	sc.nsChanged(curObj)
+}
 
-		glog.Infof("Service account \"%s\" in namespace \"%s\" has been updated to \"%s\" in namespace \"%s\"",
-			oldName, oldNamespace, curName, curNamespace)
+// Handles the event where an Istio secret is listed or created, so that the
+// secrets of the service accounts that are not selected are cleaned up.
+func (sc *SecretController) scrtAdded(obj interface{}) {
+	scrt, ok := obj.(*v1.Secret)
+	if !ok {
+		glog.Warningf("Failed to convert to secret object: %v", obj)
+		return
 	}
+	sc.enqueueSecret(scrt)
 }
 
-func (sc *SecretController) upsertSecret(saName, saNamespace string) {
-	secret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Annotations: map[string]string{serviceAccountNameAnnotationKey: saName},
-			Name:        getSecretName(saName),
-			Namespace:   saNamespace,
-		},
-		Type: IstioSecretType,
+// Handles the event where an Istio secret is deleted, so that it is re-created
+// if the service account still exists.
+func (sc *SecretController) scrtDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
 	}
+	scrt, ok := obj.(*v1.Secret)
+	if !ok {
+		glog.Warningf("Failed to convert to secret object: %v", obj)
+		return
+	}
+	sc.enqueueSecret(scrt)
+}
 
-	_, exists, err := sc.scrtStore.Get(secret)
+// Handles the event where an Istio secret is updated or re-synced, so that it
+// is refreshed if needed.
+func (sc *SecretController) scrtUpdated(oldObj, newObj interface{}) {
+	scrt, ok := newObj.(*v1.Secret)
+	if !ok {
+		glog.Warningf("Failed to convert to secret object: %v", newObj)
+		return
+	}
+	sc.enqueueSecret(scrt)
+}
+
+// enqueue adds the key of a service account to the work queue. Duplicate keys
+// that are not processed yet are coalesced by the queue.
+func (sc *SecretController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
-		glog.Errorf("Failed to get secret from the store (error %v)", err)
+		glog.Errorf("Failed to get the key of %v (error: %v)", obj, err)
+		return
 	}
+	sc.queue.Add(key)
+}
 
-	if exists {
-		// Do nothing for existing secrets. Rotating expiring certs are handled by the `scrtUpdated` method.
+// enqueueSecret adds the key of the service account of an Istio secret to the
+// work queue.
+func (sc *SecretController) enqueueSecret(scrt *v1.Secret) {
+	saName := scrt.Annotations[serviceAccountNameAnnotationKey]
+	if saName == "" {
+		glog.Warningf("Istio secret %s/%s is not annotated with its service account", scrt.Namespace, scrt.Name)
 		return
 	}
+	sc.queue.Add(scrt.GetNamespace() + "/" + saName)
+}
+
+func (sc *SecretController) runWorker() {
+	for sc.processNextItem() {
+	}
+}
+
+// processNextItem reconciles the next service account in the work queue, and
+// returns false when the queue is shut down. A failed reconciliation is retried
+// with exponential backoff.
+func (sc *SecretController) processNextItem() bool {
+	key, quit := sc.queue.Get()
+	if quit {
+		return false
+	}
+	defer sc.queue.Done(key)
+
+	if err := sc.reconcile(key.(string)); err != nil {
+		glog.Errorf("Failed to reconcile the Istio secret of service account %s, retrying (error: %v)", key, err)
+		reconcileErrors.Inc()
+		sc.queue.AddRateLimited(key)
+		return true
+	}
+	sc.queue.Forget(key)
+	return true
+}
 
-	// Now we know the secret does not exist yet. So we create a new one.
-	chain, key, err := sc.generateKeyAndCert(saName, saNamespace)
+// reconcile makes the Istio secret of the service account with the given key
+// match the desired state: the secret exists with a valid certificate if and
+// only if the service account exists and is selected.
+func (sc *SecretController) reconcile(key string) error {
+	saNamespace, saName, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
-		glog.Errorf("Failed to generate key and certificate for service account %q in namespace %q (error %v)",
-			saName, saNamespace, err)
+		// The key is malformed, so retrying does not help.
+		glog.Errorf("Invalid key %q (error: %v)", key, err)
+		return nil
+	}
 
-		return
+	obj, saExists, err := sc.saStore.GetByKey(key)
+	if err != nil {
+		return err
 	}
-	rootCert := sc.ca.GetRootCertificate()
-	secret.Data = map[string][]byte{
-		CertChainID:  chain,
-		PrivateKeyID: key,
-		RootCertID:   rootCert,
+	var sa *v1.ServiceAccount
+	wanted := false
+	if saExists {
+		sa = obj.(*v1.ServiceAccount)
+		if wanted, err = sc.selected(sa); err != nil {
+			return err
+		}
 	}
-	_, err = sc.core.Secrets(saNamespace).Create(secret)
+	obj, scrtExists, err := sc.scrtStore.GetByKey(saNamespace + "/" + getSecretName(saName))
 	if err != nil {
-		glog.Errorf("Failed to create secret (error: %s)", err)
-		return
+		return err
 	}
 
-	glog.Infof("Istio secret for service account \"%s\" in namespace \"%s\" has been created", saName, saNamespace)
+	repair := sc.takeRepair(key)
+	switch {
+	case !wanted && scrtExists:
+		return sc.deleteSecret(obj.(*v1.Secret))
+	case wanted && !scrtExists:
+		return sc.createSecret(sa)
+	case wanted && scrtExists:
+		if err := sc.refreshSecret(sa, obj.(*v1.Secret), repair); err != nil {
+			if repair {
+				sc.markRepair(key)
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-func (sc *SecretController) deleteSecret(saName, saNamespace string) {
-	err := sc.core.Secrets(saNamespace).Delete(getSecretName(saName), nil)
-	// kube-apiserver returns NotFound error when the secret is successfully deleted.
-	if err == nil || errors.IsNotFound(err) {
-		glog.Infof("Istio secret for service account \"%s\" in namespace \"%s\" has been deleted", saName, saNamespace)
-		return
+// getCertSpec returns the spec of the certificate of the service account, and
+// records an event for each rejected annotation.
+func (sc *SecretController) getCertSpec(sa *v1.ServiceAccount) certSpec {
+	spec, errs := sc.certPolicy.getCertSpec(sa)
+	for _, err := range errs {
+		glog.Warningf("Invalid certificate annotation of service account %s/%s (error: %v)",
+			sa.Namespace, sa.Name, err)
+		sc.recorder.Event(sa, v1.EventTypeWarning, invalidCertAnnotationReason, err.Error())
 	}
+	return spec
+}
 
-	glog.Errorf("Failed to delete Istio secret for service account \"%s\" in namespace \"%s\" (error: %s)",
-		saName, saNamespace, err)
+// selected returns whether the service account gets an Istio secret.
+func (sc *SecretController) selected(sa *v1.ServiceAccount) (bool, error) {
+	var ns *v1.Namespace
+	if sc.nsStore != nil {
+		obj, exists, err := sc.nsStore.GetByKey(sa.Namespace)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			ns = obj.(*v1.Namespace)
+		}
+	}
+	return sc.selector.selects(sa, ns), nil
 }
 
-func (sc *SecretController) scrtDeleted(obj interface{}) {
-	scrt, ok := obj.(*v1.Secret)
-	if !ok {
-		glog.Warning("Failed to convert to secret object: %v", obj)
-		return
+func (sc *SecretController) createSecret(sa *v1.ServiceAccount) error {
+	saName, saNamespace := sa.Name, sa.Namespace
+	spec := sc.getCertSpec(sa)
+	chain, key, err := sc.generateKeyAndCert(saName, saNamespace, spec)
+	sc.recordIssuance(saName, saNamespace, "secret created", chain, err)
+	if err != nil {
+		err = fmt.Errorf("failed to generate key and certificate for service account %q in namespace %q (error %v)",
+			saName, saNamespace, err)
+		sc.recorder.Event(sa, v1.EventTypeWarning, certIssueFailedReason, err.Error())
+		return err
 	}
 
-	glog.Infof("Re-create deleted Istio secret")
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{serviceAccountNameAnnotationKey: saName},
+			Name:        getSecretName(saName),
+			Namespace:   saNamespace,
+		},
+		Data: map[string][]byte{
+			CertChainID:  chain,
+			PrivateKeyID: key,
+			RootCertID:   sc.ca.GetRootCertificate(),
+		},
+		Type: IstioSecretType,
+	}
+	if specString := spec.String(); specString != "" {
+		secret.Annotations[certSpecAnnotationKey] = specString
+	}
+	sc.setStatusAnnotations(secret)
+	if err := sc.writeOutputs(sa, secret, nil); err != nil {
+		return err
+	}
+	created, err := sc.core.Secrets(saNamespace).Create(secret)
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to create secret (error: %s)", err)
+		sc.recorder.Event(sa, v1.EventTypeWarning, secretCreateFailedReason, err.Error())
+		return err
+	}
 
-	saName := scrt.Annotations[serviceAccountNameAnnotationKey]
-	sc.upsertSecret(saName, scrt.GetNamespace())
+	secretsCreated.Inc()
+	glog.Infof("Istio secret for service account \"%s\" in namespace \"%s\" has been created", saName, saNamespace)
+	message := fmt.Sprintf("Issued the certificate in secret %s, expiring at %s",
+		secret.Name, secret.Annotations[ExpiryAnnotationKey])
+	sc.recordEvent(sa, created, v1.EventTypeNormal, certIssuedReason, message)
+	return nil
 }
 
-func (sc *SecretController) generateKeyAndCert(saName string, saNamespace string) ([]byte, []byte, error) {
-	id := fmt.Sprintf("%s://cluster.local/ns/%s/sa/%s", ca.URIScheme, saNamespace, saName)
-	options := ca.CertOptions{
-		Host:       id,
-		RSAKeySize: keySize,
+func (sc *SecretController) deleteSecret(scrt *v1.Secret) error {
+	saName, saNamespace := scrt.Annotations[serviceAccountNameAnnotationKey], scrt.Namespace
+	if contains(secretFormats(scrt), OutputFormatTLS) {
+		name := getTLSSecretName(saName)
+		if err := sc.core.Secrets(saNamespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete TLS secret %s/%s (error: %v)", saNamespace, name, err)
+		}
+	}
+	err := sc.core.Secrets(saNamespace).Delete(scrt.Name, nil)
+	// kube-apiserver returns NotFound error when the secret is successfully deleted.
+	if err == nil || errors.IsNotFound(err) {
+		secretsDeleted.Inc()
+		glog.Infof("Istio secret for service account \"%s\" in namespace \"%s\" has been deleted", saName, saNamespace)
+		return nil
 	}
 
-	csrPEM, keyPEM, err := ca.GenCSR(options)
+	return fmt.Errorf("failed to delete Istio secret for service account \"%s\" in namespace \"%s\" (error: %s)",
+		saName, saNamespace, err)
+}
+
+func (sc *SecretController) generateKeyAndCert(saName string, saNamespace string,
+	spec certSpec) ([]byte, []byte, error) {
+
+	csrPEM, keyPEM, err := ca.GenCSR(spec.certOptions(saName, saNamespace))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	certPEM, err := sc.ca.Sign(csrPEM)
+	certPEM, err := sc.ca.Sign(csrPEM, spec.ttl)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if sc.kms != nil {
+		if keyPEM, err = kms.Seal(sc.kms, keyPEM); err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt the private key (error: %v)", err)
+		}
+	}
 	return certPEM, keyPEM, nil
 }
 
-func (sc *SecretController) scrtUpdated(oldObj, newObj interface{}) {
-	scrt, ok := newObj.(*v1.Secret)
-	if !ok {
-		glog.Warning("Failed to convert to secret object: %v", newObj)
-		return
+// recordIssuance records the audit event of issuing a certificate for the
+// service account.
+func (sc *SecretController) recordIssuance(saName, saNamespace, reason string, chain []byte, err error) {
+	event := &audit.Event{
+		Source:       audit.SourceSecretController,
+		RequestedIDs: []string{getServiceAccountID(saName, saNamespace)},
+		Reason:       reason,
 	}
-
-	certBytes := scrt.Data[CertChainID]
-	cert, err := pki.ParsePemEncodedCertificate(certBytes)
 	if err != nil {
-		// TODO: we should refresh secret in this case since the secret contains an
-		// invalid cert.
-		glog.Error(err)
-		return
+		event.Decision = audit.Deny
+		event.Error = err.Error()
+	} else {
+		event.Decision = audit.Allow
+		event.Serial = audit.CertSerial(chain)
 	}
+	audit.Record(sc.auditSink, event)
+}
 
-	ttl := time.Until(cert.NotAfter)
+// refreshSecret refreshes the secret if 1) the certificate contained in the
+// secret is due for rotation, 2) the root certificate in the secret is
+// different than the one held by the ca (this may happen when the CA is
+// restarted and a new self-signed CA cert is generated), or 3) the certificate
+// annotations of the service account are changed. The refreshes are rate
+// limited unless the certificate is about to expire.
+func (sc *SecretController) refreshSecret(sa *v1.ServiceAccount, scrt *v1.Secret, repair bool) error {
+	namespace := scrt.GetNamespace()
+	name := scrt.GetName()
 	rootCertificate := sc.ca.GetRootCertificate()
+	spec := sc.getCertSpec(sa)
+	specString := spec.String()
+
+	if repair {
+		// The secret failed the audit, so its certificate is re-issued right
+		// away.
+		glog.Infof("Repairing secret %s/%s, which failed the audit", namespace, name)
+	} else {
+		cert, err := pki.ParsePemEncodedCertificate(scrt.Data[CertChainID])
+		if err != nil {
+			// The audit pass repairs the secret.
+			glog.Errorf("Failed to parse the certificate in secret %s/%s (error: %v)", namespace, name, err)
+			return nil
+		}
 
-	// Refresh the secret if 1) the certificate contained in the secret is about
-	// to expire, or 2) the root certificate in the secret is different than the
-	// one held by the ca (this may happen when the CA is restarted and
-	// a new self-signed CA cert is generated).
-	if ttl.Seconds() < secretResyncPeriod.Seconds() || !bytes.Equal(rootCertificate, scrt.Data[RootCertID]) {
-		namespace := scrt.GetNamespace()
-		name := scrt.GetName()
+		due := !time.Now().Before(sc.rotation.renewalTime(scrt, cert))
+		if !due && bytes.Equal(rootCertificate, scrt.Data[RootCertID]) &&
+			specString == scrt.Annotations[certSpecAnnotationKey] {
+			// The output formats are changed without re-issuing the certificate.
+			if strings.Join(sc.getOutputFormats(sa), ",") == strings.Join(secretFormats(scrt), ",") {
+				return nil
+			}
+			return sc.updateOutputs(sa, scrt)
+		}
 
-		glog.Infof("Refreshing secret %s/%s, either the leaf certificate is about to expire "+
-			"or the root certificate is outdated", namespace, name)
+		if !sc.rotation.urgent(cert) && !sc.rotation.tryAccept() {
+			rotationsThrottled.Inc()
+			sc.queue.AddAfter(sa.Namespace+"/"+sa.Name, rotationRetryDelay)
+			return nil
+		}
 
-		saName := scrt.Annotations[serviceAccountNameAnnotationKey]
+		glog.Infof("Refreshing secret %s/%s, either the leaf certificate is about to expire, "+
+			"the root certificate is outdated or the certificate annotations are changed", namespace, name)
+	}
 
-		chain, key, err := sc.generateKeyAndCert(saName, namespace)
-		if err != nil {
-			glog.Errorf("Failed to generate key and certificate for service account %q in namespace %q (error %v)",
-				saName, namespace, err)
+	saName := sa.Name
 
-			return
-		}
+	chain, key, err := sc.generateKeyAndCert(saName, namespace, spec)
+	sc.recordIssuance(saName, namespace, "secret refreshed", chain, err)
+	if err != nil {
+		err = fmt.Errorf("failed to generate key and certificate for service account %q in namespace %q (error %v)",
+			saName, namespace, err)
+		sc.recordEvent(sa, scrt, v1.EventTypeWarning, certIssueFailedReason, err.Error())
+		return err
+	}
 
-		scrt.Data[CertChainID] = chain
-		scrt.Data[PrivateKeyID] = key
-		scrt.Data[RootCertID] = rootCertificate
+	updated := copySecret(scrt)
+	if specString == "" {
+		delete(updated.Annotations, certSpecAnnotationKey)
+	} else {
+		updated.Annotations[certSpecAnnotationKey] = specString
+	}
+	updated.Data[CertChainID] = chain
+	updated.Data[PrivateKeyID] = key
+	updated.Data[RootCertID] = rootCertificate
+	sc.setStatusAnnotations(updated)
+	if err := sc.writeOutputs(sa, updated, secretFormats(scrt)); err != nil {
+		return err
+	}
 
-		if _, err = sc.core.Secrets(namespace).Update(scrt); err != nil {
-			glog.Errorf("Failed to update secret %s/%s (error: %s)", namespace, name, err)
-		}
+	if _, err = sc.core.Secrets(namespace).Update(updated); err != nil {
+		err = fmt.Errorf("failed to update secret %s/%s (error: %s)", namespace, name, err)
+		sc.recordEvent(sa, scrt, v1.EventTypeWarning, secretUpdateFailedReason, err.Error())
+		return err
+	}
+	secretsRefreshed.Inc()
+	if repair {
+		secretsRepaired.Inc()
+	}
+	message := fmt.Sprintf("Rotated the certificate in secret %s, expiring at %s",
+		name, updated.Annotations[ExpiryAnnotationKey])
+	sc.recordEvent(sa, scrt, v1.EventTypeNormal, certRotatedReason, message)
+	return nil
+}
+
+// updateOutputs rewrites the output formats of the secret without re-issuing
+// its certificate.
+func (sc *SecretController) updateOutputs(sa *v1.ServiceAccount, scrt *v1.Secret) error {
+	updated := copySecret(scrt)
+	if err := sc.writeOutputs(sa, updated, secretFormats(scrt)); err != nil {
+		return err
+	}
+	if _, err := sc.core.Secrets(scrt.Namespace).Update(updated); err != nil {
+		err = fmt.Errorf("failed to update secret %s/%s (error: %s)", scrt.Namespace, scrt.Name, err)
+		sc.recordEvent(sa, scrt, v1.EventTypeWarning, secretUpdateFailedReason, err.Error())
+		return err
 	}
+	return nil
+}
+
+// writeOutputs writes the output formats of the service account to the
+// secret, and syncs its TLS secret. The TLS secret is written first, so that
+// it is written again by the retry if the secret fails to be written.
+func (sc *SecretController) writeOutputs(sa *v1.ServiceAccount, scrt *v1.Secret, oldFormats []string) error {
+	if err := writeOutputs(scrt, sc.getOutputFormats(sa), sc.kms); err != nil {
+		err = fmt.Errorf("failed to write the output formats of secret %s/%s (error: %v)",
+			scrt.Namespace, scrt.Name, err)
+		sc.recorder.Event(sa, v1.EventTypeWarning, outputFailedReason, err.Error())
+		return err
+	}
+	if err := sc.syncTLSSecret(sa, scrt, oldFormats); err != nil {
+		sc.recorder.Event(sa, v1.EventTypeWarning, outputFailedReason, err.Error())
+		return err
+	}
+	return nil
+}
+
+// goroutineGroup runs functions in goroutines, and waits for all of them to
+// return.
+type goroutineGroup struct {
+	wg sync.WaitGroup
+}
+
+func (g *goroutineGroup) start(f func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+}
+
+func (g *goroutineGroup) wait() {
+	g.wg.Wait()
+}
+
+// copySecret returns a copy of the secret that can be modified. The secrets
+// are owned by the cache, so they are copied before they are updated.
+func copySecret(scrt *v1.Secret) *v1.Secret {
+	copied := &v1.Secret{
+		ObjectMeta: scrt.ObjectMeta,
+		Data:       make(map[string][]byte, len(scrt.Data)),
+		Type:       scrt.Type,
+	}
+	for k, v := range scrt.Data {
+		copied.Data[k] = v
+	}
+	copied.Annotations = make(map[string]string, len(scrt.Annotations)+1)
+	for k, v := range scrt.Annotations {
+		copied.Annotations[k] = v
+	}
+	return copied
+}
+
+// setStatusAnnotations annotates the secret with the status of its
+// certificate. A certificate that cannot be parsed is not annotated.
+func (sc *SecretController) setStatusAnnotations(scrt *v1.Secret) {
+	if err := setStatusAnnotations(scrt.Annotations, scrt.Data[CertChainID], scrt.Data[RootCertID]); err != nil {
+		glog.Warningf("Failed to annotate secret %s/%s with the status of its certificate (error: %v)",
+			scrt.Namespace, scrt.Name, err)
+	}
+}
+
+// recordEvent records the event on both the service account and its secret.
+func (sc *SecretController) recordEvent(sa *v1.ServiceAccount, scrt *v1.Secret, eventType, reason, message string) {
+	sc.recorder.Event(sa, eventType, reason, message)
+	sc.recorder.Event(scrt, eventType, reason, message)
+}
+
+func getServiceAccountID(saName, saNamespace string) string {
+	return ca.ServiceAccountID(saName, saNamespace)
 }
 
 func getSecretName(saName string) string {
@@ -15,22 +15,34 @@
 package controller
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"istio.io/auth/pkg/audit"
+	"istio.io/auth/pkg/pki"
 	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/pki/ca/storage"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/pkg/api/v1"
 	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 type fakeCa struct{}
 
-func (ca *fakeCa) Sign([]byte) ([]byte, error) {
+func (ca *fakeCa) Sign([]byte, time.Duration) ([]byte, error) {
 	return []byte("fake cert chain"), nil
 }
 
@@ -87,7 +99,8 @@ func TestSecretController(t *testing.T) {
 			},
 		},
 		"removing service account deletes existing secret": {
-			saToDelete: createServiceAccount("deleted", "deleted-ns"),
+			existingSecret: createSecret("deleted", "istio.deleted", "deleted-ns"),
+			saToDelete:     createServiceAccount("deleted", "deleted-ns"),
 			expectedActions: []ktesting.Action{
 				ktesting.NewDeleteAction(gvr, "deleted-ns", "istio.deleted"),
 			},
@@ -100,6 +113,7 @@ func TestSecretController(t *testing.T) {
 			expectedActions: []ktesting.Action{},
 		},
 		"updating service accounts deletes old secret and creates a new one": {
+			existingSecret: createSecret("old-name", "istio.old-name", "old-ns"),
 			sasToUpdate: &updatedSas{
 				curSa: createServiceAccount("new-name", "new-ns"),
 				oldSa: createServiceAccount("old-name", "old-ns"),
@@ -118,7 +132,7 @@ func TestSecretController(t *testing.T) {
 
 	for k, tc := range testCases {
 		client := fake.NewSimpleClientset()
-		controller := NewSecretController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll)
+		controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{})
 
 		if tc.existingSecret != nil {
 			err := controller.scrtStore.Add(tc.existingSecret)
@@ -127,15 +141,19 @@ func TestSecretController(t *testing.T) {
 			}
 		}
 
+		// The informer updates its store before it invokes the handlers.
 		if tc.saToAdd != nil {
+			addServiceAccount(t, controller, tc.saToAdd)
 			controller.saAdded(tc.saToAdd)
 		}
 		if tc.saToDelete != nil {
 			controller.saDeleted(tc.saToDelete)
 		}
 		if tc.sasToUpdate != nil {
+			addServiceAccount(t, controller, tc.sasToUpdate.curSa)
 			controller.saUpdated(tc.sasToUpdate.oldSa, tc.sasToUpdate.curSa)
 		}
+		processQueue(controller)
 
 		if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
 			t.Errorf("Case %q: %s", k, err.Error())
@@ -145,9 +163,11 @@ func TestSecretController(t *testing.T) {
 
 func TestRecoverFromDeletedIstioSecret(t *testing.T) {
 	client := fake.NewSimpleClientset()
-	controller := NewSecretController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll)
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{})
+	addServiceAccount(t, controller, createServiceAccount("test", "test-ns"))
 	scrt := createSecret("test", "istio.test", "test-ns")
 	controller.scrtDeleted(scrt)
+	processQueue(controller)
 
 	gvr := schema.GroupVersionResource{
 		Resource: "secrets",
@@ -159,6 +179,27 @@ func TestRecoverFromDeletedIstioSecret(t *testing.T) {
 	}
 }
 
+func TestSecretControllerAuditEvent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	client := fake.NewSimpleClientset()
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(),
+		SecretControllerOptions{AuditSink: audit.NewWriterSink(buf)})
+	sa := createServiceAccount("test", "test-ns")
+	addServiceAccount(t, controller, sa)
+	controller.saAdded(sa)
+	processQueue(controller)
+
+	event := &audit.Event{}
+	if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+		t.Fatalf("Failed to decode the audit event %q (error %v)", buf.String(), err)
+	}
+	expectedID := "spiffe://cluster.local/ns/test-ns/sa/test"
+	if event.Source != audit.SourceSecretController || event.Decision != audit.Allow ||
+		!reflect.DeepEqual(event.RequestedIDs, []string{expectedID}) {
+		t.Errorf("Unexpected audit event %+v", event)
+	}
+}
+
 func TestUpdateSecret(t *testing.T) {
 	gvr := schema.GroupVersionResource{
 		Resource: "secrets",
@@ -190,7 +231,7 @@ func TestUpdateSecret(t *testing.T) {
 
 	for k, tc := range testCases {
 		client := fake.NewSimpleClientset()
-		controller := NewSecretController(&fakeCa{}, client.CoreV1(), metav1.NamespaceAll)
+		controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{})
 
 		scrt := createSecret("test", "istio.test", "test-ns")
 		if rc := tc.rootCert; rc != nil {
@@ -205,7 +246,12 @@ func TestUpdateSecret(t *testing.T) {
 		bs, _ := ca.GenCert(opts)
 		scrt.Data[CertChainID] = bs
 
+		addServiceAccount(t, controller, createServiceAccount("test", "test-ns"))
+		if err := controller.scrtStore.Add(scrt); err != nil {
+			t.Fatal(err)
+		}
 		controller.scrtUpdated(nil, scrt)
+		processQueue(controller)
 
 		if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
 			t.Errorf("Case %q: %s", k, err.Error())
@@ -213,6 +259,231 @@ func TestUpdateSecret(t *testing.T) {
 	}
 }
 
+func TestUpdateSecretWithCertAnnotations(t *testing.T) {
+	gvr := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+	client := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(10)
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{
+		CertPolicy:    &CertPolicy{MaxTTL: 24 * time.Hour},
+		EventRecorder: recorder,
+	})
+
+	scrt := createSecret("test", "istio.test", "test-ns")
+	scrt.Data[CertChainID], _ = ca.GenCert(ca.CertOptions{
+		IsSelfSigned: true,
+		NotAfter:     time.Now().Add(time.Hour),
+		RSAKeySize:   512,
+	})
+	if err := controller.scrtStore.Add(scrt); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret is re-issued when the annotations of the service account are
+	// changed, and the rejected annotation is recorded as an event.
+	oldSa := createServiceAccount("test", "test-ns")
+	sa := createServiceAccount("test", "test-ns")
+	sa.Annotations = map[string]string{
+		TTLAnnotationKey:      "12h",
+		DNSNamesAnnotationKey: "www.example.com",
+	}
+	addServiceAccount(t, controller, sa)
+	controller.saUpdated(oldSa, sa)
+	processQueue(controller)
+
+	expectedActions := []ktesting.Action{ktesting.NewUpdateAction(gvr, "test-ns", scrt)}
+	if err := checkActions(client.Actions(), expectedActions); err != nil {
+		t.Fatal(err)
+	}
+	updated := client.Actions()[0].(ktesting.UpdateAction).GetObject().(*v1.Secret)
+	if spec := updated.Annotations[certSpecAnnotationKey]; spec != "dns=;ttl=12h0m0s;key=RSA-1024" {
+		t.Errorf("Unexpected certificate spec annotation %q", spec)
+	}
+	if scrt.Annotations[certSpecAnnotationKey] != "" {
+		t.Error("The secret in the cache should not be modified")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning InvalidCertAnnotation "+DNSNamesAnnotationKey) {
+			t.Errorf("Unexpected event %q", event)
+		}
+	default:
+		t.Error("Expecting an event for the rejected annotation")
+	}
+}
+
+func TestSecretStatus(t *testing.T) {
+	istioCA, err := ca.NewSelfSignedIstioCA(time.Hour, 30*time.Minute, "test.org",
+		storage.NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	failures := 1
+	client.PrependReactor("create", "secrets", func(ktesting.Action) (bool, runtime.Object, error) {
+		if failures == 0 {
+			return false, nil, nil
+		}
+		failures--
+		return true, nil, fmt.Errorf("exceeded quota")
+	})
+	recorder := record.NewFakeRecorder(10)
+	controller := NewSecretController(istioCA, client.CoreV1(), SecretControllerOptions{EventRecorder: recorder})
+
+	sa := createServiceAccount("test", "test-ns")
+	addServiceAccount(t, controller, sa)
+	for i := 0; i < 2; i++ {
+		if err := controller.reconcile("test-ns/test"); (err != nil) != (i == 0) {
+			t.Fatalf("Unexpected error of reconciliation %d: %v", i, err)
+		}
+	}
+
+	created := client.Actions()[1].(ktesting.CreateAction).GetObject().(*v1.Secret)
+	cert, err := pki.ParsePemEncodedCertificate(created.Data[CertChainID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := pki.ParsePemEncodedCertificate(istioCA.GetRootCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := sha256.Sum256(root.Raw)
+	expectedAnnotations := map[string]string{
+		IssuedAtAnnotationKey:          cert.NotBefore.UTC().Format(time.RFC3339),
+		ExpiryAnnotationKey:            cert.NotAfter.UTC().Format(time.RFC3339),
+		SerialAnnotationKey:            cert.SerialNumber.Text(16),
+		IssuerFingerprintAnnotationKey: hex.EncodeToString(fingerprint[:]),
+	}
+	for key, value := range expectedAnnotations {
+		if created.Annotations[key] != value {
+			t.Errorf("Expecting annotation %s to be %q but got %q", key, value, created.Annotations[key])
+		}
+	}
+
+	expectedEvents := []string{
+		"Warning SecretCreateFailed failed to create secret (error: exceeded quota)",
+		"Normal CertificateIssued Issued the certificate in secret istio.test, expiring at " +
+			expectedAnnotations[ExpiryAnnotationKey],
+		"Normal CertificateIssued Issued the certificate in secret istio.test, expiring at " +
+			expectedAnnotations[ExpiryAnnotationKey],
+	}
+	for _, expected := range expectedEvents {
+		select {
+		case event := <-recorder.Events:
+			if event != expected {
+				t.Errorf("Expecting event %q but got %q", expected, event)
+			}
+		default:
+			t.Errorf("Expecting event %q", expected)
+		}
+	}
+}
+
+func TestRetryFailedReconciliation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	failures := 2
+	client.PrependReactor("create", "secrets", func(ktesting.Action) (bool, runtime.Object, error) {
+		if failures == 0 {
+			return false, nil, nil
+		}
+		failures--
+		return true, nil, fmt.Errorf("injected failure")
+	})
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{})
+
+	// Duplicate events of a service account are coalesced.
+	sa := createServiceAccount("test", "test-ns")
+	addServiceAccount(t, controller, sa)
+	for i := 0; i < 3; i++ {
+		controller.saAdded(sa)
+	}
+	if controller.queue.Len() != 1 {
+		t.Fatalf("Expecting 1 queued service account but got %d", controller.queue.Len())
+	}
+
+	// The failed reconciliation is retried with backoff until it succeeds.
+	deadline := time.Now().Add(5 * time.Second)
+	for failures > 0 || controller.queue.NumRequeues("test-ns/test") > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the reconciliation to be retried")
+		}
+		processQueue(controller)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	gvr := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+	create := ktesting.NewCreateAction(gvr, "test-ns", createSecret("test", "istio.test", "test-ns"))
+	expectedActions := []ktesting.Action{create, create, create}
+	if err := checkActions(client.Actions(), expectedActions); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSecretControllerSelector(t *testing.T) {
+	gvr := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+	client := fake.NewSimpleClientset()
+	selector := &Selector{NamespaceSelector: labels.SelectorFromSet(labels.Set{"istio": "enabled"})}
+	controller := NewSecretController(&fakeCa{}, client.CoreV1(), SecretControllerOptions{Selector: selector})
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns"}}
+	if err := controller.nsStore.Add(ns); err != nil {
+		t.Fatal(err)
+	}
+	addServiceAccount(t, controller, createServiceAccount("test", "test-ns"))
+
+	// The existing secret of the service account that is not selected is
+	// cleaned up when the secret is listed.
+	scrt := createSecret("test", "istio.test", "test-ns")
+	if err := controller.scrtStore.Add(scrt); err != nil {
+		t.Fatal(err)
+	}
+	controller.scrtAdded(scrt)
+	processQueue(controller)
+	if err := controller.scrtStore.Delete(scrt); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service account is selected once its namespace is labeled.
+	labeledNs := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ns", Labels: map[string]string{"istio": "enabled"}},
+	}
+	if err := controller.nsStore.Update(labeledNs); err != nil {
+		t.Fatal(err)
+	}
+	controller.nsUpdated(ns, labeledNs)
+	processQueue(controller)
+
+	expectedActions := []ktesting.Action{
+		ktesting.NewDeleteAction(gvr, "test-ns", "istio.test"),
+		ktesting.NewCreateAction(gvr, "test-ns", scrt),
+	}
+	if err := checkActions(client.Actions(), expectedActions); err != nil {
+		t.Error(err)
+	}
+}
+
+func addServiceAccount(t *testing.T, controller *SecretController, sa *v1.ServiceAccount) {
+	if err := controller.saStore.Add(sa); err != nil {
+		t.Fatalf("Failed to add a service account (error %v)", err)
+	}
+}
+
+// processQueue reconciles the service accounts in the work queue until it is
+// empty. The failed reconciliations are added back after a delay.
+func processQueue(controller *SecretController) {
+	for controller.queue.Len() > 0 {
+		controller.processNextItem()
+	}
+}
+
 func checkActions(actual, expected []ktesting.Action) error {
 	if len(actual) != len(expected) {
 		return fmt.Errorf("unexpected number of actions, want %d but got %d", len(expected), len(actual))
@@ -0,0 +1,124 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// IdentityKey is the label or annotation of a service account that opts
+	// the service account in or out of Istio secrets.
+	IdentityKey = "istio.io/identity"
+	// IdentityEnabled opts a service account in. It selects the service
+	// account regardless of the label selectors.
+	IdentityEnabled = "enabled"
+	// IdentityDisabled opts a service account out.
+	IdentityDisabled = "disabled"
+)
+
+// Selector selects the service accounts that get Istio secrets. The Istio
+// secrets of the service accounts that are not selected are deleted. A nil
+// Selector selects all the service accounts.
+type Selector struct {
+	// The namespaces whose service accounts are selected. If empty, all the
+	// namespaces are included.
+	IncludeNamespaces []string
+	// The namespaces whose service accounts are never selected, e.g.
+	// kube-system. It takes precedence over the other fields.
+	ExcludeNamespaces []string
+	// The labels of the namespaces whose service accounts are selected. If
+	// nil, the labels of the namespaces are not checked.
+	NamespaceSelector labels.Selector
+	// The labels of the service accounts that are selected. If nil, the labels
+	// of the service accounts are not checked.
+	ServiceAccountSelector labels.Selector
+	// Whether only the service accounts that opt in with IdentityKey are
+	// selected.
+	RequireOptIn bool
+}
+
+// watchesNamespaces returns whether the labels of the namespaces are needed.
+func (s *Selector) watchesNamespaces() bool {
+	return s != nil && s.NamespaceSelector != nil && !s.NamespaceSelector.Empty()
+}
+
+// selects returns whether the service account is selected. ns is the namespace
+// of the service account, which is only needed if the namespaces are selected
+// by their labels.
+func (s *Selector) selects(sa *v1.ServiceAccount, ns *v1.Namespace) bool {
+	if s == nil {
+		return optIn(sa) != IdentityDisabled
+	}
+	if contains(s.ExcludeNamespaces, sa.Namespace) {
+		return false
+	}
+	if len(s.IncludeNamespaces) > 0 && !contains(s.IncludeNamespaces, sa.Namespace) {
+		return false
+	}
+
+	switch optIn(sa) {
+	case IdentityDisabled:
+		return false
+	case IdentityEnabled:
+		return true
+	}
+	if s.RequireOptIn {
+		return false
+	}
+
+	if s.watchesNamespaces() && (ns == nil || !s.NamespaceSelector.Matches(labels.Set(ns.Labels))) {
+		return false
+	}
+	if s.ServiceAccountSelector != nil && !s.ServiceAccountSelector.Matches(labels.Set(sa.Labels)) {
+		return false
+	}
+	return true
+}
+
+// SelectsNamespace returns whether the service accounts in the namespace are
+// selected by the namespace fields, regardless of their own labels and
+// annotations.
+func (s *Selector) SelectsNamespace(ns *v1.Namespace) bool {
+	if s == nil {
+		return true
+	}
+	if contains(s.ExcludeNamespaces, ns.Name) {
+		return false
+	}
+	if len(s.IncludeNamespaces) > 0 && !contains(s.IncludeNamespaces, ns.Name) {
+		return false
+	}
+	return !s.watchesNamespaces() || s.NamespaceSelector.Matches(labels.Set(ns.Labels))
+}
+
+// optIn returns the value of IdentityKey of the service account. The
+// annotation takes precedence over the label.
+func optIn(sa *v1.ServiceAccount) string {
+	if value, ok := sa.Annotations[IdentityKey]; ok {
+		return value
+	}
+	return sa.Labels[IdentityKey]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
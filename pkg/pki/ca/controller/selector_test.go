@@ -0,0 +1,124 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestSelector(t *testing.T) {
+	createSa := func(namespace string, labels, annotations map[string]string) *v1.ServiceAccount {
+		sa := createServiceAccount("sa", namespace)
+		sa.Labels = labels
+		sa.Annotations = annotations
+		return sa
+	}
+	istioNs := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns", Labels: map[string]string{"istio": "enabled"}},
+	}
+	otherNs := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns"}}
+	nsSelector := labels.SelectorFromSet(labels.Set{"istio": "enabled"})
+	saSelector := labels.SelectorFromSet(labels.Set{"app": "web"})
+
+	testCases := map[string]struct {
+		selector *Selector
+		sa       *v1.ServiceAccount
+		ns       *v1.Namespace
+		selected bool
+	}{
+		"Nil selector": {
+			sa:       createSa("ns", nil, nil),
+			selected: true,
+		},
+		"Nil selector with opt-out annotation": {
+			sa: createSa("ns", nil, map[string]string{IdentityKey: IdentityDisabled}),
+		},
+		"Included namespace": {
+			selector: &Selector{IncludeNamespaces: []string{"ns"}},
+			sa:       createSa("ns", nil, nil),
+			selected: true,
+		},
+		"Namespace not included": {
+			selector: &Selector{IncludeNamespaces: []string{"default"}},
+			sa:       createSa("ns", nil, nil),
+		},
+		"Excluded namespace": {
+			selector: &Selector{ExcludeNamespaces: []string{"kube-system"}},
+			sa:       createSa("kube-system", nil, nil),
+		},
+		"Excluded namespace with opt-in": {
+			selector: &Selector{ExcludeNamespaces: []string{"kube-system"}},
+			sa:       createSa("kube-system", nil, map[string]string{IdentityKey: IdentityEnabled}),
+		},
+		"Matching namespace labels": {
+			selector: &Selector{NamespaceSelector: nsSelector},
+			sa:       createSa("ns", nil, nil),
+			ns:       istioNs,
+			selected: true,
+		},
+		"Mismatching namespace labels": {
+			selector: &Selector{NamespaceSelector: nsSelector},
+			sa:       createSa("ns", nil, nil),
+			ns:       otherNs,
+		},
+		"Unknown namespace": {
+			selector: &Selector{NamespaceSelector: nsSelector},
+			sa:       createSa("ns", nil, nil),
+		},
+		"Matching service account labels": {
+			selector: &Selector{ServiceAccountSelector: saSelector},
+			sa:       createSa("ns", map[string]string{"app": "web"}, nil),
+			selected: true,
+		},
+		"Mismatching service account labels": {
+			selector: &Selector{ServiceAccountSelector: saSelector},
+			sa:       createSa("ns", map[string]string{"app": "db"}, nil),
+		},
+		"Opt-in label overrides label selectors": {
+			selector: &Selector{NamespaceSelector: nsSelector, ServiceAccountSelector: saSelector},
+			sa:       createSa("ns", map[string]string{IdentityKey: IdentityEnabled}, nil),
+			ns:       otherNs,
+			selected: true,
+		},
+		"Opt-out label": {
+			selector: &Selector{},
+			sa:       createSa("ns", map[string]string{IdentityKey: IdentityDisabled}, nil),
+		},
+		"Annotation takes precedence over label": {
+			selector: &Selector{},
+			sa: createSa("ns", map[string]string{IdentityKey: IdentityEnabled},
+				map[string]string{IdentityKey: IdentityDisabled}),
+		},
+		"Opt-in required": {
+			selector: &Selector{RequireOptIn: true},
+			sa:       createSa("ns", nil, nil),
+		},
+		"Opt-in required with opt-in annotation": {
+			selector: &Selector{RequireOptIn: true},
+			sa:       createSa("ns", nil, map[string]string{IdentityKey: IdentityEnabled}),
+			selected: true,
+		},
+	}
+
+	for id, c := range testCases {
+		if selected := c.selector.selects(c.sa, c.ns); selected != c.selected {
+			t.Errorf("Case %s: expecting selected to be %v but got %v", id, c.selected, selected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"istio.io/auth/pkg/pki"
+)
+
+const (
+	// IssuedAtAnnotationKey is the annotation of an Istio secret with the time
+	// its certificate was issued, in RFC 3339 format.
+	IssuedAtAnnotationKey = "istio.io/cert-issued-at"
+	// ExpiryAnnotationKey is the annotation of an Istio secret with the time
+	// its certificate expires, in RFC 3339 format.
+	ExpiryAnnotationKey = "istio.io/cert-expiry"
+	// SerialAnnotationKey is the annotation of an Istio secret with the serial
+	// number of its certificate, in hex.
+	SerialAnnotationKey = "istio.io/cert-serial"
+	// IssuerFingerprintAnnotationKey is the annotation of an Istio secret with
+	// the SHA-256 fingerprint of the certificate that signed its certificate.
+	IssuerFingerprintAnnotationKey = "istio.io/cert-issuer-fingerprint"
+
+	// The reasons of the events recorded on the service accounts and the Istio
+	// secrets.
+	certIssuedReason         = "CertificateIssued"
+	certRotatedReason        = "CertificateRotated"
+	certIssueFailedReason    = "CertificateIssueFailed"
+	secretCreateFailedReason = "SecretCreateFailed"
+	secretUpdateFailedReason = "SecretUpdateFailed"
+	outputFailedReason       = "OutputFormatFailed"
+	tlsSecretConflictReason  = "TLSSecretConflict"
+)
+
+var statusAnnotationKeys = []string{
+	IssuedAtAnnotationKey,
+	ExpiryAnnotationKey,
+	SerialAnnotationKey,
+	IssuerFingerprintAnnotationKey,
+}
+
+// setStatusAnnotations sets the annotations that describe the certificate in
+// the chain. The issuer is the second certificate in the chain, or the root
+// certificate if the chain only has the leaf certificate.
+func setStatusAnnotations(annotations map[string]string, chain, rootCert []byte) error {
+	for _, key := range statusAnnotationKeys {
+		delete(annotations, key)
+	}
+
+	cert, err := pki.ParsePemEncodedCertificate(chain)
+	if err != nil {
+		return err
+	}
+	issuer := rootCert
+	if block, rest := pem.Decode(chain); block != nil {
+		if next, _ := pem.Decode(rest); next != nil {
+			issuer = pem.EncodeToMemory(next)
+		}
+	}
+	issuerCert, err := pki.ParsePemEncodedCertificate(issuer)
+	if err != nil {
+		return fmt.Errorf("failed to parse the issuer certificate (error: %v)", err)
+	}
+	fingerprint := sha256.Sum256(issuerCert.Raw)
+
+	annotations[IssuedAtAnnotationKey] = cert.NotBefore.UTC().Format(time.RFC3339)
+	annotations[ExpiryAnnotationKey] = cert.NotAfter.UTC().Format(time.RFC3339)
+	annotations[SerialAnnotationKey] = cert.SerialNumber.Text(16)
+	annotations[IssuerFingerprintAnnotationKey] = hex.EncodeToString(fingerprint[:])
+	return nil
+}
@@ -20,6 +20,8 @@ package ca
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -69,6 +71,10 @@ type CertOptions struct {
 
 	// The size of RSA private key to be generated.
 	RSAKeySize int
+
+	// The curve of ECDSA private key to be generated. If set, an ECDSA private
+	// key is generated instead of an RSA one. Only supported by GenCSR.
+	ECDSACurve elliptic.Curve
 }
 
 // URIScheme is the URI scheme for Istio identities.
@@ -77,20 +83,45 @@ const URIScheme = "spiffe"
 // GenCSR generates a X.509 certificate sign request and private key with the given options.
 func GenCSR(options CertOptions) ([]byte, []byte, error) {
 	// Generates a CSR
+	if options.ECDSACurve != nil {
+		priv, err := ecdsa.GenerateKey(options.ECDSACurve, rand.Reader)
+		if err != nil {
+			glog.Errorf("ECDSA key generation failed with error %s.", err)
+			return nil, nil, err
+		}
+		csr, err := genCSR(options, priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		privDer, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return csr, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDer}), nil
+	}
+
 	priv, err := rsa.GenerateKey(rand.Reader, options.RSAKeySize)
 	if err != nil {
 		glog.Errorf("RSA key generation failed with error %s.", err)
 		return nil, nil, err
 	}
-	template := GenCSRTemplate(options)
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, crypto.PrivateKey(priv))
+	csr, err := genCSR(options, priv)
 	if err != nil {
-		glog.Errorf("Could not create certificate request (err = %s).", err)
 		return nil, nil, err
 	}
+	privDer := x509.MarshalPKCS1PrivateKey(priv)
+	return csr, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privDer}), nil
+}
 
-	csr, privKey := encodePem(true, csrBytes, priv)
-	return csr, privKey, nil
+// genCSR returns the PEM-encoded CSR signed by the private key.
+func genCSR(options CertOptions, priv crypto.Signer) ([]byte, error) {
+	template := GenCSRTemplate(options)
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, priv)
+	if err != nil {
+		glog.Errorf("Could not create certificate request (err = %s).", err)
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes}), nil
 }
 
 // GenCert generates a X.509 certificate and a private key with the given options.
@@ -114,19 +145,15 @@ func GenCert(options CertOptions) ([]byte, []byte) {
 		glog.Fatalf("Could not create certificate (err = %s).", err)
 	}
 
-	return encodePem(false, certBytes, priv)
+	return encodePem(certBytes, priv)
 }
 
-func encodePem(isCSR bool, csrOrCert []byte, priv *rsa.PrivateKey) ([]byte, []byte) {
-	encodeMsg := "CERTIFICATE"
-	if isCSR {
-		encodeMsg = "CERTIFICATE REQUEST"
-	}
-	csrOrCertPem := pem.EncodeToMemory(&pem.Block{Type: encodeMsg, Bytes: csrOrCert})
+func encodePem(cert []byte, priv *rsa.PrivateKey) ([]byte, []byte) {
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
 
 	privDer := x509.MarshalPKCS1PrivateKey(priv)
 	privPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privDer})
-	return csrOrCertPem, privPem
+	return certPem, privPem
 }
 
 // LoadSignerCredsFromFiles loads the signer cert&key from the given files.
@@ -15,6 +15,8 @@
 package ca
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/pem"
 	"strings"
@@ -60,6 +62,37 @@ func TestGenCSR(t *testing.T) {
 	}
 }
 
+func TestGenCSRWithECDSAKey(t *testing.T) {
+	csrOptions := CertOptions{
+		Host:       "test_ca.com",
+		Org:        "MyOrg",
+		ECDSACurve: elliptic.P256(),
+	}
+
+	csrPem, keyPem, err := GenCSR(csrOptions)
+	if err != nil {
+		t.Fatalf("failed to gen CSR: %v", err)
+	}
+
+	csr, err := pki.ParsePemEncodedCSR(csrPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		t.Errorf("csr signature is invalid")
+	}
+	if csr.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("expecting an ECDSA public key but got %v", csr.PublicKeyAlgorithm)
+	}
+	key, err := pki.ParsePemEncodedKey(keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("expecting an ECDSA private key but got %T", key)
+	}
+}
+
 func TestGenCSRWithInvalidOption(t *testing.T) {
 	// Options with invalid Key size.
 	csrOptions := CertOptions{
@@ -0,0 +1,43 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The DNS domain of the Kubernetes cluster.
+const clusterDomain = "cluster.local"
+
+// ServiceAccountID returns the identity of the Kubernetes service account.
+func ServiceAccountID(saName, saNamespace string) string {
+	return fmt.Sprintf("%s://%s/ns/%s/sa/%s", URIScheme, clusterDomain, saNamespace, saName)
+}
+
+// PodIdentities returns the identities in a pod-scoped certificate, i.e. the
+// identity of the service account of the pod, the DNS name of the pod by its
+// name and, if the pod has an IP, the DNS name of the pod by its IP, e.g.
+// "10-0-0-1.default.pod.cluster.local".
+func PodIdentities(saName, namespace, podName, podIP string) []string {
+	ids := []string{
+		ServiceAccountID(saName, namespace),
+		fmt.Sprintf("%s.%s.pod.%s", podName, namespace, clusterDomain),
+	}
+	if podIP != "" {
+		ids = append(ids, fmt.Sprintf("%s.%s.pod.%s", strings.Replace(podIP, ".", "-", -1), namespace, clusterDomain))
+	}
+	return ids
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPodIdentities(t *testing.T) {
+	testCases := map[string]struct {
+		podIP       string
+		expectedIDs []string
+	}{
+		"Pod with an IP": {
+			podIP: "10.0.0.1",
+			expectedIDs: []string{
+				"spiffe://cluster.local/ns/default/sa/sa",
+				"pod.default.pod.cluster.local",
+				"10-0-0-1.default.pod.cluster.local",
+			},
+		},
+		"Pod without an IP": {
+			expectedIDs: []string{
+				"spiffe://cluster.local/ns/default/sa/sa",
+				"pod.default.pod.cluster.local",
+			},
+		},
+	}
+
+	for id, tc := range testCases {
+		if ids := PodIdentities("sa", "default", "pod", tc.podIP); !reflect.DeepEqual(ids, tc.expectedIDs) {
+			t.Errorf("Case %s: expecting identities %v but got %v", id, tc.expectedIDs, ids)
+		}
+	}
+}
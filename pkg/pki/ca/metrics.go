@@ -0,0 +1,129 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"istio.io/auth/pkg/pki"
+)
+
+const metricsNamespace = "istio_ca"
+
+var (
+	signDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sign_duration_seconds",
+		Help:      "The latency of signing CSRs.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	signErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sign_errors_total",
+		Help:      "The number of CSRs that failed to be signed.",
+	})
+
+	ledgerErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_errors_total",
+		Help:      "The number of issued certificates that failed to be recorded in the ledger.",
+	})
+
+	// The expiration time of the certificates issued by this process.
+	issuedCerts = &expiryTracker{}
+
+	validIssuedCerts = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "issued_certs_valid",
+		Help:      "The number of certificates issued by this process that have not expired yet.",
+	}, func() float64 {
+		return float64(issuedCerts.countValid(time.Now()))
+	})
+
+	caCertTTLDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cert_ttl_seconds"),
+		"The time until the certificates of the CA expire.",
+		[]string{"cert"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(signDuration, signErrors, ledgerErrors, validIssuedCerts)
+}
+
+// expiryTracker keeps the expiration time of certificates, so that the ones
+// that are still valid can be counted.
+type expiryTracker struct {
+	mutex    sync.Mutex
+	expiries []time.Time
+}
+
+func (t *expiryTracker) add(notAfter time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.expiries = append(t.expiries, notAfter)
+}
+
+// countValid returns the number of certificates that are valid at the given
+// time, and forgets about the expired ones.
+func (t *expiryTracker) countValid(now time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	valid := t.expiries[:0]
+	for _, notAfter := range t.expiries {
+		if notAfter.After(now) {
+			valid = append(valid, notAfter)
+		}
+	}
+	t.expiries = valid
+	return len(valid)
+}
+
+// certTTLCollector reports the time until the root certificate and the
+// signing certificate of an IstioCA expire.
+type certTTLCollector struct {
+	ca *IstioCA
+}
+
+// NewCertTTLCollector returns a Prometheus collector that reports the time
+// until the root certificate and the signing certificate of the CA expire. The
+// two are the same for a self-signed CA.
+func NewCertTTLCollector(ca *IstioCA) prometheus.Collector {
+	return &certTTLCollector{ca}
+}
+
+func (c *certTTLCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- caCertTTLDesc
+}
+
+func (c *certTTLCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	collect := func(label string, cert *x509.Certificate) {
+		ch <- prometheus.MustNewConstMetric(caCertTTLDesc, prometheus.GaugeValue, cert.NotAfter.Sub(now).Seconds(), label)
+	}
+
+	if root, err := pki.ParsePemEncodedCertificate(c.ca.rootCertBytes); err != nil {
+		glog.Errorf("Failed to parse the root certificate (error: %v)", err)
+	} else {
+		collect("root", root)
+	}
+	collect("signing", c.ca.signingCert)
+}
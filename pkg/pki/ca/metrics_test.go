@@ -0,0 +1,55 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExpiryTracker(t *testing.T) {
+	now := time.Now()
+	tracker := &expiryTracker{}
+	tracker.add(now.Add(-time.Minute))
+	tracker.add(now.Add(time.Minute))
+	tracker.add(now.Add(time.Hour))
+
+	if n := tracker.countValid(now); n != 2 {
+		t.Errorf("Expecting 2 valid certificates but got %d", n)
+	}
+	if n := tracker.countValid(now.Add(30 * time.Minute)); n != 1 {
+		t.Errorf("Expecting 1 valid certificate but got %d", n)
+	}
+	if n := len(tracker.expiries); n != 1 {
+		t.Errorf("Expecting the expired certificates to be forgotten but %d are kept", n)
+	}
+}
+
+func TestCertTTLCollector(t *testing.T) {
+	ca, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	NewCertTTLCollector(ca.(*IstioCA)).Collect(ch)
+	close(ch)
+
+	if n := len(ch); n != 2 {
+		t.Errorf("Expecting the TTL of the root and the signing certificates but got %d metrics", n)
+	}
+}
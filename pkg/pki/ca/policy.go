@@ -0,0 +1,128 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import (
+	"fmt"
+	"strings"
+)
+
+const wildcardPrefix = "*."
+
+// HostnamePolicy is the DNS name allow-list of the CA. An entry of the list is
+// either an exact DNS name (e.g. "foo.example.com"), or a domain suffix that
+// starts with "." or "*." (e.g. ".svc.cluster.local"), which allows all the
+// subdomains of that domain, including wildcard names.
+type HostnamePolicy struct {
+	names    map[string]bool
+	suffixes []string
+}
+
+// NewHostnamePolicy returns a HostnamePolicy that allows the given entries.
+// An empty list allows no DNS name at all.
+func NewHostnamePolicy(allowed []string) (*HostnamePolicy, error) {
+	p := &HostnamePolicy{names: make(map[string]bool)}
+	for _, entry := range allowed {
+		entry = normalizeDNSName(entry)
+		if entry == "" {
+			continue
+		}
+
+		suffix := ""
+		if strings.HasPrefix(entry, wildcardPrefix) {
+			suffix = entry[1:]
+		} else if strings.HasPrefix(entry, ".") {
+			suffix = entry
+		}
+
+		if suffix != "" {
+			if err := ValidateDNSName(suffix[1:]); err != nil {
+				return nil, fmt.Errorf("invalid DNS suffix %q in the allow-list (error: %v)", entry, err)
+			}
+			p.suffixes = append(p.suffixes, suffix)
+			continue
+		}
+
+		if err := ValidateDNSName(entry); err != nil {
+			return nil, fmt.Errorf("invalid DNS name %q in the allow-list (error: %v)", entry, err)
+		}
+		p.names[entry] = true
+	}
+	return p, nil
+}
+
+// IsAllowed indicates whether the CA may issue a certificate for the given DNS
+// name. A wildcard name ("*.example.com") is only allowed by a suffix entry
+// covering all the subdomains of its base domain.
+func (p *HostnamePolicy) IsAllowed(name string) bool {
+	if p == nil {
+		return false
+	}
+
+	name = normalizeDNSName(name)
+	wildcard := strings.HasPrefix(name, wildcardPrefix)
+	if wildcard {
+		name = name[len(wildcardPrefix):]
+	}
+	if ValidateDNSName(name) != nil {
+		return false
+	}
+
+	if !wildcard && p.names[name] {
+		return true
+	}
+
+	// For a wildcard name, any subdomain of the base domain must be covered.
+	subject := name
+	if wildcard {
+		subject = "." + name
+	}
+	for _, suffix := range p.suffixes {
+		if strings.HasSuffix(subject, suffix) && len(subject) > len(suffix) {
+			return true
+		}
+		if wildcard && subject == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateDNSName checks that the given name is a syntactically valid,
+// non-wildcard DNS name.
+func ValidateDNSName(name string) error {
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("the length of a DNS name must be between 1 and 253")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("the length of a DNS label must be between 1 and 63")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("a DNS label must not start or end with a hyphen")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("a DNS label must only contain letters, digits and hyphens")
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ca
+
+import "testing"
+
+func TestHostnamePolicy(t *testing.T) {
+	policy, err := NewHostnamePolicy([]string{"foo.example.com", ".svc.cluster.local", "*.internal.corp."})
+	if err != nil {
+		t.Fatalf("Failed to create the policy: %v", err)
+	}
+
+	testCases := map[string]struct {
+		name    string
+		allowed bool
+	}{
+		"Exact name": {
+			name:    "foo.example.com",
+			allowed: true,
+		},
+		"Exact name with different case and trailing dot": {
+			name:    "FOO.example.com.",
+			allowed: true,
+		},
+		"Subdomain of an exact name": {
+			name:    "bar.foo.example.com",
+			allowed: false,
+		},
+		"Wildcard of an exact name": {
+			name:    "*.example.com",
+			allowed: false,
+		},
+		"Subdomain of a suffix": {
+			name:    "svc.ns.svc.cluster.local",
+			allowed: true,
+		},
+		"Suffix itself": {
+			name:    "svc.cluster.local",
+			allowed: false,
+		},
+		"Wildcard under a suffix": {
+			name:    "*.ns.svc.cluster.local",
+			allowed: true,
+		},
+		"Wildcard of a suffix": {
+			name:    "*.internal.corp",
+			allowed: true,
+		},
+		"Unrelated name": {
+			name:    "evil.com",
+			allowed: false,
+		},
+		"Invalid name": {
+			name:    "bad_name.svc.cluster.local",
+			allowed: false,
+		},
+		"Double wildcard": {
+			name:    "*.*.internal.corp",
+			allowed: false,
+		},
+	}
+
+	for id, tc := range testCases {
+		if allowed := policy.IsAllowed(tc.name); allowed != tc.allowed {
+			t.Errorf("Case %q: expecting %t but got %t", id, tc.allowed, allowed)
+		}
+	}
+}
+
+func TestHostnamePolicyWithInvalidEntry(t *testing.T) {
+	if _, err := NewHostnamePolicy([]string{"-bad.example.com"}); err == nil {
+		t.Error("Expecting an error for an invalid entry")
+	}
+}
+
+func TestEmptyHostnamePolicy(t *testing.T) {
+	policy, err := NewHostnamePolicy(nil)
+	if err != nil {
+		t.Fatalf("Failed to create the policy: %v", err)
+	}
+	if policy.IsAllowed("foo.example.com") {
+		t.Error("An empty policy should not allow any name")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	boltCABucket          = []byte("ca")
+	boltCertsBucket       = []byte("certs")
+	boltRevocationsBucket = []byte("revocations")
+)
+
+// The time to wait for the lock of the database file, which is held by another
+// process that opened it.
+const boltOpenTimeout = 10 * time.Second
+
+// boltStore keeps the state in an embedded BoltDB file, with a bucket each for
+// the key pair, the ledger and the revocations. The file is locked while it is
+// open, so it can only be used by one process at a time.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a store that keeps the state of Istio CA in the given
+// BoltDB file, which is created if it does not exist.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s (error: %v)", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCABucket, boltCertsBucket, boltRevocationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s (error: %v)", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) LoadKeyPair() (*KeyPair, error) {
+	var kp *KeyPair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCABucket)
+		cert, key := b.Get([]byte(caCertID)), b.Get([]byte(caKeyID))
+		if cert == nil || key == nil {
+			return ErrNotFound
+		}
+		// The values are only valid within the transaction.
+		kp = &KeyPair{CertPEM: append([]byte(nil), cert...), KeyPEM: append([]byte(nil), key...)}
+		return nil
+	})
+	return kp, err
+}
+
+func (s *boltStore) CreateKeyPair(kp *KeyPair) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCABucket)
+		if b.Get([]byte(caCertID)) != nil {
+			return ErrAlreadyExists
+		}
+		if err := b.Put([]byte(caKeyID), kp.KeyPEM); err != nil {
+			return err
+		}
+		return b.Put([]byte(caCertID), kp.CertPEM)
+	})
+}
+
+func (s *boltStore) RecordCertificate(rec *CertRecord) error {
+	return s.put(boltCertsBucket, rec.Serial, rec)
+}
+
+func (s *boltStore) GetCertificate(serial string) (*CertRecord, error) {
+	rec := &CertRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltCertsBucket).Get([]byte(serial))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *boltStore) ListCertificates() ([]*CertRecord, error) {
+	var recs []*CertRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCertsBucket).ForEach(func(k, v []byte) error {
+			rec := &CertRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("malformed ledger entry %s (error: %v)", k, err)
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	// The keys are iterated in byte order, which may differ from the order of
+	// the serial numbers of different lengths.
+	sortCertRecords(recs)
+	return recs, err
+}
+
+func (s *boltStore) Revoke(rev *Revocation) error {
+	return s.put(boltRevocationsBucket, rev.Serial, rev)
+}
+
+func (s *boltStore) ListRevocations() ([]*Revocation, error) {
+	var revs []*Revocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRevocationsBucket).ForEach(func(k, v []byte) error {
+			rev := &Revocation{}
+			if err := json.Unmarshal(v, rev); err != nil {
+				return fmt.Errorf("malformed revocation %s (error: %v)", k, err)
+			}
+			revs = append(revs, rev)
+			return nil
+		})
+	})
+	sortRevocations(revs)
+	return revs, err
+}
+
+func (s *boltStore) Prune(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCertsBucket, boltRevocationsBucket} {
+			b := tx.Bucket(name)
+			// The keys are deleted after the iteration, since deleting through
+			// the cursor skips the next key.
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				// Both the records and the revocations have the expiration time.
+				rec := &CertRecord{}
+				if err := json.Unmarshal(v, rec); err == nil && rec.NotAfter.Before(before) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) put(bucket []byte, serial string, record interface{}) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(serial), value)
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"istio.io/auth/pkg/util"
+)
+
+const (
+	dirLockFile       = ".lock"
+	dirCertsDir       = "certs"
+	dirRevocationsDir = "revocations"
+)
+
+// dirStore keeps the state in a local directory: the key pair in ca-cert.pem
+// and ca-key.pem, and a JSON file per ledger entry and revocation, named by
+// the serial number. Every operation holds a lock on the .lock file, so that
+// the directory can be shared by several processes.
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore returns a store that keeps the state of Istio CA in the given
+// directory, which is created if it does not exist.
+func NewDirStore(dir string) (Store, error) {
+	for _, d := range []string{dir, filepath.Join(dir, dirCertsDir), filepath.Join(dir, dirRevocationsDir)} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s (error: %v)", d, err)
+		}
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (s *dirStore) LoadKeyPair() (*KeyPair, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cert, err := ioutil.ReadFile(filepath.Join(s.dir, caCertID))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(filepath.Join(s.dir, caKeyID))
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{CertPEM: cert, KeyPEM: key}, nil
+}
+
+func (s *dirStore) CreateKeyPair(kp *KeyPair) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(filepath.Join(s.dir, caCertID)); err == nil {
+		return ErrAlreadyExists
+	}
+	// The key is written first, so that the certificate only exists with its
+	// key.
+	if err := util.WriteFileAtomic(filepath.Join(s.dir, caKeyID), kp.KeyPEM, 0600); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(s.dir, caCertID), kp.CertPEM, 0644)
+}
+
+func (s *dirStore) RecordCertificate(rec *CertRecord) error {
+	return s.writeRecord(dirCertsDir, rec.Serial, rec)
+}
+
+func (s *dirStore) GetCertificate(serial string) (*CertRecord, error) {
+	if err := checkSerial(serial); err != nil {
+		return nil, err
+	}
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rec := &CertRecord{}
+	if err := readRecord(filepath.Join(s.dir, dirCertsDir, serial+".json"), rec); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *dirStore) ListCertificates() ([]*CertRecord, error) {
+	var recs []*CertRecord
+	err := s.readRecords(dirCertsDir, func(path string) error {
+		rec := &CertRecord{}
+		if err := readRecord(path, rec); err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+		return nil
+	})
+	sortCertRecords(recs)
+	return recs, err
+}
+
+func (s *dirStore) Revoke(rev *Revocation) error {
+	return s.writeRecord(dirRevocationsDir, rev.Serial, rev)
+}
+
+func (s *dirStore) ListRevocations() ([]*Revocation, error) {
+	var revs []*Revocation
+	err := s.readRecords(dirRevocationsDir, func(path string) error {
+		rev := &Revocation{}
+		if err := readRecord(path, rev); err != nil {
+			return err
+		}
+		revs = append(revs, rev)
+		return nil
+	})
+	sortRevocations(revs)
+	return revs, err
+}
+
+func (s *dirStore) Prune(before time.Time) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, d := range []string{dirCertsDir, dirRevocationsDir} {
+		paths, err := filepath.Glob(filepath.Join(s.dir, d, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			// Both the records and the revocations have the expiration time.
+			rec := &CertRecord{}
+			if err := readRecord(path, rec); err != nil || !rec.NotAfter.Before(before) {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *dirStore) Close() error {
+	return nil
+}
+
+// lock locks the directory, exclusively if the state is modified, and returns
+// the function that unlocks it.
+func (s *dirStore) lock(exclusive bool) (func(), error) {
+	path := filepath.Join(s.dir, dirLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s (error: %v)", path, err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s (error: %v)", path, err)
+	}
+	return func() {
+		_ = unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+func (s *dirStore) writeRecord(subdir, serial string, record interface{}) error {
+	if err := checkSerial(serial); err != nil {
+		return err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return util.WriteFileAtomic(filepath.Join(s.dir, subdir, serial+".json"), value, 0644)
+}
+
+func (s *dirStore) readRecords(subdir string, read func(path string) error) error {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, subdir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := read(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRecord(path string, record interface{}) error {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(value, record); err != nil {
+		return fmt.Errorf("malformed record %s (error: %v)", path, err)
+	}
+	return nil
+}
+
+// checkSerial verifies that the serial number is hex-encoded, since it names
+// the files of the records.
+func checkSerial(serial string) error {
+	if serial == "" || strings.Trim(serial, "0123456789abcdefABCDEF") != "" {
+		return fmt.Errorf("invalid serial number %q", serial)
+	}
+	return nil
+}
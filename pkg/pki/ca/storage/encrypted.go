@@ -0,0 +1,62 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/kms"
+)
+
+// encryptedStore seals the private key of the CA with envelope encryption
+// before it is stored, and opens it when it is loaded.
+type encryptedStore struct {
+	Store
+	kms kms.KMS
+}
+
+// NewEncryptedStore returns a store that keeps the private key of the CA in
+// the given store, sealed by the KMS. The ledger and the revocations are not
+// encrypted, since they hold no secret.
+func NewEncryptedStore(store Store, k kms.KMS) Store {
+	return &encryptedStore{Store: store, kms: k}
+}
+
+func (s *encryptedStore) LoadKeyPair() (*KeyPair, error) {
+	kp, err := s.Store.LoadKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if !kms.IsSealed(kp.KeyPEM) {
+		// The key pair was created before the encryption was enabled.
+		glog.Warning("The private key of the CA is stored without encryption")
+		return kp, nil
+	}
+	key, err := kms.Open(s.kms, kp.KeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the private key of the CA (error: %v)", err)
+	}
+	return &KeyPair{CertPEM: kp.CertPEM, KeyPEM: key}, nil
+}
+
+func (s *encryptedStore) CreateKeyPair(kp *KeyPair) error {
+	sealed, err := kms.Seal(s.kms, kp.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the private key of the CA (error: %v)", err)
+	}
+	return s.Store.CreateKeyPair(&KeyPair{CertPEM: kp.CertPEM, KeyPEM: sealed})
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// The secret that stores the key pair of a self-signed CA. The name, type
+	// and keys are kept from the earlier releases, so that the CA keeps its
+	// key pair across upgrades.
+	caSecretName = "istio-ca-secret"
+	caSecretType = "istio.io/ca-root"
+	caCertID     = "ca-cert.pem"
+	caKeyID      = "ca-key.pem"
+
+	// The ConfigMaps of the ledger and the revocations. Each entry is keyed
+	// by the serial number of the certificate, and holds the JSON-encoded
+	// record.
+	ledgerConfigMapName      = "istio-ca-ledger"
+	revocationsConfigMapName = "istio-ca-revocations"
+
+	// The number of attempts to update a ConfigMap that is concurrently
+	// updated by other replicas.
+	maxUpdateAttempts = 5
+)
+
+// kubernetesStore keeps the key pair in a secret, and the ledger and the
+// revocations in ConfigMaps of the storage namespace. The size of a ConfigMap
+// is limited, so the ledger is only suitable for meshes that issue up to a few
+// thousand certificates within their lifetime.
+type kubernetesStore struct {
+	core      corev1.CoreV1Interface
+	namespace string
+
+	// Serializes the updates of the ConfigMaps by this process, so that they
+	// only conflict with the other replicas.
+	mutex sync.Mutex
+}
+
+// NewKubernetesStore returns a store that keeps the state of Istio CA in the
+// given namespace.
+func NewKubernetesStore(core corev1.CoreV1Interface, namespace string) Store {
+	return &kubernetesStore{core: core, namespace: namespace}
+}
+
+func (s *kubernetesStore) LoadKeyPair() (*KeyPair, error) {
+	secret, err := s.core.Secrets(s.namespace).Get(caSecretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s (error: %v)", s.namespace, caSecretName, err)
+	}
+	return &KeyPair{CertPEM: secret.Data[caCertID], KeyPEM: secret.Data[caKeyID]}, nil
+}
+
+func (s *kubernetesStore) CreateKeyPair(kp *KeyPair) error {
+	secret := &v1.Secret{
+		Data: map[string][]byte{
+			caCertID: kp.CertPEM,
+			caKeyID:  kp.KeyPEM,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      caSecretName,
+			Namespace: s.namespace,
+		},
+		Type: caSecretType,
+	}
+	_, err := s.core.Secrets(s.namespace).Create(secret)
+	if errors.IsAlreadyExists(err) {
+		return ErrAlreadyExists
+	} else if err != nil {
+		return fmt.Errorf("failed to create secret %s/%s (error: %v)", s.namespace, caSecretName, err)
+	}
+	return nil
+}
+
+func (s *kubernetesStore) RecordCertificate(rec *CertRecord) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.updateConfigMap(ledgerConfigMapName, func(data map[string]string) {
+		data[rec.Serial] = string(value)
+	})
+}
+
+func (s *kubernetesStore) GetCertificate(serial string) (*CertRecord, error) {
+	data, err := s.getConfigMapData(ledgerConfigMapName)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := data[serial]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec := &CertRecord{}
+	if err := json.Unmarshal([]byte(value), rec); err != nil {
+		return nil, fmt.Errorf("malformed ledger entry %s (error: %v)", serial, err)
+	}
+	return rec, nil
+}
+
+func (s *kubernetesStore) ListCertificates() ([]*CertRecord, error) {
+	data, err := s.getConfigMapData(ledgerConfigMapName)
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*CertRecord, 0, len(data))
+	for serial, value := range data {
+		rec := &CertRecord{}
+		if err := json.Unmarshal([]byte(value), rec); err != nil {
+			return nil, fmt.Errorf("malformed ledger entry %s (error: %v)", serial, err)
+		}
+		recs = append(recs, rec)
+	}
+	sortCertRecords(recs)
+	return recs, nil
+}
+
+func (s *kubernetesStore) Revoke(rev *Revocation) error {
+	value, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return s.updateConfigMap(revocationsConfigMapName, func(data map[string]string) {
+		data[rev.Serial] = string(value)
+	})
+}
+
+func (s *kubernetesStore) ListRevocations() ([]*Revocation, error) {
+	data, err := s.getConfigMapData(revocationsConfigMapName)
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]*Revocation, 0, len(data))
+	for serial, value := range data {
+		rev := &Revocation{}
+		if err := json.Unmarshal([]byte(value), rev); err != nil {
+			return nil, fmt.Errorf("malformed revocation %s (error: %v)", serial, err)
+		}
+		revs = append(revs, rev)
+	}
+	sortRevocations(revs)
+	return revs, nil
+}
+
+func (s *kubernetesStore) Prune(before time.Time) error {
+	prune := func(data map[string]string) {
+		for serial, value := range data {
+			// Both the records and the revocations have the expiration time.
+			rec := &CertRecord{}
+			if err := json.Unmarshal([]byte(value), rec); err == nil && rec.NotAfter.Before(before) {
+				delete(data, serial)
+			}
+		}
+	}
+	if err := s.updateConfigMap(ledgerConfigMapName, prune); err != nil {
+		return err
+	}
+	return s.updateConfigMap(revocationsConfigMapName, prune)
+}
+
+func (s *kubernetesStore) Close() error {
+	return nil
+}
+
+// getConfigMapData returns the data of the ConfigMap, which is empty if the
+// ConfigMap does not exist.
+func (s *kubernetesStore) getConfigMapData(name string) (map[string]string, error) {
+	cm, err := s.core.ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s (error: %v)", s.namespace, name, err)
+	}
+	return cm.Data, nil
+}
+
+// updateConfigMap applies the mutation to the data of the ConfigMap, which is
+// created if it does not exist. The update is retried when the ConfigMap is
+// concurrently modified.
+func (s *kubernetesStore) updateConfigMap(name string, mutate func(map[string]string)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	configMaps := s.core.ConfigMaps(s.namespace)
+	var err error
+	for i := 0; i < maxUpdateAttempts; i++ {
+		var cm *v1.ConfigMap
+		cm, err = configMaps.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.namespace},
+				Data:       map[string]string{},
+			}
+			mutate(cm.Data)
+			if _, err = configMaps.Create(cm); !errors.IsAlreadyExists(err) {
+				break
+			}
+			continue
+		} else if err != nil {
+			break
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		mutate(cm.Data)
+		if _, err = configMaps.Update(cm); !errors.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s (error: %v)", s.namespace, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!darwin
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile is only supported on Linux and macOS.
+func lockFile(*os.File, bool) error {
+	return fmt.Errorf("file locking is not supported on this platform")
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage persists the state of Istio CA: the key pair of a
+// self-signed CA, the ledger of the issued certificates and the revoked
+// certificates. The state can be kept in Kubernetes, in a local directory, or
+// in an embedded BoltDB file, so that Istio CA can run without a cluster.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// BackendKubernetes keeps the state in a secret and ConfigMaps.
+	BackendKubernetes = "kubernetes"
+	// BackendDir keeps the state in files of a local directory.
+	BackendDir = "dir"
+	// BackendBolt keeps the state in an embedded BoltDB file.
+	BackendBolt = "bolt"
+)
+
+var (
+	// ErrNotFound is returned when the requested state does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when the key pair of the CA is created
+	// while another one exists, e.g. by another replica.
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// KeyPair is the PEM-encoded certificate and private key of a self-signed CA.
+type KeyPair struct {
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// CertRecord is the entry of an issued certificate in the ledger.
+type CertRecord struct {
+	// The hex-encoded serial number of the certificate.
+	Serial    string    `json:"serial"`
+	IDs       []string  `json:"ids,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// Revocation records that an issued certificate is revoked.
+type Revocation struct {
+	// The hex-encoded serial number of the certificate.
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revokedAt"`
+	Reason    string    `json:"reason,omitempty"`
+	// The expiration time of the certificate, after which the revocation is
+	// no longer needed.
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// Store persists the state of Istio CA. The implementations are safe for
+// concurrent use, including by several processes sharing the same state.
+type Store interface {
+	// LoadKeyPair returns the key pair of the CA, or ErrNotFound if none has
+	// been created.
+	LoadKeyPair() (*KeyPair, error)
+	// CreateKeyPair stores the key pair of the CA, or returns
+	// ErrAlreadyExists if one has been created.
+	CreateKeyPair(kp *KeyPair) error
+
+	// RecordCertificate adds an issued certificate to the ledger.
+	RecordCertificate(rec *CertRecord) error
+	// GetCertificate returns the ledger entry of the certificate with the
+	// given serial number, or ErrNotFound.
+	GetCertificate(serial string) (*CertRecord, error)
+	// ListCertificates returns the ledger, ordered by serial number.
+	ListCertificates() ([]*CertRecord, error)
+
+	// Revoke records the revocation of a certificate.
+	Revoke(rev *Revocation) error
+	// ListRevocations returns the revoked certificates, ordered by serial
+	// number.
+	ListRevocations() ([]*Revocation, error)
+
+	// Prune removes the ledger entries and the revocations of the
+	// certificates that expired before the given time.
+	Prune(before time.Time) error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Options holds the configurations of the stores that are not backed by
+// Kubernetes.
+type Options struct {
+	// The backend of the store: BackendDir or BackendBolt.
+	Backend string
+	// The directory of BackendDir, or the database file of BackendBolt.
+	Path string
+}
+
+// New returns the store of the given options. The Kubernetes store is created
+// by NewKubernetesStore, since it needs a client.
+func New(opts Options) (Store, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("no path is specified for the %s store", opts.Backend)
+	}
+	switch opts.Backend {
+	case BackendDir:
+		return NewDirStore(opts.Path)
+	case BackendBolt:
+		return NewBoltStore(opts.Path)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %q", opts.Backend)
+	}
+}
+
+func sortCertRecords(recs []*CertRecord) {
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Serial < recs[j].Serial })
+}
+
+func sortRevocations(revs []*Revocation) {
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Serial < revs[j].Serial })
+}
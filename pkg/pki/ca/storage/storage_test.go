@@ -0,0 +1,212 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/kms"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]func() (Store, error){
+		"Kubernetes": func() (Store, error) {
+			return NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system"), nil
+		},
+		"Dir": func() (Store, error) {
+			return New(Options{Backend: BackendDir, Path: filepath.Join(dir, "ca")})
+		},
+		"Bolt": func() (Store, error) {
+			return New(Options{Backend: BackendBolt, Path: filepath.Join(dir, "ca.db")})
+		},
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := &CertRecord{Serial: "1a", IDs: []string{"spiffe://cluster.local/ns/ns/sa/a"},
+		NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)}
+	valid := &CertRecord{Serial: "2b", IDs: []string{"spiffe://cluster.local/ns/ns/sa/b"},
+		NotBefore: now, NotAfter: now.Add(time.Hour)}
+	kp := &KeyPair{CertPEM: []byte("cert"), KeyPEM: []byte("key")}
+
+	for id, newStore := range testCases {
+		store, err := newStore()
+		if err != nil {
+			t.Errorf("Case %s: failed to create the store: %v", id, err)
+			continue
+		}
+
+		if _, err := store.LoadKeyPair(); err != ErrNotFound {
+			t.Errorf("Case %s: expecting ErrNotFound for a new store but got %v", id, err)
+		}
+		if err := store.CreateKeyPair(kp); err != nil {
+			t.Errorf("Case %s: failed to create the key pair: %v", id, err)
+		}
+		if err := store.CreateKeyPair(&KeyPair{CertPEM: []byte("other")}); err != ErrAlreadyExists {
+			t.Errorf("Case %s: expecting ErrAlreadyExists for a second key pair but got %v", id, err)
+		}
+		if loaded, err := store.LoadKeyPair(); err != nil || !reflect.DeepEqual(loaded, kp) {
+			t.Errorf("Case %s: expecting the key pair %v but got %v (%v)", id, kp, loaded, err)
+		}
+
+		for _, rec := range []*CertRecord{valid, expired} {
+			if err := store.RecordCertificate(rec); err != nil {
+				t.Errorf("Case %s: failed to record certificate %s: %v", id, rec.Serial, err)
+			}
+		}
+		if rec, err := store.GetCertificate(valid.Serial); err != nil || !reflect.DeepEqual(rec, valid) {
+			t.Errorf("Case %s: expecting the record %v but got %v (%v)", id, valid, rec, err)
+		}
+		if _, err := store.GetCertificate("ff"); err != ErrNotFound {
+			t.Errorf("Case %s: expecting ErrNotFound for an unknown serial but got %v", id, err)
+		}
+		if recs, err := store.ListCertificates(); err != nil || !reflect.DeepEqual(recs, []*CertRecord{expired, valid}) {
+			t.Errorf("Case %s: unexpected ledger %v (%v)", id, recs, err)
+		}
+
+		revs := []*Revocation{
+			{Serial: expired.Serial, RevokedAt: now, Reason: "compromised", NotAfter: expired.NotAfter},
+			{Serial: valid.Serial, RevokedAt: now, NotAfter: valid.NotAfter},
+		}
+		for _, rev := range revs {
+			if err := store.Revoke(rev); err != nil {
+				t.Errorf("Case %s: failed to revoke certificate %s: %v", id, rev.Serial, err)
+			}
+		}
+		if listed, err := store.ListRevocations(); err != nil || !reflect.DeepEqual(listed, revs) {
+			t.Errorf("Case %s: expecting the revocations %v but got %v (%v)", id, revs, listed, err)
+		}
+
+		if err := store.Prune(now); err != nil {
+			t.Errorf("Case %s: failed to prune: %v", id, err)
+		}
+		if recs, err := store.ListCertificates(); err != nil || !reflect.DeepEqual(recs, []*CertRecord{valid}) {
+			t.Errorf("Case %s: expecting only the valid certificate after pruning but got %v (%v)", id, recs, err)
+		}
+		if listed, err := store.ListRevocations(); err != nil || !reflect.DeepEqual(listed, revs[1:]) {
+			t.Errorf("Case %s: expecting only the valid revocation after pruning but got %v (%v)", id, listed, err)
+		}
+
+		if err := store.Close(); err != nil {
+			t.Errorf("Case %s: failed to close the store: %v", id, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		opts   Options
+		errMsg string
+	}{
+		"No path": {
+			opts:   Options{Backend: BackendDir},
+			errMsg: "no path is specified for the dir store",
+		},
+		"Unsupported backend": {
+			opts:   Options{Backend: "etcd", Path: "/tmp/ca"},
+			errMsg: `unsupported storage backend "etcd"`,
+		},
+	}
+
+	for id, c := range testCases {
+		if _, err := New(c.opts); err == nil || err.Error() != c.errMsg {
+			t.Errorf("Case %s: expecting error %q but got %v", id, c.errMsg, err)
+		}
+	}
+}
+
+func TestDirStoreInvalidSerial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []string{"", "../ca-key", "1a/2b"} {
+		if err := store.RecordCertificate(&CertRecord{Serial: serial}); err == nil {
+			t.Errorf("Expecting an error for the invalid serial number %q", serial)
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kekFile := filepath.Join(dir, "kek")
+	if err := ioutil.WriteFile(kekFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := kms.NewFileKMS(kekFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kp := &KeyPair{CertPEM: []byte("cert"), KeyPEM: []byte("key")}
+	testCases := map[string]struct {
+		// Whether the key pair is created before the encryption is enabled.
+		plaintext bool
+		sealed    bool
+	}{
+		"Encrypted": {
+			sealed: true,
+		},
+		"Created without encryption": {
+			plaintext: true,
+		},
+	}
+
+	for id, c := range testCases {
+		store := NewKubernetesStore(fake.NewSimpleClientset().CoreV1(), "istio-system")
+		encrypted := NewEncryptedStore(store, k)
+		creator := encrypted
+		if c.plaintext {
+			creator = store
+		}
+		if err := creator.CreateKeyPair(kp); err != nil {
+			t.Errorf("Case %s: failed to create the key pair: %v", id, err)
+			continue
+		}
+
+		stored, err := store.LoadKeyPair()
+		if err != nil {
+			t.Errorf("Case %s: failed to load the stored key pair: %v", id, err)
+		} else if sealed := kms.IsSealed(stored.KeyPEM); sealed != c.sealed {
+			t.Errorf("Case %s: expecting the stored key to be sealed (%v) but got %s", id, c.sealed, stored.KeyPEM)
+		}
+		if loaded, err := encrypted.LoadKeyPair(); err != nil || !reflect.DeepEqual(loaded, kp) {
+			t.Errorf("Case %s: expecting the key pair %v but got %v (%v)", id, kp, loaded, err)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 const (
 	blockTypeECParameters  = "EC PARAMETERS"
+	blockTypeECPrivateKey  = "EC PRIVATE KEY"
 	blockTypeRSAPrivateKey = "RSA PRIVATE KEY"
 )
 
@@ -64,7 +65,7 @@ func ParsePemEncodedKey(keyBytes []byte) (crypto.PrivateKey, error) {
 	}
 
 	switch kb.Type {
-	case blockTypeECParameters:
+	case blockTypeECParameters, blockTypeECPrivateKey:
 		key, err := x509.ParseECPrivateKey(kb.Bytes)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to parse the ECDSA private key")
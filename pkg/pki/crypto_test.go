@@ -19,6 +19,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -201,6 +202,10 @@ func TestParsePemEncodedKey(t *testing.T) {
 			pem:     keyECDSA,
 			keyType: reflect.TypeOf(&ecdsa.PrivateKey{}),
 		},
+		"Parse ECDSA private key block": {
+			pem:     strings.Replace(keyECDSA, "EC PARAMETERS", "EC PRIVATE KEY", -1),
+			keyType: reflect.TypeOf(&ecdsa.PrivateKey{}),
+		},
 		"Parse invalid ECDSA key": {
 			pem: `
 -----BEGIN EC PARAMETERS-----
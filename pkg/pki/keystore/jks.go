@@ -0,0 +1,211 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"istio.io/auth/pkg/pki"
+)
+
+const (
+	jksMagic   = 0xFEEDFEED
+	jksVersion = 2
+
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+
+	jksCertType = "X.509"
+	// The string that is mixed into the integrity check of a JKS keystore.
+	jksWhitener = "Mighty Aphrodite"
+)
+
+// The OID of the proprietary key protection algorithm of JKS.
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// EncodeJKS encodes the private key and the certificate chain, starting with
+// the certificate of the key, into a JKS keystore protected by the password.
+// The key entry is named alias, and each of trustedCerts is added as a trusted
+// certificate entry, so that the keystore can also be used as a truststore.
+func EncodeJKS(key crypto.PrivateKey, chain []*x509.Certificate, alias string,
+	trustedCerts map[string]*x509.Certificate, password string) ([]byte, error) {
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("the certificate chain is empty")
+	}
+	encodedPassword := jksPassword(password)
+	now := time.Now()
+
+	protectedKey, err := protectJKSKey(key, encodedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &jksWriter{}
+	w.uint32(jksMagic)
+	w.uint32(jksVersion)
+	w.uint32(uint32(1 + len(trustedCerts)))
+
+	w.uint32(jksPrivateKeyTag)
+	if err := w.entryHeader(alias, now); err != nil {
+		return nil, err
+	}
+	w.bytes(protectedKey)
+	w.uint32(uint32(len(chain)))
+	for _, cert := range chain {
+		if err := w.cert(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, trustedAlias := range sortedKeys(trustedCerts) {
+		w.uint32(jksTrustedCertTag)
+		if err := w.entryHeader(trustedAlias, now); err != nil {
+			return nil, err
+		}
+		if err := w.cert(trustedCerts[trustedAlias]); err != nil {
+			return nil, err
+		}
+	}
+
+	h := sha1.New()
+	_, _ = h.Write(encodedPassword)
+	_, _ = h.Write([]byte(jksWhitener))
+	_, _ = h.Write(w.buf.Bytes())
+	w.buf.Write(h.Sum(nil))
+	return w.buf.Bytes(), nil
+}
+
+// protectJKSKey encrypts the PKCS#8 encoded key with the proprietary key
+// protection algorithm of JKS, a SHA-1 based keystream with an integrity
+// check.
+func protectJKSKey(key crypto.PrivateKey, encodedPassword []byte) ([]byte, error) {
+	plaintext, err := pki.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the private key (error: %v)", err)
+	}
+	salt, err := randomBytes(sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(plaintext))
+	digest := salt
+	for i := 0; i < len(plaintext); i += sha1.Size {
+		h := sha1.New()
+		_, _ = h.Write(encodedPassword)
+		_, _ = h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plaintext); j++ {
+			encrypted[i+j] = plaintext[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	_, _ = h.Write(encodedPassword)
+	_, _ = h.Write(plaintext)
+	check := h.Sum(nil)
+
+	protected := append(append(append([]byte{}, salt...), encrypted...), check...)
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+}
+
+// jksPassword encodes the password in UTF-16 big-endian without a trailing
+// null, as JKS does.
+func jksPassword(password string) []byte {
+	var encoded []byte
+	for _, r := range password {
+		if r > 0xFFFF {
+			r1, r2 := utf16Pair(r)
+			encoded = append(encoded, byte(r1>>8), byte(r1), byte(r2>>8), byte(r2))
+			continue
+		}
+		encoded = append(encoded, byte(r>>8), byte(r))
+	}
+	return encoded
+}
+
+func utf16Pair(r rune) (rune, rune) {
+	r -= 0x10000
+	return 0xD800 + (r>>10)&0x3FF, 0xDC00 + r&0x3FF
+}
+
+// jksWriter writes the big-endian fields of a JKS keystore.
+type jksWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *jksWriter) uint32(v uint32) {
+	_ = binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *jksWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+// utf writes the string in the modified UTF-8 of Java's DataOutput.writeUTF,
+// which is the same as UTF-8 for the strings without a null character or a
+// supplementary character.
+func (w *jksWriter) utf(s string) error {
+	for _, r := range s {
+		if r == 0 || r > 0xFFFF {
+			return fmt.Errorf("unsupported character %q in %q", r, s)
+		}
+	}
+	if len(s) > 0xFFFF {
+		return fmt.Errorf("the string is too long")
+	}
+	_ = binary.Write(&w.buf, binary.BigEndian, uint16(len(s)))
+	w.buf.WriteString(s)
+	return nil
+}
+
+func (w *jksWriter) entryHeader(alias string, created time.Time) error {
+	if err := w.utf(alias); err != nil {
+		return err
+	}
+	_ = binary.Write(&w.buf, binary.BigEndian, uint64(created.UnixNano()/int64(time.Millisecond)))
+	return nil
+}
+
+func (w *jksWriter) cert(cert *x509.Certificate) error {
+	if err := w.utf(jksCertType); err != nil {
+		return err
+	}
+	w.bytes(cert.Raw)
+	return nil
+}
+
+func sortedKeys(m map[string]*x509.Certificate) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,299 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// createChain returns a key, and a chain of its certificate and the root
+// certificate that signs it.
+func createChain(t *testing.T, key crypto.Signer) []*x509.Certificate {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range [][]byte{leafDER, rootDER} {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain
+}
+
+func createKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RSA": rsaKey, "ECDSA": ecKey}
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	for id, key := range createKeys(t) {
+		chain := createChain(t, key)
+		p12, err := EncodePKCS12(key, chain, "istio", "secret")
+		if err != nil {
+			t.Errorf("Case %s: failed to encode (error: %v)", id, err)
+			continue
+		}
+
+		// ToPEM returns no block rather than an error for a wrong password.
+		if blocks, err := pkcs12.ToPEM(p12, "wrong password"); err == nil && len(blocks) > 0 {
+			t.Errorf("Case %s: expecting a wrong password to be rejected", id)
+		}
+		blocks, err := pkcs12.ToPEM(p12, "secret")
+		if err != nil {
+			t.Errorf("Case %s: failed to decode (error: %v)", id, err)
+			continue
+		}
+		var certs [][]byte
+		var decodedKey crypto.PrivateKey
+		for _, block := range blocks {
+			switch block.Type {
+			case "CERTIFICATE":
+				certs = append(certs, block.Bytes)
+			case "PRIVATE KEY":
+				// ToPEM converts the key into PKCS#1 or SEC 1.
+				if _, ok := key.(*rsa.PrivateKey); ok {
+					decodedKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+				} else {
+					decodedKey, err = x509.ParseECPrivateKey(block.Bytes)
+				}
+				if err != nil {
+					t.Errorf("Case %s: failed to parse the key (error: %v)", id, err)
+				}
+				if block.Headers["friendlyName"] != "istio" {
+					t.Errorf("Case %s: expecting the friendly name istio but got %v", id, block.Headers)
+				}
+			}
+		}
+		if len(certs) != 2 || !bytes.Equal(certs[0], chain[0].Raw) || !bytes.Equal(certs[1], chain[1].Raw) {
+			t.Errorf("Case %s: the certificate chain is not preserved", id)
+		}
+		if !reflect.DeepEqual(decodedKey, key) {
+			t.Errorf("Case %s: the key is not preserved", id)
+		}
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	for id, key := range createKeys(t) {
+		chain := createChain(t, key)
+		trusted := map[string]*x509.Certificate{"istio-root": chain[1]}
+		jks, err := EncodeJKS(key, chain, "istio", trusted, "secret")
+		if err != nil {
+			t.Errorf("Case %s: failed to encode (error: %v)", id, err)
+			continue
+		}
+
+		if _, err := decodeJKS(jks, "wrong password"); err == nil {
+			t.Errorf("Case %s: expecting an error for a wrong password", id)
+		}
+		store, err := decodeJKS(jks, "secret")
+		if err != nil {
+			t.Errorf("Case %s: failed to decode (error: %v)", id, err)
+			continue
+		}
+		if store.alias != "istio" || !reflect.DeepEqual(store.key, key) {
+			t.Errorf("Case %s: the key entry is not preserved", id)
+		}
+		if len(store.chain) != 2 || !bytes.Equal(store.chain[0], chain[0].Raw) ||
+			!bytes.Equal(store.chain[1], chain[1].Raw) {
+			t.Errorf("Case %s: the certificate chain is not preserved", id)
+		}
+		if !bytes.Equal(store.trusted["istio-root"], chain[1].Raw) {
+			t.Errorf("Case %s: the trusted certificate is not preserved", id)
+		}
+	}
+}
+
+func TestEncodeWithoutCertificate(t *testing.T) {
+	key := createKeys(t)["RSA"]
+	if _, err := EncodePKCS12(key, nil, "istio", "secret"); err == nil {
+		t.Error("Expecting an error for PKCS#12 without a certificate")
+	}
+	if _, err := EncodeJKS(key, nil, "istio", nil, "secret"); err == nil {
+		t.Error("Expecting an error for JKS without a certificate")
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// The test vector of the key derivation from RFC 7292 compatible
+	// implementations, e.g. Bouncy Castle's PKCS12ParametersGenerator tests.
+	salt := []byte{0x0A, 0x58, 0xCF, 0x64, 0x53, 0x0D, 0x82, 0x3F}
+	password, _ := bmpString("smeg")
+	expected := []byte{
+		0x8A, 0xAA, 0xE6, 0x29, 0x7B, 0x6C, 0xB0, 0x46, 0x42, 0xAB, 0x5B, 0x07, 0x78, 0x51, 0x28, 0x4E,
+		0xB7, 0x12, 0x8F, 0x1A, 0x2A, 0x7F, 0xBC, 0xA3,
+	}
+	if key := pkcs12KDF(password, salt, 1, pkcs12KeyID, 24); !bytes.Equal(key, expected) {
+		t.Errorf("Expecting key %x but got %x", expected, key)
+	}
+}
+
+type decodedJKS struct {
+	alias   string
+	key     crypto.PrivateKey
+	chain   [][]byte
+	trusted map[string][]byte
+}
+
+// decodeJKS decodes a JKS keystore as Java's KeyStore.load and getKey do.
+func decodeJKS(data []byte, password string) (*decodedJKS, error) {
+	encodedPassword := jksPassword(password)
+	if len(data) < sha1.Size {
+		return nil, fmt.Errorf("the keystore is too short")
+	}
+	content, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(encodedPassword)
+	h.Write([]byte(jksWhitener))
+	h.Write(content)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, fmt.Errorf("the keystore has been tampered with, or the password is incorrect")
+	}
+
+	r := bytes.NewReader(content)
+	var header struct{ Magic, Version, Count uint32 }
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != jksMagic || header.Version != jksVersion {
+		return nil, fmt.Errorf("invalid header %+v", header)
+	}
+
+	store := &decodedJKS{trusted: make(map[string][]byte)}
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		_ = binary.Read(r, binary.BigEndian, &tag)
+		alias := readUTF(r)
+		var timestamp uint64
+		_ = binary.Read(r, binary.BigEndian, &timestamp)
+		switch tag {
+		case jksPrivateKeyTag:
+			var info encryptedPrivateKeyInfo
+			if _, err := asn1.Unmarshal(readBytes(r), &info); err != nil {
+				return nil, err
+			}
+			key, err := recoverJKSKey(info.EncryptedData, encodedPassword)
+			if err != nil {
+				return nil, err
+			}
+			var count uint32
+			_ = binary.Read(r, binary.BigEndian, &count)
+			for j := uint32(0); j < count; j++ {
+				readUTF(r)
+				store.chain = append(store.chain, readBytes(r))
+			}
+			store.alias, store.key = alias, key
+		case jksTrustedCertTag:
+			readUTF(r)
+			store.trusted[alias] = readBytes(r)
+		default:
+			return nil, fmt.Errorf("unknown tag %d", tag)
+		}
+	}
+	return store, nil
+}
+
+func recoverJKSKey(protected, encodedPassword []byte) (crypto.PrivateKey, error) {
+	salt := protected[:sha1.Size]
+	encrypted := protected[sha1.Size : len(protected)-sha1.Size]
+	check := protected[len(protected)-sha1.Size:]
+
+	plaintext := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		h := sha1.New()
+		h.Write(encodedPassword)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			plaintext[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+	h := sha1.New()
+	h.Write(encodedPassword)
+	h.Write(plaintext)
+	if !bytes.Equal(h.Sum(nil), check) {
+		return nil, fmt.Errorf("the key cannot be recovered")
+	}
+	return x509.ParsePKCS8PrivateKey(plaintext)
+}
+
+func readUTF(r *bytes.Reader) string {
+	var n uint16
+	_ = binary.Read(r, binary.BigEndian, &n)
+	b := make([]byte, n)
+	_, _ = r.Read(b)
+	return string(b)
+}
+
+func readBytes(r *bytes.Reader) []byte {
+	var n uint32
+	_ = binary.Read(r, binary.BigEndian, &n)
+	b := make([]byte, n)
+	_, _ = r.Read(b)
+	return b
+}
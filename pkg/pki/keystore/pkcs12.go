@@ -0,0 +1,364 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keystore encodes keys and certificates into the keystore formats of
+// Java applications, i.e. PKCS#12 and JKS.
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+
+	"istio.io/auth/pkg/pki"
+)
+
+const (
+	// The number of iterations of the PKCS#12 key derivation.
+	pkcs12Iterations = 2048
+	pkcs12SaltLength = 20
+
+	// The IDs of the PKCS#12 key derivation (RFC 7292, appendix B.3).
+	pkcs12KeyID  = 1
+	pkcs12IVID   = 2
+	pkcs12MACID  = 3
+	pkcs12Rounds = 64
+)
+
+var (
+	oidData                     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPBEWithSHAAnd3KeyTDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA1                     = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodePKCS12 encodes the private key and the certificate chain, starting
+// with the certificate of the key, into a PKCS#12 keystore protected by the
+// password. The key is encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC, which
+// is supported by Java and OpenSSL, and the key entry is named alias.
+func EncodePKCS12(key crypto.PrivateKey, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("the certificate chain is empty")
+	}
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	localKeyID := sha1.Sum(chain[0].Raw)
+	attributes, err := bagAttributes(alias, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for i, cert := range chain {
+		bag, err := newCertBag(cert)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			bag.Attributes = attributes
+		}
+		certBags = append(certBags, bag)
+	}
+	keyBag, err := newShroudedKeyBag(key, encodedPassword)
+	if err != nil {
+		return nil, err
+	}
+	keyBag.Attributes = attributes
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{certBags, {keyBag}} {
+		info, err := newDataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, info)
+	}
+	authSafeBytes, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt, err := randomBytes(pkcs12SaltLength)
+	if err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(encodedPassword, macSalt, pkcs12Iterations, pkcs12MACID, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	_, _ = mac.Write(authSafeBytes)
+
+	authSafeContent, err := asn1.Marshal(authSafeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfx{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidData,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: authSafeContent},
+		},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+func newCertBag(cert *x509.Certificate) (safeBag, error) {
+	value, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{
+		ID:    oidCertBag,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+	}, nil
+}
+
+func newShroudedKeyBag(key crypto.PrivateKey, encodedPassword []byte) (safeBag, error) {
+	pkcs8, err := pki.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return safeBag{}, fmt.Errorf("failed to encode the private key (error: %v)", err)
+	}
+	salt, err := randomBytes(pkcs12SaltLength)
+	if err != nil {
+		return safeBag{}, err
+	}
+	encrypted, err := pbeEncrypt(pkcs8, encodedPassword, salt, pkcs12Iterations)
+	if err != nil {
+		return safeBag{}, err
+	}
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return safeBag{}, err
+	}
+	value, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTDESCBC,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{
+		ID:    oidPKCS8ShroudedKeyBag,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+	}, nil
+}
+
+// bagAttributes returns the attributes that bind the key and its certificate:
+// the friendly name, which Java uses as the alias, and the local key ID.
+func bagAttributes(alias string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	name, err := bmpString(alias)
+	if err != nil {
+		return nil, err
+	}
+	// The trailing null of the BMPString is only used by the key derivation.
+	encodedName, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return nil, err
+	}
+	encodedKeyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+			IsCompound: true, Bytes: encodedName}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+			IsCompound: true, Bytes: encodedKeyID}},
+	}, nil
+}
+
+func newDataContentInfo(bags []safeBag) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	content, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{
+		ContentType: oidData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	}, nil
+}
+
+// pbeEncrypt encrypts the data with pbeWithSHAAnd3-KeyTripleDES-CBC.
+func pbeEncrypt(data, encodedPassword, salt []byte, iterations int) ([]byte, error) {
+	key := pkcs12KDF(encodedPassword, salt, iterations, pkcs12KeyID, 24)
+	iv := pkcs12KDF(encodedPassword, salt, iterations, pkcs12IVID, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := des.BlockSize - len(data)%des.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+	return encrypted, nil
+}
+
+// pkcs12KDF derives a key of the given size from the password with SHA-1, as
+// specified by RFC 7292, appendix B.2.
+func pkcs12KDF(encodedPassword, salt []byte, iterations int, id byte, size int) []byte {
+	const u = sha1.Size
+	const v = pkcs12Rounds
+
+	d := bytes.Repeat([]byte{id}, v)
+	s := fillBlocks(salt, v)
+	p := fillBlocks(encodedPassword, v)
+	i := append(s, p...)
+
+	var result []byte
+	for len(result) < size {
+		h := sha1.New()
+		_, _ = h.Write(d)
+		_, _ = h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		result = append(result, a...)
+		if len(result) >= size {
+			break
+		}
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v-byte block I_j of I.
+		b := new(big.Int).SetBytes(fillBlocks(a, v)[:v])
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(i); j += v {
+			ij := new(big.Int).SetBytes(i[j : j+v])
+			ij.Add(ij, b)
+			sum := ij.Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			block := i[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(sum):], sum)
+		}
+	}
+	return result[:size:size]
+}
+
+// fillBlocks concatenates copies of data to fill whole blocks of the given
+// size. Empty data stays empty.
+func fillBlocks(data []byte, size int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	n := size * ((len(data) + size - 1) / size)
+	filled := make([]byte, n)
+	for i := range filled {
+		filled[i] = data[i%len(data)]
+	}
+	return filled
+}
+
+// bmpString encodes the string in UCS-2 big-endian with a trailing null, as
+// required by the PKCS#12 key derivation.
+func bmpString(s string) ([]byte, error) {
+	encoded := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xFFFF || utf16.IsSurrogate(r) {
+			return nil, fmt.Errorf("the character %q cannot be encoded in a BMPString", r)
+		}
+		encoded = append(encoded, byte(r>>8), byte(r))
+	}
+	return append(encoded, 0, 0), nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes (error: %v)", err)
+	}
+	return b, nil
+}
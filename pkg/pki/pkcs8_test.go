@@ -0,0 +1,86 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+func TestMarshalPKCS8PrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[string]struct {
+		key         crypto.PrivateKey
+		expectedErr bool
+	}{
+		"RSA":         {key: rsaKey},
+		"ECDSA P-224": {key: generateECKey(t, elliptic.P224())},
+		"ECDSA P-256": {key: generateECKey(t, elliptic.P256())},
+		"ECDSA P-384": {key: generateECKey(t, elliptic.P384())},
+		"ECDSA P-521": {key: generateECKey(t, elliptic.P521())},
+		"Unsupported": {key: "key", expectedErr: true},
+	}
+	for id, tc := range testCases {
+		der, err := MarshalPKCS8PrivateKey(tc.key)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("Case %s: expecting an error", id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+			continue
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			t.Errorf("Case %s: failed to parse the PKCS#8 key (error: %v)", id, err)
+			continue
+		}
+		if !samePrivateKey(parsed, tc.key) {
+			t.Errorf("Case %s: the parsed key does not match the marshaled one", id)
+		}
+	}
+}
+
+func generateECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// samePrivateKey returns whether the private keys have the same type and
+// private value.
+func samePrivateKey(a, b crypto.PrivateKey) bool {
+	switch ka := a.(type) {
+	case *rsa.PrivateKey:
+		kb, ok := b.(*rsa.PrivateKey)
+		return ok && ka.N.Cmp(kb.N) == 0 && ka.D.Cmp(kb.D) == 0
+	case *ecdsa.PrivateKey:
+		kb, ok := b.(*ecdsa.PrivateKey)
+		return ok && ka.Curve == kb.Curve && ka.D.Cmp(kb.D) == 0
+	}
+	return false
+}
@@ -15,7 +15,7 @@
 package testutil
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"fmt"
 	"reflect"
@@ -80,7 +80,8 @@ func VerifyCertificate(privPem []byte, certChainPem []byte, rootCertPem []byte,
 		return err
 	}
 
-	if !reflect.DeepEqual(priv.(*rsa.PrivateKey).PublicKey, *cert.PublicKey.(*rsa.PublicKey)) {
+	signer, ok := priv.(crypto.Signer)
+	if !ok || !reflect.DeepEqual(signer.Public(), cert.PublicKey) {
 		return fmt.Errorf("the generated private key and cert doesn't match")
 	}
 
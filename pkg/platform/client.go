@@ -18,6 +18,8 @@ import (
 	"fmt"
 
 	"google.golang.org/grpc"
+
+	"istio.io/auth/pkg/tlspolicy"
 )
 
 // ClientConfig consists of the platform client configuration.
@@ -28,6 +30,11 @@ type ClientConfig struct {
 	KeyFile string
 	// The cert chain file
 	CertChainFile string
+	// The projected service account token file of a Kubernetes pod.
+	ServiceAccountTokenFile string
+	// The TLS policy of the connections to the CA. The allowed SANs, if any,
+	// are checked against the certificate of the CA.
+	TLSPolicy tlspolicy.Options
 }
 
 // Client is the interface for implementing the client to access platform metadata.
@@ -53,6 +60,8 @@ func NewClient(platform string, config ClientConfig, caAddr string) (Client, err
 		return NewGcpClientImpl(caAddr), nil
 	case "aws":
 		return NewAwsClientImpl(), nil
+	case "k8s":
+		return NewKubernetesClientImpl(config.ServiceAccountTokenFile), nil
 	default:
 		return nil, fmt.Errorf("Invalid env %s specified", platform)
 	}
@@ -0,0 +1,118 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"istio.io/auth/pkg/pki/ca"
+)
+
+const (
+	// The environment variables of the pod, which are set through the
+	// downward API by the injected init container.
+	podNameEnv        = "POD_NAME"
+	podNamespaceEnv   = "POD_NAMESPACE"
+	podIPEnv          = "POD_IP"
+	serviceAccountEnv = "SERVICE_ACCOUNT"
+)
+
+// KubernetesClientImpl is the client of a Kubernetes pod that requests a
+// pod-scoped certificate with its projected service account token.
+type KubernetesClientImpl struct {
+	tokenFile string
+
+	podName        string
+	podNamespace   string
+	podIP          string
+	serviceAccount string
+}
+
+// NewKubernetesClientImpl creates a new KubernetesClientImpl with the token
+// in the given file, and the pod from the environment.
+func NewKubernetesClientImpl(tokenFile string) *KubernetesClientImpl {
+	return &KubernetesClientImpl{
+		tokenFile:      tokenFile,
+		podName:        os.Getenv(podNameEnv),
+		podNamespace:   os.Getenv(podNamespaceEnv),
+		podIP:          os.Getenv(podIPEnv),
+		serviceAccount: os.Getenv(serviceAccountEnv),
+	}
+}
+
+// GetDialOptions returns the GRPC dial options to connect to the CA, which
+// carry the service account token of the pod.
+func (ci *KubernetesClientImpl) GetDialOptions(cfg *ClientConfig) ([]grpc.DialOption, error) {
+	token, err := ci.GetAgentCredential()
+	if err != nil {
+		return nil, err
+	}
+
+	rootCert, err := ioutil.ReadFile(cfg.RootCACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA cert: %s", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(rootCert) {
+		return nil, fmt.Errorf("Failed to append certificates")
+	}
+	config := tls.Config{RootCAs: certPool}
+	if err := cfg.TLSPolicy.Apply(&config); err != nil {
+		return nil, fmt.Errorf("Invalid TLS policy: %s", err)
+	}
+
+	return []grpc.DialOption{
+		grpc.WithPerRPCCredentials(&jwtAccess{string(token)}),
+		grpc.WithTransportCredentials(credentials.NewTLS(&config)),
+	}, nil
+}
+
+// IsProperPlatform returns whether the pod and its service account token are
+// available.
+func (ci *KubernetesClientImpl) IsProperPlatform() bool {
+	if ci.podName == "" || ci.podNamespace == "" || ci.serviceAccount == "" {
+		return false
+	}
+	_, err := os.Stat(ci.tokenFile)
+	return err == nil
+}
+
+// GetServiceIdentity returns the comma-separated identities of the pod, i.e.
+// the identity of its service account and its DNS names.
+func (ci *KubernetesClientImpl) GetServiceIdentity() (string, error) {
+	return strings.Join(ca.PodIdentities(ci.serviceAccount, ci.podNamespace, ci.podName, ci.podIP), ","), nil
+}
+
+// GetAgentCredential returns the service account token of the pod.
+func (ci *KubernetesClientImpl) GetAgentCredential() ([]byte, error) {
+	token, err := ioutil.ReadFile(ci.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the service account token: %s", err)
+	}
+	return []byte(strings.TrimSpace(string(token))), nil
+}
+
+// GetCredentialType returns "k8s".
+func (ci *KubernetesClientImpl) GetCredentialType() string {
+	return "k8s"
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubernetesClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &KubernetesClientImpl{
+		tokenFile:      tokenFile,
+		podName:        "pod",
+		podNamespace:   "default",
+		podIP:          "10.0.0.1",
+		serviceAccount: "sa",
+	}
+	if !client.IsProperPlatform() {
+		t.Errorf("Expecting the pod to be a proper platform")
+	}
+	expectedID := "spiffe://cluster.local/ns/default/sa/sa,pod.default.pod.cluster.local," +
+		"10-0-0-1.default.pod.cluster.local"
+	if id, err := client.GetServiceIdentity(); err != nil || id != expectedID {
+		t.Errorf("Expecting identity %q but got %q (error %v)", expectedID, id, err)
+	}
+	if token, err := client.GetAgentCredential(); err != nil || string(token) != "token" {
+		t.Errorf("Expecting credential %q but got %q (error %v)", "token", token, err)
+	}
+	if options, err := client.GetDialOptions(&ClientConfig{RootCACertFile: "testdata/cert-root-good.pem"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if len(options) != 2 {
+		t.Errorf("Expecting 2 dial options but got %d", len(options))
+	}
+	if _, err := client.GetDialOptions(&ClientConfig{RootCACertFile: "testdata/missing.pem"}); err == nil {
+		t.Errorf("Expecting an error for a missing root certificate")
+	}
+
+	withoutToken := *client
+	withoutToken.tokenFile = filepath.Join(dir, "missing")
+	if withoutToken.IsProperPlatform() {
+		t.Errorf("Expecting a pod without token not to be a proper platform")
+	}
+	withoutPod := *client
+	withoutPod.podName = ""
+	if withoutPod.IsProperPlatform() {
+		t.Errorf("Expecting a pod without name not to be a proper platform")
+	}
+}
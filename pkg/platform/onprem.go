@@ -24,6 +24,7 @@ import (
 	"google.golang.org/grpc/credentials"
 
 	"istio.io/auth/pkg/pki"
+	"istio.io/auth/pkg/tlspolicy"
 )
 
 // OnPremClientImpl is the implementation of on premise metadata client.
@@ -38,7 +39,7 @@ func NewOnPremClientImpl(certChainFile string) *OnPremClientImpl {
 
 // GetDialOptions returns the GRPC dial options to connect to the CA.
 func (ci *OnPremClientImpl) GetDialOptions(cfg *ClientConfig) ([]grpc.DialOption, error) {
-	transportCreds, err := getTLSCredentials(cfg.CertChainFile, cfg.KeyFile, cfg.RootCACertFile)
+	transportCreds, err := getTLSCredentials(cfg.CertChainFile, cfg.KeyFile, cfg.RootCACertFile, &cfg.TLSPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +88,7 @@ func (ci *OnPremClientImpl) GetCredentialType() string {
 // getTLSCredentials creates transport credentials that are common to
 // node agent and CA.
 func getTLSCredentials(certificateFile string, keyFile string,
-	caCertFile string) (credentials.TransportCredentials, error) {
+	caCertFile string, policy *tlspolicy.Options) (credentials.TransportCredentials, error) {
 
 	// Load the certificate from disk
 	certificate, err := tls.LoadX509KeyPair(certificateFile, keyFile)
@@ -112,5 +113,9 @@ func getTLSCredentials(certificateFile string, keyFile string,
 	}
 	config.RootCAs = certPool
 
+	if err := policy.Apply(&config); err != nil {
+		return nil, fmt.Errorf("Invalid TLS policy: %s", err)
+	}
+
 	return credentials.NewTLS(&config), nil
 }
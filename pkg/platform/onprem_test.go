@@ -18,6 +18,8 @@ import (
 	"bytes"
 	"io/ioutil"
 	"testing"
+
+	"istio.io/auth/pkg/tlspolicy"
 )
 
 func TestGetServiceIdentity(t *testing.T) {
@@ -92,6 +94,15 @@ func TestGetTLSCredentials(t *testing.T) {
 			},
 			expectedErr: "Failed to read CA cert: open testdata/cert-root-not-exist.pem: no such file or directory",
 		},
+		"Invalid TLS policy": {
+			config: &ClientConfig{
+				CertChainFile:  "testdata/cert-from-root-good.pem",
+				KeyFile:        "testdata/key-from-root-good.pem",
+				RootCACertFile: "testdata/cert-root-good.pem",
+				TLSPolicy:      tlspolicy.Options{MinVersion: "0.9"},
+			},
+			expectedErr: "Invalid TLS policy: unsupported TLS version \"0.9\"",
+		},
 	}
 
 	for id, c := range testCases {
@@ -0,0 +1,144 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// ChallengeHTTP01 is the type of the http-01 challenge (https://tools.ietf.org/html/rfc8555#section-8.3).
+	ChallengeHTTP01 = "http-01"
+	// ChallengeDNS01 is the type of the dns-01 challenge (https://tools.ietf.org/html/rfc8555#section-8.4).
+	ChallengeDNS01 = "dns-01"
+
+	http01PathPrefix = "/.well-known/acme-challenge/"
+	dns01LabelPrefix = "_acme-challenge."
+
+	// The maximum size of a http-01 challenge response the validator reads.
+	maxHTTP01ResponseSize = 1024
+	validationTimeout     = 10 * time.Second
+)
+
+// ChallengeValidator verifies that an ACME client controls a domain name by
+// checking the provisioned response of a challenge.
+type ChallengeValidator interface {
+	// Validate returns nil if the response to the challenge of the given type
+	// for the domain carries the expected key authorization.
+	Validate(challengeType, domain, token, keyAuthorization string) error
+}
+
+// Resolver looks up DNS TXT records. It is used by the dns-01 challenge.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (r netResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// challengeValidator validates http-01 challenges over HTTP and dns-01
+// challenges with the given resolver.
+type challengeValidator struct {
+	client   *http.Client
+	resolver Resolver
+}
+
+// NewChallengeValidator returns a ChallengeValidator that fetches http-01
+// responses with the given HTTP client, and looks up dns-01 responses with
+// the given resolver. The system defaults are used for nil arguments.
+func NewChallengeValidator(client *http.Client, resolver Resolver) ChallengeValidator {
+	if client == nil {
+		client = &http.Client{
+			Timeout: validationTimeout,
+			// The challenge response must be served by the domain itself.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	if resolver == nil {
+		resolver = netResolver{}
+	}
+	return &challengeValidator{client: client, resolver: resolver}
+}
+
+func (v *challengeValidator) Validate(challengeType, domain, token, keyAuthorization string) error {
+	switch challengeType {
+	case ChallengeHTTP01:
+		return v.validateHTTP01(domain, token, keyAuthorization)
+	case ChallengeDNS01:
+		return v.validateDNS01(domain, keyAuthorization)
+	default:
+		return fmt.Errorf("unsupported challenge type %q", challengeType)
+	}
+}
+
+func (v *challengeValidator) validateHTTP01(domain, token, keyAuthorization string) error {
+	url := fmt.Sprintf("http://%s%s%s", domain, http01PathPrefix, token)
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s (error: %v)", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d from %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTP01ResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read the response from %s (error: %v)", url, err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(body), []byte(keyAuthorization)) {
+		return fmt.Errorf("the key authorization served at %s does not match", url)
+	}
+	return nil
+}
+
+func (v *challengeValidator) validateDNS01(domain, keyAuthorization string) error {
+	name := dns01LabelPrefix + domain
+	records, err := v.resolver.LookupTXT(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT records of %s (error: %v)", name, err)
+	}
+
+	expected := dns01Digest(keyAuthorization)
+	for _, r := range records {
+		if r == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record of %s matches the key authorization", name)
+}
+
+// dns01Digest returns the value of the TXT record expected by a dns-01
+// challenge.
+func dns01Digest(keyAuthorization string) string {
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
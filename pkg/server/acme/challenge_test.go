@@ -0,0 +1,139 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, fmt.Errorf("no such host %s", name)
+}
+
+func TestValidateHTTP01(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host != "foo.ns.svc.cluster.local":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == http01PathPrefix+"token":
+			fmt.Fprint(w, "token.thumbprint\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// Every domain resolves to the test server.
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	v := NewChallengeValidator(client, nil)
+
+	testCases := map[string]struct {
+		domain      string
+		token       string
+		keyAuth     string
+		expectedErr bool
+	}{
+		"Matching key authorization": {
+			domain:  "foo.ns.svc.cluster.local",
+			token:   "token",
+			keyAuth: "token.thumbprint",
+		},
+		"Mismatched key authorization": {
+			domain:      "foo.ns.svc.cluster.local",
+			token:       "token",
+			keyAuth:     "token.other",
+			expectedErr: true,
+		},
+		"Missing response": {
+			domain:      "foo.ns.svc.cluster.local",
+			token:       "missing",
+			keyAuth:     "missing.thumbprint",
+			expectedErr: true,
+		},
+		"Different domain": {
+			domain:      "bar.ns.svc.cluster.local",
+			token:       "token",
+			keyAuth:     "token.thumbprint",
+			expectedErr: true,
+		},
+	}
+
+	for id, tc := range testCases {
+		err := v.Validate(ChallengeHTTP01, tc.domain, tc.token, tc.keyAuth)
+		if tc.expectedErr != (err != nil) {
+			t.Errorf("Case %q: expecting error %t but got %v", id, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestValidateDNS01(t *testing.T) {
+	resolver := fakeResolver{
+		"_acme-challenge.foo.ns.svc.cluster.local": {"unrelated", dns01Digest("token.thumbprint")},
+	}
+	v := NewChallengeValidator(nil, resolver)
+
+	testCases := map[string]struct {
+		domain      string
+		keyAuth     string
+		expectedErr bool
+	}{
+		"Matching TXT record": {
+			domain:  "foo.ns.svc.cluster.local",
+			keyAuth: "token.thumbprint",
+		},
+		"No matching TXT record": {
+			domain:      "foo.ns.svc.cluster.local",
+			keyAuth:     "token.other",
+			expectedErr: true,
+		},
+		"No TXT record": {
+			domain:      "bar.ns.svc.cluster.local",
+			keyAuth:     "token.thumbprint",
+			expectedErr: true,
+		},
+	}
+
+	for id, tc := range testCases {
+		err := v.Validate(ChallengeDNS01, tc.domain, "token", tc.keyAuth)
+		if tc.expectedErr != (err != nil) {
+			t.Errorf("Case %q: expecting error %t but got %v", id, tc.expectedErr, err)
+		}
+	}
+}
+
+func TestValidateUnsupportedChallenge(t *testing.T) {
+	v := NewChallengeValidator(nil, fakeResolver{})
+	if err := v.Validate("tls-alpn-01", "foo.ns.svc.cluster.local", "token", "token.thumbprint"); err == nil {
+		t.Error("Expecting an error for an unsupported challenge type")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	contentTypeJOSE = "application/jose+json"
+
+	// The maximum size of a JWS request body.
+	maxRequestSize = 64 * 1024
+)
+
+// The signature algorithms accepted on requests. MAC-based algorithms and
+// "none" are not allowed (https://tools.ietf.org/html/rfc8555#section-6.2).
+var allowedSignatureAlgorithms = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.RS384): true,
+	string(jose.RS512): true,
+	string(jose.PS256): true,
+	string(jose.PS384): true,
+	string(jose.PS512): true,
+	string(jose.ES256): true,
+	string(jose.ES384): true,
+	string(jose.ES512): true,
+}
+
+// signedRequest is an authenticated ACME request.
+type signedRequest struct {
+	payload []byte
+	// The JWK in the protected header, set for requests that are signed by the
+	// JWK rather than an account.
+	jwk *jose.JSONWebKey
+	// The account that signs the request, set for requests that are signed by
+	// an account key.
+	account *account
+}
+
+// isPostAsGet indicates whether the request is a POST-as-GET request
+// (https://tools.ietf.org/html/rfc8555#section-6.3).
+func (r *signedRequest) isPostAsGet() bool {
+	return len(r.payload) == 0
+}
+
+// verifyRequest verifies the JWS-encoded body of the request, and consumes
+// its nonce. If embeddedKey is true, the request must be signed by the JWK in
+// its protected header; otherwise it must be signed by an existing account.
+func (s *Server) verifyRequest(r *http.Request, embeddedKey bool) (*signedRequest, *problem) {
+	if ct := r.Header.Get("Content-Type"); ct != contentTypeJOSE {
+		return nil, newProblem(errMalformed, http.StatusUnsupportedMediaType,
+			"the content type must be %q but got %q", contentTypeJOSE, ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "failed to read the request body (error: %v)", err)
+	}
+
+	// ACME requires the flattened JSON serialization with all the header
+	// parameters protected (https://tools.ietf.org/html/rfc8555#section-6.2).
+	flattened := struct {
+		Protected  string          `json:"protected"`
+		Header     json.RawMessage `json:"header"`
+		Signatures json.RawMessage `json:"signatures"`
+	}{}
+	if err := json.Unmarshal(body, &flattened); err != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "failed to parse the JWS (error: %v)", err)
+	}
+	if flattened.Protected == "" || flattened.Header != nil || flattened.Signatures != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest,
+			"the JWS must be flattened and only have a protected header")
+	}
+
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "failed to parse the JWS (error: %v)", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "the JWS must have exactly one signature")
+	}
+
+	header := jws.Signatures[0].Header
+	if !allowedSignatureAlgorithms[header.Algorithm] {
+		return nil, newProblem(errBadSignatureAlgorithm, http.StatusBadRequest,
+			"unsupported signature algorithm %q", header.Algorithm)
+	}
+
+	if url, _ := header.ExtraHeaders["url"].(string); url != s.baseURL+r.URL.Path {
+		return nil, newProblem(errUnauthorized, http.StatusUnauthorized,
+			"the URL in the protected header %q does not match the request", url)
+	}
+
+	if header.Nonce == "" || !s.store.consumeNonce(header.Nonce) {
+		return nil, newProblem(errBadNonce, http.StatusBadRequest, "the nonce %q is invalid", header.Nonce)
+	}
+
+	req := &signedRequest{}
+	var key interface{}
+	if embeddedKey {
+		jwk := header.JSONWebKey
+		if jwk == nil || header.KeyID != "" {
+			return nil, newProblem(errMalformed, http.StatusBadRequest,
+				"the request must be signed with a JWK in the protected header")
+		}
+		if !jwk.Valid() || !jwk.IsPublic() {
+			return nil, newProblem(errBadPublicKey, http.StatusBadRequest, "the JWK is not a valid public key")
+		}
+		req.jwk = jwk
+		key = jwk
+	} else {
+		if header.JSONWebKey != nil {
+			return nil, newProblem(errMalformed, http.StatusBadRequest,
+				"the request must be signed with an account key ID")
+		}
+		acct, status := s.lookupAccount(header.KeyID)
+		if acct == nil {
+			return nil, newProblem(errAccountDoesNotExist, http.StatusBadRequest,
+				"the account %q does not exist", header.KeyID)
+		}
+		if status != statusValid {
+			return nil, newProblem(errUnauthorized, http.StatusUnauthorized, "the account is %s", status)
+		}
+		req.account = acct
+		key = acct.key
+	}
+
+	req.payload, err = jws.Verify(key)
+	if err != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "failed to verify the JWS (error: %v)", err)
+	}
+	return req, nil
+}
+
+// lookupAccount returns the account identified by the given account URL,
+// together with its current status.
+func (s *Server) lookupAccount(kid string) (*account, string) {
+	prefix := s.baseURL + accountPath
+	if !strings.HasPrefix(kid, prefix) {
+		return nil, ""
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+	acct, ok := s.store.accounts[strings.TrimPrefix(kid, prefix)]
+	if !ok {
+		return nil, ""
+	}
+	return acct, acct.status
+}
+
+// keyThumbprint returns the base64url-encoded SHA-256 thumbprint of the JWK
+// (https://tools.ietf.org/html/rfc7638).
+func keyThumbprint(jwk *jose.JSONWebKey) (string, error) {
+	tp, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(tp), nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import "fmt"
+
+const contentTypeProblem = "application/problem+json"
+
+// ACME error types (https://tools.ietf.org/html/rfc8555#section-6.7).
+const (
+	errAccountDoesNotExist   = "urn:ietf:params:acme:error:accountDoesNotExist"
+	errBadCSR                = "urn:ietf:params:acme:error:badCSR"
+	errBadNonce              = "urn:ietf:params:acme:error:badNonce"
+	errBadPublicKey          = "urn:ietf:params:acme:error:badPublicKey"
+	errBadSignatureAlgorithm = "urn:ietf:params:acme:error:badSignatureAlgorithm"
+	errIncorrectResponse     = "urn:ietf:params:acme:error:incorrectResponse"
+	errInvalidContact        = "urn:ietf:params:acme:error:invalidContact"
+	errMalformed             = "urn:ietf:params:acme:error:malformed"
+	errOrderNotReady         = "urn:ietf:params:acme:error:orderNotReady"
+	errRejectedIdentifier    = "urn:ietf:params:acme:error:rejectedIdentifier"
+	errServerInternal        = "urn:ietf:params:acme:error:serverInternal"
+	errUnauthorized          = "urn:ietf:params:acme:error:unauthorized"
+	errUnsupportedIdentifier = "urn:ietf:params:acme:error:unsupportedIdentifier"
+)
+
+// problem is a problem document (https://tools.ietf.org/html/rfc7807) that
+// describes an ACME error.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func newProblem(errType string, status int, format string, args ...interface{}) *problem {
+	return &problem{
+		Type:   errType,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
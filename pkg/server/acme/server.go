@@ -0,0 +1,772 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"istio.io/auth/pkg/pki"
+	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/server/servingcert"
+)
+
+// The paths of the ACME resources.
+const (
+	directoryPath  = "/acme/directory"
+	newNoncePath   = "/acme/new-nonce"
+	newAccountPath = "/acme/new-account"
+	newOrderPath   = "/acme/new-order"
+	accountPath    = "/acme/acct/"
+	orderPath      = "/acme/order/"
+	authzPath      = "/acme/authz/"
+	challengePath  = "/acme/chall/"
+	certPath       = "/acme/cert/"
+
+	ordersSuffix   = "/orders"
+	finalizeSuffix = "/finalize"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypePEMChain = "application/pem-certificate-chain"
+	headerReplayNonce   = "Replay-Nonce"
+	headerLink          = "Link"
+	headerLocation      = "Location"
+	contactSchemeMailto = "mailto:"
+)
+
+// Server implements an ACME (https://tools.ietf.org/html/rfc8555) directory
+// that issues certificates for DNS names through the Istio CA. The names must
+// be allowed by the CA hostname policy, and the client must prove control of
+// them through a http-01 or dns-01 challenge.
+type Server struct {
+	ca        ca.CertificateAuthority
+	policy    *ca.HostnamePolicy
+	validator ChallengeValidator
+	store     *store
+	mux       *http.ServeMux
+
+	baseURL     string
+	port        int
+	certManager *servingcert.Manager
+}
+
+// New creates a new ACME server that serves on the given hostname and port,
+// with the serving certificate provided by the manager.
+func New(ca ca.CertificateAuthority, policy *ca.HostnamePolicy, validator ChallengeValidator,
+	hostname string, port int, certManager *servingcert.Manager) *Server {
+
+	s := &Server{
+		ca:          ca,
+		policy:      policy,
+		validator:   validator,
+		store:       newStore(),
+		mux:         http.NewServeMux(),
+		baseURL:     fmt.Sprintf("https://%s:%d", hostname, port),
+		port:        port,
+		certManager: certManager,
+	}
+
+	s.mux.HandleFunc(directoryPath, s.handleDirectory)
+	s.mux.HandleFunc(newNoncePath, s.handleNewNonce)
+	s.mux.HandleFunc(newAccountPath, s.handleNewAccount)
+	s.mux.HandleFunc(newOrderPath, s.handleNewOrder)
+	s.mux.HandleFunc(accountPath, s.handleAccount)
+	s.mux.HandleFunc(orderPath, s.handleOrder)
+	s.mux.HandleFunc(authzPath, s.handleAuthorization)
+	s.mux.HandleFunc(challengePath, s.handleChallenge)
+	s.mux.HandleFunc(certPath, s.handleCertificate)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Run starts a HTTPS server for the ACME directory on the specified port.
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %d (error: %v)", s.port, err)
+	}
+
+	config := &tls.Config{GetCertificate: s.certManager.GetCertificate}
+	server := &http.Server{Handler: s}
+
+	// server.Serve() is a blocking call, so run it in a goroutine.
+	go func() {
+		glog.Infof("Starting ACME server on port %d", s.port)
+
+		err := server.Serve(tls.NewListener(listener, config))
+
+		// server.Serve() always returns a non-nil error.
+		glog.Warningf("ACME server returns an error: %v", err)
+	}()
+
+	return nil
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusMethodNotAllowed, "method %s is not allowed", r.Method))
+		return
+	}
+
+	// revokeCert and keyChange are deliberately not offered: the CA does not
+	// publish revocations, so the certificates are kept short-lived instead,
+	// and an account changes its key by registering a new account.
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.baseURL + newNoncePath,
+		"newAccount": s.baseURL + newAccountPath,
+		"newOrder":   s.baseURL + newOrderPath,
+		"meta": map[string]interface{}{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *Server) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headerReplayNonce, s.store.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(headerLink, s.link(directoryPath, "index"))
+
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type accountRequest struct {
+	Contact              []string `json:"contact"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	Status               string   `json:"status"`
+}
+
+type accountResponse struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, true)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	ar := &accountRequest{}
+	if err := json.Unmarshal(req.payload, ar); err != nil {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest, "invalid account request (error: %v)", err))
+		return
+	}
+
+	thumbprint, err := keyThumbprint(req.jwk)
+	if err != nil {
+		s.writeProblem(w, newProblem(errBadPublicKey, http.StatusBadRequest, "invalid account key (error: %v)", err))
+		return
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	if acct, exists := s.store.accountsByKey[thumbprint]; exists {
+		w.Header().Set(headerLocation, s.baseURL+accountPath+acct.id)
+		s.writeJSON(w, http.StatusOK, s.accountResponse(acct))
+		return
+	}
+	if ar.OnlyReturnExisting {
+		s.writeProblem(w, newProblem(errAccountDoesNotExist, http.StatusBadRequest, "no account exists for the key"))
+		return
+	}
+	if p := validateContacts(ar.Contact); p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	acct := &account{
+		id:         randomID(),
+		status:     statusValid,
+		contact:    ar.Contact,
+		key:        req.jwk,
+		thumbprint: thumbprint,
+	}
+	s.store.accounts[acct.id] = acct
+	s.store.accountsByKey[thumbprint] = acct
+
+	glog.Infof("ACME account %s has been created", acct.id)
+
+	w.Header().Set(headerLocation, s.baseURL+accountPath+acct.id)
+	s.writeJSON(w, http.StatusCreated, s.accountResponse(acct))
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, accountPath)
+	listOrders := strings.HasSuffix(id, ordersSuffix)
+	id = strings.TrimSuffix(id, ordersSuffix)
+	if id != req.account.id {
+		s.writeProblem(w, newProblem(errUnauthorized, http.StatusForbidden, "the request is not signed by the account"))
+		return
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	acct := req.account
+	if listOrders {
+		urls := []string{}
+		for _, id := range acct.orderIDs {
+			urls = append(urls, s.baseURL+orderPath+id)
+		}
+		s.writeJSON(w, http.StatusOK, map[string][]string{"orders": urls})
+		return
+	}
+
+	if !req.isPostAsGet() {
+		ar := &accountRequest{}
+		if err := json.Unmarshal(req.payload, ar); err != nil {
+			s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest, "invalid account request (error: %v)", err))
+			return
+		}
+		if ar.Contact != nil {
+			if p := validateContacts(ar.Contact); p != nil {
+				s.writeProblem(w, p)
+				return
+			}
+			acct.contact = ar.Contact
+		}
+		switch ar.Status {
+		case "":
+		case statusDeactivated:
+			acct.status = statusDeactivated
+			glog.Infof("ACME account %s has been deactivated", acct.id)
+		default:
+			s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest, "cannot update the status to %q", ar.Status))
+			return
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, s.accountResponse(acct))
+}
+
+type orderRequest struct {
+	Identifiers []identifier `json:"identifiers"`
+	NotBefore   string       `json:"notBefore"`
+	NotAfter    string       `json:"notAfter"`
+}
+
+type orderResponse struct {
+	Status         string       `json:"status"`
+	Expires        string       `json:"expires"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *problem     `json:"error,omitempty"`
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	or := &orderRequest{}
+	if err := json.Unmarshal(req.payload, or); err != nil {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest, "invalid order request (error: %v)", err))
+		return
+	}
+	if or.NotBefore != "" || or.NotAfter != "" {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest,
+			"notBefore and notAfter are not supported, the validity is determined by the CA"))
+		return
+	}
+	if len(or.Identifiers) == 0 {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest, "the order has no identifier"))
+		return
+	}
+
+	ids := []identifier{}
+	seen := make(map[string]bool)
+	for _, id := range or.Identifiers {
+		if id.Type != identifierTypeDNS {
+			s.writeProblem(w, newProblem(errUnsupportedIdentifier, http.StatusBadRequest,
+				"unsupported identifier type %q", id.Type))
+			return
+		}
+		name := strings.ToLower(id.Value)
+		if !s.policy.IsAllowed(name) {
+			s.writeProblem(w, newProblem(errRejectedIdentifier, http.StatusBadRequest,
+				"the CA policy does not allow issuing certificates for %q", id.Value))
+			return
+		}
+		if !seen[name] {
+			seen[name] = true
+			ids = append(ids, identifier{Type: identifierTypeDNS, Value: name})
+		}
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	now := time.Now()
+	s.store.prune(now)
+	o := &order{
+		id:          randomID(),
+		accountID:   req.account.id,
+		status:      statusPending,
+		expires:     now.Add(orderTTL),
+		identifiers: ids,
+	}
+	for _, id := range ids {
+		o.authzIDs = append(o.authzIDs, s.newAuthorization(o, id).id)
+	}
+	s.store.orders[o.id] = o
+	req.account.orderIDs = append(req.account.orderIDs, o.id)
+
+	w.Header().Set(headerLocation, s.baseURL+orderPath+o.id)
+	s.writeJSON(w, http.StatusCreated, s.orderResponse(o))
+}
+
+// newAuthorization creates a pending authorization for the identifier of the
+// order. The caller must hold the store lock.
+func (s *Server) newAuthorization(o *order, id identifier) *authorization {
+	authz := &authorization{
+		id:         randomID(),
+		accountID:  o.accountID,
+		orderID:    o.id,
+		status:     statusPending,
+		expires:    o.expires,
+		identifier: id,
+	}
+
+	// A wildcard name can only be validated with a dns-01 challenge on its
+	// base domain (https://tools.ietf.org/html/rfc8555#section-7.1.3).
+	types := []string{ChallengeHTTP01, ChallengeDNS01}
+	if strings.HasPrefix(id.Value, "*.") {
+		authz.identifier.Value = strings.TrimPrefix(id.Value, "*.")
+		authz.wildcard = true
+		types = []string{ChallengeDNS01}
+	}
+
+	for _, t := range types {
+		c := &challenge{
+			id:      randomID(),
+			authzID: authz.id,
+			typ:     t,
+			token:   randomID(),
+			status:  statusPending,
+		}
+		s.store.challenges[c.id] = c
+		authz.challengeIDs = append(authz.challengeIDs, c.id)
+	}
+	s.store.authorizations[authz.id] = authz
+	return authz
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, orderPath)
+	finalize := strings.HasSuffix(id, finalizeSuffix)
+	id = strings.TrimSuffix(id, finalizeSuffix)
+
+	s.store.Lock()
+	o, exists := s.store.orders[id]
+	if !exists || o.accountID != req.account.id {
+		s.store.Unlock()
+		s.writeProblem(w, newProblem(errMalformed, http.StatusNotFound, "the order %q does not exist", id))
+		return
+	}
+	s.store.updateOrderStatus(o)
+
+	if !finalize {
+		defer s.store.Unlock()
+		s.writeJSON(w, http.StatusOK, s.orderResponse(o))
+		return
+	}
+
+	if o.status != statusReady {
+		s.store.Unlock()
+		s.writeProblem(w, newProblem(errOrderNotReady, http.StatusForbidden, "the order is %s", o.status))
+		return
+	}
+	csr, p := s.parseFinalizeRequest(req, o)
+	if p != nil {
+		s.store.Unlock()
+		s.writeProblem(w, p)
+		return
+	}
+	o.status = statusProcessing
+	s.store.Unlock()
+
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	chain, err := s.ca.Sign(csrPEM, 0)
+
+	s.store.Lock()
+	defer s.store.Unlock()
+	if err != nil {
+		glog.Errorf("Failed to sign the CSR of ACME order %s (error: %v)", o.id, err)
+
+		o.status = statusInvalid
+		o.err = newProblem(errServerInternal, http.StatusInternalServerError, "failed to sign the CSR")
+	} else {
+		glog.Infof("Certificate for ACME order %s has been issued", o.id)
+
+		o.status = statusValid
+		o.certID = randomID()
+		s.store.certs[o.certID] = chain
+	}
+
+	w.Header().Set(headerLocation, s.baseURL+orderPath+o.id)
+	s.writeJSON(w, http.StatusOK, s.orderResponse(o))
+}
+
+// parseFinalizeRequest extracts the CSR from a finalize request, and checks
+// that it requests exactly the identifiers of the order. The caller must hold
+// the store lock.
+func (s *Server) parseFinalizeRequest(req *signedRequest, o *order) (*x509.CertificateRequest, *problem) {
+	fr := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(req.payload, &fr); err != nil {
+		return nil, newProblem(errMalformed, http.StatusBadRequest, "invalid finalize request (error: %v)", err)
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(fr.CSR)
+	if err != nil {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "the CSR is not base64url-encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "failed to parse the CSR (error: %v)", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "invalid CSR signature (error: %v)", err)
+	}
+
+	if tp, err := keyThumbprint(&jose.JSONWebKey{Key: csr.PublicKey}); err != nil || tp == req.account.thumbprint {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "the CSR must not use the account key")
+	}
+
+	names := make(map[string]bool)
+	if san := pki.ExtractSANExtension(csr.Extensions); san != nil {
+		ids, err := pki.ExtractIDsFromSAN(san)
+		if err != nil {
+			return nil, newProblem(errBadCSR, http.StatusBadRequest, "invalid SAN extension (error: %v)", err)
+		}
+		for _, id := range ids {
+			if id.Type != pki.TypeDNS {
+				return nil, newProblem(errBadCSR, http.StatusBadRequest, "the CSR may only contain DNS names")
+			}
+			names[strings.ToLower(string(id.Value))] = true
+		}
+	}
+
+	expected := make(map[string]bool)
+	for _, id := range o.identifiers {
+		expected[id.Value] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !expected[cn] {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "the common name %q is not in the order", cn)
+	}
+	if len(names) != len(expected) {
+		return nil, newProblem(errBadCSR, http.StatusBadRequest, "the CSR does not match the identifiers of the order")
+	}
+	for name := range names {
+		if !expected[name] {
+			return nil, newProblem(errBadCSR, http.StatusBadRequest, "the name %q is not in the order", name)
+		}
+	}
+	return csr, nil
+}
+
+type authorizationResponse struct {
+	Status     string              `json:"status"`
+	Expires    string              `json:"expires"`
+	Identifier identifier          `json:"identifier"`
+	Challenges []challengeResponse `json:"challenges"`
+	Wildcard   bool                `json:"wildcard,omitempty"`
+}
+
+type challengeResponse struct {
+	Type      string   `json:"type"`
+	URL       string   `json:"url"`
+	Token     string   `json:"token"`
+	Status    string   `json:"status"`
+	Validated string   `json:"validated,omitempty"`
+	Error     *problem `json:"error,omitempty"`
+}
+
+func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, authzPath)
+	authz, exists := s.store.authorizations[id]
+	if !exists || authz.accountID != req.account.id {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusNotFound, "the authorization %q does not exist", id))
+		return
+	}
+
+	if !req.isPostAsGet() {
+		update := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &update); err != nil || update.Status != statusDeactivated {
+			s.writeProblem(w, newProblem(errMalformed, http.StatusBadRequest,
+				"an authorization can only be updated to %q", statusDeactivated))
+			return
+		}
+		authz.status = statusDeactivated
+		s.store.updateOrderStatus(s.store.orders[authz.orderID])
+	}
+
+	s.writeJSON(w, http.StatusOK, s.authorizationResponse(authz))
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	s.store.Lock()
+	id := strings.TrimPrefix(r.URL.Path, challengePath)
+	c, exists := s.store.challenges[id]
+	if !exists || s.store.authorizations[c.authzID].accountID != req.account.id {
+		s.store.Unlock()
+		s.writeProblem(w, newProblem(errMalformed, http.StatusNotFound, "the challenge %q does not exist", id))
+		return
+	}
+	authz := s.store.authorizations[c.authzID]
+
+	// A POST-as-GET request fetches the challenge, while any other request asks
+	// the server to validate the challenge.
+	if req.isPostAsGet() || c.status != statusPending || authz.status != statusPending {
+		defer s.store.Unlock()
+		w.Header().Set(headerLink, s.link(authzPath+authz.id, "up"))
+		s.writeJSON(w, http.StatusOK, s.challengeResponse(c))
+		return
+	}
+
+	c.status = statusProcessing
+	domain, token, keyAuthorization := authz.identifier.Value, c.token, c.token+"."+req.account.thumbprint
+	s.store.Unlock()
+
+	err := s.validator.Validate(c.typ, domain, token, keyAuthorization)
+
+	s.store.Lock()
+	defer s.store.Unlock()
+	// The order may have expired and been pruned during the validation.
+	o, exists := s.store.orders[authz.orderID]
+	if !exists || s.store.challenges[id] != c || s.store.authorizations[c.authzID] != authz {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusNotFound, "the challenge %q has expired", id))
+		return
+	}
+	if err != nil {
+		glog.Warningf("ACME %s challenge for %q has failed (error: %v)", c.typ, domain, err)
+
+		c.status = statusInvalid
+		c.err = newProblem(errIncorrectResponse, http.StatusForbidden, "%v", err)
+		authz.status = statusInvalid
+	} else {
+		c.status = statusValid
+		c.validated = time.Now()
+		authz.status = statusValid
+	}
+	s.store.updateOrderStatus(o)
+
+	w.Header().Set(headerLink, s.link(authzPath+authz.id, "up"))
+	s.writeJSON(w, http.StatusOK, s.challengeResponse(c))
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyPost(r, false)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, certPath)
+	chain, exists := s.store.certs[id]
+	owned := false
+	for _, orderID := range req.account.orderIDs {
+		if s.store.orders[orderID].certID == id {
+			owned = true
+			break
+		}
+	}
+	if !exists || !owned {
+		s.writeProblem(w, newProblem(errMalformed, http.StatusNotFound, "the certificate %q does not exist", id))
+		return
+	}
+
+	s.setCommonHeaders(w)
+	w.Header().Set("Content-Type", contentTypePEMChain)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(chain); err != nil {
+		glog.Warningf("Failed to write the certificate (error: %v)", err)
+	}
+}
+
+// verifyPost checks the request is a POST, and verifies its JWS body.
+func (s *Server) verifyPost(r *http.Request, embeddedKey bool) (*signedRequest, *problem) {
+	if r.Method != http.MethodPost {
+		return nil, newProblem(errMalformed, http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	}
+	return s.verifyRequest(r, embeddedKey)
+}
+
+func (s *Server) accountResponse(acct *account) *accountResponse {
+	return &accountResponse{
+		Status:  acct.status,
+		Contact: acct.contact,
+		Orders:  s.baseURL + accountPath + acct.id + ordersSuffix,
+	}
+}
+
+func (s *Server) orderResponse(o *order) *orderResponse {
+	resp := &orderResponse{
+		Status:      o.status,
+		Expires:     o.expires.UTC().Format(time.RFC3339),
+		Identifiers: o.identifiers,
+		Finalize:    s.baseURL + orderPath + o.id + finalizeSuffix,
+		Error:       o.err,
+	}
+	for _, id := range o.authzIDs {
+		resp.Authorizations = append(resp.Authorizations, s.baseURL+authzPath+id)
+	}
+	if o.certID != "" {
+		resp.Certificate = s.baseURL + certPath + o.certID
+	}
+	return resp
+}
+
+func (s *Server) authorizationResponse(authz *authorization) *authorizationResponse {
+	resp := &authorizationResponse{
+		Status:     authz.status,
+		Expires:    authz.expires.UTC().Format(time.RFC3339),
+		Identifier: authz.identifier,
+		Wildcard:   authz.wildcard,
+	}
+	for _, id := range authz.challengeIDs {
+		resp.Challenges = append(resp.Challenges, *s.challengeResponse(s.store.challenges[id]))
+	}
+	return resp
+}
+
+func (s *Server) challengeResponse(c *challenge) *challengeResponse {
+	resp := &challengeResponse{
+		Type:   c.typ,
+		URL:    s.baseURL + challengePath + c.id,
+		Token:  c.token,
+		Status: c.status,
+		Error:  c.err,
+	}
+	if !c.validated.IsZero() {
+		resp.Validated = c.validated.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+func (s *Server) link(path, rel string) string {
+	return fmt.Sprintf("<%s%s>;rel=%q", s.baseURL, path, rel)
+}
+
+// setCommonHeaders sets the headers that all the ACME responses carry.
+func (s *Server) setCommonHeaders(w http.ResponseWriter) {
+	w.Header().Set(headerReplayNonce, s.store.newNonce())
+	w.Header().Add(headerLink, s.link(directoryPath, "index"))
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("Failed to marshal the ACME response (error: %v)", err)
+		s.writeProblem(w, newProblem(errServerInternal, http.StatusInternalServerError, "internal error"))
+		return
+	}
+
+	s.setCommonHeaders(w)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	if _, err := w.Write(bs); err != nil {
+		glog.Warningf("Failed to write the ACME response (error: %v)", err)
+	}
+}
+
+func (s *Server) writeProblem(w http.ResponseWriter, p *problem) {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		glog.Errorf("Failed to marshal the ACME problem (error: %v)", err)
+		bs = []byte("{}")
+	}
+
+	s.setCommonHeaders(w)
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.WriteHeader(p.Status)
+	if _, err := w.Write(bs); err != nil {
+		glog.Warningf("Failed to write the ACME problem (error: %v)", err)
+	}
+}
+
+func validateContacts(contacts []string) *problem {
+	for _, c := range contacts {
+		if !strings.HasPrefix(c, contactSchemeMailto) {
+			return newProblem(errInvalidContact, http.StatusBadRequest, "unsupported contact %q", c)
+		}
+	}
+	return nil
+}
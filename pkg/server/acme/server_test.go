@@ -0,0 +1,455 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"istio.io/auth/pkg/pki/ca"
+)
+
+type fakeCA struct {
+	signedCSRs int
+}
+
+func (f *fakeCA) Sign(csrPEM []byte, ttl time.Duration) ([]byte, error) {
+	f.signedCSRs++
+	return []byte("fake cert chain"), nil
+}
+
+func (f *fakeCA) GetRootCertificate() []byte {
+	return []byte("fake root cert")
+}
+
+type fakeValidator struct {
+	failingDomains map[string]bool
+	validated      []string
+}
+
+func (f *fakeValidator) Validate(challengeType, domain, token, keyAuthorization string) error {
+	f.validated = append(f.validated, challengeType+":"+domain)
+	if f.failingDomains[domain] {
+		return fmt.Errorf("no response for %s", domain)
+	}
+	return nil
+}
+
+// testClient is a minimal ACME client.
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+	kid    string
+}
+
+func newTestServer(t *testing.T, validator ChallengeValidator) (*Server, *httptest.Server, *fakeCA) {
+	policy, err := ca.NewHostnamePolicy([]string{".svc.cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fca := &fakeCA{}
+	s := New(fca, policy, validator, "localhost", 8443, nil)
+	ts := httptest.NewServer(s)
+	s.baseURL = ts.URL
+	return s, ts, fca
+}
+
+func newTestClient(t *testing.T, ts *httptest.Server) *testClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, server: ts, key: key}
+}
+
+func (c *testClient) nonce() string {
+	resp, err := http.Head(c.server.URL + newNoncePath)
+	if err != nil {
+		c.t.Fatalf("Failed to get a nonce: %v", err)
+	}
+	return resp.Header.Get(headerReplayNonce)
+}
+
+func (c *testClient) sign(url, nonce string, payload interface{}) string {
+	bs := []byte{}
+	if payload != nil {
+		var err error
+		if bs, err = json.Marshal(payload); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	opts := &jose.SignerOptions{EmbedJWK: c.kid == ""}
+	opts.WithHeader("url", url).WithHeader("nonce", nonce)
+	var key interface{} = c.key
+	if c.kid != "" {
+		key = jose.JSONWebKey{Key: c.key, KeyID: c.kid}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	jws, err := signer.Sign(bs)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return jws.FullSerialize()
+}
+
+// post sends a signed request to the URL. A nil payload makes a POST-as-GET
+// request.
+func (c *testClient) post(url string, payload interface{}) (*http.Response, []byte) {
+	return c.postBody(url, c.sign(url, c.nonce(), payload))
+}
+
+func (c *testClient) postBody(url, body string) (*http.Response, []byte) {
+	resp, err := http.Post(url, contentTypeJOSE, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("Failed to post to %s: %v", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, bs
+}
+
+func (c *testClient) register() {
+	resp, body := c.post(c.server.URL+newAccountPath, map[string]interface{}{
+		"contact":              []string{"mailto:admin@example.com"},
+		"termsOfServiceAgreed": true,
+	})
+	if resp.StatusCode != http.StatusCreated {
+		c.t.Fatalf("Failed to create an account: %d %s", resp.StatusCode, body)
+	}
+	c.kid = resp.Header.Get(headerLocation)
+}
+
+func (c *testClient) newOrder(names ...string) (*http.Response, *orderResponse) {
+	ids := []identifier{}
+	for _, n := range names {
+		ids = append(ids, identifier{Type: identifierTypeDNS, Value: n})
+	}
+	resp, body := c.post(c.server.URL+newOrderPath, map[string]interface{}{"identifiers": ids})
+	o := &orderResponse{}
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.Unmarshal(body, o); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return resp, o
+}
+
+func (c *testClient) authorization(url string) *authorizationResponse {
+	resp, body := c.post(url, nil)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("Failed to fetch the authorization: %d %s", resp.StatusCode, body)
+	}
+	authz := &authorizationResponse{}
+	if err := json.Unmarshal(body, authz); err != nil {
+		c.t.Fatal(err)
+	}
+	return authz
+}
+
+// completeChallenges responds to the challenge of the given type of every
+// authorization of the order.
+func (c *testClient) completeChallenges(o *orderResponse, challengeType string) {
+	for _, url := range o.Authorizations {
+		for _, ch := range c.authorization(url).Challenges {
+			if ch.Type != challengeType {
+				continue
+			}
+			if resp, body := c.post(ch.URL, struct{}{}); resp.StatusCode != http.StatusOK {
+				c.t.Fatalf("Failed to respond to the challenge: %d %s", resp.StatusCode, body)
+			}
+		}
+	}
+}
+
+func (c *testClient) order(url string) *orderResponse {
+	_, body := c.post(url, nil)
+	o := &orderResponse{}
+	if err := json.Unmarshal(body, o); err != nil {
+		c.t.Fatal(err)
+	}
+	return o
+}
+
+func (c *testClient) csr(names ...string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: names[0]}, DNSNames: names}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(der)
+}
+
+func decodeProblem(t *testing.T, body []byte) *problem {
+	p := &problem{}
+	if err := json.Unmarshal(body, p); err != nil {
+		t.Fatalf("Failed to decode the problem %s: %v", body, err)
+	}
+	return p
+}
+
+func TestDirectory(t *testing.T) {
+	_, ts, _ := newTestServer(t, &fakeValidator{})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + directoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		t.Fatal(err)
+	}
+	for key, path := range map[string]string{
+		"newNonce":   newNoncePath,
+		"newAccount": newAccountPath,
+		"newOrder":   newOrderPath,
+	} {
+		if dir[key] != ts.URL+path {
+			t.Errorf("Unexpected %s URL: want %s but got %v", key, ts.URL+path, dir[key])
+		}
+	}
+}
+
+func TestIssuance(t *testing.T) {
+	validator := &fakeValidator{}
+	_, ts, fca := newTestServer(t, validator)
+	defer ts.Close()
+
+	c := newTestClient(t, ts)
+	c.register()
+
+	// Registering the same key again returns the existing account.
+	kid := c.kid
+	c.kid = ""
+	resp, body := c.post(ts.URL+newAccountPath, map[string]interface{}{"onlyReturnExisting": true})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(headerLocation) != kid {
+		t.Fatalf("Failed to look up the existing account: %d %s", resp.StatusCode, body)
+	}
+	c.kid = kid
+
+	resp, o := c.newOrder("foo.ns.svc.cluster.local", "*.bar.svc.cluster.local")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create an order: %d", resp.StatusCode)
+	}
+	if o.Status != statusPending || len(o.Authorizations) != 2 {
+		t.Fatalf("Unexpected order: %+v", o)
+	}
+	orderURL := resp.Header.Get(headerLocation)
+
+	wildcard := c.authorization(o.Authorizations[1])
+	if !wildcard.Wildcard || wildcard.Identifier.Value != "bar.svc.cluster.local" ||
+		len(wildcard.Challenges) != 1 || wildcard.Challenges[0].Type != ChallengeDNS01 {
+		t.Errorf("Unexpected wildcard authorization: %+v", wildcard)
+	}
+	if authz := c.authorization(o.Authorizations[0]); len(authz.Challenges) != 2 {
+		t.Errorf("Unexpected authorization: %+v", authz)
+	}
+
+	csr := c.csr("foo.ns.svc.cluster.local", "*.bar.svc.cluster.local")
+	resp, body = c.post(o.Finalize, map[string]string{"csr": csr})
+	if p := decodeProblem(t, body); resp.StatusCode != http.StatusForbidden || p.Type != errOrderNotReady {
+		t.Errorf("Expecting orderNotReady but got: %d %s", resp.StatusCode, body)
+	}
+
+	c.completeChallenges(o, ChallengeDNS01)
+	if len(validator.validated) != 2 {
+		t.Errorf("Unexpected validations: %v", validator.validated)
+	}
+	if o = c.order(orderURL); o.Status != statusReady {
+		t.Fatalf("Expecting a ready order but got: %+v", o)
+	}
+
+	// The CSR must match the identifiers of the order.
+	resp, body = c.post(o.Finalize, map[string]string{"csr": c.csr("foo.ns.svc.cluster.local")})
+	if p := decodeProblem(t, body); resp.StatusCode != http.StatusBadRequest || p.Type != errBadCSR {
+		t.Errorf("Expecting badCSR but got: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = c.post(o.Finalize, map[string]string{"csr": csr})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to finalize the order: %d %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != statusValid || o.Certificate == "" || fca.signedCSRs != 1 {
+		t.Fatalf("Unexpected finalized order: %+v", o)
+	}
+
+	resp, body = c.post(o.Certificate, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentTypePEMChain ||
+		string(body) != "fake cert chain" {
+		t.Errorf("Unexpected certificate response: %d %s", resp.StatusCode, body)
+	}
+
+	// The certificate is not visible to other accounts.
+	other := newTestClient(t, ts)
+	other.register()
+	if resp, _ := other.post(o.Certificate, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expecting the certificate to be hidden from other accounts but got %d", resp.StatusCode)
+	}
+}
+
+func TestFailedChallenge(t *testing.T) {
+	validator := &fakeValidator{failingDomains: map[string]bool{"foo.ns.svc.cluster.local": true}}
+	_, ts, _ := newTestServer(t, validator)
+	defer ts.Close()
+
+	c := newTestClient(t, ts)
+	c.register()
+
+	_, o := c.newOrder("foo.ns.svc.cluster.local")
+	c.completeChallenges(o, ChallengeHTTP01)
+
+	authz := c.authorization(o.Authorizations[0])
+	if authz.Status != statusInvalid {
+		t.Errorf("Expecting an invalid authorization but got %s", authz.Status)
+	}
+	for _, ch := range authz.Challenges {
+		if ch.Type == ChallengeHTTP01 && (ch.Status != statusInvalid || ch.Error == nil ||
+			ch.Error.Type != errIncorrectResponse) {
+			t.Errorf("Unexpected challenge: %+v", ch)
+		}
+	}
+}
+
+// pruningValidator prunes the expired orders of the server while it validates
+// a challenge, as if another request did.
+type pruningValidator struct {
+	server *Server
+}
+
+func (v *pruningValidator) Validate(challengeType, domain, token, keyAuthorization string) error {
+	v.server.store.Lock()
+	defer v.server.store.Unlock()
+	v.server.store.prune(time.Now().Add(365 * 24 * time.Hour))
+	return nil
+}
+
+func TestChallengePrunedDuringValidation(t *testing.T) {
+	validator := &pruningValidator{}
+	s, ts, _ := newTestServer(t, validator)
+	defer ts.Close()
+	validator.server = s
+
+	c := newTestClient(t, ts)
+	c.register()
+	_, o := c.newOrder("foo.ns.svc.cluster.local")
+	for _, ch := range c.authorization(o.Authorizations[0]).Challenges {
+		if ch.Type != ChallengeHTTP01 {
+			continue
+		}
+		resp, body := c.post(ch.URL, struct{}{})
+		if p := decodeProblem(t, body); resp.StatusCode != http.StatusNotFound || p.Type != errMalformed {
+			t.Errorf("Expecting the pruned challenge to be not found but got %d %s", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRejectedOrders(t *testing.T) {
+	_, ts, _ := newTestServer(t, &fakeValidator{})
+	defer ts.Close()
+
+	c := newTestClient(t, ts)
+	c.register()
+
+	testCases := map[string]struct {
+		ids     []identifier
+		errType string
+	}{
+		"Name not in the allow-list": {
+			ids:     []identifier{{Type: identifierTypeDNS, Value: "evil.com"}},
+			errType: errRejectedIdentifier,
+		},
+		"Unsupported identifier type": {
+			ids:     []identifier{{Type: "ip", Value: "10.0.0.1"}},
+			errType: errUnsupportedIdentifier,
+		},
+		"No identifier": {
+			ids:     []identifier{},
+			errType: errMalformed,
+		},
+	}
+
+	for id, tc := range testCases {
+		resp, body := c.post(ts.URL+newOrderPath, map[string]interface{}{"identifiers": tc.ids})
+		if p := decodeProblem(t, body); resp.StatusCode != http.StatusBadRequest || p.Type != tc.errType {
+			t.Errorf("Case %q: expecting %s but got %d %s", id, tc.errType, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRequestVerification(t *testing.T) {
+	_, ts, _ := newTestServer(t, &fakeValidator{})
+	defer ts.Close()
+
+	c := newTestClient(t, ts)
+	c.register()
+	url := ts.URL + newOrderPath
+	payload := map[string]interface{}{
+		"identifiers": []identifier{{Type: identifierTypeDNS, Value: "foo.ns.svc.cluster.local"}},
+	}
+
+	// A nonce cannot be used twice.
+	body := c.sign(url, c.nonce(), payload)
+	if resp, _ := c.postBody(url, body); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expecting the first request to succeed but got %d", resp.StatusCode)
+	}
+	resp, respBody := c.postBody(url, body)
+	if p := decodeProblem(t, respBody); p.Type != errBadNonce || resp.Header.Get(headerReplayNonce) == "" {
+		t.Errorf("Expecting badNonce with a fresh nonce but got %s", respBody)
+	}
+
+	// The URL in the protected header must match the request.
+	resp, respBody = c.postBody(url, c.sign(ts.URL+newAccountPath, c.nonce(), payload))
+	if p := decodeProblem(t, respBody); resp.StatusCode != http.StatusUnauthorized || p.Type != errUnauthorized {
+		t.Errorf("Expecting unauthorized but got %d %s", resp.StatusCode, respBody)
+	}
+
+	// Requests other than new-account must be signed by an account.
+	c.kid = ""
+	resp, respBody = c.post(url, payload)
+	if p := decodeProblem(t, respBody); resp.StatusCode != http.StatusBadRequest || p.Type != errMalformed {
+		t.Errorf("Expecting malformed but got %d %s", resp.StatusCode, respBody)
+	}
+}
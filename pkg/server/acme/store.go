@@ -0,0 +1,235 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Status values of ACME objects (https://tools.ietf.org/html/rfc8555#section-7.1.6).
+const (
+	statusPending     = "pending"
+	statusReady       = "ready"
+	statusProcessing  = "processing"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusDeactivated = "deactivated"
+)
+
+const (
+	identifierTypeDNS = "dns"
+
+	nonceTTL = 10 * time.Minute
+	orderTTL = 7 * 24 * time.Hour
+
+	// maxNonces bounds the number of outstanding nonces. Once it is reached,
+	// a new nonce replaces the oldest one, which the client retries with a
+	// fresh nonce after a badNonce error.
+	maxNonces = 10000
+	// pruneInterval is how often the expired orders are removed.
+	pruneInterval = time.Minute
+)
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type account struct {
+	id         string
+	status     string
+	contact    []string
+	key        *jose.JSONWebKey
+	thumbprint string
+	orderIDs   []string
+}
+
+type order struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []identifier
+	authzIDs    []string
+	certID      string
+	err         *problem
+}
+
+type authorization struct {
+	id           string
+	accountID    string
+	orderID      string
+	status       string
+	expires      time.Time
+	identifier   identifier
+	wildcard     bool
+	challengeIDs []string
+}
+
+type challenge struct {
+	id        string
+	authzID   string
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *problem
+}
+
+// store keeps the ACME state in memory. All the accesses must be guarded by
+// the mutex, except for the nonces which have their own lock, so that
+// responses can carry a fresh nonce while the state is locked.
+type store struct {
+	sync.Mutex
+
+	nonceMutex sync.Mutex
+	nonces     map[string]time.Time
+	// nonceRing holds the nonces in the order they are issued, and nonceNext
+	// is the position of the next, i.e. the oldest, nonce.
+	nonceRing []string
+	nonceNext int
+
+	accounts       map[string]*account
+	accountsByKey  map[string]*account
+	orders         map[string]*order
+	authorizations map[string]*authorization
+	challenges     map[string]*challenge
+	certs          map[string][]byte
+	lastPrune      time.Time
+}
+
+func newStore() *store {
+	return &store{
+		nonces:         make(map[string]time.Time),
+		nonceRing:      make([]string, maxNonces),
+		accounts:       make(map[string]*account),
+		accountsByKey:  make(map[string]*account),
+		orders:         make(map[string]*order),
+		authorizations: make(map[string]*authorization),
+		challenges:     make(map[string]*challenge),
+		certs:          make(map[string][]byte),
+	}
+}
+
+func (s *store) newNonce() string {
+	s.nonceMutex.Lock()
+	defer s.nonceMutex.Unlock()
+
+	n := randomID()
+	if oldest := s.nonceRing[s.nonceNext]; oldest != "" {
+		delete(s.nonces, oldest)
+	}
+	s.nonceRing[s.nonceNext] = n
+	s.nonceNext = (s.nonceNext + 1) % len(s.nonceRing)
+	s.nonces[n] = time.Now().Add(nonceTTL)
+	return n
+}
+
+// consumeNonce returns whether the nonce was issued by this server and has not
+// been used yet. A nonce can be consumed only once.
+func (s *store) consumeNonce(n string) bool {
+	s.nonceMutex.Lock()
+	defer s.nonceMutex.Unlock()
+
+	expiry, ok := s.nonces[n]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, n)
+	return expiry.After(time.Now())
+}
+
+// prune removes the expired orders with their authorizations, challenges and
+// certificates, at most once per pruneInterval. The certificate of an order
+// can thus be downloaded until the order expires. The caller must hold the
+// lock.
+func (s *store) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < pruneInterval {
+		return
+	}
+	s.lastPrune = now
+
+	expired := make(map[string]bool)
+	for id, o := range s.orders {
+		if !now.After(o.expires) {
+			continue
+		}
+		expired[id] = true
+		for _, authzID := range o.authzIDs {
+			for _, challengeID := range s.authorizations[authzID].challengeIDs {
+				delete(s.challenges, challengeID)
+			}
+			delete(s.authorizations, authzID)
+		}
+		delete(s.certs, o.certID)
+		delete(s.orders, id)
+	}
+	if len(expired) == 0 {
+		return
+	}
+	for _, acct := range s.accounts {
+		orderIDs := acct.orderIDs[:0]
+		for _, id := range acct.orderIDs {
+			if !expired[id] {
+				orderIDs = append(orderIDs, id)
+			}
+		}
+		acct.orderIDs = orderIDs
+	}
+	glog.Infof("Removed %d expired ACME orders", len(expired))
+}
+
+// updateOrderStatus derives the status of an order from its authorizations.
+// The caller must hold the lock.
+func (s *store) updateOrderStatus(o *order) {
+	if o.status != statusPending {
+		return
+	}
+	if time.Now().After(o.expires) {
+		o.status = statusInvalid
+		return
+	}
+
+	ready := true
+	for _, id := range o.authzIDs {
+		switch s.authorizations[id].status {
+		case statusValid:
+		case statusPending:
+			ready = false
+		default:
+			o.status = statusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = statusReady
+	}
+}
+
+// randomID returns a random URL-safe string used for object IDs, nonces and
+// challenge tokens.
+func randomID() string {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		glog.Fatalf("Failed to generate a random ID: %s.", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
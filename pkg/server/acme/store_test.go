@@ -0,0 +1,79 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonceLimit(t *testing.T) {
+	s := newStore()
+	first := s.newNonce()
+	second := s.newNonce()
+	for i := 0; i < maxNonces-1; i++ {
+		s.newNonce()
+	}
+
+	if len(s.nonces) != maxNonces {
+		t.Errorf("Expecting %d outstanding nonces but got %d", maxNonces, len(s.nonces))
+	}
+	// The oldest nonce is replaced.
+	if s.consumeNonce(first) {
+		t.Error("Expecting the oldest nonce to be rejected")
+	}
+	if !s.consumeNonce(second) {
+		t.Error("Expecting the second nonce to be accepted")
+	}
+	if s.consumeNonce(second) {
+		t.Error("Expecting the nonce to be accepted only once")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	s := newStore()
+	acct := &account{id: "acct", orderIDs: []string{"expired", "current"}}
+	s.accounts[acct.id] = acct
+	s.orders["expired"] = &order{id: "expired", expires: now.Add(-time.Second), authzIDs: []string{"authz"},
+		certID: "cert"}
+	s.orders["current"] = &order{id: "current", expires: now.Add(time.Hour)}
+	s.authorizations["authz"] = &authorization{id: "authz", challengeIDs: []string{"chall"}}
+	s.challenges["chall"] = &challenge{id: "chall"}
+	s.certs["cert"] = []byte("cert")
+
+	s.prune(now)
+
+	if _, ok := s.orders["expired"]; ok {
+		t.Error("Expecting the expired order to be removed")
+	}
+	if _, ok := s.orders["current"]; !ok {
+		t.Error("Expecting the current order to be kept")
+	}
+	if len(s.authorizations) != 0 || len(s.challenges) != 0 || len(s.certs) != 0 {
+		t.Errorf("Expecting the objects of the expired order to be removed but got %v, %v and %v",
+			s.authorizations, s.challenges, s.certs)
+	}
+	if len(acct.orderIDs) != 1 || acct.orderIDs[0] != "current" {
+		t.Errorf("Expecting only the current order of the account but got %v", acct.orderIDs)
+	}
+
+	// The orders are pruned at most once per interval.
+	s.orders["expired"] = &order{id: "expired", expires: now.Add(-time.Second)}
+	s.prune(now.Add(pruneInterval / 2))
+	if _, ok := s.orders["expired"]; !ok {
+		t.Error("Expecting the orders not to be pruned again within the interval")
+	}
+}
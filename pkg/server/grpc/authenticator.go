@@ -26,6 +26,8 @@ import (
 	"google.golang.org/grpc/peer"
 
 	"istio.io/auth/pkg/pki"
+
+	"k8s.io/client-go/pkg/api/v1"
 )
 
 const (
@@ -40,11 +42,31 @@ type authSource int
 const (
 	authSourceClientCertificate authSource = iota
 	authSourceIDToken
+	authSourcePeerCredential
+	authSourceServiceAccountToken
 )
 
+func (s authSource) String() string {
+	switch s {
+	case authSourceClientCertificate:
+		return "client_certificate"
+	case authSourceIDToken:
+		return "id_token"
+	case authSourcePeerCredential:
+		return "peer_credential"
+	case authSourceServiceAccountToken:
+		return "service_account_token"
+	default:
+		return "unknown"
+	}
+}
+
 type user struct {
 	authSource authSource
 	identities []string
+	// The pod that the user is bound to, if it is authenticated by a
+	// pod-bound service account token.
+	pod *v1.Pod
 }
 
 type authenticator interface {
@@ -60,7 +82,7 @@ type clientCertAuthenticator struct{}
 // chain validation itself.
 func (cca *clientCertAuthenticator) authenticate(ctx context.Context) *user {
 	peer, ok := peer.FromContext(ctx)
-	if !ok {
+	if !ok || peer.AuthInfo == nil {
 		glog.Info("no client certificate is presented")
 		return nil
 	}
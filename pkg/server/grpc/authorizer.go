@@ -14,23 +14,36 @@
 
 package grpc
 
-import "github.com/golang/glog"
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
 
 type authorizer interface {
-	authorize(requester *user, requestedIds []string) bool
+	// authorize returns nil if the requester is allowed to request the
+	// identities, or an error that tells why it is not.
+	authorize(requester *user, requestedIds []string) error
 }
 
 // simpleAuthorizer approves a request if the requested identities matches the
 // identities of the requester.
 type simpleAuthorizer struct{}
 
-func (authZ *simpleAuthorizer) authorize(requester *user, requestedIDs []string) bool {
+func (authZ *simpleAuthorizer) authorize(requester *user, requestedIDs []string) error {
 	if requester.authSource == authSourceIDToken {
 		// TODO: currently the "sub" claim of an ID token returned by GCP
 		// metadata server contains obfuscated user ID, so we cannot do
 		// authorization upon that.
 
-		return true
+		return nil
+	}
+
+	if requester.authSource == authSourcePeerCredential {
+		// Local processes are only accepted from the allowed UIDs on a Unix
+		// domain socket, and are trusted to request any identity, e.g. an
+		// admin sidecar that provisions certificates for workloads.
+		return nil
 	}
 
 	idMap := make(map[string]bool, len(requester.identities))
@@ -42,9 +55,9 @@ func (authZ *simpleAuthorizer) authorize(requester *user, requestedIDs []string)
 		if _, exists := idMap[requestedID]; !exists {
 			glog.Warningf("The requested identity (%q) does not match the requester", requestedID)
 
-			return false
+			return fmt.Errorf("the requested identity (%q) does not match the requester", requestedID)
 		}
 	}
 
-	return true
+	return nil
 }
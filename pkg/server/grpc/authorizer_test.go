@@ -36,8 +36,8 @@ func TestAuthroizer(t *testing.T) {
 
 	authz := &simpleAuthorizer{}
 	for id, tc := range testCases {
-		result := authz.authorize(&user{authSourceClientCertificate, tc.userIDs}, tc.requestedIDs)
-		if tc.authorized != result {
+		err := authz.authorize(&user{authSource: authSourceClientCertificate, identities: tc.userIDs}, tc.requestedIDs)
+		if result := err == nil; tc.authorized != result {
 			t.Errorf("Case %q: unexpected authorization result: want %t but got %t", id, tc.authorized, result)
 		}
 	}
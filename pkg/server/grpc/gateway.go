@@ -0,0 +1,262 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"istio.io/auth/pkg/audit"
+	pb "istio.io/auth/proto"
+)
+
+const (
+	gatewayCSRPath     = "/v1/csr"
+	gatewayRootPath    = "/v1/root"
+	gatewayOpenAPIPath = "/v1/openapi.json"
+	gatewayRevokePath  = "/v1/admin/revoke"
+
+	// The maximum size of a request body accepted by the gateway.
+	maxGatewayRequestSize = 64 * 1024
+)
+
+// The HTTP status codes of the GRPC codes returned by the service.
+var gatewayHTTPStatus = map[codes.Code]int{
+	codes.OK:                http.StatusOK,
+	codes.InvalidArgument:   http.StatusBadRequest,
+	codes.Unauthenticated:   http.StatusUnauthorized,
+	codes.PermissionDenied:  http.StatusForbidden,
+	codes.Unimplemented:     http.StatusMethodNotAllowed,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+}
+
+// csrRequest is the JSON form of pb.Request. Unlike the proto3 JSON mapping,
+// the CSR is a PEM string rather than base64-encoded bytes, so that requests
+// can be written with common command-line tools.
+type csrRequest struct {
+	CsrPem              string `json:"csr_pem"`
+	NodeAgentCredential []byte `json:"node_agent_credential,omitempty"`
+	CredentialType      string `json:"credential_type,omitempty"`
+}
+
+// csrResponse is the JSON form of pb.Response.
+type csrResponse struct {
+	IsApproved      bool   `json:"is_approved"`
+	SignedCertChain string `json:"signed_cert_chain"`
+}
+
+type rootResponse struct {
+	RootCert string `json:"root_cert"`
+}
+
+// revokeRequest asks to revoke the certificate with the hex-encoded serial
+// number.
+type revokeRequest struct {
+	Serial string `json:"serial"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type revokeResponse struct {
+	Serial string `json:"serial"`
+}
+
+type gatewayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// gatewayHandler returns the HTTP handler that exposes the service as
+// HTTP/JSON.
+func (s *Server) gatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(gatewayCSRPath, s.handleGatewayCSR)
+	mux.HandleFunc(gatewayRootPath, s.handleGatewayRoot)
+	mux.HandleFunc(gatewayOpenAPIPath, handleGatewayOpenAPI)
+	if s.revoker != nil && len(s.adminIdentities) > 0 {
+		mux.HandleFunc(gatewayRevokePath, s.handleGatewayRevoke)
+	}
+	return mux
+}
+
+// handleGatewayCSR serves HandleCSR over HTTP.
+func (s *Server) handleGatewayCSR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeGatewayError(w, codes.Unimplemented, "method "+r.Method+" is not allowed")
+		return
+	}
+
+	request := &csrRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxGatewayRequestSize)).Decode(request); err != nil {
+		writeGatewayError(w, codes.InvalidArgument, "failed to decode the request (error "+err.Error()+")")
+		return
+	}
+
+	retryAfter := 0
+	ctx := context.WithValue(gatewayContext(r), retryHintKey{}, &retryAfter)
+	response, err := s.HandleCSR(ctx, &pb.Request{
+		CsrPem:              []byte(request.CsrPem),
+		NodeAgentCredential: request.NodeAgentCredential,
+		CredentialType:      request.CredentialType,
+	})
+	if err != nil {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		writeGatewayError(w, grpc.Code(err), grpc.ErrorDesc(err))
+		return
+	}
+
+	writeGatewayJSON(w, http.StatusOK, &csrResponse{
+		IsApproved:      response.IsApproved,
+		SignedCertChain: string(response.SignedCertChain),
+	})
+}
+
+// handleGatewayRoot returns the root certificate of the CA, which is the trust
+// bundle of the certificates it issues. It does not require authentication.
+func (s *Server) handleGatewayRoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, codes.Unimplemented, "method "+r.Method+" is not allowed")
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, &rootResponse{RootCert: string(s.ca.GetRootCertificate())})
+}
+
+// handleGatewayRevoke revokes an issued certificate. The caller must be
+// authenticated as one of the admin identities.
+func (s *Server) handleGatewayRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeGatewayError(w, codes.Unimplemented, "method "+r.Method+" is not allowed")
+		return
+	}
+
+	ctx := gatewayContext(r)
+	if allowed, wait := s.allowSource(ctx); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeGatewayError(w, codes.ResourceExhausted, "too many requests")
+		return
+	}
+	user := s.authenticate(ctx)
+	event := newCSREvent(ctx, user)
+	event.Source = audit.SourceRevocation
+	code, message := s.revoke(user, r, event)
+	if code != codes.OK {
+		event.Decision = audit.Deny
+		event.Error = message
+		audit.Record(s.auditSink, event)
+		writeGatewayError(w, code, message)
+		return
+	}
+	event.Decision = audit.Revoke
+	audit.Record(s.auditSink, event)
+	writeGatewayJSON(w, http.StatusOK, &revokeResponse{Serial: event.Serial})
+}
+
+// revoke authorizes and performs the revocation. The serial number and the
+// reason are recorded in the audit event.
+func (s *Server) revoke(user *user, r *http.Request, event *audit.Event) (codes.Code, string) {
+	if user == nil {
+		return codes.Unauthenticated, "failed to authenticate request"
+	}
+	if !s.isAdmin(user) {
+		glog.Warningf("%v are not allowed to revoke certificates", user.identities)
+		return codes.PermissionDenied, "the caller is not an administrator"
+	}
+
+	request := &revokeRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxGatewayRequestSize)).Decode(request); err != nil {
+		return codes.InvalidArgument, "failed to decode the request (error " + err.Error() + ")"
+	}
+	serial := strings.ToLower(request.Serial)
+	if serial == "" {
+		return codes.InvalidArgument, "the serial number is not specified"
+	}
+	event.Serial = serial
+	event.Reason = request.Reason
+	if err := s.revoker.Revoke(serial, request.Reason); err != nil {
+		glog.Errorf("Failed to revoke certificate %s (error: %v)", serial, err)
+		return codes.Internal, err.Error()
+	}
+	glog.Infof("Certificate %s is revoked by %v", serial, user.identities)
+	return codes.OK, ""
+}
+
+// isAdmin returns whether one of the identities of the user is an admin
+// identity.
+func (s *Server) isAdmin(user *user) bool {
+	for _, id := range user.identities {
+		for _, admin := range s.adminIdentities {
+			if id == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func handleGatewayOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.WriteString(w, openAPISpec); err != nil {
+		glog.Warningf("failed to write the OpenAPI description (error %v)", err)
+	}
+}
+
+// gatewayContext attaches the TLS state and the authorization header of the
+// HTTP request to the context in the way GRPC does, so that the GRPC
+// authenticators apply to the request as well.
+func gatewayContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	p := &peer.Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx = peer.NewContext(ctx, p)
+	if authHeader := r.Header.Get(httpAuthHeader); authHeader != "" {
+		ctx = metadata.NewContext(ctx, metadata.Pairs(httpAuthHeader, authHeader))
+	}
+	return ctx
+}
+
+func writeGatewayError(w http.ResponseWriter, code codes.Code, message string) {
+	status, ok := gatewayHTTPStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeGatewayJSON(w, status, &gatewayError{Code: code.String(), Message: message})
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("failed to write the response (error %v)", err)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"istio.io/auth/pkg/audit"
+	"istio.io/auth/pkg/pki"
+)
+
+func TestGatewayCSR(t *testing.T) {
+	body, err := json.Marshal(&csrRequest{CsrPem: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		method        string
+		body          string
+		authenticated bool
+		authorized    bool
+		status        int
+		code          string
+		cert          string
+	}{
+		"Unsupported method": {
+			method: "GET",
+			status: http.StatusMethodNotAllowed,
+			code:   "Unimplemented",
+		},
+		"Malformed request": {
+			method: "POST",
+			body:   "{",
+			status: http.StatusBadRequest,
+			code:   "InvalidArgument",
+		},
+		"Unauthenticated request": {
+			method: "POST",
+			body:   string(body),
+			status: http.StatusUnauthorized,
+			code:   "Unauthenticated",
+		},
+		"Unauthorized request": {
+			method:        "POST",
+			body:          string(body),
+			authenticated: true,
+			status:        http.StatusForbidden,
+			code:          "PermissionDenied",
+		},
+		"Successful signing": {
+			method:        "POST",
+			body:          string(body),
+			authenticated: true,
+			authorized:    true,
+			status:        http.StatusOK,
+			cert:          "generated cert",
+		},
+	}
+
+	for id, c := range testCases {
+		server := &Server{
+			authenticators: []authenticator{&mockAuthenticator{c.authenticated}},
+			authorizer:     &mockAuthorizer{c.authorized},
+			ca:             &mockCA{cert: "generated cert"},
+			hostname:       "hostname",
+			port:           8080,
+			gatewayPort:    8443,
+		}
+		w := httptest.NewRecorder()
+		server.gatewayHandler().ServeHTTP(w, httptest.NewRequest(c.method, gatewayCSRPath, strings.NewReader(c.body)))
+
+		if w.Code != c.status {
+			t.Errorf("Case %s: expecting status to be (%d) but got (%d)", id, c.status, w.Code)
+			continue
+		}
+		if c.status != http.StatusOK {
+			gerr := &gatewayError{}
+			if err := json.Unmarshal(w.Body.Bytes(), gerr); err != nil || gerr.Code != c.code {
+				t.Errorf("Case %s: expecting code to be (%s) but got (%s)", id, c.code, w.Body.String())
+			}
+			continue
+		}
+		response := &csrResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Errorf("Case %s: failed to decode the response (error %v)", id, err)
+		} else if !response.IsApproved || response.SignedCertChain != c.cert {
+			t.Errorf("Case %s: expecting cert to be (%s) but got (%s)", id, c.cert, response.SignedCertChain)
+		}
+	}
+}
+
+type identityAuthenticator struct {
+	identities []string
+}
+
+func (authn *identityAuthenticator) authenticate(ctx context.Context) *user {
+	if len(authn.identities) == 0 {
+		return nil
+	}
+	return &user{identities: authn.identities}
+}
+
+type fakeRevoker struct {
+	err     error
+	revoked map[string]string
+}
+
+func (r *fakeRevoker) Revoke(serial, reason string) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.revoked[serial] = reason
+	return nil
+}
+
+func TestGatewayRevoke(t *testing.T) {
+	admin := "spiffe://cluster.local/ns/istio-system/sa/admin"
+	testCases := map[string]struct {
+		method     string
+		body       string
+		identities []string
+		revokeErr  error
+		status     int
+		code       string
+		decision   audit.Decision
+	}{
+		"Unsupported method": {
+			method: "GET",
+			status: http.StatusMethodNotAllowed,
+			code:   "Unimplemented",
+		},
+		"Unauthenticated request": {
+			method:   "POST",
+			body:     `{"serial": "1a"}`,
+			status:   http.StatusUnauthorized,
+			code:     "Unauthenticated",
+			decision: audit.Deny,
+		},
+		"Non-admin caller": {
+			method:     "POST",
+			body:       `{"serial": "1a"}`,
+			identities: []string{"spiffe://cluster.local/ns/default/sa/default"},
+			status:     http.StatusForbidden,
+			code:       "PermissionDenied",
+			decision:   audit.Deny,
+		},
+		"Malformed request": {
+			method:     "POST",
+			body:       "{",
+			identities: []string{admin},
+			status:     http.StatusBadRequest,
+			code:       "InvalidArgument",
+			decision:   audit.Deny,
+		},
+		"Missing serial": {
+			method:     "POST",
+			body:       `{"reason": "compromised"}`,
+			identities: []string{admin},
+			status:     http.StatusBadRequest,
+			code:       "InvalidArgument",
+			decision:   audit.Deny,
+		},
+		"Failed revocation": {
+			method:     "POST",
+			body:       `{"serial": "1a"}`,
+			identities: []string{admin},
+			revokeErr:  errors.New("certificate 1a was not issued by the CA"),
+			status:     http.StatusInternalServerError,
+			code:       "Internal",
+			decision:   audit.Deny,
+		},
+		"Successful revocation": {
+			method:     "POST",
+			body:       `{"serial": "1A", "reason": "compromised"}`,
+			identities: []string{admin},
+			status:     http.StatusOK,
+			decision:   audit.Revoke,
+		},
+	}
+
+	for id, c := range testCases {
+		buf := &bytes.Buffer{}
+		revoker := &fakeRevoker{err: c.revokeErr, revoked: map[string]string{}}
+		server := &Server{
+			authenticators:  []authenticator{&identityAuthenticator{c.identities}},
+			auditSink:       audit.NewWriterSink(buf),
+			revoker:         revoker,
+			adminIdentities: []string{admin},
+		}
+		w := httptest.NewRecorder()
+		server.gatewayHandler().ServeHTTP(w, httptest.NewRequest(c.method, gatewayRevokePath, strings.NewReader(c.body)))
+
+		if w.Code != c.status {
+			t.Errorf("Case %s: expecting status to be (%d) but got (%d)", id, c.status, w.Code)
+			continue
+		}
+		if c.decision != "" {
+			event := &audit.Event{}
+			if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+				t.Errorf("Case %s: failed to decode the audit event (error %v)", id, err)
+			} else if event.Source != audit.SourceRevocation || event.Decision != c.decision {
+				t.Errorf("Case %s: unexpected audit event %+v", id, event)
+			}
+		}
+		if c.status != http.StatusOK {
+			gerr := &gatewayError{}
+			if err := json.Unmarshal(w.Body.Bytes(), gerr); err != nil || gerr.Code != c.code {
+				t.Errorf("Case %s: expecting code to be (%s) but got (%s)", id, c.code, w.Body.String())
+			}
+			continue
+		}
+		if reason, ok := revoker.revoked["1a"]; !ok || reason != "compromised" {
+			t.Errorf("Case %s: expecting certificate 1a to be revoked but got %v", id, revoker.revoked)
+		}
+	}
+}
+
+func TestGatewayRevokeDisabled(t *testing.T) {
+	server := &Server{ca: &mockCA{}, revoker: &fakeRevoker{}}
+	w := httptest.NewRecorder()
+	server.gatewayHandler().ServeHTTP(w, httptest.NewRequest("POST", gatewayRevokePath, strings.NewReader("{}")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expecting status to be (%d) without admin identities but got (%d)", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestGatewayRoot(t *testing.T) {
+	server := &Server{ca: &mockCA{}}
+	w := httptest.NewRecorder()
+	server.gatewayHandler().ServeHTTP(w, httptest.NewRequest("GET", gatewayRootPath, nil))
+
+	response := &rootResponse{}
+	if w.Code != http.StatusOK {
+		t.Errorf("Expecting status to be (%d) but got (%d)", http.StatusOK, w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+		t.Errorf("Failed to decode the response (error %v)", err)
+	}
+}
+
+func TestGatewayOpenAPI(t *testing.T) {
+	server := &Server{ca: &mockCA{}}
+	w := httptest.NewRecorder()
+	server.gatewayHandler().ServeHTTP(w, httptest.NewRequest("GET", gatewayOpenAPIPath, nil))
+
+	spec := struct {
+		Paths map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Failed to decode the OpenAPI description (error %v)", err)
+	}
+	for _, path := range []string{gatewayCSRPath, gatewayRootPath, gatewayRevokePath} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("Path %s is not described", path)
+		}
+	}
+}
+
+func TestGatewayContext(t *testing.T) {
+	userID := "test.identity"
+	sanExt, err := pki.BuildSANExtension([]pki.Identity{{Type: pki.TypeURI, Value: []byte(userID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", gatewayCSRPath, nil)
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Extensions: []pkix.Extension{*sanExt}}}},
+	}
+	r.Header.Set("Authorization", "Bearer bearer-token")
+	ctx := gatewayContext(r)
+
+	expected := &user{identities: []string{userID}}
+	if u := (&clientCertAuthenticator{}).authenticate(ctx); !reflect.DeepEqual(expected, u) {
+		t.Errorf("Unexpected authentication result: want %v but got %v", expected, u)
+	}
+	if token := extractBearerToken(ctx); token != "bearer-token" {
+		t.Errorf("Unexpected bearer token: want %s but got %s", "bearer-token", token)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"istio.io/auth/pkg/peercred"
+)
+
+const (
+	// NetworkTCP is the network of a TCP listener.
+	NetworkTCP = "tcp"
+	// NetworkUnix is the network of a Unix domain socket listener.
+	NetworkUnix = "unix"
+)
+
+// ListenerOptions are the options of a listener of the GRPC service.
+type ListenerOptions struct {
+	// The network of the listener, i.e. "tcp" or "unix".
+	Network string
+	// The address to listen on, e.g. ":8060" or "/var/run/istio-ca/ca.sock".
+	Address string
+	// Whether a TCP listener serves without TLS. It is only allowed on a
+	// loopback address. A Unix domain socket never uses TLS.
+	Plaintext bool
+	// The types of the authenticators in the order they are tried, i.e.
+	// "client_certificate", "id_token", "peer_credential" or
+	// "service_account_token".
+	Authenticators []string
+	// The UIDs of the local processes that the "peer_credential"
+	// authenticator accepts.
+	AllowedUIDs []uint32
+}
+
+// authenticatorsKey is the context key of the authenticator chain of the
+// listener that a request is received on.
+type authenticatorsKey struct{}
+
+// listener is a listener of the GRPC service with its own authenticator chain.
+type listener struct {
+	opts           ListenerOptions
+	authenticators []authenticator
+}
+
+// newListener validates the options and creates the authenticators of a
+// listener. The ID token and the service account token authenticators are
+// shared between listeners, so they are passed in, and are nil if they are
+// unavailable.
+func newListener(opts ListenerOptions, idToken, saToken authenticator) (*listener, error) {
+	switch opts.Network {
+	case NetworkTCP:
+		if opts.Plaintext && !isLoopback(opts.Address) {
+			return nil, fmt.Errorf("plaintext listener %s is not on a loopback address", opts.Address)
+		}
+	case NetworkUnix:
+	default:
+		return nil, fmt.Errorf("unsupported network %q of listener %s", opts.Network, opts.Address)
+	}
+	if len(opts.Authenticators) == 0 {
+		return nil, fmt.Errorf("listener %s has no authenticator", opts.Address)
+	}
+
+	l := &listener{opts: opts}
+	for _, name := range opts.Authenticators {
+		var authn authenticator
+		switch name {
+		case authSourceClientCertificate.String():
+			if opts.Network != NetworkTCP || opts.Plaintext {
+				return nil, fmt.Errorf("client certificates require a TLS listener but %s is not", opts.Address)
+			}
+			authn = &clientCertAuthenticator{}
+		case authSourceIDToken.String():
+			if idToken == nil {
+				continue
+			}
+			authn = idToken
+		case authSourcePeerCredential.String():
+			if opts.Network != NetworkUnix {
+				return nil, fmt.Errorf("peer credentials require a Unix domain socket but %s is not", opts.Address)
+			}
+			authn = newPeerCredAuthenticator(opts.AllowedUIDs)
+		case authSourceServiceAccountToken.String():
+			if saToken == nil {
+				return nil, fmt.Errorf("service account tokens of listener %s are not enabled", opts.Address)
+			}
+			authn = saToken
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q of listener %s", name, opts.Address)
+		}
+		l.authenticators = append(l.authenticators, authn)
+	}
+	return l, nil
+}
+
+// listen creates the network listener. A stale Unix domain socket left by a
+// previous process is removed first.
+func (l *listener) listen() (net.Listener, error) {
+	if l.opts.Network == NetworkUnix {
+		if err := os.Remove(l.opts.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot remove the stale socket %s (error: %v)", l.opts.Address, err)
+		}
+	}
+	lis, err := net.Listen(l.opts.Network, l.opts.Address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s (error: %v)", l.opts.Address, err)
+	}
+	return lis, nil
+}
+
+// credentials returns the transport credentials of the listener, or nil for
+// a plaintext listener.
+func (l *listener) credentials(tlsCreds credentials.TransportCredentials) credentials.TransportCredentials {
+	switch {
+	case l.opts.Network == NetworkUnix:
+		return peercred.NewCredentials()
+	case l.opts.Plaintext:
+		return nil
+	default:
+		return tlsCreds
+	}
+}
+
+// intercept attaches the authenticator chain of the listener to the request.
+func (l *listener) intercept(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(context.WithValue(ctx, authenticatorsKey{}, l.authenticators), req)
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,242 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+
+	"istio.io/auth/pkg/server/servingcert"
+	pb "istio.io/auth/proto"
+)
+
+func TestNewListener(t *testing.T) {
+	testCases := map[string]struct {
+		opts           ListenerOptions
+		idToken        authenticator
+		saToken        authenticator
+		authenticators int
+		expectedErr    string
+	}{
+		"TLS listener": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"client_certificate", "id_token"},
+			},
+			idToken:        &mockAuthenticator{},
+			authenticators: 2,
+		},
+		"ID token authenticator unavailable": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"client_certificate", "id_token"},
+			},
+			authenticators: 1,
+		},
+		"Plaintext localhost listener": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        "127.0.0.1:8061",
+				Plaintext:      true,
+				Authenticators: []string{"id_token"},
+			},
+			idToken:        &mockAuthenticator{},
+			authenticators: 1,
+		},
+		"Plaintext listener on a non-loopback address": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8061",
+				Plaintext:      true,
+				Authenticators: []string{"id_token"},
+			},
+			expectedErr: "plaintext listener :8061 is not on a loopback address",
+		},
+		"Client certificates on a plaintext listener": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        "localhost:8061",
+				Plaintext:      true,
+				Authenticators: []string{"client_certificate"},
+			},
+			expectedErr: "client certificates require a TLS listener but localhost:8061 is not",
+		},
+		"Unix domain socket": {
+			opts: ListenerOptions{
+				Network:        NetworkUnix,
+				Address:        "/tmp/ca.sock",
+				Authenticators: []string{"peer_credential", "id_token"},
+				AllowedUIDs:    []uint32{0},
+			},
+			idToken:        &mockAuthenticator{},
+			authenticators: 2,
+		},
+		"Peer credentials on a TCP listener": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"peer_credential"},
+			},
+			expectedErr: "peer credentials require a Unix domain socket but :8060 is not",
+		},
+		"Service account tokens": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"client_certificate", "service_account_token"},
+			},
+			saToken:        &mockAuthenticator{},
+			authenticators: 2,
+		},
+		"Service account tokens not enabled": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"service_account_token"},
+			},
+			expectedErr: "service account tokens of listener :8060 are not enabled",
+		},
+		"Unsupported network": {
+			opts: ListenerOptions{
+				Network:        "udp",
+				Address:        ":8060",
+				Authenticators: []string{"id_token"},
+			},
+			expectedErr: `unsupported network "udp" of listener :8060`,
+		},
+		"No authenticator": {
+			opts: ListenerOptions{
+				Network: NetworkTCP,
+				Address: ":8060",
+			},
+			expectedErr: "listener :8060 has no authenticator",
+		},
+		"Unknown authenticator": {
+			opts: ListenerOptions{
+				Network:        NetworkTCP,
+				Address:        ":8060",
+				Authenticators: []string{"password"},
+			},
+			expectedErr: `unknown authenticator "password" of listener :8060`,
+		},
+	}
+
+	for id, c := range testCases {
+		l, err := newListener(c.opts, c.idToken, c.saToken)
+		if c.expectedErr != "" {
+			if err == nil {
+				t.Errorf("Case %s: expecting error %q but got none", id, c.expectedErr)
+			} else if err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %q", id, c.expectedErr, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+			continue
+		}
+		if len(l.authenticators) != c.authenticators {
+			t.Errorf("Case %s: expecting %d authenticators but got %d", id, c.authenticators, len(l.authenticators))
+		}
+	}
+}
+
+func TestUnixDomainSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ca.sock")
+
+	istioCA, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		allowedUIDs []uint32
+		code        codes.Code
+	}{
+		"Allowed UID": {
+			allowedUIDs: []uint32{uint32(os.Getuid())},
+			code:        codes.OK,
+		},
+		"Disallowed UID": {
+			allowedUIDs: []uint32{uint32(os.Getuid()) + 1},
+			code:        codes.Unauthenticated,
+		},
+	}
+
+	for id, c := range testCases {
+		l, err := newListener(ListenerOptions{
+			Network:        NetworkUnix,
+			Address:        socket,
+			Authenticators: []string{"peer_credential"},
+			AllowedUIDs:    c.allowedUIDs,
+		}, nil, nil)
+		if err != nil {
+			t.Fatalf("Case %s: %v", id, err)
+		}
+		server := &Server{
+			listeners:    []*listener{l},
+			authorizer:   &simpleAuthorizer{},
+			rateLimiter:  newRateLimiter(RateLimitOptions{}),
+			ca:           istioCA,
+			hostname:     "localhost",
+			healthServer: health.NewServer(),
+			certManager:  servingcert.NewManager(istioCA, servingcert.Options{Hosts: []string{"localhost"}}),
+			stopCh:       make(chan struct{}),
+		}
+		if err := server.Run(); err != nil {
+			t.Fatalf("Case %s: %v", id, err)
+		}
+
+		conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second),
+			grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout(NetworkUnix, addr, timeout)
+			}))
+		if err != nil {
+			t.Fatalf("Case %s: failed to dial %s: %v", id, socket, err)
+		}
+		_, err = pb.NewIstioCAServiceClient(conn).HandleCSR(context.Background(), &pb.Request{CsrPem: []byte(csr)})
+		if code := grpc.Code(err); code != c.code {
+			t.Errorf("Case %s: expecting code %v but got %v (%v)", id, c.code, code, err)
+		}
+		conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := server.Stop(ctx); err != nil {
+			t.Errorf("Case %s: failed to stop the server: %v", id, err)
+		}
+		cancel()
+	}
+}
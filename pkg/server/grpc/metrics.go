@@ -0,0 +1,68 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+const (
+	metricsNamespace = "istio_ca"
+
+	// The authenticator label of the requests that are not authenticated.
+	noAuthenticator = "none"
+	// The credential type label of the requests with a credential type that is
+	// not known to the CA. The credential type is set by clients, so it cannot
+	// be used as a label value as is.
+	otherCredentialType = "other"
+)
+
+var (
+	csrCounts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "csr_requests_total",
+		Help:      "The number of CSRs handled by the CA server.",
+	}, []string{"code", "authenticator", "credential_type"})
+
+	authorizationDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "authorization_denials_total",
+		Help:      "The number of CSRs that are not authorized for the requested identities.",
+	}, []string{"authenticator"})
+
+	knownCredentialTypes = map[string]bool{
+		"":       true,
+		"aws":    true,
+		"gcp":    true,
+		"onprem": true,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(csrCounts, authorizationDenials)
+}
+
+// recordCSR records the result of a CSR.
+func recordCSR(u *user, credentialType string, err error) {
+	authn := noAuthenticator
+	if u != nil {
+		authn = u.authSource.String()
+	}
+	if !knownCredentialTypes[credentialType] {
+		credentialType = otherCredentialType
+	}
+	csrCounts.WithLabelValues(grpc.Code(err).String(), authn, credentialType).Inc()
+}
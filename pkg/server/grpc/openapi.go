@@ -0,0 +1,148 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+// openAPISpec is the OpenAPI (Swagger 2.0) description of the HTTP/JSON
+// gateway. It must be kept in sync with gateway.go.
+const openAPISpec = `{
+  "swagger": "2.0",
+  "info": {
+    "title": "Istio CA",
+    "description": "HTTP/JSON gateway of the istio.v1.auth.IstioCAService GRPC service.",
+    "version": "v1"
+  },
+  "schemes": ["https"],
+  "consumes": ["application/json"],
+  "produces": ["application/json"],
+  "paths": {
+    "/v1/csr": {
+      "post": {
+        "summary": "Signs a certificate signing request.",
+        "description": "The caller must present a client certificate or a Bearer ID token for the CSR identities.",
+        "operationId": "HandleCSR",
+        "parameters": [
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {"$ref": "#/definitions/Request"}
+          }
+        ],
+        "responses": {
+          "200": {"description": "The CSR is signed.", "schema": {"$ref": "#/definitions/Response"}},
+          "400": {"description": "The CSR is invalid.", "schema": {"$ref": "#/definitions/Error"}},
+          "401": {"description": "The caller is not authenticated.", "schema": {"$ref": "#/definitions/Error"}},
+          "403": {"description": "The caller is not authorized.", "schema": {"$ref": "#/definitions/Error"}},
+          "429": {
+            "description": "Too many requests. The Retry-After header tells when to retry.",
+            "schema": {"$ref": "#/definitions/Error"}
+          },
+          "500": {"description": "The CSR cannot be signed.", "schema": {"$ref": "#/definitions/Error"}}
+        }
+      }
+    },
+    "/v1/root": {
+      "get": {
+        "summary": "Returns the root certificate of the CA.",
+        "operationId": "GetRootCertificate",
+        "responses": {
+          "200": {"description": "The root certificate.", "schema": {"$ref": "#/definitions/Root"}}
+        }
+      }
+    },
+    "/v1/admin/revoke": {
+      "post": {
+        "summary": "Revokes an issued certificate.",
+        "description": "Served only if the CA records the issued certificates and admin identities are configured.",
+        "operationId": "Revoke",
+        "parameters": [
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {"$ref": "#/definitions/RevokeRequest"}
+          }
+        ],
+        "responses": {
+          "200": {"description": "The certificate is revoked.", "schema": {"$ref": "#/definitions/RevokeResponse"}},
+          "400": {"description": "The request is invalid.", "schema": {"$ref": "#/definitions/Error"}},
+          "401": {
+            "description": "The caller presents neither a client certificate nor a Bearer ID token.",
+            "schema": {"$ref": "#/definitions/Error"}
+          },
+          "403": {"description": "The caller is not an administrator.", "schema": {"$ref": "#/definitions/Error"}},
+          "429": {
+            "description": "Too many requests. The Retry-After header tells when to retry.",
+            "schema": {"$ref": "#/definitions/Error"}
+          },
+          "500": {"description": "The certificate cannot be revoked.", "schema": {"$ref": "#/definitions/Error"}}
+        }
+      }
+    }
+  },
+  "definitions": {
+    "Request": {
+      "type": "object",
+      "required": ["csr_pem"],
+      "properties": {
+        "csr_pem": {"type": "string", "description": "PEM-encoded certificate signing request."},
+        "node_agent_credential": {
+          "type": "string",
+          "format": "byte",
+          "description": "Opaque credential for node agent."
+        },
+        "credential_type": {
+          "type": "string",
+          "description": "Type of the node_agent_credential (aws/gcp/onprem/custom...)."
+        }
+      }
+    },
+    "Response": {
+      "type": "object",
+      "properties": {
+        "is_approved": {"type": "boolean"},
+        "signed_cert_chain": {"type": "string", "description": "PEM-encoded certificate chain."}
+      }
+    },
+    "Root": {
+      "type": "object",
+      "properties": {
+        "root_cert": {"type": "string", "description": "PEM-encoded root certificate."}
+      }
+    },
+    "RevokeRequest": {
+      "type": "object",
+      "required": ["serial"],
+      "properties": {
+        "serial": {"type": "string", "description": "Hex-encoded serial number of the certificate."},
+        "reason": {"type": "string", "description": "Reason of the revocation, recorded in the ledger."}
+      }
+    },
+    "RevokeResponse": {
+      "type": "object",
+      "properties": {
+        "serial": {"type": "string", "description": "Hex-encoded serial number of the revoked certificate."}
+      }
+    },
+    "Error": {
+      "type": "object",
+      "properties": {
+        "code": {"type": "string", "description": "The GRPC status code, e.g. PermissionDenied."},
+        "message": {"type": "string"}
+      }
+    }
+  }
+}
+`
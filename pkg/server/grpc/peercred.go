@@ -0,0 +1,56 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"strconv"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"istio.io/auth/pkg/peercred"
+)
+
+// An authenticator that authenticates the local processes connected through
+// a Unix domain socket by their user IDs.
+type peerCredAuthenticator struct {
+	allowedUIDs map[uint32]bool
+}
+
+func newPeerCredAuthenticator(allowedUIDs []uint32) *peerCredAuthenticator {
+	uids := make(map[uint32]bool, len(allowedUIDs))
+	for _, uid := range allowedUIDs {
+		uids[uid] = true
+	}
+	return &peerCredAuthenticator{allowedUIDs: uids}
+}
+
+// authenticate returns a user identified by the UID of the peer process, if the
+// UID is allowed.
+func (pa *peerCredAuthenticator) authenticate(ctx context.Context) *user {
+	cred, ok := peercred.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if !pa.allowedUIDs[cred.UID] {
+		glog.Warningf("the peer process %d runs as a UID (%d) that is not allowed", cred.PID, cred.UID)
+		return nil
+	}
+
+	return &user{
+		authSource: authSourcePeerCredential,
+		identities: []string{"uid:" + strconv.FormatUint(uint64(cred.UID), 10)},
+	}
+}
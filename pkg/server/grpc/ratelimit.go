@@ -0,0 +1,249 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// RetryAfterKey is the key of the GRPC trailer that tells a rate-limited
+	// client how many seconds to wait before retrying.
+	RetryAfterKey = "retry-after"
+
+	// The keys of the global and the per-IP limits in the rate limit spec.
+	globalRateLimitKey = "global"
+	ipRateLimitKey     = "ip"
+
+	// The number of buckets the rate limiter keeps. Once it is reached, the
+	// least recently used bucket is dropped for a new one.
+	maxRateLimitBuckets = 10000
+)
+
+// RateLimit is a token bucket limit. A zero QPS means no limit.
+type RateLimit struct {
+	// The sustained number of requests per second.
+	QPS float64
+	// The number of requests that can be made at once.
+	Burst int64
+}
+
+// RateLimitOptions are the rate limits of CSRs.
+type RateLimitOptions struct {
+	// The limit of all the requests.
+	Global RateLimit
+	// The limit of the requests from each source IP address.
+	PerIP RateLimit
+	// The limits of the requests from each identity, keyed by the type of the
+	// authenticator that authenticates the identity, i.e. "client_certificate",
+	// "id_token" or "peer_credential".
+	PerIdentity map[string]RateLimit
+}
+
+// ParseRateLimits parses a comma-separated list of rate limits in the form of
+// "key=qps:burst", where key is "global", "ip" or an authenticator type, e.g.
+// "global=100:200,ip=10:20,client_certificate=1:5".
+func ParseRateLimits(spec string) (*RateLimitOptions, error) {
+	opts := &RateLimitOptions{PerIdentity: map[string]RateLimit{}}
+	if spec == "" {
+		return opts, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("rate limit %q is not in the form of key=qps:burst", entry)
+		}
+		limit, err := parseRateLimit(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q (error %v)", entry, err)
+		}
+
+		switch key := strings.TrimSpace(kv[0]); key {
+		case globalRateLimitKey:
+			opts.Global = limit
+		case ipRateLimitKey:
+			opts.PerIP = limit
+		case authSourceClientCertificate.String(), authSourceIDToken.String(), authSourcePeerCredential.String(),
+			authSourceServiceAccountToken.String():
+			opts.PerIdentity[key] = limit
+		default:
+			return nil, fmt.Errorf("unknown rate limit key %q", key)
+		}
+	}
+	return opts, nil
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("the limit must be in the form of qps:burst")
+	}
+	qps, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || qps < 0 {
+		return RateLimit{}, fmt.Errorf("invalid QPS %q", parts[0])
+	}
+	burst, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("invalid burst %q", parts[1])
+	}
+	return RateLimit{QPS: qps, Burst: burst}, nil
+}
+
+func (l RateLimit) newBucket() *ratelimit.Bucket {
+	if l.QPS <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucketWithRate(l.QPS, l.Burst)
+}
+
+// rateLimiter limits requests with token buckets that are kept per identity,
+// per source IP and globally.
+type rateLimiter struct {
+	opts   RateLimitOptions
+	global *ratelimit.Bucket
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the keyedBuckets, the most recently used first.
+	lru *list.List
+}
+
+type keyedBucket struct {
+	key    string
+	bucket *ratelimit.Bucket
+}
+
+func newRateLimiter(opts RateLimitOptions) *rateLimiter {
+	return &rateLimiter{
+		opts:    opts,
+		global:  opts.Global.newBucket(),
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// allowSource takes a token from the bucket of the source IP and the global
+// bucket, and returns whether the request is allowed. If not, it also returns
+// how long the caller should wait before retrying. It is checked before the
+// request is authenticated, so that unauthenticated requests are limited too.
+func (l *rateLimiter) allowSource(ip string) (bool, time.Duration) {
+	var buckets []*ratelimit.Bucket
+	if ip != "" {
+		buckets = append(buckets, l.getBucket(ipRateLimitKey+"/"+ip, l.opts.PerIP))
+	}
+	return take(append(buckets, l.global))
+}
+
+// allowUser takes a token from the bucket of the authenticated identities, if
+// their authentication source is limited, like allowSource.
+func (l *rateLimiter) allowUser(u *user) (bool, time.Duration) {
+	if u == nil {
+		return true, 0
+	}
+	source := u.authSource.String()
+	limit, ok := l.opts.PerIdentity[source]
+	if !ok {
+		return true, 0
+	}
+	return take([]*ratelimit.Bucket{l.getBucket(source+"/"+strings.Join(u.identities, ","), limit)})
+}
+
+// take takes a token from every bucket, and returns whether all of them have
+// one. A bucket that rejects the request leaves the tokens taken from the
+// buckets before it.
+func take(buckets []*ratelimit.Bucket) (bool, time.Duration) {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if b.TakeAvailable(1) == 0 {
+			// The bucket is empty, so the next token is available after one
+			// refill interval at most.
+			return false, time.Duration(float64(time.Second) / b.Rate())
+		}
+	}
+	return true, 0
+}
+
+func (l *rateLimiter) getBucket(key string, limit RateLimit) *ratelimit.Bucket {
+	if limit.QPS <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*keyedBucket).bucket
+	}
+	if l.lru.Len() >= maxRateLimitBuckets {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*keyedBucket).key)
+	}
+	b := limit.newBucket()
+	l.buckets[key] = l.lru.PushFront(&keyedBucket{key: key, bucket: b})
+	return b
+}
+
+// retryHintKey is the context key of the retry hint of the HTTP gateway, which
+// cannot receive GRPC trailers.
+type retryHintKey struct{}
+
+// setRetryAfter tells the client how long to wait before retrying, rounded up
+// to seconds.
+func setRetryAfter(ctx context.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	if hint, ok := ctx.Value(retryHintKey{}).(*int); ok {
+		*hint = seconds
+		return
+	}
+	// SetTrailer fails only if the context does not belong to a GRPC call.
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterKey, strconv.Itoa(seconds)))
+}
+
+// peerIP returns the IP address of the client, or an empty string if it is
+// unknown or the client is not connected over TCP, e.g. over a Unix domain
+// socket, whose clients would otherwise share a bucket.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr, ok := p.Addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
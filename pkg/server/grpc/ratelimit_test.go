@@ -0,0 +1,287 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+
+	pb "istio.io/auth/proto"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	testCases := map[string]struct {
+		spec   string
+		opts   *RateLimitOptions
+		errMsg string
+	}{
+		"Empty spec": {
+			spec: "",
+			opts: &RateLimitOptions{PerIdentity: map[string]RateLimit{}},
+		},
+		"All limits": {
+			spec: "global=100:200,ip=10:20,client_certificate=1:5,id_token=0.5:1",
+			opts: &RateLimitOptions{
+				Global: RateLimit{QPS: 100, Burst: 200},
+				PerIP:  RateLimit{QPS: 10, Burst: 20},
+				PerIdentity: map[string]RateLimit{
+					"client_certificate": {QPS: 1, Burst: 5},
+					"id_token":           {QPS: 0.5, Burst: 1},
+				},
+			},
+		},
+		"Missing key": {
+			spec:   "10:20",
+			errMsg: `rate limit "10:20" is not in the form of key=qps:burst`,
+		},
+		"Unknown key": {
+			spec:   "user=10:20",
+			errMsg: `unknown rate limit key "user"`,
+		},
+		"Missing burst": {
+			spec:   "global=10",
+			errMsg: `invalid rate limit "global=10" (error the limit must be in the form of qps:burst)`,
+		},
+		"Invalid QPS": {
+			spec:   "global=-1:20",
+			errMsg: `invalid rate limit "global=-1:20" (error invalid QPS "-1")`,
+		},
+		"Invalid burst": {
+			spec:   "global=10:0",
+			errMsg: `invalid rate limit "global=10:0" (error invalid burst "0")`,
+		},
+	}
+
+	for id, c := range testCases {
+		opts, err := ParseRateLimits(c.spec)
+		if c.errMsg != "" {
+			if err == nil {
+				t.Errorf("Case %s: expecting error (%s) but got none", id, c.errMsg)
+			} else if err.Error() != c.errMsg {
+				t.Errorf("Case %s: expecting error (%s) but got (%v)", id, c.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error %v", id, err)
+		} else if !reflect.DeepEqual(c.opts, opts) {
+			t.Errorf("Case %s: expecting %+v but got %+v", id, c.opts, opts)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	alice := &user{authSource: authSourceClientCertificate, identities: []string{"alice"}}
+	bob := &user{authSource: authSourceClientCertificate, identities: []string{"bob"}}
+	carol := &user{authSource: authSourceIDToken, identities: []string{"carol"}}
+
+	type request struct {
+		ip      string
+		user    *user
+		allowed bool
+	}
+	testCases := map[string]struct {
+		opts     RateLimitOptions
+		requests []request
+	}{
+		"No limit": {
+			requests: []request{
+				{"10.0.0.1", alice, true},
+				{"10.0.0.1", alice, true},
+				{"10.0.0.1", nil, true},
+			},
+		},
+		"Per identity": {
+			opts: RateLimitOptions{
+				PerIdentity: map[string]RateLimit{"client_certificate": {QPS: 0.001, Burst: 1}},
+			},
+			requests: []request{
+				{"10.0.0.1", alice, true},
+				{"10.0.0.1", alice, false},
+				{"10.0.0.1", bob, true},
+				// ID token identities are not limited.
+				{"10.0.0.1", carol, true},
+				{"10.0.0.1", carol, true},
+			},
+		},
+		"Per IP": {
+			opts: RateLimitOptions{PerIP: RateLimit{QPS: 0.001, Burst: 2}},
+			requests: []request{
+				{"10.0.0.1", alice, true},
+				{"10.0.0.1", bob, true},
+				{"10.0.0.1", nil, false},
+				{"10.0.0.2", nil, true},
+			},
+		},
+		"Global": {
+			opts: RateLimitOptions{Global: RateLimit{QPS: 0.001, Burst: 2}},
+			requests: []request{
+				{"10.0.0.1", alice, true},
+				{"10.0.0.2", bob, true},
+				{"10.0.0.3", carol, false},
+			},
+		},
+	}
+
+	for id, c := range testCases {
+		limiter := newRateLimiter(c.opts)
+		for i, r := range c.requests {
+			allowed, wait := limiter.allowSource(r.ip)
+			if allowed {
+				allowed, wait = limiter.allowUser(r.user)
+			}
+			if allowed != r.allowed {
+				t.Errorf("Case %s: expecting request #%d to be allowed (%t) but got (%t)", id, i, r.allowed, allowed)
+			} else if !allowed && wait <= 0 {
+				t.Errorf("Case %s: expecting a positive wait for request #%d but got %v", id, i, wait)
+			}
+		}
+	}
+}
+
+func TestRateLimiterBucketLimit(t *testing.T) {
+	limit := RateLimit{QPS: 0.001, Burst: 1}
+	limiter := newRateLimiter(RateLimitOptions{PerIP: limit})
+	// None of the buckets is full, since each has served a request.
+	for i := 0; i < maxRateLimitBuckets+10; i++ {
+		limiter.allowSource(fmt.Sprintf("ip-%d", i))
+		if i == 0 {
+			// The first bucket stays recently used.
+			continue
+		}
+		limiter.allowSource("ip-0")
+	}
+
+	if n := len(limiter.buckets); n != maxRateLimitBuckets || limiter.lru.Len() != maxRateLimitBuckets {
+		t.Errorf("Expecting %d buckets but got %d", maxRateLimitBuckets, n)
+	}
+	if _, ok := limiter.buckets[ipRateLimitKey+"/ip-0"]; !ok {
+		t.Error("Expecting the recently used bucket to be kept")
+	}
+	if _, ok := limiter.buckets[ipRateLimitKey+"/ip-1"]; ok {
+		t.Error("Expecting the least recently used bucket to be dropped")
+	}
+}
+
+func TestHandleCSRRateLimited(t *testing.T) {
+	limits, err := ParseRateLimits("ip=0.001:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		authenticators: []authenticator{&mockAuthenticator{true}},
+		authorizer:     &mockAuthorizer{true},
+		rateLimiter:    newRateLimiter(*limits),
+		ca:             &mockCA{cert: "generated cert"},
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}})
+
+	if _, err := server.HandleCSR(ctx, &pb.Request{CsrPem: []byte(csr)}); err != nil {
+		t.Fatalf("Unexpected error for the first request: %v", err)
+	}
+	if _, err := server.HandleCSR(ctx, &pb.Request{CsrPem: []byte(csr)}); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expecting code to be (%s) but got (%v)", codes.ResourceExhausted, err)
+	}
+}
+
+func TestHandleCSRRateLimitedBeforeAuthentication(t *testing.T) {
+	limits, err := ParseRateLimits("ip=0.001:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authn := &countingAuthenticator{}
+	server := &Server{
+		authenticators: []authenticator{authn},
+		authorizer:     &mockAuthorizer{true},
+		rateLimiter:    newRateLimiter(*limits),
+		ca:             &mockCA{cert: "generated cert"},
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}})
+
+	// The unauthenticated requests are counted, and the rejected ones are not
+	// authenticated.
+	expectedCodes := []codes.Code{codes.Unauthenticated, codes.ResourceExhausted, codes.ResourceExhausted}
+	for i, code := range expectedCodes {
+		if _, err := server.HandleCSR(ctx, &pb.Request{CsrPem: []byte(csr)}); grpc.Code(err) != code {
+			t.Errorf("Expecting code of request #%d to be (%s) but got (%v)", i, code, err)
+		}
+	}
+	if authn.count != 1 {
+		t.Errorf("Expecting 1 authentication but got %d", authn.count)
+	}
+}
+
+func TestPeerIP(t *testing.T) {
+	testCases := map[string]struct {
+		addr       net.Addr
+		expectedIP string
+	}{
+		"TCP":         {addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, expectedIP: "10.0.0.1"},
+		"IPv6":        {addr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}, expectedIP: "::1"},
+		"Unix socket": {addr: &net.UnixAddr{Name: "/var/run/istio-ca.sock", Net: "unix"}},
+		"No address":  {},
+	}
+	for id, c := range testCases {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: c.addr})
+		if ip := peerIP(ctx); ip != c.expectedIP {
+			t.Errorf("Case %s: expecting IP %q but got %q", id, c.expectedIP, ip)
+		}
+	}
+}
+
+// countingAuthenticator counts the requests, and authenticates none of them.
+type countingAuthenticator struct {
+	count int
+}
+
+func (a *countingAuthenticator) authenticate(ctx context.Context) *user {
+	a.count++
+	return nil
+}
+
+func TestGatewayCSRRateLimited(t *testing.T) {
+	body, err := json.Marshal(&csrRequest{CsrPem: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		authenticators: []authenticator{&mockAuthenticator{true}},
+		authorizer:     &mockAuthorizer{true},
+		rateLimiter:    newRateLimiter(RateLimitOptions{Global: RateLimit{QPS: 0.001, Burst: 1}}),
+		ca:             &mockCA{cert: "generated cert"},
+	}
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		server.gatewayHandler().ServeHTTP(w, httptest.NewRequest("POST", gatewayCSRPath, strings.NewReader(string(body))))
+		if w.Code != status {
+			t.Errorf("Expecting status of request #%d to be (%d) but got (%d)", i, status, w.Code)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); (status == http.StatusTooManyRequests) != (retryAfter != "") {
+			t.Errorf("Unexpected Retry-After header of request #%d: %q", i, retryAfter)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"istio.io/auth/pkg/pki/ca"
+
+	"k8s.io/client-go/pkg/api/v1"
+	authv1beta1 "k8s.io/client-go/pkg/apis/authentication/v1beta1"
+)
+
+const (
+	serviceAccountUserPrefix = "system:serviceaccount:"
+
+	// The keys of the extra information about the user of a pod-bound
+	// service account token.
+	podNameExtraKey = "authentication.kubernetes.io/pod-name"
+	podUIDExtraKey  = "authentication.kubernetes.io/pod-uid"
+)
+
+// TokenReviewer validates Kubernetes service account tokens. It is implemented
+// by the TokenReviews client of the Kubernetes authentication API.
+type TokenReviewer interface {
+	Create(*authv1beta1.TokenReview) (*authv1beta1.TokenReview, error)
+}
+
+// PodRegistry tracks the pods that get pod-scoped certificates.
+type PodRegistry interface {
+	// GetPod returns the pod with the given name and UID, or an error if it
+	// cannot get a certificate.
+	GetPod(namespace, name, uid string) (*v1.Pod, error)
+	// Bind records the certificate with the given serial number as issued to
+	// the pod.
+	Bind(pod *v1.Pod, serial string)
+}
+
+// ServiceAccountTokenOptions are the options of the authenticator of the
+// pod-bound service account tokens, which issues pod-scoped certificates.
+type ServiceAccountTokenOptions struct {
+	// The reviewer of the tokens.
+	Reviewer TokenReviewer
+	// The pods that the tokens can be bound to.
+	Pods PodRegistry
+	// The TTL of the pod-scoped certificates. If zero, the default TTL of the
+	// CA is used.
+	CertTTL time.Duration
+}
+
+// serviceAccountTokenAuthenticator authenticates a pod by its service account
+// token that is bound to the pod. The pod is allowed the identity of its
+// service account, and its DNS names by its name and IP.
+type serviceAccountTokenAuthenticator struct {
+	reviewer TokenReviewer
+	pods     PodRegistry
+}
+
+func (a *serviceAccountTokenAuthenticator) authenticate(ctx context.Context) *user {
+	token := extractBearerToken(ctx)
+	if token == "" {
+		return nil
+	}
+	return a.authenticateToken(token)
+}
+
+func (a *serviceAccountTokenAuthenticator) authenticateToken(token string) *user {
+	review, err := a.reviewer.Create(&authv1beta1.TokenReview{Spec: authv1beta1.TokenReviewSpec{Token: token}})
+	if err != nil {
+		glog.Warningf("failed to review the service account token (error %v)", err)
+		return nil
+	}
+	if !review.Status.Authenticated {
+		glog.Warningf("the service account token is not authenticated (error %s)", review.Status.Error)
+		return nil
+	}
+
+	userInfo := review.Status.User
+	if !strings.HasPrefix(userInfo.Username, serviceAccountUserPrefix) {
+		glog.Warningf("the token of %q is not a service account token", userInfo.Username)
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(userInfo.Username, serviceAccountUserPrefix), ":")
+	if len(parts) != 2 {
+		glog.Warningf("invalid service account user name %q", userInfo.Username)
+		return nil
+	}
+	namespace, saName := parts[0], parts[1]
+
+	podName, podUID := firstExtra(userInfo, podNameExtraKey), firstExtra(userInfo, podUIDExtraKey)
+	if podName == "" || podUID == "" {
+		glog.Warningf("the service account token of %q is not bound to a pod", userInfo.Username)
+		return nil
+	}
+	pod, err := a.pods.GetPod(namespace, podName, podUID)
+	if err != nil {
+		glog.Warningf("the pod of the service account token is rejected (error %v)", err)
+		return nil
+	}
+	if pod.Spec.ServiceAccountName != saName {
+		glog.Warningf("pod %s/%s does not run as service account %s", namespace, podName, saName)
+		return nil
+	}
+
+	return &user{
+		authSource: authSourceServiceAccountToken,
+		identities: ca.PodIdentities(saName, namespace, pod.Name, pod.Status.PodIP),
+		pod:        pod,
+	}
+}
+
+func firstExtra(userInfo authv1beta1.UserInfo, key string) string {
+	if values := userInfo.Extra[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
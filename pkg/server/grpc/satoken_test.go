@@ -0,0 +1,180 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"istio.io/auth/pkg/audit"
+	"istio.io/auth/pkg/pki"
+	pb "istio.io/auth/proto"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	authv1beta1 "k8s.io/client-go/pkg/apis/authentication/v1beta1"
+)
+
+type fakeTokenReviewer struct {
+	users map[string]authv1beta1.UserInfo
+}
+
+func (r *fakeTokenReviewer) Create(review *authv1beta1.TokenReview) (*authv1beta1.TokenReview, error) {
+	if review.Spec.Token == "broken" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	result := *review
+	if userInfo, ok := r.users[review.Spec.Token]; ok {
+		result.Status = authv1beta1.TokenReviewStatus{Authenticated: true, User: userInfo}
+	} else {
+		result.Status = authv1beta1.TokenReviewStatus{Error: "invalid token"}
+	}
+	return &result, nil
+}
+
+type fakePodRegistry struct {
+	pods  map[string]*v1.Pod
+	bound map[string][]string
+}
+
+func (r *fakePodRegistry) GetPod(namespace, name, uid string) (*v1.Pod, error) {
+	pod, ok := r.pods[namespace+"/"+name]
+	if !ok || string(pod.UID) != uid {
+		return nil, fmt.Errorf("pod %s/%s with UID %s does not exist", namespace, name, uid)
+	}
+	return pod, nil
+}
+
+func (r *fakePodRegistry) Bind(pod *v1.Pod, serial string) {
+	r.bound[pod.Name] = append(r.bound[pod.Name], serial)
+}
+
+func podUser(sa, podName, podUID string) authv1beta1.UserInfo {
+	return authv1beta1.UserInfo{
+		Username: "system:serviceaccount:default:" + sa,
+		Extra: map[string]authv1beta1.ExtraValue{
+			podNameExtraKey: {podName},
+			podUIDExtraKey:  {podUID},
+		},
+	}
+}
+
+func TestServiceAccountTokenAuthenticator(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"},
+		Spec:       v1.PodSpec{ServiceAccountName: "sa"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	authn := &serviceAccountTokenAuthenticator{
+		reviewer: &fakeTokenReviewer{users: map[string]authv1beta1.UserInfo{
+			"pod-token":         podUser("sa", "pod", "uid"),
+			"stale-token":       podUser("sa", "pod", "old-uid"),
+			"other-sa-token":    podUser("other", "pod", "uid"),
+			"unbound-token":     {Username: "system:serviceaccount:default:sa"},
+			"user-token":        {Username: "alice"},
+			"malformed-sa-name": {Username: "system:serviceaccount:default"},
+		}},
+		pods: &fakePodRegistry{pods: map[string]*v1.Pod{"default/pod": pod}},
+	}
+
+	testCases := map[string]struct {
+		token string
+		user  *user
+	}{
+		"Pod-bound token": {
+			token: "pod-token",
+			user: &user{
+				authSource: authSourceServiceAccountToken,
+				identities: []string{
+					"spiffe://cluster.local/ns/default/sa/sa",
+					"pod.default.pod.cluster.local",
+					"10-0-0-1.default.pod.cluster.local",
+				},
+				pod: pod,
+			},
+		},
+		"Token of a deleted pod": {
+			token: "stale-token",
+		},
+		"Token of another service account": {
+			token: "other-sa-token",
+		},
+		"Token not bound to a pod": {
+			token: "unbound-token",
+		},
+		"Token of a user": {
+			token: "user-token",
+		},
+		"Malformed service account name": {
+			token: "malformed-sa-name",
+		},
+		"Invalid token": {
+			token: "invalid-token",
+		},
+		"Failed review": {
+			token: "broken",
+		},
+	}
+
+	for id, tc := range testCases {
+		if u := authn.authenticateToken(tc.token); !reflect.DeepEqual(u, tc.user) {
+			t.Errorf("Case %s: expecting user %+v but got %+v", id, tc.user, u)
+		}
+	}
+}
+
+type podAuthenticator struct {
+	pod *v1.Pod
+}
+
+func (a *podAuthenticator) authenticate(ctx context.Context) *user {
+	return &user{authSource: authSourceServiceAccountToken, pod: a.pod}
+}
+
+func TestPodScopedCertificate(t *testing.T) {
+	istioCA, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"}}
+	pods := &fakePodRegistry{bound: map[string][]string{}}
+	server := &Server{
+		authenticators: []authenticator{&podAuthenticator{pod}},
+		authorizer:     &mockAuthorizer{true},
+		ca:             istioCA,
+		pods:           pods,
+		podCertTTL:     10 * time.Minute,
+	}
+
+	response, err := server.HandleCSR(context.Background(), &pb.Request{CsrPem: []byte(csr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := pki.ParsePemEncodedCertificate(response.SignedCertChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := cert.NotAfter.Sub(cert.NotBefore); ttl != server.podCertTTL {
+		t.Errorf("Expecting the TTL of the pod-scoped certificate to be %v but got %v", server.podCertTTL, ttl)
+	}
+	expectedSerials := []string{audit.CertSerial(response.SignedCertChain)}
+	if !reflect.DeepEqual(pods.bound["pod"], expectedSerials) {
+		t.Errorf("Expecting the certificates %v to be bound to the pod but got %v", expectedSerials, pods.bound["pod"])
+	}
+}
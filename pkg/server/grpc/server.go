@@ -19,32 +19,78 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 
 	"github.com/golang/glog"
 
 	"golang.org/x/net/context"
 
+	"istio.io/auth/pkg/audit"
 	"istio.io/auth/pkg/pki"
 	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/server/servingcert"
+	"istio.io/auth/pkg/tlspolicy"
 	pb "istio.io/auth/proto"
 )
 
-const certExpirationBuffer = time.Minute
+const (
+	// The interval between the attempts to issue the first serving certificate.
+	warmUpRetryInterval = 5 * time.Second
+
+	// The name of the service reported by the health service.
+	serviceName = "istio.v1.auth.IstioCAService"
+	// The name of the service whose health reports whether this replica is
+	// the leader that runs the secret controller.
+	leaderServiceName = "istio.v1.auth.SecretController"
+)
 
 // Server implements pb.IstioCAService and provides the service on the
-// specified port.
+// specified listeners. The service is also exposed as HTTP/JSON on the gateway
+// port, if specified.
 type Server struct {
+	// The authenticators of the gateway, and of the requests that are not
+	// received on a listener.
 	authenticators []authenticator
+	listeners      []*listener
 	authorizer     authorizer
+	rateLimiter    *rateLimiter
+	auditSink      audit.Sink
+	tlsPolicy      tlspolicy.Options
 	ca             ca.CertificateAuthority
-	certificate    *tls.Certificate
 	hostname       string
 	port           int
+	gatewayPort    int
+
+	// The revoker of the issued certificates, and the identities that may
+	// revoke them through the gateway. Revocation is not served unless both
+	// are set.
+	revoker         Revoker
+	adminIdentities []string
+
+	// The pods that get pod-scoped certificates, and the TTL of their
+	// certificates. The pods are nil unless service account tokens are
+	// accepted.
+	pods       PodRegistry
+	podCertTTL time.Duration
+
+	enableReflection bool
+	grpcServers      []*grpc.Server
+	gatewayServer    *http.Server
+	healthServer     *health.Server
+	// Closed when the server is stopped.
+	stopCh chan struct{}
+
+	// The serving certificate shared by GRPC and the gateway.
+	certManager *servingcert.Manager
 }
 
 // HandleCSR handles an incoming certificate signing request (CSR). It does
@@ -52,33 +98,99 @@ type Server struct {
 // and returns the resulting certificate. If not approved, reason for refusal
 // to sign is returned as part of the response object.
 func (s *Server) HandleCSR(ctx context.Context, request *pb.Request) (*pb.Response, error) {
-	user := s.authenticate(ctx)
+	// The source of the request is limited before the authentication, which
+	// may be expensive, e.g. a token review, and its identity after it.
+	var user *user
+	allowed, wait := s.allowSource(ctx)
+	if allowed {
+		user = s.authenticate(ctx)
+		allowed, wait = s.allowUser(user)
+	}
+	event := newCSREvent(ctx, user)
+
+	var response *pb.Response
+	var err error
+	if !allowed {
+		setRetryAfter(ctx, wait)
+		event.Reason = "rate limited"
+		err = grpc.Errorf(codes.ResourceExhausted, "too many certificate signing requests, retry after %v", wait)
+	} else {
+		response, err = s.handleCSR(user, request, event)
+	}
+	recordCSR(user, request.CredentialType, err)
+
+	if err != nil {
+		event.Decision = audit.Deny
+		event.Error = grpc.ErrorDesc(err)
+	} else {
+		event.Decision = audit.Allow
+		event.Serial = audit.CertSerial(response.SignedCertChain)
+	}
+	audit.Record(s.auditSink, event)
+
+	return response, err
+}
+
+// allowSource applies the per-IP and global rate limits to the request.
+func (s *Server) allowSource(ctx context.Context) (bool, time.Duration) {
+	if s.rateLimiter == nil {
+		return true, 0
+	}
+	return s.rateLimiter.allowSource(peerIP(ctx))
+}
+
+// allowUser applies the per-identity rate limits to the authenticated request.
+func (s *Server) allowUser(user *user) (bool, time.Duration) {
+	if s.rateLimiter == nil {
+		return true, 0
+	}
+	return s.rateLimiter.allowUser(user)
+}
+
+// handleCSR authorizes and signs the CSR. The requested identities and the
+// reason of a denial are recorded in the audit event.
+func (s *Server) handleCSR(user *user, request *pb.Request, event *audit.Event) (*pb.Response, error) {
 	if user == nil {
 		glog.Warning("failed to authenticate request")
 
+		event.Reason = "not authenticated"
 		return nil, grpc.Errorf(codes.Unauthenticated, "failed to authenticate request")
 	}
 
 	csr, err := pki.ParsePemEncodedCSR(request.CsrPem)
 	if err != nil {
+		event.Reason = "invalid CSR"
 		return nil, grpc.Errorf(codes.InvalidArgument, "failed to parse the CSR (error %v)", err)
 	}
 
 	requestedIDs := pki.ExtractIDs(csr.Extensions)
+	event.RequestedIDs = requestedIDs
 	if len(requestedIDs) == 0 {
+		event.Reason = "no identity is requested"
 		return nil, grpc.Errorf(codes.InvalidArgument, "failed to extract identities from the CSR")
 	}
 
-	if !s.authorizer.authorize(user, requestedIDs) {
+	if err := s.authorizer.authorize(user, requestedIDs); err != nil {
+		authorizationDenials.WithLabelValues(user.authSource.String()).Inc()
+		event.Reason = err.Error()
 		return nil, grpc.Errorf(codes.PermissionDenied, "certificate signing request is not authorized")
 	}
 
-	cert, err := s.ca.Sign(request.CsrPem)
+	var ttl time.Duration
+	if user.pod != nil {
+		ttl = s.podCertTTL
+	}
+	cert, err := s.ca.Sign(request.CsrPem, ttl)
 	if err != nil {
 		glog.Error(err)
 
+		event.Reason = "signing failed"
 		return nil, grpc.Errorf(codes.Internal, "failed to sign the CSR (error %v)", err)
 	}
+	if user.pod != nil {
+		// The certificate is forgotten when the pod is deleted.
+		s.pods.Bind(user.pod, audit.CertSerial(cert))
+	}
 
 	response := &pb.Response{
 		IsApproved:      true,
@@ -88,117 +200,324 @@ func (s *Server) HandleCSR(ctx context.Context, request *pb.Request) (*pb.Respon
 	return response, nil
 }
 
-// Run starts a GRPC server on the specified port.
+// newCSREvent creates the audit event of a CSR from the caller.
+func newCSREvent(ctx context.Context, user *user) *audit.Event {
+	event := &audit.Event{Source: audit.SourceCSR}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		event.PeerAddress = p.Addr.String()
+	}
+	if user != nil {
+		event.AuthSource = user.authSource.String()
+		event.Identities = user.identities
+	}
+	return event
+}
+
+// Run starts a GRPC server on each listener, and the HTTP/JSON gateway if the
+// gateway port is specified. The health service reports NOT_SERVING until the
+// first serving certificate has been issued by the CA.
 func (s *Server) Run() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	tlsConfig, err := s.createTLSConfig()
 	if err != nil {
-		return fmt.Errorf("cannot listen on port %d (error: %v)", s.port, err)
+		return err
 	}
+	tlsCreds := credentials.NewTLS(tlsConfig)
 
-	serverOption := s.createTLSServerOption()
+	for _, l := range s.listeners {
+		if err := s.serve(l, tlsCreds); err != nil {
+			return err
+		}
+	}
 
-	grpcServer := grpc.NewServer(serverOption)
+	if s.gatewayPort > 0 {
+		if err := s.runGateway(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	go s.warmUp()
+	return nil
+}
+
+// serve starts a GRPC server on the listener.
+func (s *Server) serve(l *listener, tlsCreds credentials.TransportCredentials) error {
+	lis, err := l.listen()
+	if err != nil {
+		return err
+	}
+
+	serverOptions := []grpc.ServerOption{grpc.UnaryInterceptor(l.intercept)}
+	if creds := l.credentials(tlsCreds); creds != nil {
+		serverOptions = append(serverOptions, grpc.Creds(creds))
+	}
+
+	grpcServer := grpc.NewServer(serverOptions...)
 	pb.RegisterIstioCAServiceServer(grpcServer, s)
+	healthpb.RegisterHealthServer(grpcServer, s.healthServer)
+	if s.enableReflection {
+		reflection.Register(grpcServer)
+	}
+	s.grpcServers = append(s.grpcServers, grpcServer)
 
 	// grpcServer.Serve() is a blocking call, so run it in a goroutine.
 	go func() {
-		glog.Infof("Starting GRPC server on port %d", s.port)
+		glog.Infof("Starting GRPC server on %s %s", l.opts.Network, l.opts.Address)
 
-		err := grpcServer.Serve(listener)
+		err := grpcServer.Serve(lis)
 
 		// grpcServer.Serve() always returns a non-nil error.
-		glog.Warningf("GRPC server returns an error: %v", err)
+		glog.Warningf("GRPC server on %s returns an error: %v", l.opts.Address, err)
+	}()
+
+	return nil
+}
+
+// runGateway starts a HTTPS server for the HTTP/JSON gateway with the given TLS
+// configuration, which is the same as the GRPC server.
+func (s *Server) runGateway(tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.gatewayPort))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %d (error: %v)", s.gatewayPort, err)
+	}
+
+	s.gatewayServer = &http.Server{Handler: s.gatewayHandler()}
+
+	// gatewayServer.Serve() is a blocking call, so run it in a goroutine.
+	go func() {
+		glog.Infof("Starting HTTP/JSON gateway on port %d", s.gatewayPort)
+
+		err := s.gatewayServer.Serve(tls.NewListener(listener, tlsConfig))
+
+		// gatewayServer.Serve() always returns a non-nil error.
+		glog.Warningf("HTTP/JSON gateway returns an error: %v", err)
 	}()
 
 	return nil
 }
 
+// warmUp issues the first serving certificate, retrying until it succeeds or
+// the server is stopped, and then marks the service as serving.
+func (s *Server) warmUp() {
+	for {
+		_, err := s.certManager.GetCertificate(nil)
+		if err == nil {
+			s.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+			glog.Info("GRPC server is serving")
+			return
+		}
+		glog.Warningf("failed to issue the serving certificate (error %v)", err)
+
+		select {
+		case <-time.After(warmUpRetryInterval):
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// Stop gracefully stops the server. The service is marked as NOT_SERVING and
+// stops accepting new connections, while the in-flight requests are allowed
+// to finish until the context is done. The remaining connections are then
+// closed, and the error of the context is returned.
+func (s *Server) Stop(ctx context.Context) error {
+	if len(s.grpcServers) == 0 {
+		return nil
+	}
+
+	s.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	close(s.stopCh)
+
+	grpcStopped := make(chan struct{})
+	go func() {
+		for _, grpcServer := range s.grpcServers {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+
+	var err error
+	if s.gatewayServer != nil {
+		err = s.gatewayServer.Shutdown(ctx)
+	}
+
+	select {
+	case <-grpcStopped:
+		glog.Info("GRPC server has stopped")
+		return err
+	case <-ctx.Done():
+		glog.Warning("GRPC server is forced to stop")
+		for _, grpcServer := range s.grpcServers {
+			grpcServer.Stop()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Server) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	// The empty service name stands for the overall health of the server.
+	s.healthServer.SetServingStatus("", status)
+	s.healthServer.SetServingStatus(serviceName, status)
+}
+
+// SetLeader reports through the health service whether this replica is the
+// leader that runs the secret controller. The overall health is not affected,
+// since every replica serves CSRs.
+func (s *Server) SetLeader(isLeader bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if isLeader {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	s.healthServer.SetServingStatus(leaderServiceName, status)
+}
+
+// ServerOptions are the options of the CA server.
+type ServerOptions struct {
+	// The hostname of the server, which is used in its serving certificate.
+	Hostname string
+	// The port of the GRPC service, which is served with TLS on all the
+	// interfaces if no listener is specified.
+	Port int
+	// The listeners of the GRPC service.
+	Listeners []ListenerOptions
+	// The port of the HTTP/JSON gateway. The gateway is not served if it is 0.
+	GatewayPort int
+	// Whether to register the GRPC server reflection service.
+	EnableReflection bool
+	// The rate limits of CSRs.
+	RateLimits RateLimitOptions
+	// The sink of the audit events of CSRs. The events are discarded if it is
+	// nil.
+	AuditSink audit.Sink
+	// The TLS policy of the GRPC server and the gateway.
+	TLSPolicy tlspolicy.Options
+	// The manager of the serving certificate. If nil, the certificate is
+	// issued by the CA for the hostname.
+	CertManager *servingcert.Manager
+	// The options of the pod-bound service account tokens, which get
+	// pod-scoped certificates. If nil, the tokens are not accepted.
+	ServiceAccountTokens *ServiceAccountTokenOptions
+	// The revoker of the issued certificates. If nil, the gateway does not
+	// serve revocation.
+	Revoker Revoker
+	// The identities of the administrators, who may revoke certificates
+	// through the gateway. If empty, the gateway does not serve revocation.
+	AdminIdentities []string
+}
+
+// Revoker revokes issued certificates. It is implemented by ca.IstioCA with a
+// ledger.
+type Revoker interface {
+	// Revoke records the revocation of the certificate with the given
+	// hex-encoded serial number.
+	Revoke(serial, reason string) error
+}
+
 // New creates a new instance of `IstioCAServiceServer`.
-func New(ca ca.CertificateAuthority, hostname string, port int) *Server {
-	// Notice that the order of authenticators matters, since at runtime
-	// authenticators are actived sequentially and the first successful attempt
-	// is used as the authentication result.
-	authenticators := []authenticator{&clientCertAuthenticator{}}
-	aud := fmt.Sprintf("grpc://%s:%d", hostname, port)
-	if jwtAuthenticator, err := newIDTokenAuthenticator(aud); err != nil {
+func New(ca ca.CertificateAuthority, opts *ServerOptions) (*Server, error) {
+	// The ID token authenticator is shared by the gateway and the listeners.
+	var jwtAuthenticator authenticator
+	aud := fmt.Sprintf("grpc://%s:%d", opts.Hostname, opts.Port)
+	if authn, err := newIDTokenAuthenticator(aud); err != nil {
 		glog.Errorf(
 			"failed to create JWT authenticator and JWT token will not be used for authentication (error %v)",
 			err)
 	} else {
+		jwtAuthenticator = authn
+	}
+
+	// Notice that the order of authenticators matters, since at runtime
+	// authenticators are actived sequentially and the first successful attempt
+	// is used as the authentication result.
+	authenticators := []authenticator{&clientCertAuthenticator{}}
+	if jwtAuthenticator != nil {
 		authenticators = append(authenticators, jwtAuthenticator)
 	}
+	defaultAuthenticators := []string{authSourceClientCertificate.String(), authSourceIDToken.String()}
+
+	var saTokenAuthenticator authenticator
+	var pods PodRegistry
+	var podCertTTL time.Duration
+	if saTokens := opts.ServiceAccountTokens; saTokens != nil {
+		saTokenAuthenticator = &serviceAccountTokenAuthenticator{reviewer: saTokens.Reviewer, pods: saTokens.Pods}
+		authenticators = append(authenticators, saTokenAuthenticator)
+		defaultAuthenticators = append(defaultAuthenticators, authSourceServiceAccountToken.String())
+		pods = saTokens.Pods
+		podCertTTL = saTokens.CertTTL
+	}
+
+	listenerOpts := opts.Listeners
+	if len(listenerOpts) == 0 {
+		listenerOpts = []ListenerOptions{{
+			Network:        NetworkTCP,
+			Address:        fmt.Sprintf(":%d", opts.Port),
+			Authenticators: defaultAuthenticators,
+		}}
+	}
+	var listeners []*listener
+	for _, lo := range listenerOpts {
+		l, err := newListener(lo, jwtAuthenticator, saTokenAuthenticator)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
 
-	return &Server{
-		authenticators: authenticators,
-		authorizer:     &simpleAuthorizer{},
-		ca:             ca,
-		hostname:       hostname,
-		port:           port,
+	certManager := opts.CertManager
+	if certManager == nil {
+		certManager = servingcert.NewManager(ca, servingcert.Options{Hosts: []string{opts.Hostname}})
 	}
+
+	s := &Server{
+		authenticators:   authenticators,
+		listeners:        listeners,
+		authorizer:       &simpleAuthorizer{},
+		rateLimiter:      newRateLimiter(opts.RateLimits),
+		auditSink:        opts.AuditSink,
+		tlsPolicy:        opts.TLSPolicy,
+		ca:               ca,
+		pods:             pods,
+		podCertTTL:       podCertTTL,
+		revoker:          opts.Revoker,
+		adminIdentities:  opts.AdminIdentities,
+		hostname:         opts.Hostname,
+		port:             opts.Port,
+		gatewayPort:      opts.GatewayPort,
+		enableReflection: opts.EnableReflection,
+		healthServer:     health.NewServer(),
+		stopCh:           make(chan struct{}),
+		certManager:      certManager,
+	}
+	s.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	s.SetLeader(false)
+	return s, nil
 }
 
-func (s *Server) createTLSServerOption() grpc.ServerOption {
+func (s *Server) createTLSConfig() (*tls.Config, error) {
 	cp := x509.NewCertPool()
 	cp.AppendCertsFromPEM(s.ca.GetRootCertificate())
 
 	config := &tls.Config{
-		ClientCAs:  cp,
-		ClientAuth: tls.VerifyClientCertIfGiven,
-		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			if s.certificate == nil || shouldRefresh(s.certificate) {
-				// Apply new certificate if there isn't one yet, or the one has become invalid.
-				newCert, err := s.applyServerCertificate()
-				if err != nil {
-					return nil, err
-				}
-				s.certificate = newCert
-			}
-			return s.certificate, nil
-		},
-	}
-	return grpc.Creds(credentials.NewTLS(config))
-}
-
-func (s *Server) applyServerCertificate() (*tls.Certificate, error) {
-	opts := ca.CertOptions{
-		Host:       s.hostname,
-		RSAKeySize: 2048,
-	}
-
-	csrPEM, privPEM, err := ca.GenCSR(opts)
-	if err != nil {
-		return nil, err
+		ClientCAs:      cp,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		GetCertificate: s.certManager.GetCertificate,
 	}
-
-	certPEM, err := s.ca.Sign(csrPEM)
-	if err != nil {
-		return nil, err
+	if err := s.tlsPolicy.ApplyServer(config); err != nil {
+		return nil, fmt.Errorf("invalid TLS policy (error: %v)", err)
 	}
-
-	cert, err := tls.X509KeyPair(certPEM, privPEM)
-	if err != nil {
-		return nil, err
-	}
-	return &cert, nil
+	return config, nil
 }
 
+// authenticate authenticates the request with the authenticators of the
+// listener it is received on.
 func (s *Server) authenticate(ctx context.Context) *user {
-	for _, authn := range s.authenticators {
+	authenticators, ok := ctx.Value(authenticatorsKey{}).([]authenticator)
+	if !ok {
+		authenticators = s.authenticators
+	}
+	for _, authn := range authenticators {
 		if u := authn.authenticate(ctx); u != nil {
 			return u
 		}
 	}
 	return nil
 }
-
-// shouldRefresh indicates whether the given certificate should be refreshed.
-func shouldRefresh(cert *tls.Certificate) bool {
-	// Check whether there is a valid leaf certificate.
-	leaf := cert.Leaf
-	if leaf == nil {
-		return true
-	}
-
-	// Check whether the leaf certificate is about to expire.
-	return leaf.NotAfter.Add(-certExpirationBuffer).Before(time.Now())
-}
@@ -16,18 +16,24 @@ package grpc
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"net"
+	"reflect"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
 
 	"golang.org/x/net/context"
 
+	"istio.io/auth/pkg/audit"
 	"istio.io/auth/pkg/pki/ca"
+	"istio.io/auth/pkg/server/servingcert"
 	pb "istio.io/auth/proto"
 )
 
@@ -49,7 +55,7 @@ type mockCA struct {
 	errMsg string
 }
 
-func (ca *mockCA) Sign(csrPEM []byte) ([]byte, error) {
+func (ca *mockCA) Sign(csrPEM []byte, ttl time.Duration) ([]byte, error) {
 	if ca.errMsg != "" {
 		return nil, fmt.Errorf(ca.errMsg)
 	}
@@ -75,8 +81,11 @@ type mockAuthorizer struct {
 	authorized bool
 }
 
-func (authz *mockAuthorizer) authorize(*user, []string) bool {
-	return authz.authorized
+func (authz *mockAuthorizer) authorize(*user, []string) error {
+	if !authz.authorized {
+		return fmt.Errorf("not authorized")
+	}
+	return nil
 }
 
 func TestSign(t *testing.T) {
@@ -125,7 +134,7 @@ func TestSign(t *testing.T) {
 		}
 		request := &pb.Request{CsrPem: []byte(c.csr)}
 
-		response, err := server.HandleCSR(nil, request)
+		response, err := server.HandleCSR(context.Background(), request)
 		if c.code != grpc.Code(err) {
 			t.Errorf("Case %s: expecting code to be (%d) but got (%d)", id, c.code, grpc.Code(err))
 		} else if c.code == codes.OK && !bytes.Equal(response.SignedCertChain, []byte(c.cert)) {
@@ -134,40 +143,167 @@ func TestSign(t *testing.T) {
 	}
 }
 
-func TestShouldRefresh(t *testing.T) {
-	now := time.Now()
+func TestHandleCSRAuditEvent(t *testing.T) {
 	testCases := map[string]struct {
-		cert          *tls.Certificate
-		shouldRefresh bool
+		authenticated bool
+		authorized    bool
+		decision      audit.Decision
+		reason        string
+		requestedIDs  []string
 	}{
-		"No leaf cert": {
-			cert:          &tls.Certificate{},
-			shouldRefresh: true,
-		},
-		"Cert is expired": {
-			cert: &tls.Certificate{
-				Leaf: &x509.Certificate{NotAfter: now},
-			},
-			shouldRefresh: true,
+		"Unauthenticated request": {
+			decision: audit.Deny,
+			reason:   "not authenticated",
 		},
-		"Cert is about to expire": {
-			cert: &tls.Certificate{
-				Leaf: &x509.Certificate{NotAfter: now.Add(5 * time.Second)},
-			},
-			shouldRefresh: true,
+		"Unauthorized request": {
+			authenticated: true,
+			decision:      audit.Deny,
+			reason:        "not authorized",
+			requestedIDs:  []string{"spiffe://test.com/namespace/ns/serviceaccount/sa"},
 		},
-		"Cert is valid": {
-			cert: &tls.Certificate{
-				Leaf: &x509.Certificate{NotAfter: now.Add(5 * time.Minute)},
-			},
-			shouldRefresh: false,
+		"Successful signing": {
+			authenticated: true,
+			authorized:    true,
+			decision:      audit.Allow,
+			requestedIDs:  []string{"spiffe://test.com/namespace/ns/serviceaccount/sa"},
 		},
 	}
 
-	for id, tc := range testCases {
-		result := shouldRefresh(tc.cert)
-		if tc.shouldRefresh != result {
-			t.Errorf("%s: expected result is %t but got %t", id, tc.shouldRefresh, result)
+	for id, c := range testCases {
+		buf := &bytes.Buffer{}
+		server := &Server{
+			authenticators: []authenticator{&mockAuthenticator{c.authenticated}},
+			authorizer:     &mockAuthorizer{c.authorized},
+			auditSink:      audit.NewWriterSink(buf),
+			ca:             &mockCA{cert: "generated cert"},
+		}
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}})
+		_, _ = server.HandleCSR(ctx, &pb.Request{CsrPem: []byte(csr)})
+
+		event := &audit.Event{}
+		if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+			t.Errorf("Case %s: failed to decode the audit event %q (error %v)", id, buf.String(), err)
+			continue
+		}
+		if event.Decision != c.decision || event.Reason != c.reason {
+			t.Errorf("Case %s: expecting decision (%s, %q) but got (%s, %q)",
+				id, c.decision, c.reason, event.Decision, event.Reason)
+		}
+		if event.PeerAddress != "10.0.0.1:80" {
+			t.Errorf("Case %s: unexpected peer address %s", id, event.PeerAddress)
+		}
+		if !reflect.DeepEqual(event.RequestedIDs, c.requestedIDs) {
+			t.Errorf("Case %s: expecting requested IDs %v but got %v", id, c.requestedIDs, event.RequestedIDs)
+		}
+	}
+}
+
+func TestHealthAndStop(t *testing.T) {
+	istioCA, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := newListener(ListenerOptions{
+		Network:        NetworkTCP,
+		Address:        "127.0.0.1:0",
+		Authenticators: []string{authSourceClientCertificate.String()},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{
+		authenticators: []authenticator{&mockAuthenticator{}},
+		listeners:      []*listener{l},
+		authorizer:     &mockAuthorizer{},
+		ca:             istioCA,
+		hostname:       "localhost",
+		healthServer:   health.NewServer(),
+		certManager:    servingcert.NewManager(istioCA, servingcert.Options{Hosts: []string{"localhost"}}),
+		stopCh:         make(chan struct{}),
+	}
+	server.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	checkStatus := func(expected healthpb.HealthCheckResponse_ServingStatus) bool {
+		resp, err := server.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{Service: serviceName})
+		return err == nil && resp.Status == expected
+	}
+
+	if !checkStatus(healthpb.HealthCheckResponse_NOT_SERVING) {
+		t.Error("Expecting the server to be not serving before it runs")
+	}
+
+	if err := server.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server becomes serving once the first serving certificate is issued.
+	deadline := time.Now().Add(10 * time.Second)
+	for !checkStatus(healthpb.HealthCheckResponse_SERVING) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting the server to be serving after the serving certificate is issued")
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		t.Errorf("Failed to stop the server: %v", err)
 	}
+	if !checkStatus(healthpb.HealthCheckResponse_NOT_SERVING) {
+		t.Error("Expecting the server to be not serving after it stops")
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	server := &Server{healthServer: health.NewServer(), stopCh: make(chan struct{})}
+	if err := server.Stop(context.Background()); err != nil {
+		t.Errorf("Unexpected error when stopping a server that is not running: %v", err)
+	}
+}
+
+func TestSetLeader(t *testing.T) {
+	server := &Server{healthServer: health.NewServer()}
+	server.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+
+	for _, isLeader := range []bool{true, false} {
+		server.SetLeader(isLeader)
+
+		expected := healthpb.HealthCheckResponse_NOT_SERVING
+		if isLeader {
+			expected = healthpb.HealthCheckResponse_SERVING
+		}
+		resp, err := server.healthServer.Check(context.Background(),
+			&healthpb.HealthCheckRequest{Service: leaderServiceName})
+		if err != nil || resp.Status != expected {
+			t.Errorf("Expecting the leader status %v when isLeader is %v but got %v (%v)", expected, isLeader, resp, err)
+		}
+		resp, err = server.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Expecting the overall status not to be affected by the leadership but got %v (%v)", resp, err)
+		}
+	}
+}
+
+func createCA() (ca.CertificateAuthority, error) {
+	start := time.Now().Add(-5 * time.Minute)
+	end := start.Add(24 * time.Hour)
+
+	rootCertBytes, rootKeyBytes := ca.GenCert(ca.CertOptions{
+		IsCA:         true,
+		IsSelfSigned: true,
+		NotAfter:     end,
+		NotBefore:    start,
+		Org:          "Root CA",
+		RSAKeySize:   1024,
+	})
+
+	return ca.NewIstioCA(&ca.IstioCAOptions{
+		CertTTL:          time.Hour,
+		SigningCertBytes: rootCertBytes,
+		SigningKeyBytes:  rootKeyBytes,
+		RootCertBytes:    rootCertBytes,
+	})
 }
@@ -0,0 +1,233 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servingcert manages the TLS serving certificates of the Istio CA
+// servers.
+package servingcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/pki/ca"
+)
+
+const (
+	defaultKeySize        = 2048
+	defaultRenewFraction  = 0.5
+	defaultReloadInterval = 10 * time.Second
+	// How long to wait after a failed issuance before trying again, so that a
+	// failing CA does not hold up every handshake with key generation.
+	issueRetryInterval = 30 * time.Second
+)
+
+// Options are the options of a serving certificate.
+type Options struct {
+	// The DNS names and IP addresses that the certificate is issued for, e.g.
+	// the hostname of the server and the DNS names of its Kubernetes service.
+	Hosts []string
+	// The size of the RSA key of an issued certificate. Defaults to 2048.
+	KeySize int
+	// The fraction of the lifetime of an issued certificate after which it is
+	// renewed. Defaults to 0.5.
+	RenewFraction float64
+
+	// The files of an operator-supplied certificate chain and its key. If set,
+	// the certificate is served instead of issuing one, so that replicas of
+	// the CA can share a certificate, e.g. from a mounted Kubernetes secret.
+	CertFile string
+	KeyFile  string
+	// How often the files are checked for changes. Defaults to 10 seconds.
+	ReloadInterval time.Duration
+}
+
+// Manager provides a serving certificate for TLS handshakes. The certificate
+// is either issued by the CA and renewed before it expires, or loaded from
+// files and reloaded when they change.
+type Manager struct {
+	ca   ca.CertificateAuthority
+	opts Options
+	now  func() time.Time
+
+	// The fields below are guarded by mutex.
+	mutex sync.Mutex
+	cert  *tls.Certificate
+	// When the issued certificate should be renewed, or the failed issuance
+	// retried, and the error of the failed issuance.
+	renewAt  time.Time
+	issueErr error
+	// When the files should be checked next, and their last modification times.
+	nextCheck               time.Time
+	certModTime, keyModTime time.Time
+}
+
+// NewManager creates a Manager that issues certificates through the CA, or
+// loads them from the files in the options.
+func NewManager(ca ca.CertificateAuthority, opts Options) *Manager {
+	if opts.KeySize <= 0 {
+		opts.KeySize = defaultKeySize
+	}
+	if opts.RenewFraction <= 0 || opts.RenewFraction > 1 {
+		opts.RenewFraction = defaultRenewFraction
+	}
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = defaultReloadInterval
+	}
+	return &Manager{ca: ca, opts: opts, now: time.Now}
+}
+
+// GetCertificate returns the serving certificate. It can be used as
+// tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.opts.CertFile != "" {
+		return m.loadCertificate()
+	}
+	return m.issueCertificate()
+}
+
+// issueCertificate returns the issued certificate, and issues a new one if it
+// is due for renewal. A failed renewal keeps the current certificate until it
+// expires, and is retried after issueRetryInterval. It must be called with the
+// mutex held.
+func (m *Manager) issueCertificate() (*tls.Certificate, error) {
+	now := m.now()
+	if now.Before(m.renewAt) {
+		if m.cert != nil && now.Before(m.cert.Leaf.NotAfter) {
+			return m.cert, nil
+		}
+		return nil, m.issueErr
+	}
+
+	cert, err := m.issue()
+	if err != nil {
+		m.renewAt = now.Add(issueRetryInterval)
+		m.issueErr = err
+		if m.cert != nil && now.Before(m.cert.Leaf.NotAfter) {
+			glog.Warningf("Failed to renew the serving certificate, the current one is used until retrying in %v "+
+				"(error: %v)", issueRetryInterval, err)
+			return m.cert, nil
+		}
+		return nil, err
+	}
+
+	m.cert = cert
+	m.issueErr = nil
+	m.renewAt = renewTime(cert.Leaf, m.opts.RenewFraction)
+	glog.Infof("Serving certificate is issued for %v, will renew at %v", m.opts.Hosts, m.renewAt)
+	return m.cert, nil
+}
+
+func (m *Manager) issue() (*tls.Certificate, error) {
+	csrPEM, keyPEM, err := ca.GenCSR(ca.CertOptions{
+		Host:       strings.Join(m.opts.Hosts, ","),
+		RSAKeySize: m.opts.KeySize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := m.ca.Sign(csrPEM, 0)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+// loadCertificate returns the certificate loaded from the files, and reloads
+// it if the files have changed since the last check. A failed reload keeps the
+// current certificate. It must be called with the mutex held.
+func (m *Manager) loadCertificate() (*tls.Certificate, error) {
+	now := m.now()
+	if m.cert != nil && now.Before(m.nextCheck) {
+		return m.cert, nil
+	}
+	m.nextCheck = now.Add(m.opts.ReloadInterval)
+
+	certModTime, keyModTime, err := m.modTimes()
+	if err == nil && m.cert != nil && certModTime.Equal(m.certModTime) && keyModTime.Equal(m.keyModTime) {
+		return m.cert, nil
+	}
+
+	var cert *tls.Certificate
+	if err == nil {
+		cert, err = loadKeyPair(m.opts.CertFile, m.opts.KeyFile)
+	}
+	if err != nil {
+		if m.cert != nil {
+			glog.Warningf("Failed to reload the serving certificate, the current one is used (error: %v)", err)
+			return m.cert, nil
+		}
+		return nil, err
+	}
+
+	m.cert = cert
+	m.certModTime, m.keyModTime = certModTime, keyModTime
+	glog.Infof("Serving certificate is loaded from %s", m.opts.CertFile)
+	return m.cert, nil
+}
+
+func (m *Manager) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(m.opts.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(m.opts.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the serving certificate (error: %v)", err)
+	}
+	return withLeaf(&cert)
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return withLeaf(&cert)
+}
+
+// withLeaf populates the parsed leaf certificate, which tls.X509KeyPair does
+// not.
+func withLeaf(cert *tls.Certificate) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+// renewTime returns the time after the given fraction of the lifetime of the
+// certificate.
+func renewTime(leaf *x509.Certificate, fraction float64) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servingcert
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca"
+)
+
+// flakyCA is a CA that fails to sign when failing is set. It counts the
+// signing requests.
+type flakyCA struct {
+	ca.CertificateAuthority
+	failing bool
+	signs   int
+}
+
+func (f *flakyCA) Sign(csrPEM []byte, ttl time.Duration) ([]byte, error) {
+	f.signs++
+	if f.failing {
+		return nil, fmt.Errorf("cannot sign")
+	}
+	return f.CertificateAuthority.Sign(csrPEM, ttl)
+}
+
+func createCA(t *testing.T) ca.CertificateAuthority {
+	rootCert, rootKey := ca.GenCert(ca.CertOptions{
+		IsCA:         true,
+		IsSelfSigned: true,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		Org:          "Root CA",
+		RSAKeySize:   1024,
+	})
+	istioCA, err := ca.NewIstioCA(&ca.IstioCAOptions{
+		CertTTL:          time.Hour,
+		SigningCertBytes: rootCert,
+		SigningKeyBytes:  rootKey,
+		RootCertBytes:    rootCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return istioCA
+}
+
+func TestRenewTime(t *testing.T) {
+	notBefore := time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(time.Hour)}
+
+	testCases := map[string]struct {
+		fraction float64
+		expected time.Time
+	}{
+		"Half way": {
+			fraction: 0.5,
+			expected: notBefore.Add(30 * time.Minute),
+		},
+		"Late renewal": {
+			fraction: 0.9,
+			expected: notBefore.Add(54 * time.Minute),
+		},
+		"At expiry": {
+			fraction: 1,
+			expected: notBefore.Add(time.Hour),
+		},
+	}
+
+	for id, c := range testCases {
+		if renewAt := renewTime(leaf, c.fraction); !renewAt.Equal(c.expected) {
+			t.Errorf("Case %s: expecting renewal at %v but got %v", id, c.expected, renewAt)
+		}
+	}
+}
+
+func TestIssueAndRenew(t *testing.T) {
+	fca := &flakyCA{CertificateAuthority: createCA(t)}
+	m := NewManager(fca, Options{Hosts: []string{"istio-ca", "istio-ca.istio-system.svc", "10.0.0.1"}, KeySize: 1024})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to issue the serving certificate (error: %v)", err)
+	}
+	if cert.Leaf == nil {
+		t.Fatal("Expecting the leaf certificate to be parsed")
+	}
+	if expected := []string{"istio-ca", "istio-ca.istio-system.svc"}; !reflect.DeepEqual(cert.Leaf.DNSNames, expected) {
+		t.Errorf("Expecting DNS names %v but got %v", expected, cert.Leaf.DNSNames)
+	}
+	if len(cert.Leaf.IPAddresses) != 1 || cert.Leaf.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("Expecting IP address 10.0.0.1 but got %v", cert.Leaf.IPAddresses)
+	}
+
+	if cached, _ := m.GetCertificate(nil); cached != cert {
+		t.Error("Expecting the certificate to be cached before renewal")
+	}
+
+	// A failed renewal keeps the current certificate.
+	now = renewTime(cert.Leaf, defaultRenewFraction).Add(time.Second)
+	fca.failing = true
+	if current, err := m.GetCertificate(nil); err != nil || current != cert {
+		t.Errorf("Expecting the current certificate after a failed renewal but got error %v", err)
+	}
+
+	// The renewal is not retried until the retry interval passes.
+	fca.failing = false
+	if current, err := m.GetCertificate(nil); err != nil || current != cert {
+		t.Errorf("Expecting the current certificate before the retry but got error %v", err)
+	}
+	now = now.Add(issueRetryInterval)
+	renewed, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to renew the serving certificate (error: %v)", err)
+	}
+	if renewed == cert {
+		t.Error("Expecting the certificate to be renewed")
+	}
+}
+
+func TestIssueWithFailingCA(t *testing.T) {
+	fca := &flakyCA{CertificateAuthority: createCA(t), failing: true}
+	m := NewManager(fca, Options{Hosts: []string{"istio-ca"}, KeySize: 1024})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// The handshakes within the retry interval fail without signing again.
+	for i := 0; i < 3; i++ {
+		if _, err := m.GetCertificate(nil); err == nil {
+			t.Fatal("Expecting an error from a failing CA")
+		}
+	}
+	if fca.signs != 1 {
+		t.Errorf("Expecting 1 signing request within the retry interval but got %d", fca.signs)
+	}
+
+	now = now.Add(issueRetryInterval)
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Fatal("Expecting an error from a failing CA")
+	}
+	if fca.signs != 2 {
+		t.Errorf("Expecting a retry after the retry interval but got %d signing requests", fca.signs)
+	}
+}
+
+func TestLoadAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servingcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeKeyPair := func(org string, modTime time.Time) {
+		certPEM, keyPEM := ca.GenCert(ca.CertOptions{
+			Host:         "istio-ca",
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+			Org:          org,
+			IsSelfSigned: true,
+			IsServer:     true,
+			RSAKeySize:   1024,
+		})
+		for file, content := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := ioutil.WriteFile(file, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	now := time.Now()
+	writeKeyPair("first", now)
+	m := NewManager(nil, Options{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Minute})
+	m.now = func() time.Time { return now }
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to load the serving certificate (error: %v)", err)
+	}
+	if org := cert.Leaf.Subject.Organization[0]; org != "first" {
+		t.Errorf("Expecting the first certificate but got %s", org)
+	}
+
+	// The files are not checked again until the reload interval passes.
+	writeKeyPair("second", now.Add(time.Second))
+	if cached, _ := m.GetCertificate(nil); cached != cert {
+		t.Error("Expecting the certificate to be cached within the reload interval")
+	}
+
+	now = now.Add(2 * time.Minute)
+	reloaded, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to reload the serving certificate (error: %v)", err)
+	}
+	if org := reloaded.Leaf.Subject.Organization[0]; org != "second" {
+		t.Errorf("Expecting the second certificate but got %s", org)
+	}
+
+	// A broken file keeps the current certificate.
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if current, err := m.GetCertificate(nil); err != nil || current != reloaded {
+		t.Errorf("Expecting the current certificate after a failed reload but got error %v", err)
+	}
+}
+
+func TestLoadMissingFiles(t *testing.T) {
+	m := NewManager(nil, Options{CertFile: "not-exist.pem", KeyFile: "not-exist-key.pem"})
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Error("Expecting an error when the certificate files do not exist")
+	}
+}
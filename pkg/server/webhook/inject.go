@@ -0,0 +1,218 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"istio.io/auth/pkg/pki/ca/controller"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// The names of the injected volumes and containers.
+	certsVolumeName      = "istio-pod-certs"
+	tokenVolumeName      = "istio-token"
+	rootCertVolumeName   = "istio-ca-root-cert"
+	initContainerName    = "istio-pod-cert"
+	renewalContainerName = "istio-pod-cert-renewal"
+
+	certsMountPath    = "/etc/certs"
+	tokenMountPath    = "/var/run/secrets/istio"
+	rootCertMountPath = "/etc/istio-ca"
+
+	tokenFileName = "istio-token"
+
+	// The environment variables of the init container, which must match
+	// istio.io/auth/pkg/platform.
+	podNameEnv        = "POD_NAME"
+	podNamespaceEnv   = "POD_NAMESPACE"
+	podIPEnv          = "POD_IP"
+	serviceAccountEnv = "SERVICE_ACCOUNT"
+)
+
+// podInitContainers is the init containers of a pod, which the vendored API
+// does not decode from the spec.
+type podInitContainers struct {
+	Spec struct {
+		InitContainers []json.RawMessage `json:"initContainers"`
+	} `json:"spec"`
+}
+
+// needsInjection returns whether the pod opts in to a pod-scoped certificate
+// and is not injected yet.
+func needsInjection(pod *v1.Pod) bool {
+	if pod.Annotations[controller.PodCertAnnotationKey] != "true" {
+		return false
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == certsVolumeName {
+			return false
+		}
+	}
+	return true
+}
+
+// injectionPatch returns the JSON patch that injects an init container into
+// the pod, which requests a pod-scoped certificate from the CA with the
+// projected service account token of the pod, and writes it into an in-memory
+// volume that is mounted into every container of the pod. A sidecar keeps
+// renewing the certificate for the lifetime of the pod. The root certificate
+// is mounted from its ConfigMap. The pod is labeled so that the CA issues it
+// the certificate.
+func (s *Server) injectionPatch(pod *v1.Pod, initContainers int) []patchOperation {
+	var patch []patchOperation
+
+	if pod.Labels == nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/labels",
+			Value: map[string]string{controller.PodCertLabelKey: "true"},
+		})
+	} else {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/labels/" + escapePointer(controller.PodCertLabelKey),
+			Value: "true",
+		})
+	}
+
+	// The projected service account token is not in the vendored API yet, so
+	// the volumes are written as JSON objects.
+	volumes := []interface{}{
+		map[string]interface{}{
+			"name":     certsVolumeName,
+			"emptyDir": map[string]interface{}{"medium": "Memory"},
+		},
+		map[string]interface{}{
+			"name": tokenVolumeName,
+			"projected": map[string]interface{}{
+				"sources": []interface{}{
+					map[string]interface{}{
+						"serviceAccountToken": map[string]interface{}{
+							"path":              tokenFileName,
+							"expirationSeconds": int64(s.opts.TokenExpiration.Seconds()),
+						},
+					},
+				},
+			},
+		},
+		map[string]interface{}{
+			"name":      rootCertVolumeName,
+			"configMap": map[string]interface{}{"name": controller.RootCertConfigMapName},
+		},
+	}
+	patch = append(patch, appendPatch("/spec/volumes", len(pod.Spec.Volumes) == 0, volumes)...)
+
+	// The init container runs first, so that the other init containers get the
+	// certificate too.
+	if initContainers == 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/initContainers",
+			Value: []v1.Container{s.initContainer()},
+		})
+	} else {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/initContainers/0", Value: s.initContainer()})
+	}
+
+	mounts := []interface{}{
+		v1.VolumeMount{Name: certsVolumeName, MountPath: certsMountPath, ReadOnly: true},
+		v1.VolumeMount{Name: rootCertVolumeName, MountPath: rootCertMountPath, ReadOnly: true},
+	}
+	for i, container := range pod.Spec.Containers {
+		mountsPath := fmt.Sprintf("/spec/containers/%d/volumeMounts", i)
+		patch = append(patch, appendPatch(mountsPath, len(container.VolumeMounts) == 0, mounts)...)
+	}
+
+	// The sidecar is appended after the mounts, so that it does not mount the
+	// certificates read-only.
+	renewal := []interface{}{s.renewalContainer()}
+	patch = append(patch, appendPatch("/spec/containers", len(pod.Spec.Containers) == 0, renewal)...)
+	return patch
+}
+
+// initContainer returns the container that runs the node agent once to
+// request the pod-scoped certificate before the other containers start.
+func (s *Server) initContainer() v1.Container {
+	return s.nodeAgentContainer(initContainerName, true)
+}
+
+// renewalContainer returns the sidecar that runs the node agent to renew the
+// pod-scoped certificate before it expires.
+func (s *Server) renewalContainer() v1.Container {
+	return s.nodeAgentContainer(renewalContainerName, false)
+}
+
+// nodeAgentContainer returns a container that runs the node agent, which
+// exits after the first certificate if oneShot is true.
+func (s *Server) nodeAgentContainer(name string, oneShot bool) v1.Container {
+	fieldEnv := func(name, fieldPath string) v1.EnvVar {
+		return v1.EnvVar{
+			Name:      name,
+			ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: fieldPath}},
+		}
+	}
+	args := []string{"--env=k8s"}
+	if oneShot {
+		args = append(args, "--one-shot")
+	}
+	args = append(args,
+		"--ca-address="+s.opts.CAAddress,
+		"--root-cert="+path.Join(rootCertMountPath, controller.RootCertID),
+		"--workload-cert-chain="+path.Join(certsMountPath, controller.CertChainID),
+		"--workload-key="+path.Join(certsMountPath, controller.PrivateKeyID),
+		"--workload-root-cert="+path.Join(certsMountPath, controller.RootCertID),
+		"--service-account-token="+path.Join(tokenMountPath, tokenFileName),
+	)
+	return v1.Container{
+		Name:  name,
+		Image: s.opts.Image,
+		Args:  args,
+		Env: []v1.EnvVar{
+			fieldEnv(podNameEnv, "metadata.name"),
+			fieldEnv(podNamespaceEnv, "metadata.namespace"),
+			fieldEnv(podIPEnv, "status.podIP"),
+			fieldEnv(serviceAccountEnv, "spec.serviceAccountName"),
+		},
+		VolumeMounts: []v1.VolumeMount{
+			{Name: certsVolumeName, MountPath: certsMountPath},
+			{Name: tokenVolumeName, MountPath: tokenMountPath, ReadOnly: true},
+			{Name: rootCertVolumeName, MountPath: rootCertMountPath, ReadOnly: true},
+		},
+	}
+}
+
+// appendPatch returns the operations that append the values to the array at
+// the path, which is created if it is empty.
+func appendPatch(arrayPath string, empty bool, values []interface{}) []patchOperation {
+	if empty {
+		return []patchOperation{{Op: "add", Path: arrayPath, Value: values}}
+	}
+	patch := make([]patchOperation, 0, len(values))
+	for _, value := range values {
+		patch = append(patch, patchOperation{Op: "add", Path: arrayPath + "/-", Value: value})
+	}
+	return patch
+}
+
+// escapePointer escapes a key in a JSON pointer (RFC 6901).
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
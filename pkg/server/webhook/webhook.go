@@ -0,0 +1,219 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook implements the mutating admission webhook that injects the
+// pods that opt in to pod-scoped certificates.
+package webhook
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/pki/ca/controller"
+	"istio.io/auth/pkg/server/servingcert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// InjectPath is the path of the webhook that the
+	// MutatingWebhookConfiguration of the pods points to.
+	InjectPath = "/inject"
+
+	// The maximum size of an admission review.
+	maxRequestSize = 1 << 20
+)
+
+// Options are the options of the webhook.
+type Options struct {
+	// The port of the HTTPS server.
+	Port int
+	// The image of the init container and the renewal sidecar, which run the
+	// node agent.
+	Image string
+	// The address of the CA that the node agent requests the certificate
+	// from, e.g. "istio-ca.istio-system:8060".
+	CAAddress string
+	// The lifetime of the projected service account token, which the kubelet
+	// refreshes for the renewal sidecar.
+	TokenExpiration time.Duration
+
+	// The namespace whose pods are injected, or metav1.NamespaceAll for all
+	// the namespaces. Together with Selector, it must match the namespaces
+	// that get the ConfigMap of the root certificate, since the pods cannot
+	// start without it.
+	Namespace string
+	// The selector of the namespaces whose pods are injected. All the
+	// namespaces are selected if nil.
+	Selector *controller.Selector
+	// The client to get the namespaces of the pods.
+	Namespaces corev1.NamespacesGetter
+}
+
+// Server is the HTTPS server of the webhook. Its serving certificate must be
+// valid for the name of the Kubernetes service of the webhook, and the
+// MutatingWebhookConfiguration must trust the root certificate of the CA.
+type Server struct {
+	opts        Options
+	certManager *servingcert.Manager
+	mux         *http.ServeMux
+}
+
+// New creates a new webhook server with the serving certificate provided by
+// the manager.
+func New(opts Options, certManager *servingcert.Manager) *Server {
+	s := &Server{
+		opts:        opts,
+		certManager: certManager,
+		mux:         http.NewServeMux(),
+	}
+	s.mux.HandleFunc(InjectPath, s.handleInject)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Run starts a HTTPS server for the webhook on the specified port.
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.opts.Port))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %d (error: %v)", s.opts.Port, err)
+	}
+
+	config := &tls.Config{GetCertificate: s.certManager.GetCertificate}
+	server := &http.Server{Handler: s}
+
+	// server.Serve() is a blocking call, so run it in a goroutine.
+	go func() {
+		glog.Infof("Starting pod certificate webhook on port %d", s.opts.Port)
+
+		err := server.Serve(tls.NewListener(listener, config))
+
+		// server.Serve() always returns a non-nil error.
+		glog.Warningf("Pod certificate webhook returns an error: %v", err)
+	}()
+
+	return nil
+}
+
+func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the request (error: %v)", err), http.StatusBadRequest)
+		return
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.admit(review.Request)
+	review.Request = nil
+	if review.APIVersion == "" {
+		review.APIVersion = admissionAPIVersion
+		review.Kind = admissionReviewKind
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		glog.Warningf("Failed to write the admission review (error: %v)", err)
+	}
+}
+
+// admit returns the response to the admission request. A pod that opts in to
+// a pod-scoped certificate is patched, or denied if its namespace does not get
+// the root certificate, and the other objects are admitted as they are.
+func (s *Server) admit(request *admissionRequest) *admissionResponse {
+	response := &admissionResponse{UID: request.UID, Allowed: true}
+	if request.Kind.Kind != "Pod" || request.Operation != "CREATE" {
+		return response
+	}
+
+	pod := &v1.Pod{}
+	initContainers := &podInitContainers{}
+	if err := decodePod(request.Object, pod, initContainers); err != nil {
+		response.Allowed = false
+		response.Result = &admissionStatus{Message: fmt.Sprintf("failed to decode the pod (error: %v)", err)}
+		return response
+	}
+	if !needsInjection(pod) {
+		return response
+	}
+	if err := s.checkNamespace(request.Namespace); err != nil {
+		response.Allowed = false
+		response.Result = &admissionStatus{Message: fmt.Sprintf("cannot inject a pod-scoped certificate (error: %v)", err)}
+		return response
+	}
+
+	patch, err := json.Marshal(s.injectionPatch(pod, len(initContainers.Spec.InitContainers)))
+	if err != nil {
+		response.Allowed = false
+		response.Result = &admissionStatus{Message: fmt.Sprintf("failed to encode the patch (error: %v)", err)}
+		return response
+	}
+	patchType := patchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+	podsInjected.Inc()
+	glog.Infof("Injected pod %s/%s with a pod-scoped certificate", request.Namespace, podName(pod))
+	return response
+}
+
+// checkNamespace returns an error if the namespace does not get the ConfigMap
+// of the root certificate, which the injected volume requires.
+func (s *Server) checkNamespace(namespace string) error {
+	if s.opts.Namespace != metav1.NamespaceAll && namespace != s.opts.Namespace {
+		return fmt.Errorf("namespace %s is not watched by Istio CA", namespace)
+	}
+	ns, err := s.opts.Namespaces.Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get namespace %s: %v", namespace, err)
+	}
+	if !s.opts.Selector.SelectsNamespace(ns) {
+		return fmt.Errorf("namespace %s does not get the root certificate of Istio CA", namespace)
+	}
+	return nil
+}
+
+func decodePod(object []byte, pod *v1.Pod, initContainers *podInitContainers) error {
+	if err := json.Unmarshal(object, pod); err != nil {
+		return err
+	}
+	return json.Unmarshal(object, initContainers)
+}
+
+// podName returns the name of the pod, or its generate name if the name is
+// not assigned yet.
+func podName(pod *v1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
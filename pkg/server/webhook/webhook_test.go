@@ -0,0 +1,285 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki/ca/controller"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestInject(t *testing.T) {
+	optedIn := map[string]string{controller.PodCertAnnotationKey: "true"}
+	testCases := map[string]struct {
+		kind          string
+		namespace     string
+		pod           *v1.Pod
+		object        string
+		allowed       bool
+		expectedPaths []string
+	}{
+		"Pod without opt-in": {
+			pod:     &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}},
+			allowed: true,
+		},
+		"Pod without labels, volumes or init containers": {
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: optedIn},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+			},
+			allowed: true,
+			expectedPaths: []string{
+				"/metadata/labels",
+				"/spec/volumes",
+				"/spec/initContainers",
+				"/spec/containers/0/volumeMounts",
+				"/spec/containers/-",
+			},
+		},
+		"Pod with labels, volumes and init containers": {
+			object: `{
+				"metadata": {"annotations": {"istio.io/pod-cert": "true"}, "labels": {"app": "test"}},
+				"spec": {
+					"volumes": [{"name": "data"}],
+					"initContainers": [{"name": "init"}],
+					"containers": [
+						{"name": "app", "volumeMounts": [{"name": "data", "mountPath": "/data"}]},
+						{"name": "sidecar"}
+					]
+				}
+			}`,
+			allowed: true,
+			expectedPaths: []string{
+				"/metadata/labels/istio.io~1pod-cert",
+				"/spec/volumes/-",
+				"/spec/volumes/-",
+				"/spec/volumes/-",
+				"/spec/initContainers/0",
+				"/spec/containers/0/volumeMounts/-",
+				"/spec/containers/0/volumeMounts/-",
+				"/spec/containers/1/volumeMounts",
+				"/spec/containers/-",
+			},
+		},
+		"Pod in a namespace without the root certificate": {
+			namespace: "unlabeled",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: optedIn},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+			},
+		},
+		"Pod in an excluded namespace": {
+			namespace: "kube-system",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: optedIn},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+			},
+		},
+		"Pod in a missing namespace": {
+			namespace: "missing",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: optedIn},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+			},
+		},
+		"Pod without opt-in in a namespace without the root certificate": {
+			namespace: "unlabeled",
+			pod:       &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}},
+			allowed:   true,
+		},
+		"Injected pod": {
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: optedIn},
+				Spec:       v1.PodSpec{Volumes: []v1.Volume{{Name: certsVolumeName}}},
+			},
+			allowed: true,
+		},
+		"Other kind": {
+			kind:    "Service",
+			object:  `{"metadata":{"annotations":{"istio.io/pod-cert":"true"}}}`,
+			allowed: true,
+		},
+		"Malformed pod": {
+			object: `{"spec":[]}`,
+		},
+	}
+
+	injected := map[string]string{"istio-injection": "enabled"}
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: injected}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: injected}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	)
+	server := New(Options{
+		Image:           "istio/node-agent",
+		CAAddress:       "istio-ca:8060",
+		TokenExpiration: 10 * time.Minute,
+		Selector: &controller.Selector{
+			ExcludeNamespaces: []string{"kube-system"},
+			NamespaceSelector: labels.SelectorFromSet(labels.Set(injected)),
+		},
+		Namespaces: client.CoreV1(),
+	}, nil)
+	for id, tc := range testCases {
+		kind := tc.kind
+		if kind == "" {
+			kind = "Pod"
+		}
+		namespace := tc.namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		object := []byte(tc.object)
+		if tc.pod != nil {
+			var err error
+			if object, err = json.Marshal(tc.pod); err != nil {
+				t.Fatal(err)
+			}
+		}
+		review := &admissionReview{
+			APIVersion: admissionAPIVersion,
+			Kind:       admissionReviewKind,
+			Request: &admissionRequest{
+				UID:       "uid",
+				Kind:      groupVersionKind{Version: "v1", Kind: kind},
+				Namespace: namespace,
+				Operation: "CREATE",
+				Object:    object,
+			},
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, InjectPath, bytes.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Case %s: unexpected status %d", id, recorder.Code)
+			continue
+		}
+		result := &admissionReview{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil || result.Response == nil {
+			t.Errorf("Case %s: invalid admission review %q", id, recorder.Body.String())
+			continue
+		}
+		if result.Response.UID != "uid" || result.Response.Allowed != tc.allowed {
+			t.Errorf("Case %s: expecting the pod to be allowed to be %t but got %+v", id, tc.allowed, result.Response)
+		}
+
+		var paths []string
+		if len(result.Response.Patch) > 0 {
+			var patch []patchOperation
+			if err := json.Unmarshal(result.Response.Patch, &patch); err != nil {
+				t.Errorf("Case %s: invalid patch %q", id, result.Response.Patch)
+				continue
+			}
+			for _, op := range patch {
+				paths = append(paths, op.Path)
+			}
+		}
+		if !reflect.DeepEqual(paths, tc.expectedPaths) {
+			t.Errorf("Case %s: expecting patch paths %v but got %v", id, tc.expectedPaths, paths)
+		}
+	}
+}
+
+func TestInitContainer(t *testing.T) {
+	server := New(Options{Image: "istio/node-agent", CAAddress: "istio-ca:8060"}, nil)
+	container := server.initContainer()
+	expectedArgs := []string{
+		"--env=k8s",
+		"--one-shot",
+		"--ca-address=istio-ca:8060",
+		"--root-cert=/etc/istio-ca/root-cert.pem",
+		"--workload-cert-chain=/etc/certs/cert-chain.pem",
+		"--workload-key=/etc/certs/key.pem",
+		"--workload-root-cert=/etc/certs/root-cert.pem",
+		"--service-account-token=/var/run/secrets/istio/istio-token",
+	}
+	if container.Image != "istio/node-agent" || !reflect.DeepEqual(container.Args, expectedArgs) {
+		t.Errorf("Unexpected init container %+v", container)
+	}
+}
+
+func TestWatchedNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	)
+	server := New(Options{Namespace: "default", Namespaces: client.CoreV1()}, nil)
+	testCases := map[string]struct {
+		namespace string
+		allowed   bool
+	}{
+		"Watched namespace": {namespace: "default", allowed: true},
+		"Other namespace":   {namespace: "other"},
+	}
+	for id, tc := range testCases {
+		err := server.checkNamespace(tc.namespace)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("Case %s: expecting the namespace to be allowed to be %t but got error %v", id, tc.allowed, err)
+		}
+	}
+}
+
+func TestRenewalContainer(t *testing.T) {
+	server := New(Options{Image: "istio/node-agent", CAAddress: "istio-ca:8060"}, nil)
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}}
+	var renewal *v1.Container
+	for _, op := range server.injectionPatch(pod, 0) {
+		if container, ok := op.Value.(v1.Container); ok && op.Path == "/spec/containers/-" {
+			renewal = &container
+		}
+	}
+	if renewal == nil {
+		t.Fatal("No renewal container is injected")
+	}
+
+	// The sidecar runs the node agent like the init container, except that it
+	// keeps renewing the certificate.
+	initContainer := server.initContainer()
+	expectedArgs := []string{}
+	for _, arg := range initContainer.Args {
+		if arg != "--one-shot" {
+			expectedArgs = append(expectedArgs, arg)
+		}
+	}
+	if renewal.Name != renewalContainerName || renewal.Image != initContainer.Image ||
+		!reflect.DeepEqual(renewal.Args, expectedArgs) {
+		t.Errorf("Unexpected renewal container %+v", renewal)
+	}
+	if !reflect.DeepEqual(renewal.Env, initContainer.Env) ||
+		!reflect.DeepEqual(renewal.VolumeMounts, initContainer.VolumeMounts) {
+		t.Errorf("Expecting the renewal container to have the environment and mounts of the init container, "+
+			"but got %+v", renewal)
+	}
+	for _, mount := range renewal.VolumeMounts {
+		if mount.Name == certsVolumeName && mount.ReadOnly {
+			t.Errorf("Expecting the renewal container to write the certificates, but got %+v", mount)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlspolicy configures the TLS connections between Istio CA and the
+// node agents.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"istio.io/auth/pkg/pki"
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+	}
+
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	curves = map[string]tls.CurveID{
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+		"X25519": tls.X25519,
+	}
+)
+
+// Options is a TLS policy. The zero value keeps the defaults of Go.
+type Options struct {
+	// The minimum TLS version, i.e. "1.0", "1.1" or "1.2".
+	MinVersion string
+	// The names of the allowed cipher suites, e.g.
+	// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256".
+	CipherSuites []string
+	// The names of the elliptic curves in the order of preference, i.e.
+	// "P256", "P384", "P521" or "X25519".
+	CurvePreferences []string
+
+	// Whether a server requires clients to present a certificate.
+	RequireClientCert bool
+	// Paths to PEM bundles of the CAs that a server trusts for client
+	// certificates in addition to its own root, e.g. the CA of the bootstrap
+	// certificates of node agents.
+	ClientCAFiles []string
+
+	// The identities that a peer certificate must carry one of in its SAN
+	// extension. An entry ending with "*" matches the identities with the
+	// prefix before it. Any identity is allowed if it is empty.
+	AllowedSANs []string
+}
+
+// Apply applies the options that are common to clients and servers to the
+// config.
+func (o *Options) Apply(config *tls.Config) error {
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return fmt.Errorf("unsupported TLS version %q", o.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	for _, name := range o.CipherSuites {
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+	if len(config.CipherSuites) > 0 {
+		config.PreferServerCipherSuites = true
+	}
+
+	for _, name := range o.CurvePreferences {
+		curve, ok := curves[name]
+		if !ok {
+			return fmt.Errorf("unsupported curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if len(o.AllowedSANs) > 0 {
+		config.VerifyPeerCertificate = o.verifySANs
+	}
+	return nil
+}
+
+// ApplyServer applies the options to the config of a server. The client CAs
+// are added to config.ClientCAs, which is created if it is nil.
+func (o *Options) ApplyServer(config *tls.Config) error {
+	if err := o.Apply(config); err != nil {
+		return err
+	}
+
+	if o.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if len(o.ClientCAFiles) > 0 && config.ClientCAs == nil {
+		config.ClientCAs = x509.NewCertPool()
+	}
+	for _, file := range o.ClientCAFiles {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle %s (error: %v)", file, err)
+		}
+		if !config.ClientCAs.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("no certificate is found in client CA bundle %s", file)
+		}
+	}
+	return nil
+}
+
+// verifySANs checks the SAN identities of the verified peer certificate
+// against the allow-list. A peer without a certificate is left to the client
+// authentication policy of the config.
+func (o *Options) verifySANs(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := verifiedChains[0][0]
+	ids := pki.ExtractIDs(leaf.Extensions)
+	for _, id := range ids {
+		if o.isAllowedSAN(id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the peer identities %v is allowed", ids)
+}
+
+func (o *Options) isAllowedSAN(id string) bool {
+	for _, allowed := range o.AllowedSANs {
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed {
+			if strings.HasPrefix(id, prefix) {
+				return true
+			}
+		} else if id == allowed {
+			return true
+		}
+	}
+	return false
+}
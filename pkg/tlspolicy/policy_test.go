@@ -0,0 +1,197 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/auth/pkg/pki"
+	"istio.io/auth/pkg/pki/ca"
+)
+
+func TestApply(t *testing.T) {
+	testCases := map[string]struct {
+		opts     Options
+		expected *tls.Config
+		errMsg   string
+	}{
+		"Defaults": {
+			expected: &tls.Config{},
+		},
+		"All options": {
+			opts: Options{
+				MinVersion:       "1.2",
+				CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+				CurvePreferences: []string{"X25519", "P256"},
+			},
+			expected: &tls.Config{
+				MinVersion:               tls.VersionTLS12,
+				CipherSuites:             []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				PreferServerCipherSuites: true,
+				CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+			},
+		},
+		"Unsupported version": {
+			opts:   Options{MinVersion: "3.0"},
+			errMsg: `unsupported TLS version "3.0"`,
+		},
+		"Unsupported cipher suite": {
+			opts:   Options{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			errMsg: `unsupported cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+		},
+		"Unsupported curve": {
+			opts:   Options{CurvePreferences: []string{"P224"}},
+			errMsg: `unsupported curve "P224"`,
+		},
+	}
+
+	for id, c := range testCases {
+		config := &tls.Config{}
+		err := c.opts.Apply(config)
+		if c.errMsg != "" {
+			if err == nil || err.Error() != c.errMsg {
+				t.Errorf("Case %s: expecting error (%s) but got (%v)", id, c.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error %v", id, err)
+		} else if !reflect.DeepEqual(c.expected, config) {
+			t.Errorf("Case %s: expecting config %+v but got %+v", id, c.expected, config)
+		}
+	}
+}
+
+func TestApplyServer(t *testing.T) {
+	certPEM, _ := ca.GenCert(ca.CertOptions{
+		Host:         "bootstrap-ca",
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		Org:          "bootstrap",
+		IsCA:         true,
+		IsSelfSigned: true,
+		RSAKeySize:   1024,
+	})
+	file, err := ioutil.TempFile("", "client-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	if _, err := file.Write(certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		opts       Options
+		clientAuth tls.ClientAuthType
+		numCAs     int
+		errMsg     string
+	}{
+		"Defaults": {
+			clientAuth: tls.VerifyClientCertIfGiven,
+			numCAs:     0,
+		},
+		"Required client cert with extra CAs": {
+			opts:       Options{RequireClientCert: true, ClientCAFiles: []string{file.Name()}},
+			clientAuth: tls.RequireAndVerifyClientCert,
+			numCAs:     1,
+		},
+		"Missing CA bundle": {
+			opts:   Options{ClientCAFiles: []string{"not-exist.pem"}},
+			errMsg: "failed to read client CA bundle not-exist.pem (error: open not-exist.pem: no such file or directory)",
+		},
+	}
+
+	for id, c := range testCases {
+		config := &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: x509.NewCertPool()}
+		err := c.opts.ApplyServer(config)
+		if c.errMsg != "" {
+			if err == nil || err.Error() != c.errMsg {
+				t.Errorf("Case %s: expecting error (%s) but got (%v)", id, c.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error %v", id, err)
+			continue
+		}
+		if config.ClientAuth != c.clientAuth {
+			t.Errorf("Case %s: expecting client auth %v but got %v", id, c.clientAuth, config.ClientAuth)
+		}
+		// Subjects is the only way to inspect a cert pool.
+		if n := len(config.ClientCAs.Subjects()); n != c.numCAs {
+			t.Errorf("Case %s: expecting %d client CAs but got %d", id, c.numCAs, n)
+		}
+	}
+}
+
+func TestVerifySANs(t *testing.T) {
+	sanExt, err := pki.BuildSANExtension([]pki.Identity{
+		{Type: pki.TypeURI, Value: []byte("spiffe://cluster.local/ns/istio-system/sa/istio-ca")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains := [][]*x509.Certificate{{{Extensions: []pkix.Extension{*sanExt}}}}
+
+	testCases := map[string]struct {
+		allowedSANs []string
+		chains      [][]*x509.Certificate
+		allowed     bool
+	}{
+		"Exact match": {
+			allowedSANs: []string{"spiffe://cluster.local/ns/istio-system/sa/istio-ca"},
+			chains:      chains,
+			allowed:     true,
+		},
+		"Prefix match": {
+			allowedSANs: []string{"spiffe://cluster.local/ns/istio-system/*"},
+			chains:      chains,
+			allowed:     true,
+		},
+		"No match": {
+			allowedSANs: []string{"spiffe://cluster.local/ns/default/*", "spiffe://cluster.local/ns/istio-system"},
+			chains:      chains,
+			allowed:     false,
+		},
+		"No peer certificate": {
+			allowedSANs: []string{"spiffe://cluster.local/ns/default/*"},
+			allowed:     true,
+		},
+	}
+
+	for id, c := range testCases {
+		opts := &Options{AllowedSANs: c.allowedSANs}
+		config := &tls.Config{}
+		if err := opts.Apply(config); err != nil {
+			t.Fatalf("Case %s: unexpected error %v", id, err)
+		}
+		if err := config.VerifyPeerCertificate(nil, c.chains); (err == nil) != c.allowed {
+			t.Errorf("Case %s: expecting allowed to be %t but got error %v", id, c.allowed, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// dataDirName is the symlink to the directory with the current files. It
+	// is named as in the volumes of Kubernetes secrets, so that the tools
+	// that watch those volumes also watch the files written by WriteDirAtomic.
+	dataDirName    = "..data"
+	dataDirTmpName = "..data_tmp"
+	// The prefix of the directories with the files, which is followed by the
+	// time they are written at.
+	timestampDirPrefix = ".."
+
+	timestampDirPermission = 0755
+)
+
+// WriteDirAtomic writes the files named by the keys to the directory, such
+// that a reader sees either all the previous or all the new files. As in the
+// volumes of Kubernetes secrets, the files are written to a new hidden
+// directory, the symlink dir/..data is switched to it with a rename, and each
+// file is a symlink to the file in dir/..data. The files in dir/..data that
+// are not written are kept, with their permissions and owners.
+func WriteDirAtomic(dir string, files map[string]File) error {
+	for name := range files {
+		if name == "" || strings.HasPrefix(name, "..") || strings.ContainsRune(name, os.PathSeparator) {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	dataDir := filepath.Join(dir, dataDirName)
+	oldTarget, err := os.Readlink(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s (error: %v)", dataDir, err)
+	}
+
+	tsDir, err := ioutil.TempDir(dir, timestampDirPrefix+time.Now().Format("2006_01_02_15_04_05."))
+	if err != nil {
+		return fmt.Errorf("failed to create a directory in %s (error: %v)", dir, err)
+	}
+	oldDir := ""
+	if oldTarget != "" {
+		oldDir = filepath.Join(dir, oldTarget)
+	}
+	names, err := writeTimestampDir(tsDir, oldDir, files)
+	if err == nil {
+		err = os.Chmod(tsDir, timestampDirPermission)
+	}
+	if err == nil {
+		err = switchSymlink(dir, dataDirTmpName, dataDirName, filepath.Base(tsDir))
+	}
+	if err != nil {
+		_ = os.RemoveAll(tsDir)
+		return fmt.Errorf("failed to write the files in %s (error: %v)", dir, err)
+	}
+
+	// The new files are visible once they are linked. The files that are
+	// already linked see the new content through dir/..data.
+	for _, name := range names {
+		target := filepath.Join(dataDirName, name)
+		if current, err := os.Readlink(filepath.Join(dir, name)); err == nil && current == target {
+			continue
+		}
+		if err := switchSymlink(dir, ".."+name+"_tmp", name, target); err != nil {
+			return fmt.Errorf("failed to link %s in %s (error: %v)", name, dir, err)
+		}
+	}
+	if oldTarget != "" && oldTarget != filepath.Base(tsDir) {
+		_ = os.RemoveAll(filepath.Join(dir, oldTarget))
+	}
+	return nil
+}
+
+// writeTimestampDir writes the files to tsDir and links the files of the old
+// directory, if any, that are not written, and returns the names of all of
+// them.
+func writeTimestampDir(tsDir, oldDir string, files map[string]File) ([]string, error) {
+	var names []string
+	if oldDir != "" {
+		entries, err := ioutil.ReadDir(oldDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if _, ok := files[entry.Name()]; ok || !entry.Mode().IsRegular() {
+				continue
+			}
+			// The hard link keeps the permission and the owner of the file.
+			if err := os.Link(filepath.Join(oldDir, entry.Name()), filepath.Join(tsDir, entry.Name())); err != nil {
+				return nil, err
+			}
+			names = append(names, entry.Name())
+		}
+	}
+	for name, file := range files {
+		if err := writeSyncedFile(filepath.Join(tsDir, name), file); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func writeSyncedFile(filename string, file File) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.Perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(file.Content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// The permission is not masked by the umask.
+		err = os.Chmod(filename, file.Perm)
+	}
+	if err == nil && file.Owner != nil {
+		err = os.Chown(filename, file.Owner.UID, file.Owner.GID)
+	}
+	return err
+}
+
+// switchSymlink atomically points dir/name to target, through the temporary
+// symlink dir/tmpName.
+func switchSymlink(dir, tmpName, name, target string) error {
+	tmp := filepath.Join(dir, tmpName)
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteDirAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicwriter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A regular file is replaced by a link.
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("old cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteDirAtomic(dir, map[string]File{
+		"cert.pem": {Content: []byte("cert 1"), Perm: 0644},
+		"key.pem":  {Content: []byte("key 1"), Perm: 0600},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"cert.pem": "cert 1", "key.pem": "key 1"})
+	if info, err := os.Stat(filepath.Join(dir, "key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expecting key.pem to have permission 0600 but got %v (error: %v)", info, err)
+	}
+
+	// The files that are not written are kept, and the previous directory
+	// is removed.
+	if err := WriteDirAtomic(dir, map[string]File{
+		"cert.pem": {Content: []byte("cert 2"), Perm: 0644},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"cert.pem": "cert 2", "key.pem": "key 1"})
+	if info, err := os.Stat(filepath.Join(dir, "key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expecting key.pem to keep permission 0600 but got %v (error: %v)", info, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 4 {
+		t.Errorf("Expecting ..data, a timestamped directory and 2 files but got %v", names)
+	}
+
+	for _, name := range []string{"..data", "", "sub/cert.pem"} {
+		if err := WriteDirAtomic(dir, map[string]File{name: {}}); err == nil ||
+			!strings.HasPrefix(err.Error(), "invalid file name") {
+			t.Errorf("Expecting %q to be rejected but got %v", name, err)
+		}
+	}
+}
+
+func checkFiles(t *testing.T, dir string, expected map[string]string) {
+	for name, content := range expected {
+		path := filepath.Join(dir, name)
+		if target, err := os.Readlink(path); err != nil || target != filepath.Join("..data", name) {
+			t.Errorf("Expecting %s to link to ..data/%s but got %s (error: %v)", name, name, target, err)
+		}
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != content {
+			t.Errorf("Expecting %s to contain %q but got %q (error: %v)", name, content, data, err)
+		}
+	}
+}
@@ -15,8 +15,10 @@
 package util
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 // FileUtil is the interface for utility functions operating on files.
@@ -25,6 +27,23 @@ type FileUtil interface {
 	Read(string) ([]byte, error)
 	// Write writes data to a file named by filename.
 	Write(string, []byte, os.FileMode) error
+	// WriteAll writes the files named by the keys as one atomic operation in
+	// each directory.
+	WriteAll(map[string]File) error
+}
+
+// File is the content, the permission and the owner of a file written by WriteAll.
+type File struct {
+	Content []byte
+	Perm    os.FileMode
+	// Owner is optional. If nil, the file is owned by the user of the process.
+	Owner *FileOwner
+}
+
+// FileOwner is the user and group that own a file.
+type FileOwner struct {
+	UID int
+	GID int
 }
 
 // FileUtilImpl is an implementation of File.
@@ -36,7 +55,58 @@ func (f FileUtilImpl) Read(filename string) ([]byte, error) {
 	return ioutil.ReadFile(filename)
 }
 
-// Write writes data to a file named by filename.
+// Write writes data to a file named by filename. A reader of the file sees
+// either the previous or the new content.
 func (f FileUtilImpl) Write(filename string, content []byte, perm os.FileMode) error {
-	return ioutil.WriteFile(filename, content, perm)
+	return WriteFileAtomic(filename, content, perm)
+}
+
+// WriteAll writes the files named by the keys. See WriteDirAtomic for how a
+// reader sees the files of a directory change together.
+func (f FileUtilImpl) WriteAll(files map[string]File) error {
+	dirs := make(map[string]map[string]File)
+	for path, file := range files {
+		dir, name := filepath.Split(path)
+		if dirs[dir] == nil {
+			dirs[dir] = make(map[string]File)
+		}
+		dirs[dir][name] = file
+	}
+	for dir, dirFiles := range dirs {
+		dir = filepath.Clean(dir)
+		if err := os.MkdirAll(dir, timestampDirPermission); err != nil {
+			return fmt.Errorf("failed to create %s (error: %v)", dir, err)
+		}
+		if err := WriteDirAtomic(dir, dirFiles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the directory of the
+// file, and renames it to the file once it is synced to the disk.
+func WriteFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s (error: %v)", filename, err)
+	}
+	return nil
 }
@@ -0,0 +1,59 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileUtilImpl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The directory is created.
+	certsDir := filepath.Join(dir, "certs")
+	f := FileUtilImpl{}
+
+	token := filepath.Join(dir, "token")
+	if err := f.Write(token, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(token); err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0600 {
+		t.Errorf("Expecting a regular file with permission 0600 but got %v (error: %v)", info, err)
+	}
+
+	files := map[string]File{
+		filepath.Join(dir, "root-cert.pem"): {Content: []byte("root"), Perm: 0644},
+		filepath.Join(certsDir, "cert.pem"): {Content: []byte("cert"), Perm: 0644},
+		filepath.Join(certsDir, "key.pem"): {
+			Content: []byte("key"),
+			Perm:    0600,
+			Owner:   &FileOwner{UID: os.Getuid(), GID: os.Getgid()},
+		},
+	}
+	if err := f.WriteAll(files); err != nil {
+		t.Fatal(err)
+	}
+	for path, file := range files {
+		if content, err := f.Read(path); err != nil || string(content) != string(file.Content) {
+			t.Errorf("Expecting %s to contain %q but got %q (error: %v)", path, file.Content, content, err)
+		}
+	}
+}
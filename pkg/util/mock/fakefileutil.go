@@ -17,6 +17,8 @@ package mock
 import (
 	"fmt"
 	"os"
+
+	"istio.io/auth/pkg/util"
 )
 
 // FakeFileUtil is a mocked FileUtil for testing.
@@ -41,3 +43,13 @@ func (f FakeFileUtil) Write(filename string, content []byte, perm os.FileMode) e
 	f.WriteContent[filename] = content
 	return nil
 }
+
+// WriteAll writes the files to their filename entries in WriteContent.
+func (f FakeFileUtil) WriteAll(files map[string]util.File) error {
+	for filename, file := range files {
+		if err := f.Write(filename, file.Content, file.Perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
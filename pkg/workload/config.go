@@ -15,6 +15,8 @@
 package workload
 
 import (
+	"os"
+
 	"istio.io/auth/pkg/util"
 )
 
@@ -22,7 +24,7 @@ const (
 	// SecretFile propages the key/cert to the workload through file.
 	SecretFile int = iota // 0
 	// WorkloadAPI propages the key/cert to the workload through API.
-	WorkloadAPI // 1, unimplemented.
+	WorkloadAPI // 1
 )
 
 // Config is the configuration for node agent to workload communication.
@@ -38,6 +40,41 @@ type Config struct {
 
 	// ServiceIdentityPrivateKeyFile is valid in FILE mode. It specifies the file path for service identity private key.
 	ServiceIdentityPrivateKeyFile string
+
+	// ServiceIdentityRootCertFile is valid in FILE mode. It specifies the file path for the root certificate.
+	// If empty, the root certificate is not written.
+	ServiceIdentityRootCertFile string
+
+	// ServiceIdentityBundleFile is valid in FILE mode. It specifies the file path for the root certificate
+	// followed by the federated bundle. If empty, the bundle is not written.
+	ServiceIdentityBundleFile string
+
+	// CertFilePermission is valid in FILE mode. It specifies the permission of the certificate files. If
+	// zero, the certificate files are readable by all users.
+	CertFilePermission os.FileMode
+
+	// KeyFilePermission is valid in FILE mode. It specifies the permission of the private key file. If zero,
+	// the private key file is only readable by its owner.
+	KeyFilePermission os.FileMode
+
+	// FileOwner is valid in FILE mode. It specifies the owner of the files. If nil, the files are owned by
+	// the user of the node agent.
+	FileOwner *util.FileOwner
+
+	// Hooks is valid in FILE mode. It specifies the hooks run after the service identity is rotated.
+	Hooks []Hook
+
+	// SocketPath is valid in WORKLOAD API mode. It specifies the Unix domain socket of the Workload API.
+	SocketPath string
+
+	// AuthorizedUIDs is valid in WORKLOAD API mode. It maps the identities to the UIDs of the workload
+	// processes that may fetch them. An identity that is not listed is only served to the processes that
+	// run as the same user as the node agent.
+	AuthorizedUIDs map[string][]uint32
+
+	// OnFetch is optional and valid in WORKLOAD API mode. It is called when a workload process of the UID
+	// fetches its identities, e.g. for the node agent to issue the identities of the UID on demand.
+	OnFetch func(uid uint32)
 }
 
 // NewSecretFileServerConfig creates a Config for propogating key/cert to workload through file.
@@ -49,3 +86,12 @@ func NewSecretFileServerConfig(certFile string, keyFile string) Config {
 		ServiceIdentityPrivateKeyFile: keyFile,
 	}
 }
+
+// NewWorkloadAPIServerConfig creates a Config for serving key/cert to workload through the Workload API.
+func NewWorkloadAPIServerConfig(socketPath string, authorizedUIDs map[string][]uint32) Config {
+	return Config{
+		Mode:           WorkloadAPI,
+		SocketPath:     socketPath,
+		AuthorizedUIDs: authorizedUIDs,
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	commandHookPrefix = "exec:"
+	signalHookPrefix  = "signal:"
+
+	// hookTimeout bounds the time a hook may take, since the rotation waits
+	// for it.
+	hookTimeout = 30 * time.Second
+)
+
+var hookSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Hook is run after the key/cert of the workload are rotated, e.g. to make
+// the server that reads them reload.
+type Hook interface {
+	// Run runs the hook.
+	Run() error
+	// String describes the hook in the logs.
+	String() string
+}
+
+// ParseHook parses a hook. "exec:<command> [<arg>...]" runs the command,
+// which is split by spaces. "signal:<signal>:<PID file>" sends the signal,
+// e.g. HUP, to the process whose PID is in the file. An http:// or https://
+// URL is POSTed to, and a 2xx status is expected.
+func ParseHook(value string) (Hook, error) {
+	switch {
+	case strings.HasPrefix(value, commandHookPrefix):
+		args := strings.Fields(strings.TrimPrefix(value, commandHookPrefix))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("the command of hook %q is empty", value)
+		}
+		return NewCommandHook(args), nil
+	case strings.HasPrefix(value, signalHookPrefix):
+		parts := strings.SplitN(strings.TrimPrefix(value, signalHookPrefix), ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("hook %q is not in the form of signal:<signal>:<PID file>", value)
+		}
+		sig, ok := hookSignals[strings.TrimPrefix(strings.ToUpper(parts[0]), "SIG")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal %q of hook %q", parts[0], value)
+		}
+		return NewSignalHook(sig, parts[1]), nil
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		return NewHTTPHook(value), nil
+	default:
+		return nil, fmt.Errorf("unknown hook %q", value)
+	}
+}
+
+type commandHook struct {
+	args []string
+}
+
+// NewCommandHook creates a hook that runs the command with the arguments.
+func NewCommandHook(args []string) Hook {
+	return &commandHook{args: args}
+}
+
+func (h *commandHook) Run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, h.args[0], h.args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (h *commandHook) String() string {
+	return commandHookPrefix + strings.Join(h.args, " ")
+}
+
+type signalHook struct {
+	sig     syscall.Signal
+	pidFile string
+}
+
+// NewSignalHook creates a hook that sends the signal to the process whose PID
+// is in the file. The file is read every time, so that the process may be
+// restarted.
+func NewSignalHook(sig syscall.Signal, pidFile string) Hook {
+	return &signalHook{sig: sig, pidFile: pidFile}
+}
+
+func (h *signalHook) Run() error {
+	content, err := ioutil.ReadFile(h.pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("%s does not contain a PID", h.pidFile)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(h.sig)
+}
+
+func (h *signalHook) String() string {
+	return fmt.Sprintf("%s%v:%s", signalHookPrefix, h.sig, h.pidFile)
+}
+
+type httpHook struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPHook creates a hook that POSTs to the URL, and expects a 2xx status.
+func NewHTTPHook(url string) Hook {
+	return &httpHook{url: url, client: &http.Client{Timeout: hookTimeout}}
+}
+
+func (h *httpHook) Run() error {
+	resp, err := h.client.Post(h.url, "", nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *httpHook) String() string {
+	return h.url
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseHook(t *testing.T) {
+	testCases := map[string]struct {
+		value       string
+		hook        string
+		expectedErr string
+	}{
+		"Command": {
+			value: "exec:nginx  -s reload",
+			hook:  "exec:nginx -s reload",
+		},
+		"Signal": {
+			value: "signal:SIGHUP:/var/run/nginx.pid",
+			hook:  "signal:hangup:/var/run/nginx.pid",
+		},
+		"HTTP": {
+			value: "http://localhost:15000/reload",
+			hook:  "http://localhost:15000/reload",
+		},
+		"Empty command": {
+			value:       "exec: ",
+			expectedErr: `the command of hook "exec: " is empty`,
+		},
+		"Missing PID file": {
+			value:       "signal:HUP",
+			expectedErr: `hook "signal:HUP" is not in the form of signal:<signal>:<PID file>`,
+		},
+		"Unsupported signal": {
+			value:       "signal:KILL:/var/run/nginx.pid",
+			expectedErr: `unsupported signal "KILL" of hook "signal:KILL:/var/run/nginx.pid"`,
+		},
+		"Unknown hook": {
+			value:       "ftp://localhost/reload",
+			expectedErr: `unknown hook "ftp://localhost/reload"`,
+		},
+	}
+
+	for id, c := range testCases {
+		hook, err := ParseHook(c.value)
+		if c.expectedErr != "" {
+			if err == nil || err.Error() != c.expectedErr {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if hook.String() != c.hook {
+			t.Errorf("Case %s: expecting %s but got %s", id, c.hook, hook)
+		}
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	if err := NewCommandHook([]string{"true"}).Run(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := NewCommandHook([]string{"sh", "-c", "echo failed; exit 1"}).Run(); err == nil ||
+		err.Error() != "exit status 1 (output: failed)" {
+		t.Errorf("Expecting the command to fail but got %v", err)
+	}
+}
+
+func TestSignalHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	if err := NewSignalHook(syscall.SIGUSR1, pidFile).Run(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-signals:
+	case <-time.After(5 * time.Second):
+		t.Error("Expecting the signal to be sent to the process")
+	}
+
+	if err := NewSignalHook(syscall.SIGUSR1, filepath.Join(dir, "missing")).Run(); err == nil {
+		t.Error("Expecting an error for a missing PID file")
+	}
+}
+
+func TestHTTPHook(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	hook := NewHTTPHook(server.URL)
+	if err := hook.Run(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	status = http.StatusInternalServerError
+	if err := hook.Run(); err == nil || !strings.HasPrefix(err.Error(), "unexpected status 500") {
+		t.Errorf("Expecting the hook to fail but got %v", err)
+	}
+}
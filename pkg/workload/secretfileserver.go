@@ -14,6 +14,14 @@
 
 package workload
 
+import (
+	"os"
+
+	"github.com/golang/glog"
+
+	"istio.io/auth/pkg/util"
+)
+
 const (
 	keyFilePermission  = 0600
 	certFilePermission = 0644
@@ -24,12 +32,63 @@ type SecretFileServer struct {
 	cfg Config
 }
 
+// SetServiceIdentity writes the service identity into the file system as one atomic operation in each
+// directory, and runs the hooks.
+func (sf *SecretFileServer) SetServiceIdentity(id ServiceIdentity) error {
+	files := map[string]util.File{
+		sf.cfg.ServiceIdentityCertFile:       sf.file(id.CertChain, sf.certPermission()),
+		sf.cfg.ServiceIdentityPrivateKeyFile: sf.file(id.PrivateKey, sf.keyPermission()),
+	}
+	if sf.cfg.ServiceIdentityRootCertFile != "" && len(id.RootCert) > 0 {
+		files[sf.cfg.ServiceIdentityRootCertFile] = sf.file(id.RootCert, sf.certPermission())
+	}
+	if sf.cfg.ServiceIdentityBundleFile != "" && len(id.RootCert)+len(id.FederatedBundle) > 0 {
+		bundle := append([]byte{}, id.RootCert...)
+		if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		bundle = append(bundle, id.FederatedBundle...)
+		files[sf.cfg.ServiceIdentityBundleFile] = sf.file(bundle, sf.certPermission())
+	}
+	if err := sf.cfg.FileUtil.WriteAll(files); err != nil {
+		return err
+	}
+
+	// The files are already rotated, so a failed hook is only logged.
+	for _, hook := range sf.cfg.Hooks {
+		if err := hook.Run(); err != nil {
+			glog.Errorf("Rotation hook %s failed (error: %v)", hook, err)
+		} else {
+			glog.Infof("Rotation hook %s succeeded", hook)
+		}
+	}
+	return nil
+}
+
 // SetServiceIdentityPrivateKey sets the service identity private key into the file system.
 func (sf *SecretFileServer) SetServiceIdentityPrivateKey(content []byte) error {
-	return sf.cfg.FileUtil.Write(sf.cfg.ServiceIdentityPrivateKeyFile, content, keyFilePermission)
+	return sf.cfg.FileUtil.Write(sf.cfg.ServiceIdentityPrivateKeyFile, content, sf.keyPermission())
 }
 
 // SetServiceIdentityCert sets the service identity certificate into the file system.
 func (sf *SecretFileServer) SetServiceIdentityCert(content []byte) error {
-	return sf.cfg.FileUtil.Write(sf.cfg.ServiceIdentityCertFile, content, certFilePermission)
+	return sf.cfg.FileUtil.Write(sf.cfg.ServiceIdentityCertFile, content, sf.certPermission())
+}
+
+func (sf *SecretFileServer) file(content []byte, perm os.FileMode) util.File {
+	return util.File{Content: content, Perm: perm, Owner: sf.cfg.FileOwner}
+}
+
+func (sf *SecretFileServer) certPermission() os.FileMode {
+	if sf.cfg.CertFilePermission != 0 {
+		return sf.cfg.CertFilePermission
+	}
+	return certFilePermission
+}
+
+func (sf *SecretFileServer) keyPermission() os.FileMode {
+	if sf.cfg.KeyFilePermission != 0 {
+		return sf.cfg.KeyFilePermission
+	}
+	return keyFilePermission
 }
@@ -0,0 +1,137 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"istio.io/auth/pkg/util"
+	"istio.io/auth/pkg/util/mock"
+)
+
+type fakeHook struct {
+	runs int
+	err  error
+}
+
+func (h *fakeHook) Run() error {
+	h.runs++
+	return h.err
+}
+
+func (h *fakeHook) String() string {
+	return "fake"
+}
+
+func TestSetServiceIdentity(t *testing.T) {
+	testCases := map[string]struct {
+		rootCertFile string
+		bundleFile   string
+		id           ServiceIdentity
+		written      map[string][]byte
+	}{
+		"Without root cert file": {
+			id: ServiceIdentity{CertChain: []byte("cert"), PrivateKey: []byte("key"), RootCert: []byte("root")},
+			written: map[string][]byte{
+				"cert_file": []byte("cert"),
+				"key_file":  []byte("key"),
+			},
+		},
+		"With bundle file": {
+			bundleFile: "bundle_file",
+			id: ServiceIdentity{
+				CertChain:       []byte("cert"),
+				PrivateKey:      []byte("key"),
+				RootCert:        []byte("root"),
+				FederatedBundle: []byte("federated"),
+			},
+			written: map[string][]byte{
+				"cert_file":   []byte("cert"),
+				"key_file":    []byte("key"),
+				"bundle_file": []byte("root\nfederated"),
+			},
+		},
+		"With root cert file": {
+			rootCertFile: "root_file",
+			id:           ServiceIdentity{CertChain: []byte("cert"), PrivateKey: []byte("key"), RootCert: []byte("root")},
+			written: map[string][]byte{
+				"cert_file": []byte("cert"),
+				"key_file":  []byte("key"),
+				"root_file": []byte("root"),
+			},
+		},
+	}
+
+	for id, c := range testCases {
+		fileUtil := mock.FakeFileUtil{WriteContent: make(map[string][]byte)}
+		// A failed hook does not fail the rotation, or stop the other hooks.
+		hooks := []*fakeHook{{err: fmt.Errorf("hook error")}, {}}
+		server, err := NewSecretServer(Config{
+			Mode:                          SecretFile,
+			FileUtil:                      fileUtil,
+			ServiceIdentityCertFile:       "cert_file",
+			ServiceIdentityPrivateKeyFile: "key_file",
+			ServiceIdentityRootCertFile:   c.rootCertFile,
+			ServiceIdentityBundleFile:     c.bundleFile,
+			Hooks:                         []Hook{hooks[0], hooks[1]},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetServiceIdentity(c.id); err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		}
+		if !reflect.DeepEqual(fileUtil.WriteContent, c.written) {
+			t.Errorf("Case %s: expecting %v to be written but got %v", id, c.written, fileUtil.WriteContent)
+		}
+		for _, hook := range hooks {
+			if hook.runs != 1 {
+				t.Errorf("Case %s: expecting each hook to run once but got %d", id, hook.runs)
+			}
+		}
+	}
+}
+
+func TestSetServiceIdentityPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretfileserver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := NewSecretFileServerConfig(filepath.Join(dir, "cert-chain.pem"), filepath.Join(dir, "key.pem"))
+	cfg.ServiceIdentityRootCertFile = filepath.Join(dir, "root-cert.pem")
+	cfg.KeyFilePermission = 0640
+	cfg.FileOwner = &util.FileOwner{UID: os.Getuid(), GID: os.Getgid()}
+	server, err := NewSecretServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ServiceIdentity{CertChain: []byte("cert"), PrivateKey: []byte("key"), RootCert: []byte("root")}
+	if err := server.SetServiceIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]os.FileMode{"cert-chain.pem": 0644, "key.pem": 0640, "root-cert.pem": 0644}
+	for name, perm := range expected {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Mode().Perm() != perm {
+			t.Errorf("Expecting %s to have permission %v but got %v (error: %v)", name, perm, info, err)
+		}
+	}
+}
@@ -18,8 +18,24 @@ import (
 	"fmt"
 )
 
+// ServiceIdentity is the key/cert of a service identity, which are set to the workload together.
+type ServiceIdentity struct {
+	// CertChain is the PEM-encoded certificate chain.
+	CertChain []byte
+	// PrivateKey is the PEM-encoded private key.
+	PrivateKey []byte
+	// RootCert is the PEM-encoded root certificate. It is optional.
+	RootCert []byte
+	// FederatedBundle is the PEM-encoded root certificates of the other trust domains that the workload
+	// trusts. It is optional.
+	FederatedBundle []byte
+}
+
 // SecretServer is for implementing the communication from the node agent to the workload.
 type SecretServer interface {
+	// SetServiceIdentity sets the key/cert of the service identity to the channel accessible to the workload
+	// as one operation, so that the workload does not see a cert with the key of another one.
+	SetServiceIdentity(ServiceIdentity) error
 	// SetServiceIdentityPrivateKey sets the service identity private key to the channel accessible to the workload.
 	SetServiceIdentityPrivateKey([]byte) error
 	// SetServiceIdentityCert sets the service identity cert to the channel accessible to the workload.
@@ -32,7 +48,11 @@ func NewSecretServer(cfg Config) (SecretServer, error) {
 	case SecretFile:
 		return &SecretFileServer{cfg}, nil
 	case WorkloadAPI:
-		return nil, fmt.Errorf("WORKLOAD API is unimplemented")
+		server, err := NewWorkloadAPIServer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return server, nil
 	default:
 		return nil, fmt.Errorf("mode: %d is not supported", cfg.Mode)
 	}
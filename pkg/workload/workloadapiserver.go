@@ -0,0 +1,375 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"istio.io/auth/pkg/peercred"
+	"istio.io/auth/pkg/pki"
+	pb "istio.io/auth/proto"
+)
+
+const (
+	// SecurityHeader is the metadata that the requests to the Workload API
+	// must carry with the value "true", so that a workload cannot be tricked
+	// into forwarding a request to it, e.g. through a proxy.
+	SecurityHeader = "workload.spiffe.io"
+
+	// The workloads of all users can connect to the socket, and are authorized
+	// by the credentials of their processes.
+	socketPermission = 0666
+)
+
+// svid is an identity served through the Workload API.
+type svid struct {
+	// the DER-encoded certificate chain
+	chain []byte
+	// the DER-encoded PKCS#8 private key
+	key []byte
+}
+
+// WorkloadAPIServer is an implementation of SecretServer that serves the
+// key/cert to the workloads through the SPIFFE Workload API on a Unix domain
+// socket. It serves several identities, and pushes them to the connected
+// workloads whenever they are rotated.
+type WorkloadAPIServer struct {
+	cfg      Config
+	server   *grpc.Server
+	listener net.Listener
+	// the UID of the node agent, which may fetch the identities that are not
+	// listed in authorizedUIDs
+	uid uint32
+
+	mu sync.Mutex
+	// the certificate and the private key set through SecretServer, which are
+	// served once they match
+	pendingCert []byte
+	pendingKey  []byte
+	svids       map[string]*svid
+	bundle      []byte
+	// authorizedUIDs is initialized from cfg.AuthorizedUIDs.
+	authorizedUIDs map[string][]uint32
+	// updated is closed and replaced whenever the identities change.
+	updated chan struct{}
+}
+
+// NewWorkloadAPIServer creates a WorkloadAPIServer and starts serving on the
+// socket of the configuration.
+func NewWorkloadAPIServer(cfg Config) (*WorkloadAPIServer, error) {
+	if cfg.SocketPath == "" {
+		return nil, fmt.Errorf("the socket of the Workload API is not specified")
+	}
+	if err := os.Remove(cfg.SocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot remove the stale socket %s (error: %v)", cfg.SocketPath, err)
+	}
+	lis, err := net.Listen("unix", cfg.SocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s (error: %v)", cfg.SocketPath, err)
+	}
+	if err := os.Chmod(cfg.SocketPath, socketPermission); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("cannot change the permission of %s (error: %v)", cfg.SocketPath, err)
+	}
+
+	s := &WorkloadAPIServer{
+		cfg:            cfg,
+		server:         grpc.NewServer(grpc.Creds(peercred.NewCredentials())),
+		listener:       lis,
+		uid:            uint32(os.Getuid()),
+		svids:          make(map[string]*svid),
+		authorizedUIDs: make(map[string][]uint32),
+		updated:        make(chan struct{}),
+	}
+	for id, uids := range cfg.AuthorizedUIDs {
+		s.authorizedUIDs[id] = uids
+	}
+	pb.RegisterSpiffeWorkloadAPIServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(lis); err != nil {
+			glog.Errorf("Workload API on %s stopped (error: %v)", cfg.SocketPath, err)
+		}
+	}()
+	glog.Infof("Serving the Workload API on %s", cfg.SocketPath)
+	return s, nil
+}
+
+// Stop stops serving the Workload API and closes the connected streams.
+func (s *WorkloadAPIServer) Stop() {
+	s.server.Stop()
+}
+
+// SetServiceIdentityPrivateKey sets the private key of the service identity.
+// It is served with the certificate that matches it.
+func (s *WorkloadAPIServer) SetServiceIdentityPrivateKey(content []byte) error {
+	if _, err := pki.ParsePemEncodedKey(content); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingKey = content
+	return s.publishPending()
+}
+
+// SetServiceIdentityCert sets the certificate chain of the service identity.
+// It is served with the private key that matches it.
+func (s *WorkloadAPIServer) SetServiceIdentityCert(content []byte) error {
+	if _, err := pki.ParsePemEncodedCertificate(content); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingCert = content
+	return s.publishPending()
+}
+
+// SetSecret serves the PEM-encoded certificate chain and private key under
+// the identity of the certificate, replacing the previous ones of the
+// identity.
+func (s *WorkloadAPIServer) SetSecret(certChain, privateKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.setSecret(certChain, privateKey); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// RemoveSecret stops serving the identity.
+func (s *WorkloadAPIServer) RemoveSecret(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.svids[identity]; ok {
+		delete(s.svids, identity)
+		s.notify()
+	}
+}
+
+// SetAuthorizedUIDs sets the UIDs of the workload processes that may fetch
+// the identity. If uids is empty, the identity is only served to the user of
+// the node agent.
+func (s *WorkloadAPIServer) SetAuthorizedUIDs(identity string, uids []uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(uids) == 0 {
+		delete(s.authorizedUIDs, identity)
+	} else {
+		s.authorizedUIDs[identity] = uids
+	}
+	s.notify()
+}
+
+// SetTrustBundle sets the PEM-encoded root certificates that the workloads
+// verify their peers with.
+func (s *WorkloadAPIServer) SetTrustBundle(rootCerts []byte) error {
+	bundle, err := parseBundle(rootCerts)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.bundle, bundle) {
+		s.bundle = bundle
+		s.notify()
+	}
+	return nil
+}
+
+// SetServiceIdentity serves the service identity, and the root certificate as
+// the trust bundle if it is set. The workloads receive them in one response.
+// The federated bundle is not served, since the Workload API keys it by
+// trust domain.
+func (s *WorkloadAPIServer) SetServiceIdentity(id ServiceIdentity) error {
+	var bundle []byte
+	if len(id.RootCert) > 0 {
+		var err error
+		if bundle, err = parseBundle(id.RootCert); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.setSecret(id.CertChain, id.PrivateKey); err != nil {
+		return err
+	}
+	if bundle != nil {
+		s.bundle = bundle
+	}
+	s.notify()
+	return nil
+}
+
+// FetchX509SVID streams the identities that the calling workload is
+// authorized for, and a new response whenever they change.
+func (s *WorkloadAPIServer) FetchX509SVID(_ *pb.X509SVIDRequest,
+	stream pb.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	ctx := stream.Context()
+	if md, ok := metadata.FromContext(ctx); !ok || len(md[SecurityHeader]) == 0 || md[SecurityHeader][0] != "true" {
+		return grpc.Errorf(codes.InvalidArgument, "the request must carry the metadata %s: true", SecurityHeader)
+	}
+	cred, ok := peercred.FromContext(ctx)
+	if !ok {
+		return grpc.Errorf(codes.PermissionDenied, "the workload cannot be attested")
+	}
+	glog.Infof("Workload process %d (UID %d) fetches its identities", cred.PID, cred.UID)
+	if s.cfg.OnFetch != nil {
+		s.cfg.OnFetch(cred.UID)
+	}
+
+	var sent *pb.X509SVIDResponse
+	for {
+		resp, updated := s.response(cred.UID)
+		// The stream waits until the workload is authorized for an identity.
+		if len(resp.Svids) > 0 && !reflect.DeepEqual(resp, sent) {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			sent = resp
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publishPending serves the pending certificate and private key once they
+// match. The node agent sets them one after the other on rotation, so the
+// first one waits for the second.
+func (s *WorkloadAPIServer) publishPending() error {
+	if s.pendingCert == nil || s.pendingKey == nil {
+		return nil
+	}
+	if _, err := tls.X509KeyPair(s.pendingCert, s.pendingKey); err != nil {
+		// One of them is rotated, and the other is yet to be set.
+		return nil
+	}
+	if err := s.setSecret(s.pendingCert, s.pendingKey); err != nil {
+		return err
+	}
+	s.pendingCert, s.pendingKey = nil, nil
+	s.notify()
+	return nil
+}
+
+// setSecret sets the identity of the certificate without waking up the
+// streams. It must be called with s.mu held.
+func (s *WorkloadAPIServer) setSecret(certChain, privateKey []byte) error {
+	pair, err := tls.X509KeyPair(certChain, privateKey)
+	if err != nil {
+		return fmt.Errorf("invalid certificate and private key (error: %v)", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse the certificate (error: %v)", err)
+	}
+	identity := ""
+	for _, id := range pki.ExtractIDs(leaf.Extensions) {
+		if strings.HasPrefix(id, "spiffe://") {
+			identity = id
+			break
+		}
+	}
+	if identity == "" {
+		return fmt.Errorf("the certificate has no SPIFFE identity")
+	}
+	key, err := pki.MarshalPKCS8PrivateKey(pair.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode the private key (error: %v)", err)
+	}
+
+	s.svids[identity] = &svid{chain: bytes.Join(pair.Certificate, nil), key: key}
+	glog.Infof("Serving identity %s through the Workload API", identity)
+	return nil
+}
+
+// parseBundle returns the concatenated DER-encoded certificates of the PEM
+// data.
+func parseBundle(rootCerts []byte) ([]byte, error) {
+	var bundle []byte
+	for block, rest := pem.Decode(rootCerts); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to parse the trust bundle (error: %v)", err)
+		}
+		bundle = append(bundle, block.Bytes...)
+	}
+	if len(bundle) == 0 {
+		return nil, fmt.Errorf("the trust bundle has no certificates")
+	}
+	return bundle, nil
+}
+
+// notify wakes up the streams. It must be called with s.mu held.
+func (s *WorkloadAPIServer) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// response returns the identities that the UID is authorized for, sorted by
+// identity, and the channel that is closed when they change.
+func (s *WorkloadAPIServer) response(uid uint32) (*pb.X509SVIDResponse, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.svids {
+		if s.authorized(id, uid) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	resp := &pb.X509SVIDResponse{}
+	for _, id := range ids {
+		resp.Svids = append(resp.Svids, &pb.X509SVID{
+			SpiffeId:    id,
+			X509Svid:    s.svids[id].chain,
+			X509SvidKey: s.svids[id].key,
+			Bundle:      s.bundle,
+		})
+	}
+	return resp, s.updated
+}
+
+func (s *WorkloadAPIServer) authorized(identity string, uid uint32) bool {
+	uids, ok := s.authorizedUIDs[identity]
+	if !ok {
+		return uid == s.uid
+	}
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
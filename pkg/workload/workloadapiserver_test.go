@@ -0,0 +1,217 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"istio.io/auth/pkg/pki/ca"
+	pb "istio.io/auth/proto"
+)
+
+const (
+	testIdentity  = "spiffe://cluster.local/ns/default/sa/test"
+	otherIdentity = "spiffe://cluster.local/ns/default/sa/other"
+)
+
+func TestWorkloadAPIServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workloadapiserver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "workload.sock")
+
+	// The other identity is only served to another user.
+	cfg := NewWorkloadAPIServerConfig(socket, map[string][]uint32{
+		otherIdentity: {uint32(os.Getuid()) + 1},
+	})
+	fetchedUIDs := make(chan uint32, 1)
+	cfg.OnFetch = func(uid uint32) { fetchedUIDs <- uid }
+	server, err := NewWorkloadAPIServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	rootPEM, _ := genKeyPair("root")
+	if err := server.SetTrustBundle(rootPEM); err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey := genKeyPair(otherIdentity)
+	if err := server.SetSecret(otherCert, otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewSpiffeWorkloadAPIClient(conn)
+
+	// The requests without the security header are rejected.
+	stream, err := client.FetchX509SVID(context.Background(), &pb.X509SVIDRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expecting InvalidArgument without the security header but got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewContext(context.Background(), metadata.Pairs(SecurityHeader, "true")))
+	defer cancel()
+	stream, err = client.FetchX509SVID(ctx, &pb.X509SVIDRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := <-fetchedUIDs; uid != uint32(os.Getuid()) {
+		t.Errorf("Expecting the fetch of UID %d to be observed but got %d", os.Getuid(), uid)
+	}
+
+	// The stream waits for an identity of the workload. The certificate and
+	// the private key are served together.
+	certPEM, keyPEM := genKeyPair(testIdentity)
+	if err := server.SetServiceIdentityCert(certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetServiceIdentityPrivateKey(keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, stream, certPEM, rootPEM)
+
+	// The rotated identity is pushed.
+	certPEM, keyPEM = genKeyPair(testIdentity)
+	if err := server.SetServiceIdentityCert(certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetServiceIdentityPrivateKey(keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, stream, certPEM, rootPEM)
+
+	// The identity and the trust bundle are pushed together.
+	certPEM, keyPEM = genKeyPair(testIdentity)
+	rootPEM, _ = genKeyPair("new root")
+	id := ServiceIdentity{CertChain: certPEM, PrivateKey: keyPEM, RootCert: rootPEM}
+	if err := server.SetServiceIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	checkResponse(t, stream, certPEM, rootPEM)
+
+	// The other identity is pushed once the workload is authorized for it.
+	server.SetAuthorizedUIDs(otherIdentity, []uint32{uint32(os.Getuid())})
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Svids) != 2 || resp.Svids[0].SpiffeId != otherIdentity || resp.Svids[1].SpiffeId != testIdentity {
+		t.Errorf("Expecting %s and %s to be served but got %v", otherIdentity, testIdentity, resp.Svids)
+	}
+}
+
+func TestSetSecret(t *testing.T) {
+	certPEM, keyPEM := genKeyPair(testIdentity)
+	_, otherKey := genKeyPair(testIdentity)
+	dnsCert, dnsKey := genKeyPair("istio-ca")
+
+	testCases := map[string]struct {
+		cert        []byte
+		key         []byte
+		expectedErr string
+	}{
+		"Valid": {
+			cert: certPEM,
+			key:  keyPEM,
+		},
+		"Mismatched key": {
+			cert:        certPEM,
+			key:         otherKey,
+			expectedErr: "invalid certificate and private key",
+		},
+		"No SPIFFE identity": {
+			cert:        dnsCert,
+			key:         dnsKey,
+			expectedErr: "the certificate has no SPIFFE identity",
+		},
+	}
+
+	for id, c := range testCases {
+		server := &WorkloadAPIServer{svids: make(map[string]*svid), updated: make(chan struct{})}
+		err := server.SetSecret(c.cert, c.key)
+		if c.expectedErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), c.expectedErr) {
+				t.Errorf("Case %s: expecting error %q but got %v", id, c.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %s: unexpected error: %v", id, err)
+		} else if _, ok := server.svids[testIdentity]; !ok {
+			t.Errorf("Case %s: expecting %s to be served", id, testIdentity)
+		}
+	}
+}
+
+func checkResponse(t *testing.T, stream pb.SpiffeWorkloadAPI_FetchX509SVIDClient, certPEM, rootPEM []byte) {
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Svids) != 1 || resp.Svids[0].SpiffeId != testIdentity {
+		t.Fatalf("Expecting only %s to be served but got %v", testIdentity, resp.Svids)
+	}
+	svid := resp.Svids[0]
+	certBlock, _ := pem.Decode(certPEM)
+	if !bytes.Equal(svid.X509Svid, certBlock.Bytes) {
+		t.Error("Expecting the DER-encoded certificate chain")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey); err != nil {
+		t.Errorf("Expecting a PKCS#8 private key but got error %v", err)
+	}
+	rootBlock, _ := pem.Decode(rootPEM)
+	if !bytes.Equal(svid.Bundle, rootBlock.Bytes) {
+		t.Error("Expecting the DER-encoded trust bundle")
+	}
+}
+
+func genKeyPair(host string) ([]byte, []byte) {
+	return ca.GenCert(ca.CertOptions{
+		Host:         host,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		Org:          "test.org",
+		IsSelfSigned: true,
+		IsClient:     true,
+		RSAKeySize:   1024,
+	})
+}